@@ -0,0 +1,224 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package accounts
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"git.astrospark.com/bolorama/config"
+	"git.astrospark.com/bolorama/data"
+	"git.astrospark.com/bolorama/events"
+	"git.astrospark.com/bolorama/privacy"
+	"git.astrospark.com/bolorama/state"
+	"git.astrospark.com/bolorama/util"
+)
+
+// Players register a name through the web API and get a token. A player using
+// a registered name must then log in, on the web from the address they play
+// from or with a "/login <token>" chat message, within
+// account_login_grace_seconds or be kicked.
+
+const kMaxNameLength = 20
+const kTokenBytes = 16
+
+// a web login lets players from the address use the name for this long
+const kWebLoginDuration = 24 * time.Hour
+
+const kCheckInterval = time.Second
+
+var ErrNameTaken = errors.New("name is already registered")
+var ErrBadName = errors.New("name must be 1 to 20 printable characters")
+var ErrBadLogin = errors.New("unknown name or token")
+
+type webLogin struct {
+	name    string
+	expires time.Time
+}
+
+var mutex sync.Mutex
+var webLogins = make(map[string]webLogin) // by IP address
+
+// Register reserves name and returns the token that proves who owns it.
+func Register(db *sql.DB, name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > kMaxNameLength || strings.IndexFunc(name, func(r rune) bool { return !unicode.IsPrint(r) }) >= 0 {
+		return "", ErrBadName
+	}
+
+	buffer := make([]byte, kTokenBytes)
+	if _, err := rand.Read(buffer); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buffer)
+
+	inserted, err := data.InsertAccount(db, name, state.HashToken(token))
+	if err != nil {
+		return "", err
+	}
+	if !inserted {
+		return "", ErrNameTaken
+	}
+	return token, nil
+}
+
+// Unregister frees name. Returns false if it was not registered.
+func Unregister(db *sql.DB, name string) (bool, error) {
+	return data.DeleteAccount(db, strings.TrimSpace(name))
+}
+
+// Login lets players from ip use the name for a day.
+func Login(db *sql.DB, name string, token string, ip net.IP) error {
+	name = strings.TrimSpace(name)
+	tokenHash, ok, err := data.SelectAccountTokenHash(db, name)
+	if err != nil {
+		return err
+	}
+	if !ok || tokenHash != state.HashToken(token) {
+		return ErrBadLogin
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	webLogins[ip.String()] = webLogin{name: name, expires: time.Now().Add(kWebLoginDuration)}
+	return nil
+}
+
+func webLoggedIn(ip string, name string) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	login, ok := webLogins[ip]
+	if ok && time.Now().After(login.expires) {
+		delete(webLogins, ip)
+		return false
+	}
+	return ok && strings.EqualFold(login.name, name)
+}
+
+// session is a player using a registered name.
+type session struct {
+	name     string
+	loggedIn bool
+	deadline time.Time
+}
+
+// Run kicks players who use a registered name without logging in, until the
+// events channel is closed. Accounts are kept in the statistics database, so
+// it does nothing without one.
+func Run(context *state.ServerContext, eventChannel <-chan events.Event) {
+	defer context.Stats.WaitGroup.Done()
+
+	db := context.Db
+	if db == nil {
+		context.Logger.Println("Accounts need enable_statistics")
+		for range eventChannel {
+		}
+		return
+	}
+	grace := time.Duration(config.GetValueInt("account_login_grace_seconds")) * time.Second
+	sessions := make(map[util.PlayerAddr]*session)
+
+	ticker := time.NewTicker(kCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event, ok := <-eventChannel:
+			if !ok {
+				return
+			}
+			switch event.Type {
+			case events.NameChanged:
+				delete(sessions, event.PlayerAddr)
+				_, registered, err := data.SelectAccountTokenHash(db, event.Name)
+				if err != nil {
+					context.Logger.Println("Accounts:", err)
+				}
+				if registered {
+					sessions[event.PlayerAddr] = &session{
+						name:     event.Name,
+						loggedIn: webLoggedIn(event.PlayerAddr.IpAddr, event.Name),
+						deadline: time.Now().Add(grace),
+					}
+				}
+			case events.PlayerLogin:
+				s, ok := sessions[event.PlayerAddr]
+				if !ok {
+					break
+				}
+				name, ok, err := data.SelectAccountName(db, event.Text)
+				if err != nil {
+					context.Logger.Println("Accounts:", err)
+				}
+				if ok && strings.EqualFold(name, s.name) {
+					s.loggedIn = true
+					context.Logger.Println("Player", s.name, "logged in")
+				}
+			case events.PlayerMigrated:
+				if s, ok := sessions[event.PreviousAddr]; ok {
+					delete(sessions, event.PreviousAddr)
+					sessions[event.PlayerAddr] = s
+				}
+			case events.PlayerLeft:
+				delete(sessions, event.PlayerAddr)
+			}
+		case <-ticker.C:
+			for addr, s := range sessions {
+				if s.loggedIn || time.Now().Before(s.deadline) {
+					continue
+				}
+				delete(sessions, addr)
+				kickImpostor(context, addr, s.name)
+			}
+		}
+	}
+}
+
+func kickImpostor(context *state.ServerContext, addr util.PlayerAddr, name string) {
+	state.Do(context, func(s *state.State) {
+		player, err := state.PlayerGetByPort(s, addr.ProxyPort)
+		if err != nil || player.IpAddr.String() != addr.IpAddr || player.IpPort != addr.IpPort {
+			return
+		}
+		context.Logger.Println("Kicking player using registered name", name, "without logging in")
+		context.Audit.Record("accounts", "kick", fmt.Sprintf("%d (%s %s)", player.ProxyPort, player.Name, privacy.Addr(player.IpAddr, player.IpPort)), "did not log in to a registered name", "")
+		state.PlayerKick(s, addr.ProxyPort, 0)
+	})
+}
+
+// Purge forgets the web logins from ip, or of name.
+func Purge(ip net.IP, name string) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	found := false
+	for key, login := range webLogins {
+		if (ip != nil && key == ip.String()) || (name != "" && strings.EqualFold(login.name, name)) {
+			delete(webLogins, key)
+			found = true
+		}
+	}
+	return found
+}
@@ -0,0 +1,366 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package acme
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// A minimal RFC 8555 client: just enough to register an account and have a
+// certificate issued for a few names, answering the http-01 or the
+// tls-alpn-01 (RFC 8737) challenge.
+
+const kRequestTimeout = 30 * time.Second
+const kMaxResponseBytes = 1 << 20
+const kPollInterval = 2 * time.Second
+const kPollAttempts = 30
+
+const errorBadNonce = "urn:ietf:params:acme:error:badNonce"
+
+type directory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+// problem is an RFC 7807 error returned by the CA.
+type problem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+}
+
+func (p *problem) Error() string {
+	return fmt.Sprintf("acme: %s (%s)", p.Detail, p.Type)
+}
+
+type identifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type order struct {
+	Status         string   `json:"status"`
+	Authorizations []string `json:"authorizations"`
+	Finalize       string   `json:"finalize"`
+	Certificate    string   `json:"certificate"`
+	Error          *problem `json:"error"`
+}
+
+type authorization struct {
+	Status     string      `json:"status"`
+	Identifier identifier  `json:"identifier"`
+	Challenges []challenge `json:"challenges"`
+}
+
+type challenge struct {
+	Type   string   `json:"type"`
+	Url    string   `json:"url"`
+	Token  string   `json:"token"`
+	Status string   `json:"status"`
+	Error  *problem `json:"error"`
+}
+
+// solver publishes the response to a challenge until the returned function is
+// called.
+type solver func(challengeType string, domain string, token string, keyAuthorization string) (func(), error)
+
+type client struct {
+	http      *http.Client
+	key       *ecdsa.PrivateKey
+	kid       string // account URL, once registered
+	directory directory
+	nonce     string
+}
+
+func newClient(directoryUrl string, key *ecdsa.PrivateKey) (*client, error) {
+	c := &client{http: &http.Client{Timeout: kRequestTimeout}, key: key}
+	response, err := c.http.Get(directoryUrl)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("acme: directory: %s", response.Status)
+	}
+	if err := json.NewDecoder(io.LimitReader(response.Body, kMaxResponseBytes)).Decode(&c.directory); err != nil {
+		return nil, fmt.Errorf("acme: directory: %s", err)
+	}
+	return c, nil
+}
+
+// register creates the account for the client's key, or finds the existing
+// one, agreeing to the CA's terms of service.
+func (c *client) register(email string) error {
+	request := struct {
+		TermsOfServiceAgreed bool     `json:"termsOfServiceAgreed"`
+		Contact              []string `json:"contact,omitempty"`
+	}{TermsOfServiceAgreed: true}
+	if email != "" {
+		request.Contact = []string{"mailto:" + email}
+	}
+	response, err := c.post(c.directory.NewAccount, request, nil)
+	if err != nil {
+		return err
+	}
+	c.kid = response.Header.Get("Location")
+	if c.kid == "" {
+		return fmt.Errorf("acme: no account URL")
+	}
+	return nil
+}
+
+// obtain has a certificate issued for domains, signed with certKey, and
+// returns the PEM encoded chain.
+func (c *client) obtain(domains []string, certKey crypto.Signer, challengeType string, solve solver) ([]byte, error) {
+	var request struct {
+		Identifiers []identifier `json:"identifiers"`
+	}
+	for _, domain := range domains {
+		request.Identifiers = append(request.Identifiers, identifier{Type: "dns", Value: domain})
+	}
+	var o order
+	response, err := c.post(c.directory.NewOrder, request, &o)
+	if err != nil {
+		return nil, err
+	}
+	orderUrl := response.Header.Get("Location")
+
+	for _, authorizationUrl := range o.Authorizations {
+		if err := c.authorize(authorizationUrl, challengeType, solve); err != nil {
+			return nil, err
+		}
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domains[0]},
+		DNSNames: domains,
+	}, certKey)
+	if err != nil {
+		return nil, err
+	}
+	finalize := struct {
+		Csr string `json:"csr"`
+	}{encode(csr)}
+	if _, err := c.post(o.Finalize, finalize, &o); err != nil {
+		return nil, err
+	}
+	for attempt := 0; o.Status != "valid"; attempt++ {
+		if o.Status == "invalid" || attempt == kPollAttempts {
+			return nil, fmt.Errorf("acme: order %s: %v", o.Status, o.Error)
+		}
+		time.Sleep(kPollInterval)
+		if _, err := c.post(orderUrl, nil, &o); err != nil {
+			return nil, err
+		}
+	}
+
+	_, chain, err := c.postRaw(o.Certificate, nil)
+	return chain, err
+}
+
+// authorize proves control of the domain of an authorization, unless the CA
+// already accepts it.
+func (c *client) authorize(authorizationUrl string, challengeType string, solve solver) error {
+	var a authorization
+	if _, err := c.post(authorizationUrl, nil, &a); err != nil {
+		return err
+	}
+	if a.Status == "valid" {
+		return nil
+	}
+
+	var ch *challenge
+	for i := range a.Challenges {
+		if a.Challenges[i].Type == challengeType {
+			ch = &a.Challenges[i]
+		}
+	}
+	if ch == nil {
+		return fmt.Errorf("acme: %s: no %s challenge offered", a.Identifier.Value, challengeType)
+	}
+
+	cleanup, err := solve(challengeType, a.Identifier.Value, ch.Token, ch.Token+"."+c.thumbprint())
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	if _, err := c.post(ch.Url, struct{}{}, nil); err != nil {
+		return err
+	}
+	for attempt := 0; a.Status != "valid"; attempt++ {
+		if a.Status == "invalid" || attempt == kPollAttempts {
+			for _, challenge := range a.Challenges {
+				if challenge.Type == challengeType && challenge.Error != nil {
+					return fmt.Errorf("acme: %s: %s", a.Identifier.Value, challenge.Error.Detail)
+				}
+			}
+			return fmt.Errorf("acme: %s: authorization %s", a.Identifier.Value, a.Status)
+		}
+		time.Sleep(kPollInterval)
+		if _, err := c.post(authorizationUrl, nil, &a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// post sends payload, signed, to url and decodes the response into result if
+// it is not nil. A nil payload makes a POST-as-GET.
+func (c *client) post(url string, payload interface{}, result interface{}) (*http.Response, error) {
+	response, body, err := c.postRaw(url, payload)
+	if err != nil {
+		return nil, err
+	}
+	if result != nil {
+		if err := json.Unmarshal(body, result); err != nil {
+			return nil, fmt.Errorf("acme: %s: %s", url, err)
+		}
+	}
+	return response, nil
+}
+
+func (c *client) postRaw(url string, payload interface{}) (*http.Response, []byte, error) {
+	for attempt := 1; ; attempt++ {
+		request, err := c.sign(url, payload)
+		if err != nil {
+			return nil, nil, err
+		}
+		response, err := c.http.Post(url, "application/jose+json", bytes.NewReader(request))
+		if err != nil {
+			return nil, nil, err
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(response.Body, kMaxResponseBytes))
+		response.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		if nonce := response.Header.Get("Replay-Nonce"); nonce != "" {
+			c.nonce = nonce
+		}
+
+		if response.StatusCode >= 400 {
+			p := &problem{}
+			json.Unmarshal(body, p)
+			// nonces expire; the error carries a fresh one
+			if p.Type == errorBadNonce && attempt == 1 {
+				continue
+			}
+			if p.Detail == "" {
+				p.Detail = response.Status
+			}
+			return nil, nil, p
+		}
+		return response, body, nil
+	}
+}
+
+// sign returns the JWS (RFC 7515, flattened JSON serialization) of payload
+// for url.
+func (c *client) sign(url string, payload interface{}) ([]byte, error) {
+	nonce, err := c.takeNonce()
+	if err != nil {
+		return nil, err
+	}
+	protected := map[string]interface{}{"alg": "ES256", "nonce": nonce, "url": url}
+	if c.kid != "" {
+		protected["kid"] = c.kid
+	} else {
+		protected["jwk"] = jwk(&c.key.PublicKey)
+	}
+	header, err := json.Marshal(protected)
+	if err != nil {
+		return nil, err
+	}
+	var body []byte
+	if payload != nil {
+		if body, err = json.Marshal(payload); err != nil {
+			return nil, err
+		}
+	}
+
+	signingInput := encode(header) + "." + encode(body)
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, c.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	return json.Marshal(map[string]string{
+		"protected": encode(header),
+		"payload":   encode(body),
+		"signature": encode(signature),
+	})
+}
+
+func (c *client) takeNonce() (string, error) {
+	if nonce := c.nonce; nonce != "" {
+		c.nonce = ""
+		return nonce, nil
+	}
+	response, err := c.http.Head(c.directory.NewNonce)
+	if err != nil {
+		return "", err
+	}
+	response.Body.Close()
+	nonce := response.Header.Get("Replay-Nonce")
+	if nonce == "" {
+		return "", fmt.Errorf("acme: no nonce")
+	}
+	return nonce, nil
+}
+
+// thumbprint returns the RFC 7638 thumbprint of the account key, which ends
+// every key authorization.
+func (c *client) thumbprint() string {
+	// the members of a JWK thumbprint are in lexical order, as json.Marshal
+	// writes maps
+	encoded, _ := json.Marshal(jwk(&c.key.PublicKey))
+	digest := sha256.Sum256(encoded)
+	return encode(digest[:])
+}
+
+// jwk returns the JSON Web Key of a P-256 public key.
+func jwk(key *ecdsa.PublicKey) map[string]string {
+	return map[string]string{
+		"crv": "P-256",
+		"kty": "EC",
+		"x":   encode(key.X.FillBytes(make([]byte, 32))),
+		"y":   encode(key.Y.FillBytes(make([]byte, 32))),
+	}
+}
+
+func encode(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
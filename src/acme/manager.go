@@ -0,0 +1,325 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ChallengeHttp    = "http-01"
+	ChallengeTlsAlpn = "tls-alpn-01"
+)
+
+// LetsEncrypt is the production directory of Let's Encrypt.
+const LetsEncrypt = "https://acme-v02.api.letsencrypt.org/directory"
+
+// ChallengePath is where the http-01 challenge is answered, on port 80.
+const ChallengePath = "/.well-known/acme-challenge/"
+
+const kRenewBefore = 30 * 24 * time.Hour
+const kCheckInterval = 12 * time.Hour
+const kRetryInterval = time.Hour
+
+const alpnProtocol = "acme-tls/1"
+
+var idPeAcmeIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// Manager keeps a certificate for Domains, issued by the CA at DirectoryUrl
+// and saved in CacheDirectory, renewing it a month before it expires. The
+// files in CacheDirectory are account.key, the ACME account, and cert.pem and
+// key.pem, which may be used elsewhere too.
+type Manager struct {
+	DirectoryUrl   string
+	Email          string
+	Domains        []string
+	CacheDirectory string
+	Challenge      string      // ChallengeHttp or ChallengeTlsAlpn
+	Logger         *log.Logger // receives the progress of Run
+
+	mutex       sync.Mutex
+	certificate *tls.Certificate
+	tokens      map[string]string           // http-01 key authorizations by token
+	alpnCerts   map[string]*tls.Certificate // tls-alpn-01 certificates by domain
+}
+
+// TLSConfig returns the configuration for the HTTPS server, which answers the
+// tls-alpn-01 challenge.
+func (m *Manager) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: m.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1", alpnProtocol},
+	}
+}
+
+// GetCertificate returns the certificate for a TLS handshake.
+func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, protocol := range hello.SupportedProtos {
+		if protocol == alpnProtocol {
+			if certificate, ok := m.alpnCerts[strings.ToLower(hello.ServerName)]; ok {
+				return certificate, nil
+			}
+			return nil, fmt.Errorf("acme: no challenge for %s", hello.ServerName)
+		}
+	}
+	if m.certificate == nil {
+		return nil, errors.New("acme: no certificate yet")
+	}
+	return m.certificate, nil
+}
+
+// ServeChallenge answers the http-01 challenge at ChallengePath.
+func (m *Manager) ServeChallenge(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, ChallengePath)
+	m.mutex.Lock()
+	keyAuthorization, ok := m.tokens[token]
+	m.mutex.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(keyAuthorization))
+}
+
+// Run loads the saved certificate, then obtains or renews it when needed
+// until ctx is done.
+func (m *Manager) Run(ctx context.Context) {
+	if err := m.load(); err != nil && !os.IsNotExist(err) {
+		m.Logger.Println("Failed to load certificate:", err)
+	}
+
+	for {
+		wait := kCheckInterval
+		if m.needsRenewal() {
+			m.Logger.Println("Requesting certificate for", strings.Join(m.Domains, ", "))
+			if err := m.renew(); err != nil {
+				m.Logger.Println("Failed to obtain certificate:", err)
+				wait = kRetryInterval
+			} else {
+				m.Logger.Println("Obtained certificate for", strings.Join(m.Domains, ", "))
+			}
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (m *Manager) needsRenewal() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.certificate == nil || time.Until(m.certificate.Leaf.NotAfter) < kRenewBefore
+}
+
+func (m *Manager) load() error {
+	certificate, err := tls.LoadX509KeyPair(m.path("cert.pem"), m.path("key.pem"))
+	if err != nil {
+		return err
+	}
+	if certificate.Leaf, err = x509.ParseCertificate(certificate.Certificate[0]); err != nil {
+		return err
+	}
+	if !sameNames(certificate.Leaf.DNSNames, m.Domains) {
+		// the names were changed since it was issued
+		return nil
+	}
+
+	m.mutex.Lock()
+	m.certificate = &certificate
+	m.mutex.Unlock()
+	return nil
+}
+
+func (m *Manager) renew() error {
+	if err := os.MkdirAll(m.CacheDirectory, 0700); err != nil {
+		return err
+	}
+	accountKey, err := m.loadKey("account.key")
+	if err != nil {
+		return err
+	}
+	c, err := newClient(m.DirectoryUrl, accountKey)
+	if err != nil {
+		return err
+	}
+	if err := c.register(m.Email); err != nil {
+		return err
+	}
+
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	chain, err := c.obtain(m.Domains, certKey, m.Challenge, m.solve)
+	if err != nil {
+		return err
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(certKey)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(m.path("key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(m.path("cert.pem"), chain, 0644); err != nil {
+		return err
+	}
+	return m.load()
+}
+
+// solve publishes the response to a challenge.
+func (m *Manager) solve(challengeType string, domain string, token string, keyAuthorization string) (func(), error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	switch challengeType {
+	case ChallengeHttp:
+		if m.tokens == nil {
+			m.tokens = make(map[string]string)
+		}
+		m.tokens[token] = keyAuthorization
+		return func() {
+			m.mutex.Lock()
+			delete(m.tokens, token)
+			m.mutex.Unlock()
+		}, nil
+	case ChallengeTlsAlpn:
+		certificate, err := alpnCertificate(domain, keyAuthorization)
+		if err != nil {
+			return nil, err
+		}
+		if m.alpnCerts == nil {
+			m.alpnCerts = make(map[string]*tls.Certificate)
+		}
+		m.alpnCerts[strings.ToLower(domain)] = certificate
+		return func() {
+			m.mutex.Lock()
+			delete(m.alpnCerts, strings.ToLower(domain))
+			m.mutex.Unlock()
+		}, nil
+	}
+	return nil, fmt.Errorf("acme: unsupported challenge %s", challengeType)
+}
+
+// alpnCertificate returns the self-signed certificate answering the
+// tls-alpn-01 challenge: it carries the digest of the key authorization in the
+// critical acmeIdentifier extension.
+func alpnCertificate(domain string, keyAuthorization string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(keyAuthorization))
+	value, err := asn1.Marshal(digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: domain},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		DNSNames:     []string{domain},
+		ExtraExtensions: []pkix.Extension{
+			{Id: idPeAcmeIdentifier, Critical: true, Value: value},
+		},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// loadKey reads a P-256 key from the cache directory, creating it if it does
+// not exist.
+func (m *Manager) loadKey(name string) (*ecdsa.PrivateKey, error) {
+	encoded, err := ioutil.ReadFile(m.path(name))
+	if os.IsNotExist(err) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		err = ioutil.WriteFile(m.path(name), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+		return key, err
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(encoded)
+	if block == nil {
+		return nil, fmt.Errorf("acme: malformed key %s", m.path(name))
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
+func (m *Manager) path(name string) string {
+	return filepath.Join(m.CacheDirectory, name)
+}
+
+func sameNames(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, name := range b {
+		found := false
+		for _, other := range a {
+			if strings.EqualFold(name, other) {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,1050 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package admin
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.astrospark.com/bolorama/accounts"
+	"git.astrospark.com/bolorama/config"
+	"git.astrospark.com/bolorama/events"
+	"git.astrospark.com/bolorama/privacy"
+	"git.astrospark.com/bolorama/security"
+	"git.astrospark.com/bolorama/state"
+	"git.astrospark.com/bolorama/stats"
+	"git.astrospark.com/bolorama/tournament"
+	"git.astrospark.com/bolorama/trace"
+)
+
+// command handles one console line. args excludes the command name. The
+// returned text is written back to the console.
+type command struct {
+	usage string
+	fn    func(context *state.ServerContext, args []string) string
+}
+
+var commands map[string]command
+
+// commands that change something, recorded in the audit log when given
+// arguments
+var audited = map[string]bool{
+	"kick":        true,
+	"unkick":      true,
+	"shadowban":   true,
+	"unshadowban": true,
+	"mute":        true,
+	"unmute":      true,
+	"unregister":  true,
+	"result":      true,
+	"schedule":    true,
+	"title":       true,
+	"unlist":      true,
+	"list":        true,
+	"dedup":       true,
+	"tournament":  true,
+	"purge":       true,
+	"drain":       true,
+	"restart":     true,
+	"ban":         true,
+	"broadcast":   true,
+	"check":       true,
+}
+
+const kDefaultKickMinutes = 10
+
+const kPrompt = "bolorama> "
+
+// how long Send waits for the server
+const kSendTimeout = 10 * time.Second
+
+func init() {
+	commands = map[string]command{
+		"audit": {"audit [n]    show the last n (default 20) entries of the audit log and check it", auditCommand},
+		"check": {"check [repair]    cross-check the players and proxy ports, as consistency_check_seconds does", checkCommand},
+		"drain": {"drain [start | stop]\n" +
+			"    refuse new games and players while the games in progress finish, or show how far draining has got",
+			drainCommand},
+		"broadcast": {"broadcast [<message> | clear]\n" +
+			"    show a message at the top of the tracker listing, and send it to hooks, or show the current one",
+			broadcastCommand},
+		"dump": {"dump    write the state to a JSON file in dump_directory, as SIGUSR1 does", dumpCommand},
+		"help": {"help", help},
+		"kick": {"kick <proxy port> [duration]\n" +
+			"    disconnect a player and refuse their address for duration: minutes, or e.g. 90m, 24h, 7d (default 10m)",
+			kickCommand},
+		"unkick": {"unkick [<ip>]    list kicked addresses, or let one in again", unkickCommand},
+		"ban": {"ban <ip> [duration]\n" +
+			"    refuse an address as kick does, disconnecting its players",
+			banCommand},
+		"status": {"status [json]    show the games, players, drain and scheduled restart, as text or JSON", statusCommand},
+		"shadowban": {"shadowban <proxy port>\n" +
+			"    drop everything sent by players from the player's address, without them noticing",
+			shadowbanCommand},
+		"unshadowban": {"unshadowban [<ip>]    list shadow banned addresses, or lift a ban", unshadowbanCommand},
+		"result":      {"result <player name> beat|drew <player name>    record a game result for the rankings", resultCommand},
+		"restart": {"restart [at <time> | in <duration> | cancel]\n" +
+			"    restart once the games in progress end after time (as for schedule) or duration (as for kick), warning at 30, 10, 5 and 1 minutes",
+			restartCommand},
+		"unregister": {"unregister <player name>    free a registered name", unregisterCommand},
+		"purge": {"purge <ip> | <player name>\n" +
+			"    erase what is stored about an address (bans, mutes, security log) or a name (statistics, rating, account)",
+			purgeCommand},
+		"schedule": {"schedule [add <start> <max players> <map name> | rm <id>]\n" +
+			"    start is local time as 2006-01-02T15:04 or RFC 3339; 0 max players for no limit",
+			scheduleCommand},
+		"mute":   {"mute <proxy port>    blank the chat messages of players from a player's address", muteCommand},
+		"unmute": {"unmute [<ip>]    list muted addresses, or let one chat again", unmuteCommand},
+		"tag":    {"tag <proxy port> <tag>", tagCommand},
+		"title":  {"title <proxy port> [title]    set or clear the title of a player's game", titleCommand},
+		"unlist": {"unlist <proxy port>    hide a player's game from the listings", unlistCommand},
+		"list":   {"list <proxy port>    list a player's game again", listCommand},
+		"dedup": {"dedup <proxy port> on|off\n" +
+			"    drop packets received twice within dedup_window_ms in a player's game, or stop",
+			dedupCommand},
+		"tournament": {"tournament [new <name> | add <player name> | start | result <match> <winner name>]\n" +
+			"    run a single elimination tournament; entrants are seeded in the order added",
+			tournamentCommand},
+		"untag": {"untag <proxy port> <tag>", untagCommand},
+		"trace": {"trace [add <filter>... | rm <n> | clear]\n" +
+			"    filter terms: player=ip[:port] port=<proxy port> game=<id hex> type=<packet type> dir=in|out",
+			traceCommand},
+		"trackers": {"trackers    list the main tracker and those set in trackers, with their games and players", trackersCommand},
+	}
+}
+
+// Listen binds admin_port, on the loopback interface only since the console
+// has no authentication; use an SSH tunnel to reach it remotely. Returns nil
+// unless admin_port is set.
+func Listen() (*net.TCPListener, error) {
+	port := config.GetValueInt("admin_port")
+	if port <= 0 {
+		return nil, nil
+	}
+	listener, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	if err != nil {
+		return nil, fmt.Errorf("admin_port: %s", err)
+	}
+	return listener, nil
+}
+
+// Console serves the admin console, a line based text protocol, on the
+// listener bound by Listen. Does nothing if it is nil.
+func Console(context *state.ServerContext, listener *net.TCPListener) {
+	defer context.Network.WaitGroup.Done()
+
+	if listener == nil {
+		return
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	context.Logger.Println("Listening on admin port", port)
+
+	wg := sync.WaitGroup{}
+	conns := make(map[net.Conn]struct{})
+	mutex := sync.Mutex{}
+
+	go func() {
+		<-context.Network.Ctx.Done()
+		listener.Close()
+		mutex.Lock()
+		for conn := range conns {
+			conn.Close()
+		}
+		mutex.Unlock()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !strings.HasSuffix(err.Error(), "use of closed network connection") {
+				context.Logger.Println(err)
+			}
+			break
+		}
+
+		mutex.Lock()
+		conns[conn] = struct{}{}
+		mutex.Unlock()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			session(context, conn)
+			mutex.Lock()
+			delete(conns, conn)
+			mutex.Unlock()
+		}()
+	}
+
+	wg.Wait()
+	context.Logger.Println("Stopped listening on admin port", port)
+}
+
+func session(context *state.ServerContext, conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	fmt.Fprint(conn, kPrompt)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 0 {
+			if fields[0] == "quit" || fields[0] == "exit" {
+				return
+			}
+			fmt.Fprint(conn, Execute(context, "admin", fields))
+		}
+		fmt.Fprint(conn, kPrompt)
+	}
+}
+
+// Execute runs a console command for actor (the console or a hook) and
+// returns its output. A reason for the audit log can follow the arguments
+// after #, e.g. "kick 40001 1d # spawn camping". The command runs on the main
+// tracker, whose context is given, or on a tracker set in trackers if its
+// name follows @ before the command, e.g. "@newbie kick 41001".
+func Execute(context *state.ServerContext, actor string, fields []string) string {
+	reason := ""
+	for i, field := range fields {
+		if strings.HasPrefix(field, "#") {
+			reason = strings.TrimSpace(strings.TrimPrefix(strings.Join(fields[i:], " "), "#"))
+			fields = fields[:i]
+			break
+		}
+	}
+	if len(fields) == 0 {
+		return ""
+	}
+
+	mainContext := context
+	if strings.HasPrefix(fields[0], "@") {
+		name := strings.TrimPrefix(fields[0], "@")
+		tracker, ok := mainContext.Tracker(name)
+		if !ok {
+			return fmt.Sprintf("unknown tracker: %s (try trackers)\n", name)
+		}
+		context = tracker
+		fields = fields[1:]
+		if len(fields) == 0 {
+			return ""
+		}
+	}
+
+	cmd, ok := commands[fields[0]]
+	if !ok {
+		return fmt.Sprintf("unknown command: %s (try help)\n", fields[0])
+	}
+	args := fields[1:]
+	if !audited[fields[0]] || len(args) == 0 {
+		return cmd.fn(context, args)
+	}
+
+	target := describeTarget(context, args)
+	if fields[0] == "purge" {
+		// the audit log cannot be edited, so it must not keep what was erased
+		target = ""
+	}
+	if context.Name != "" {
+		target = strings.TrimSpace("@" + context.Name + " " + target)
+	}
+	output := cmd.fn(context, args)
+	context.Audit.Record(actor, fields[0], target, reason, strings.TrimSpace(output))
+	// hooks follow the main tracker's events
+	mainContext.Events.Publish(events.Event{Type: events.Moderation, Name: actor, Text: strings.TrimSpace(fields[0] + " " + target), Reason: reason})
+	return output
+}
+
+// describeTarget returns the arguments of a command, with the player if the
+// first is a proxy port, since the port may be reused once they are gone.
+func describeTarget(context *state.ServerContext, args []string) string {
+	target := strings.Join(args, " ")
+	if ip := net.ParseIP(args[0]); ip != nil {
+		return strings.Join(append([]string{privacy.Ip(ip)}, args[1:]...), " ")
+	}
+	port, err := strconv.Atoi(args[0])
+	if err != nil {
+		return target
+	}
+	state.Do(context, func(s *state.State) {
+		if player, err := state.PlayerGetByPort(s, port); err == nil {
+			target = fmt.Sprintf("%s (%s %s)", target, player.Name, privacy.Addr(player.IpAddr, player.IpPort))
+		}
+	})
+	return target
+}
+
+func help(context *state.ServerContext, args []string) string {
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var builder strings.Builder
+	for _, name := range names {
+		builder.WriteString(commands[name].usage)
+		builder.WriteString("\n")
+	}
+	builder.WriteString("@<tracker> <command>    run a command on a tracker set in trackers\n")
+	builder.WriteString("quit\n")
+	return builder.String()
+}
+
+func trackersCommand(context *state.ServerContext, args []string) string {
+	var builder strings.Builder
+	for _, tracker := range append([]*state.ServerContext{context}, context.Trackers...) {
+		name := tracker.Name
+		if name == "" {
+			name = "(main)"
+		}
+		var games, players int
+		state.Do(tracker, func(s *state.State) {
+			games = len(s.Games)
+			players = len(s.Players)
+		})
+		fmt.Fprintf(&builder, "%s: port %d, proxy ports from %d, games: %d, players: %d\n", name, tracker.ProxyPort, tracker.Ports.First(), games, players)
+	}
+	return builder.String()
+}
+
+const kDefaultAuditEntries = 20
+
+func auditCommand(context *state.ServerContext, args []string) string {
+	n := kDefaultAuditEntries
+	if len(args) > 0 {
+		var err error
+		if n, err = strconv.Atoi(args[0]); err != nil || n < 0 {
+			return "usage: " + commands["audit"].usage + "\n"
+		}
+	}
+	if context.Audit == nil {
+		return "audit log needs audit_file\n"
+	}
+
+	entries, err := context.Audit.Verify()
+	if len(entries) > n {
+		entries = entries[len(entries)-n:]
+	}
+	var builder strings.Builder
+	for _, entry := range entries {
+		fmt.Fprintf(&builder, "%s %s: %s %s", entry.Time.Local().Format("2006-01-02 15:04:05"), entry.Actor, entry.Action, entry.Target)
+		if entry.Reason != "" {
+			fmt.Fprintf(&builder, " # %s", entry.Reason)
+		}
+		if entry.Result != "" {
+			fmt.Fprintf(&builder, " -> %s", strings.ReplaceAll(entry.Result, "\n", "; "))
+		}
+		builder.WriteString("\n")
+	}
+	if err != nil {
+		fmt.Fprintf(&builder, "audit log is not intact: %v\n", err)
+	}
+	return builder.String()
+}
+
+func kickCommand(context *state.ServerContext, args []string) string {
+	duration := kDefaultKickMinutes * time.Minute
+	var port int
+	var err error
+	if len(args) > 0 {
+		port, err = strconv.Atoi(args[0])
+	}
+	if err == nil && len(args) > 1 {
+		duration, err = parseDuration(args[1])
+	}
+	if len(args) < 1 || err != nil {
+		return "usage: " + commands["kick"].usage + "\n"
+	}
+
+	state.Do(context, func(s *state.State) {
+		err = state.PlayerKick(s, port, duration)
+	})
+	if err != nil {
+		return fmt.Sprintln(err)
+	}
+	return ""
+}
+
+func banCommand(context *state.ServerContext, args []string) string {
+	duration := kDefaultKickMinutes * time.Minute
+	var ip net.IP
+	var err error
+	if len(args) > 0 {
+		ip = net.ParseIP(args[0])
+	}
+	if len(args) > 1 {
+		duration, err = parseDuration(args[1])
+	}
+	if ip == nil || err != nil {
+		return "usage: " + commands["ban"].usage + "\n"
+	}
+
+	state.Do(context, func(s *state.State) {
+		state.PlayerBan(s, ip, duration)
+	})
+	return ""
+}
+
+func unkickCommand(context *state.ServerContext, args []string) string {
+	if len(args) > 0 {
+		ip := net.ParseIP(args[0])
+		if ip == nil {
+			return "usage: " + commands["unkick"].usage + "\n"
+		}
+		found := false
+		state.Do(context, func(s *state.State) {
+			found = state.PlayerUnkick(s, ip)
+		})
+		if !found {
+			return fmt.Sprintf("%s is not kicked\n", args[0])
+		}
+		return ""
+	}
+
+	var kicked map[string]time.Time
+	state.Do(context, func(s *state.State) {
+		kicked = state.PlayerKicked(s)
+	})
+	var ips []string
+	for ip := range kicked {
+		ips = append(ips, ip)
+	}
+	sort.Slice(ips, func(i, j int) bool {
+		return kicked[ips[i]].Before(kicked[ips[j]])
+	})
+
+	var builder strings.Builder
+	for _, ip := range ips {
+		until := kicked[ip]
+		fmt.Fprintf(&builder, "%s until %s (%s left)\n", ip, until.Format("Jan 2 15:04"), formatRemaining(time.Until(until)))
+	}
+	return builder.String()
+}
+
+// parseDuration parses a kick duration: a number of minutes, a Go duration
+// such as 90m or 24h, or a number of days such as 7d.
+func parseDuration(value string) (time.Duration, error) {
+	if minutes, err := strconv.Atoi(value); err == nil {
+		return time.Duration(minutes) * time.Minute, nil
+	}
+	if strings.HasSuffix(value, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+		return time.Duration(days) * 24 * time.Hour, err
+	}
+	return time.ParseDuration(value)
+}
+
+// formatRemaining rounds d to a readable precision, e.g. 6d23h or 4h12m.
+func formatRemaining(d time.Duration) string {
+	if d >= 24*time.Hour {
+		days := int(d / (24 * time.Hour))
+		return fmt.Sprintf("%dd%dh", days, int((d-time.Duration(days)*24*time.Hour)/time.Hour))
+	}
+	return strings.TrimSuffix(d.Round(time.Minute).String(), "0s")
+}
+
+func shadowbanCommand(context *state.ServerContext, args []string) string {
+	if len(args) < 1 {
+		return "usage: " + commands["shadowban"].usage + "\n"
+	}
+	port, err := strconv.Atoi(args[0])
+	if err != nil {
+		return "usage: " + commands["shadowban"].usage + "\n"
+	}
+
+	state.Do(context, func(s *state.State) {
+		err = state.PlayerShadowBan(s, port)
+	})
+	if err != nil {
+		return fmt.Sprintln(err)
+	}
+	return ""
+}
+
+func unshadowbanCommand(context *state.ServerContext, args []string) string {
+	if len(args) > 0 {
+		ip := net.ParseIP(args[0])
+		if ip == nil {
+			return "usage: " + commands["unshadowban"].usage + "\n"
+		}
+		found := false
+		state.Do(context, func(s *state.State) {
+			found = state.PlayerUnshadowBan(s, ip)
+		})
+		if !found {
+			return fmt.Sprintf("%s is not shadow banned\n", args[0])
+		}
+		return ""
+	}
+
+	var ips []string
+	state.Do(context, func(s *state.State) {
+		ips = state.PlayerShadowBans(s)
+	})
+	sort.Strings(ips)
+	var builder strings.Builder
+	for _, ip := range ips {
+		fmt.Fprintln(&builder, ip)
+	}
+	return builder.String()
+}
+
+func titleCommand(context *state.ServerContext, args []string) string {
+	if len(args) < 1 {
+		return "usage: " + commands["title"].usage + "\n"
+	}
+	port, err := strconv.Atoi(args[0])
+	if err != nil {
+		return "usage: " + commands["title"].usage + "\n"
+	}
+
+	state.Do(context, func(s *state.State) {
+		err = state.GameSetTitle(s, port, strings.Join(args[1:], " "))
+	})
+	if err != nil {
+		return fmt.Sprintln(err)
+	}
+	return ""
+}
+
+func broadcastCommand(context *state.ServerContext, args []string) string {
+	output := ""
+	state.Do(context, func(s *state.State) {
+		switch {
+		case len(args) == 1 && args[0] == "clear":
+			state.ServerBroadcast(s, "")
+		case len(args) > 0:
+			state.ServerBroadcast(s, strings.Join(args, " "))
+		case state.ServerBroadcastText(s) == "":
+			output = "no broadcast\n"
+		default:
+			output = state.ServerBroadcastText(s) + "\n"
+		}
+	})
+	return output
+}
+
+func checkCommand(context *state.ServerContext, args []string) string {
+	if len(args) > 1 || (len(args) == 1 && args[0] != "repair") {
+		return "usage: " + commands["check"].usage + "\n"
+	}
+	var problems []string
+	state.Do(context, func(s *state.State) {
+		problems = state.CheckConsistency(s, len(args) == 1)
+	})
+	if len(problems) == 0 {
+		return "consistent\n"
+	}
+	return strings.Join(problems, "\n") + "\n"
+}
+
+func dumpCommand(context *state.ServerContext, args []string) string {
+	filename, err := state.Dump(context)
+	if err != nil {
+		return fmt.Sprintln(err)
+	}
+	return fmt.Sprintf("dumped state to %s\n", filename)
+}
+
+func unlistCommand(context *state.ServerContext, args []string) string {
+	return setUnlisted(context, args, true, commands["unlist"].usage)
+}
+
+func listCommand(context *state.ServerContext, args []string) string {
+	return setUnlisted(context, args, false, commands["list"].usage)
+}
+
+func dedupCommand(context *state.ServerContext, args []string) string {
+	if len(args) < 2 || (args[1] != "on" && args[1] != "off") {
+		return "usage: " + commands["dedup"].usage + "\n"
+	}
+	port, err := strconv.Atoi(args[0])
+	if err != nil {
+		return "usage: " + commands["dedup"].usage + "\n"
+	}
+
+	state.Do(context, func(s *state.State) {
+		err = state.GameSetDedup(s, port, args[1] == "on")
+	})
+	if err != nil {
+		return fmt.Sprintln(err)
+	}
+	return ""
+}
+
+func setUnlisted(context *state.ServerContext, args []string, unlisted bool, usage string) string {
+	if len(args) < 1 {
+		return "usage: " + usage + "\n"
+	}
+	port, err := strconv.Atoi(args[0])
+	if err != nil {
+		return "usage: " + usage + "\n"
+	}
+
+	state.Do(context, func(s *state.State) {
+		err = state.GameSetUnlisted(s, port, unlisted)
+	})
+	if err != nil {
+		return fmt.Sprintln(err)
+	}
+	return ""
+}
+
+func muteCommand(context *state.ServerContext, args []string) string {
+	if len(args) < 1 {
+		return "usage: " + commands["mute"].usage + "\n"
+	}
+	port, err := strconv.Atoi(args[0])
+	if err != nil {
+		return "usage: " + commands["mute"].usage + "\n"
+	}
+
+	state.Do(context, func(s *state.State) {
+		err = state.PlayerMute(s, port)
+	})
+	if err != nil {
+		return fmt.Sprintln(err)
+	}
+	return ""
+}
+
+func unmuteCommand(context *state.ServerContext, args []string) string {
+	if len(args) > 0 {
+		ip := net.ParseIP(args[0])
+		if ip == nil {
+			return "usage: " + commands["unmute"].usage + "\n"
+		}
+		found := false
+		state.Do(context, func(s *state.State) {
+			found = state.PlayerUnmute(s, ip)
+		})
+		if !found {
+			return fmt.Sprintf("%s is not muted\n", args[0])
+		}
+		return ""
+	}
+
+	var ips []string
+	state.Do(context, func(s *state.State) {
+		ips = state.PlayerMutes(s)
+	})
+	sort.Strings(ips)
+	var builder strings.Builder
+	for _, ip := range ips {
+		fmt.Fprintln(&builder, ip)
+	}
+	return builder.String()
+}
+
+func tagCommand(context *state.ServerContext, args []string) string {
+	return setTag(context, args, true, commands["tag"].usage)
+}
+
+func untagCommand(context *state.ServerContext, args []string) string {
+	return setTag(context, args, false, commands["untag"].usage)
+}
+
+func setTag(context *state.ServerContext, args []string, add bool, usage string) string {
+	if len(args) < 2 {
+		return "usage: " + usage + "\n"
+	}
+	port, err := strconv.Atoi(args[0])
+	if err != nil {
+		return "usage: " + usage + "\n"
+	}
+
+	state.Do(context, func(s *state.State) {
+		err = state.PlayerTag(s, port, args[1], add)
+	})
+	if err != nil {
+		return fmt.Sprintln(err)
+	}
+	return ""
+}
+
+func unregisterCommand(context *state.ServerContext, args []string) string {
+	if context.Db == nil {
+		return "accounts need enable_statistics\n"
+	}
+	if len(args) < 1 {
+		return "usage: " + commands["unregister"].usage + "\n"
+	}
+
+	removed, err := accounts.Unregister(context.Db, strings.Join(args, " "))
+	if err != nil {
+		return fmt.Sprintln("failed to unregister:", err)
+	}
+	if !removed {
+		return "name is not registered\n"
+	}
+	return ""
+}
+
+func drainCommand(context *state.ServerContext, args []string) string {
+	if len(args) > 1 || (len(args) == 1 && args[0] != "start" && args[0] != "stop") {
+		return "usage: " + commands["drain"].usage + "\n"
+	}
+
+	progress := ""
+	state.Do(context, func(s *state.State) {
+		if len(args) == 1 {
+			state.ServerDrain(s, args[0] == "start")
+		}
+		progress = state.DrainProgress(s)
+	})
+	return progress + "\n"
+}
+
+func statusCommand(context *state.ServerContext, args []string) string {
+	if len(args) == 1 && args[0] == "json" {
+		encoded, err := json.Marshal(CollectStatus(context))
+		if err != nil {
+			return fmt.Sprintln(err)
+		}
+		return string(encoded) + "\n"
+	}
+	var builder strings.Builder
+	state.Do(context, func(s *state.State) {
+		fmt.Fprintf(&builder, "games: %d, players: %d\n", len(s.Games), len(s.Players))
+		fmt.Fprintf(&builder, "drain: %s\n", state.DrainProgress(s))
+		if restartAt := state.ServerRestartTime(s); !restartAt.IsZero() {
+			fmt.Fprintf(&builder, "restart: %s\n", restartAt.Local().Format(time.RFC1123))
+		}
+		if broadcast := state.ServerBroadcastText(s); broadcast != "" {
+			fmt.Fprintf(&builder, "broadcast: %s\n", broadcast)
+		}
+		if panics := state.Panics(); panics > 0 {
+			fmt.Fprintf(&builder, "panics recovered: %d\n", panics)
+		}
+		if len(s.Players) > 0 {
+			builder.WriteString(state.SprintServerState(s, "\n"))
+		}
+	})
+	return builder.String()
+}
+
+func restartCommand(context *state.ServerContext, args []string) string {
+	usage := "usage: " + commands["restart"].usage + "\n"
+	var at time.Time
+	switch {
+	case len(args) == 0:
+	case len(args) == 1 && args[0] == "cancel":
+	case len(args) == 2 && args[0] == "at":
+		start, err := parseStartTime(args[1])
+		if err != nil {
+			return usage
+		}
+		at = start
+	case len(args) == 2 && args[0] == "in":
+		duration, err := parseDuration(args[1])
+		if err != nil || duration < 0 {
+			return usage
+		}
+		at = time.Now().Add(duration)
+	default:
+		return usage
+	}
+	if len(args) == 2 && at.Before(time.Now().Add(-time.Minute)) {
+		return "restart time has passed\n"
+	}
+
+	output := ""
+	state.Do(context, func(s *state.State) {
+		if len(args) == 1 {
+			output = "restart cancelled\n"
+			if !state.ServerCancelRestart(s) {
+				output = "no restart is scheduled\n"
+			}
+			return
+		}
+		if len(args) == 2 {
+			state.ServerScheduleRestart(s, at)
+		}
+		if restartAt := state.ServerRestartTime(s); !restartAt.IsZero() {
+			output = fmt.Sprintf("restart at %s (%s)\n", restartAt.Local().Format(time.RFC1123), state.DrainProgress(s))
+		} else if len(args) == 0 {
+			output = "no restart is scheduled\n"
+		}
+	})
+	return output
+}
+
+func purgeCommand(context *state.ServerContext, args []string) string {
+	if len(args) < 1 {
+		return "usage: " + commands["purge"].usage + "\n"
+	}
+
+	var builder strings.Builder
+	if ip := net.ParseIP(args[0]); ip != nil && len(args) == 1 {
+		found := false
+		state.Do(context, func(s *state.State) {
+			found = state.PlayerPurge(s, ip)
+		})
+		if found {
+			fmt.Fprintln(&builder, "removed bans and mutes")
+		}
+		if accounts.Purge(ip, "") {
+			fmt.Fprintln(&builder, "removed web logins")
+		}
+		removed, err := security.Purge(ip)
+		if err != nil {
+			fmt.Fprintln(&builder, "failed to purge security log:", err)
+		} else if removed > 0 {
+			fmt.Fprintf(&builder, "removed %d security log events\n", removed)
+		}
+	} else {
+		name := strings.Join(args, " ")
+		if accounts.Purge(nil, name) {
+			fmt.Fprintln(&builder, "removed web logins")
+		}
+		if context.Db != nil {
+			removed, err := stats.PurgePlayer(context.Db, name)
+			if err != nil {
+				fmt.Fprintln(&builder, "failed to purge statistics:", err)
+			} else if removed {
+				fmt.Fprintln(&builder, "removed statistics, rating and account")
+			}
+		}
+	}
+	if builder.Len() == 0 {
+		return "nothing stored\n"
+	}
+	return builder.String()
+}
+
+func resultCommand(context *state.ServerContext, args []string) string {
+	if context.Db == nil {
+		return "rankings need enable_statistics\n"
+	}
+
+	// player names may contain spaces
+	for i, arg := range args {
+		if (arg != "beat" && arg != "drew") || i == 0 || i == len(args)-1 {
+			continue
+		}
+		first, second := strings.Join(args[:i], " "), strings.Join(args[i+1:], " ")
+		a, b, err := stats.RecordResult(context.Db, first, second, arg == "drew")
+		if err != nil {
+			return fmt.Sprintln("failed to record result:", err)
+		}
+		return fmt.Sprintf("%s: %.0f, %s: %.0f\n", a.Name, a.Rating, b.Name, b.Rating)
+	}
+	return "usage: " + commands["result"].usage + "\n"
+}
+
+func tournamentCommand(context *state.ServerContext, args []string) string {
+	usage := "usage: " + commands["tournament"].usage + "\n"
+	if len(args) > 0 {
+		var err error
+		switch args[0] {
+		case "new":
+			if len(args) < 2 {
+				return usage
+			}
+			tournament.New(context, strings.Join(args[1:], " "))
+		case "add":
+			if len(args) < 2 {
+				return usage
+			}
+			err = tournament.Add(context, strings.Join(args[1:], " "))
+		case "start":
+			err = tournament.Start(context)
+		case "result":
+			if len(args) < 3 {
+				return usage
+			}
+			id, convErr := strconv.Atoi(args[1])
+			if convErr != nil {
+				return usage
+			}
+			err = tournament.Result(context, id, strings.Join(args[2:], " "))
+		default:
+			return usage
+		}
+		if err != nil {
+			return fmt.Sprintln(err)
+		}
+	}
+
+	t := tournament.Current(context)
+	if t == nil {
+		return "no tournament\n"
+	}
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "%s\n", t.Name)
+	if !t.Started {
+		fmt.Fprintf(&builder, "entrants: %s\n", strings.Join(t.Entrants, ", "))
+		return builder.String()
+	}
+	for _, match := range t.Matches {
+		players := [2]string{match.Players[0], match.Players[1]}
+		for i := range players {
+			if players[i] == "" {
+				players[i] = "?"
+			}
+		}
+		fmt.Fprintf(&builder, "round %d match %d: %s vs %s", match.Round, match.Id, players[0], players[1])
+		if match.Winner != "" {
+			fmt.Fprintf(&builder, ", won by %s", match.Winner)
+		} else if match.GameId != "" {
+			fmt.Fprintf(&builder, ", playing game %s", match.GameId)
+		}
+		builder.WriteString("\n")
+	}
+	if champion := t.Champion(); champion != "" {
+		fmt.Fprintf(&builder, "champion: %s\n", champion)
+	}
+	return builder.String()
+}
+
+func scheduleCommand(context *state.ServerContext, args []string) string {
+	usage := "usage: " + commands["schedule"].usage + "\n"
+	if len(args) > 0 {
+		var err error
+		switch args[0] {
+		case "add":
+			if len(args) < 4 {
+				return usage
+			}
+			game := state.ScheduledGame{MapName: strings.Join(args[3:], " "), ScheduledBy: "admin"}
+			game.Start, err = parseStartTime(args[1])
+			if err != nil {
+				return usage
+			}
+			game.MaxPlayers, err = strconv.Atoi(args[2])
+			if err != nil {
+				return usage
+			}
+			state.Do(context, func(s *state.State) {
+				_, err = state.ScheduleAdd(s, game)
+			})
+		case "rm":
+			if len(args) < 2 {
+				return usage
+			}
+			id, convErr := strconv.Atoi(args[1])
+			if convErr != nil {
+				return usage
+			}
+			found := false
+			state.Do(context, func(s *state.State) {
+				found = state.ScheduleRemove(s, id)
+			})
+			if !found {
+				err = fmt.Errorf("no scheduled game %d", id)
+			}
+		default:
+			return usage
+		}
+		if err != nil {
+			return fmt.Sprintln(err)
+		}
+	}
+
+	var games []state.ScheduledGame
+	state.Do(context, func(s *state.State) {
+		games = state.ScheduleList(s)
+	})
+	if len(games) == 0 {
+		return "no games scheduled\n"
+	}
+	var builder strings.Builder
+	for _, game := range games {
+		fmt.Fprintf(&builder, "%d: %s (by %s)", game.Id, game.Announcement(), game.ScheduledBy)
+		if game.GameId != nil {
+			builder.WriteString(", started")
+		}
+		builder.WriteString("\n")
+	}
+	return builder.String()
+}
+
+// parseStartTime parses a scheduled game's start time, either RFC 3339 or
+// local time without a zone.
+func parseStartTime(value string) (time.Time, error) {
+	if start, err := time.Parse(time.RFC3339, value); err == nil {
+		return start, nil
+	}
+	return time.ParseInLocation("2006-01-02T15:04", value, time.Local)
+}
+
+func traceCommand(context *state.ServerContext, args []string) string {
+	if len(args) > 0 {
+		switch args[0] {
+		case "add":
+			filter, err := trace.ParseFilter(args[1:])
+			if err != nil {
+				return fmt.Sprintln(err)
+			}
+			context.Tracer.Add(filter)
+		case "rm":
+			if len(args) < 2 {
+				return "usage: " + commands["trace"].usage + "\n"
+			}
+			index, err := strconv.Atoi(args[1])
+			if err != nil || !context.Tracer.Remove(index) {
+				return fmt.Sprintf("no filter %s\n", args[1])
+			}
+		case "clear":
+			context.Tracer.Clear()
+		default:
+			return "usage: " + commands["trace"].usage + "\n"
+		}
+	}
+
+	filters := context.Tracer.Filters()
+	if len(filters) == 0 {
+		return "tracing off\n"
+	}
+	var builder strings.Builder
+	for i, filter := range filters {
+		fmt.Fprintf(&builder, "%d: %s\n", i, filter)
+	}
+	return builder.String()
+}
+
+// Send runs command on the admin console of the server running on this host
+// and returns its output.
+func Send(command string) (string, error) {
+	port := config.GetValueInt("admin_port")
+	if port <= 0 {
+		return "", fmt.Errorf("admin_port is not set")
+	}
+	conn, err := net.DialTimeout("tcp4", fmt.Sprintf("127.0.0.1:%d", port), kSendTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(kSendTimeout))
+
+	if _, err := fmt.Fprintf(conn, "%s\nquit\n", command); err != nil {
+		return "", err
+	}
+	output, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return "", err
+	}
+	return strings.ReplaceAll(string(output), kPrompt, ""), nil
+}
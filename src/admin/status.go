@@ -0,0 +1,123 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package admin
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"git.astrospark.com/bolorama/privacy"
+	"git.astrospark.com/bolorama/state"
+)
+
+// Status is a snapshot of the server for the dashboards: the web page (see
+// the web package) and bolorama top, which reads it with "status json".
+type Status struct {
+	Time      time.Time     `json:"time"`
+	Drain     string        `json:"drain"`
+	Restart   *time.Time    `json:"restart,omitempty"`
+	Broadcast string        `json:"broadcast,omitempty"`
+	Panics    uint64        `json:"panics"` // recovered instead of crashing the server
+	Games     []GameStatus  `json:"games"`
+	Routes    []RouteStatus `json:"routes"`
+}
+
+// GameStatus is a game in progress.
+type GameStatus struct {
+	GameId  string `json:"game_id"`
+	Title   string `json:"title,omitempty"`
+	MapName string `json:"map_name"`
+	Players int    `json:"players"`
+	// time forwarded packets spend in the proxy, 0 until some are forwarded
+	LatencyP50Us int64 `json:"latency_p50_us"`
+	LatencyP99Us int64 `json:"latency_p99_us"`
+}
+
+// RouteStatus is a player's proxy port.
+type RouteStatus struct {
+	ProxyPort      int      `json:"proxy_port"`
+	Name           string   `json:"name"`
+	GameId         string   `json:"game_id"`
+	Address        string   `json:"address"`
+	Version        string   `json:"version"`
+	RttMs          int64    `json:"rtt_ms"`          // 0 until measured
+	IdleSeconds    int64    `json:"idle_seconds"`    // since the player last sent
+	RxPackets      int64    `json:"rx_packets"`      // from the player
+	TxPackets      int64    `json:"tx_packets"`      // to the player
+	QueuedPackets  int      `json:"queued_packets"`  // waiting to be sent to the player
+	DroppedPackets uint64   `json:"dropped_packets"` // on a full transmit queue
+	Tags           []string `json:"tags"`
+	Disconnected   bool     `json:"disconnected"` // held for reconnect_grace_seconds
+}
+
+// CollectStatus takes a snapshot of the server.
+func CollectStatus(context *state.ServerContext) Status {
+	status := Status{Time: time.Now(), Panics: state.Panics(), Games: []GameStatus{}, Routes: []RouteStatus{}}
+	state.Do(context, func(s *state.State) {
+		status.Drain = state.DrainProgress(s)
+		if restartAt := state.ServerRestartTime(s); !restartAt.IsZero() {
+			status.Restart = &restartAt
+		}
+		status.Broadcast = state.ServerBroadcastText(s)
+
+		latencies := state.GameLatencies(s)
+		for gameId, info := range s.Games {
+			latency := latencies[gameId]
+			status.Games = append(status.Games, GameStatus{
+				GameId:       hex.EncodeToString(gameId[:]),
+				Title:        state.GameTitle(s, gameId),
+				MapName:      info.MapName,
+				Players:      int(info.PlayerCount),
+				LatencyP50Us: latency.Quantile(0.5).Microseconds(),
+				LatencyP99Us: latency.Quantile(0.99).Microseconds(),
+			})
+		}
+		for _, player := range s.Players {
+			route := RouteStatus{
+				ProxyPort:    player.ProxyPort,
+				Name:         player.Name,
+				GameId:       hex.EncodeToString(player.GameId[:]),
+				Address:      privacy.Addr(player.IpAddr, player.IpPort),
+				Version:      player.Version.String(),
+				RttMs:        player.Rtt.Milliseconds(),
+				Tags:         append([]string{}, player.Tags...),
+				Disconnected: !player.DisconnectedAt.IsZero(),
+			}
+			if player.Route != nil {
+				route.IdleSeconds = int64(player.Route.ReceivedIdle().Seconds())
+				route.RxPackets, route.TxPackets = player.Route.Packets()
+				route.QueuedPackets = player.Route.TxQueue.Len()
+				route.DroppedPackets = player.Route.TxQueue.Drops()
+			}
+			status.Routes = append(status.Routes, route)
+		}
+	})
+
+	sort.Slice(status.Games, func(i, j int) bool { return status.Games[i].GameId < status.Games[j].GameId })
+	sort.Slice(status.Routes, func(i, j int) bool { return status.Routes[i].ProxyPort < status.Routes[j].ProxyPort })
+	return status
+}
+
+// ParseStatus reads the output of "status json".
+func ParseStatus(output string) (Status, error) {
+	var status Status
+	err := json.Unmarshal([]byte(output), &status)
+	return status, err
+}
@@ -0,0 +1,211 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package alert
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.astrospark.com/bolorama/config"
+	"git.astrospark.com/bolorama/events"
+	"git.astrospark.com/bolorama/metrics"
+	"git.astrospark.com/bolorama/state"
+)
+
+// Alert rules are conditions on the metrics (see the metrics package) given
+// in alert_rules, one per list item:
+//
+//	<metric> <op> <threshold> [for <duration>]
+//
+// e.g. "proxy_ports_percent > 90", "games == 0 for 12h" or
+// "proxy_unknown_packets > 5 for 10m". op is one of > >= < <= == !=.
+// Gauges are compared as they are and running totals as their rate per
+// second; the latency histogram has latency.p50_us and latency.p99_us. Every
+// alert_check_seconds the metrics are read, and a rule whose condition has
+// held for its duration raises an Alert event, which is resolved once the
+// condition no longer holds.
+
+// Rule is a parsed alert rule.
+type Rule struct {
+	Text      string
+	Metric    string
+	Op        string
+	Threshold float64
+	For       time.Duration
+}
+
+var ops = map[string]func(a float64, b float64) bool{
+	">":  func(a float64, b float64) bool { return a > b },
+	">=": func(a float64, b float64) bool { return a >= b },
+	"<":  func(a float64, b float64) bool { return a < b },
+	"<=": func(a float64, b float64) bool { return a <= b },
+	"==": func(a float64, b float64) bool { return a == b },
+	"!=": func(a float64, b float64) bool { return a != b },
+}
+
+// ParseRule parses an alert rule. The metric is not checked, since metrics
+// are registered by the server as it starts.
+func ParseRule(text string) (Rule, error) {
+	fields := strings.Fields(text)
+	if len(fields) != 3 && (len(fields) != 5 || fields[3] != "for") {
+		return Rule{}, fmt.Errorf("not <metric> <op> <threshold> [for <duration>]: %s", text)
+	}
+
+	rule := Rule{Text: strings.Join(fields, " "), Metric: fields[0], Op: fields[1]}
+	if _, ok := ops[rule.Op]; !ok {
+		return Rule{}, fmt.Errorf("%s: op is not one of >, >=, <, <=, ==, !=", text)
+	}
+	threshold, err := strconv.ParseFloat(strings.TrimSuffix(fields[2], "%"), 64)
+	if err != nil {
+		return Rule{}, fmt.Errorf("%s: threshold is not a number", text)
+	}
+	rule.Threshold = threshold
+	if len(fields) == 5 {
+		rule.For, err = time.ParseDuration(fields[4])
+		if err != nil || rule.For < 0 {
+			return Rule{}, fmt.Errorf("%s: not a duration such as 90s, 10m or 12h: %s", text, fields[4])
+		}
+	}
+	return rule, nil
+}
+
+// ParseRules parses alert_rules, returning the first error.
+func ParseRules(texts []string) ([]Rule, error) {
+	var rules []Rule
+	for _, text := range texts {
+		rule, err := ParseRule(text)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// ruleState is how a rule has fared so far.
+type ruleState struct {
+	since  time.Time // when the condition started holding, zero if it does not
+	firing bool
+}
+
+// evaluator is a metrics.Sink checking the rules each time the metrics are
+// reported to it.
+type evaluator struct {
+	context  *state.ServerContext
+	rules    []Rule
+	states   []ruleState
+	interval time.Duration
+	values   map[string]float64
+}
+
+func (e *evaluator) Gauge(name string, value int64) {
+	e.values[name] = float64(value)
+}
+
+func (e *evaluator) Count(name string, delta int64) {
+	e.values[name] = float64(delta) / e.interval.Seconds()
+}
+
+func (e *evaluator) Flush() error {
+	now := time.Now()
+	for i, rule := range e.rules {
+		ruleState := &e.states[i]
+
+		// running totals have no rate until the second report, and latency
+		// percentiles none while no packets are forwarded
+		value, ok := e.values[rule.Metric]
+		if !ok {
+			continue
+		}
+
+		if !ops[rule.Op](value, rule.Threshold) {
+			ruleState.since = time.Time{}
+			if ruleState.firing {
+				ruleState.firing = false
+				e.publish(rule, state.AlertResolved, fmt.Sprintf("resolved: %s (%s is %s)", rule.Text, rule.Metric, formatValue(value)))
+			}
+			continue
+		}
+
+		if ruleState.since.IsZero() {
+			ruleState.since = now
+		}
+		if !ruleState.firing && now.Sub(ruleState.since) >= rule.For {
+			ruleState.firing = true
+			e.publish(rule, state.AlertFiring, fmt.Sprintf("%s (%s is %s)", rule.Text, rule.Metric, formatValue(value)))
+		}
+	}
+	e.values = make(map[string]float64)
+	return nil
+}
+
+func (e *evaluator) publish(rule Rule, reason string, text string) {
+	e.context.Logger.Println("Alert:", text)
+	e.context.Events.Publish(events.Event{Type: events.Alert, Name: rule.Text, Reason: reason, Text: text})
+}
+
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// knownMetric reports whether name is one a rule can use.
+func knownMetric(name string) bool {
+	for _, metric := range metrics.All() {
+		switch metric.Kind {
+		case metrics.KindHistogram:
+			if name == metric.Name+".p50_us" || name == metric.Name+".p99_us" || name == metric.Name+".count" {
+				return true
+			}
+		default:
+			if name == metric.Name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Run checks rules, parsed from alert_rules, every alert_check_seconds until
+// the network is shut down. The metrics they name are looked up when it
+// starts, once the metrics are registered.
+func Run(context *state.ServerContext, rules []Rule) {
+	defer context.Network.WaitGroup.Done()
+
+	if len(rules) == 0 {
+		return
+	}
+	for _, rule := range rules {
+		if !knownMetric(rule.Metric) {
+			context.Logger.Printf("alert_rules: %s: no metric named %s\n", rule.Text, rule.Metric)
+		}
+	}
+
+	interval := time.Duration(config.GetValueInt("alert_check_seconds")) * time.Second
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	metrics.Report(context.Network.Ctx, &evaluator{
+		context:  context,
+		rules:    rules,
+		states:   make([]ruleState, len(rules)),
+		interval: interval,
+		values:   make(map[string]float64),
+	}, interval, context.Logger)
+}
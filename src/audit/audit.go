@@ -0,0 +1,173 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package audit
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// The audit log records administrative actions to audit_file, one JSON entry
+// per line. Each entry holds the HMAC-SHA256 of the line before it, keyed
+// with audit_secret, so a line that is changed or removed breaks the chain
+// (see Verify), and without the secret the chain cannot be rebuilt to hide
+// it. The file is only ever appended to.
+
+// Entry is one action: who took it, on what and why.
+type Entry struct {
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`
+	Action string    `json:"action"`
+	Target string    `json:"target"`
+	Reason string    `json:"reason,omitempty"`
+	// Result is what the action printed, such as an error
+	Result string `json:"result,omitempty"`
+	// Prev is the HMAC-SHA256 of the previous line, hex encoded, or empty
+	// for the first entry
+	Prev string `json:"prev"`
+}
+
+// Log is an audit log file. The trackers of a server share one.
+type Log struct {
+	filename       string
+	secret         []byte
+	logger         *log.Logger
+	mutex          sync.Mutex
+	lastHash       string
+	lastHashLoaded bool
+}
+
+// NewLog returns the audit log in filename, keyed with secret, or nil if
+// filename is "". An empty secret leaves the chain unkeyed, so anyone who
+// can write the file can rebuild it.
+func NewLog(filename string, secret string, logger *log.Logger) *Log {
+	if filename == "" {
+		return nil
+	}
+	return &Log{filename: filename, secret: []byte(secret), logger: logger}
+}
+
+func (auditLog *Log) hashLine(line []byte) string {
+	mac := hmac.New(sha256.New, auditLog.secret)
+	mac.Write(line)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Record appends an entry to the audit log. Does nothing if auditLog is nil.
+func (auditLog *Log) Record(actor string, action string, target string, reason string, result string) {
+	if auditLog == nil {
+		return
+	}
+
+	auditLog.mutex.Lock()
+	defer auditLog.mutex.Unlock()
+
+	if !auditLog.lastHashLoaded {
+		entries, hashes, err := auditLog.read()
+		if err != nil && !os.IsNotExist(err) {
+			auditLog.logger.Println("Failed to read audit log:", err)
+			return
+		}
+		if len(entries) > 0 {
+			auditLog.lastHash = hashes[len(hashes)-1]
+		}
+		auditLog.lastHashLoaded = true
+	}
+
+	entry := Entry{Time: time.Now().UTC(), Actor: actor, Action: action, Target: target, Reason: reason, Result: result, Prev: auditLog.lastHash}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		auditLog.logger.Println(err)
+		return
+	}
+
+	file, err := os.OpenFile(auditLog.filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		auditLog.logger.Println("Failed to write audit log:", err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		auditLog.logger.Println("Failed to write audit log:", err)
+		return
+	}
+	auditLog.lastHash = auditLog.hashLine(line)
+}
+
+// read returns the entries in the file and the hash of each line.
+func (auditLog *Log) read() ([]Entry, []string, error) {
+	file, err := os.Open(auditLog.filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	var entries []Entry
+	var hashes []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return entries, hashes, fmt.Errorf("line %d: %v", len(entries)+1, err)
+		}
+		entries = append(entries, entry)
+		hashes = append(hashes, auditLog.hashLine(scanner.Bytes()))
+	}
+	return entries, hashes, scanner.Err()
+}
+
+// Verify returns the entries of the audit log, and an error naming the first
+// line that does not follow from the one before it, if any. Does nothing if
+// auditLog is nil.
+func (auditLog *Log) Verify() ([]Entry, error) {
+	if auditLog == nil {
+		return nil, nil
+	}
+
+	auditLog.mutex.Lock()
+	defer auditLog.mutex.Unlock()
+
+	entries, hashes, err := auditLog.read()
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return entries, err
+	}
+	for i, entry := range entries {
+		prev := ""
+		if i > 0 {
+			prev = hashes[i-1]
+		}
+		if !hmac.Equal([]byte(entry.Prev), []byte(prev)) {
+			return entries, fmt.Errorf("line %d does not follow from the line before it", i+1)
+		}
+	}
+	if auditLog.lastHashLoaded && auditLog.lastHash != "" && (len(hashes) == 0 || hashes[len(hashes)-1] != auditLog.lastHash) {
+		return entries, fmt.Errorf("the last entry written is missing")
+	}
+	return entries, nil
+}
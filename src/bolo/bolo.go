@@ -23,8 +23,10 @@ import (
 	"encoding/hex"
 	"fmt"
 	"net"
+	"strings"
 	"time"
 
+	"git.astrospark.com/bolorama/profanity"
 	"git.astrospark.com/bolorama/proxy"
 	"git.astrospark.com/bolorama/util"
 	"github.com/snksoft/crc"
@@ -71,6 +73,16 @@ const OpcodeGameInfoSubcodePillbox = 0x02
 const OpcodeGameInfoSubcodeBase = 0x03
 const OpcodeGameInfoSubcodeStart = 0x04
 
+// LoginCommand starts a chat message that logs the sender in to an account,
+// e.g. "/login 0123abcd...". The message is blanked for the players it is
+// sent to, so the token is seen by the proxy only.
+const LoginCommand = "/login"
+
+// The opcodes Bolo uses to form and leave alliances have not been identified,
+// so teams are not tracked. They can be found by recording a game in which
+// players ally (record_directory) or tracing its game state packets
+// (type=0x02); until then they are skipped like other opcodes we do not need.
+
 /* Macs count time since Midnight, 1st Jan 1904. Unix counts from 1970.
    This value adjusts for the 66 years and 17 leap-days difference. */
 const seconds1904ToUnixEpoch = (((1970-1904)*365 + 17) * 24 * 60 * 60)
@@ -92,6 +104,22 @@ type GameInfo struct {
 	NeutralPillboxCount  uint16
 	NeutralBaseCount     uint16
 	HasPassword          bool
+	Version              Version
+	// set only for games on WinBolo servers, which are listed but not proxied
+	WinBoloServer *net.UDPAddr
+	// set only for Mac Bolo hosts listed in pure tracker mode, which players
+	// connect to directly
+	DirectHost *net.UDPAddr
+	LastSeen   time.Time // last game info received
+}
+
+// DirectAddr returns the address players connect to for games that are
+// listed but not proxied, or nil for proxied games.
+func (gameInfo GameInfo) DirectAddr() *net.UDPAddr {
+	if gameInfo.WinBoloServer != nil {
+		return gameInfo.WinBoloServer
+	}
+	return gameInfo.DirectHost
 }
 
 var opcodeLengthLookup = []int{
@@ -106,15 +134,95 @@ var opcodeLengthLookup = []int{
 }
 
 func verifyBoloSignature(msg []byte) bool {
-	return string(msg[0:4]) == boloSignature
+	return len(msg) >= 4 && string(msg[0:4]) == boloSignature
 }
 
 func verifyBoloVersion(msg []byte) bool {
-	return bytes.Equal(msg[4:7], []byte{0x65, 0x99, 0x08})
+	return versionSupported(GetVersion(msg))
 }
 
+// GetPacketType returns the type of a packet, or -1 if it is too short to
+// have one.
 func GetPacketType(msg []byte) int {
-	return int(msg[7])
+	if len(msg) < PacketHeaderSize {
+		return -1
+	}
+	return int(msg[PacketTypeOffset])
+}
+
+// GetGameStateSender returns the Bolo player id of the sender of a game state
+// packet, taken from its first block.
+func GetGameStateSender(msg []byte) (int, bool) {
+	pos := PacketHeaderSize + 1 // skip state sequence
+	if len(msg) < pos+3 || GetPacketType(msg) != PacketTypeGameState {
+		return 0, false
+	}
+
+	blockLength := int(msg[pos] & 0x7f)
+	if blockLength < 4 {
+		return 0, false
+	}
+
+	// block length, block sequence, then sender flags + sender id
+	return int(msg[pos+2] & 0x0f), true
+}
+
+// IsBulkPacket reports whether a packet carries map data, which is sent in
+// bulk when a player joins and can wait behind the packets of the game play.
+func IsBulkPacket(msg []byte) bool {
+	if len(msg) <= PacketHeaderSize || GetPacketType(msg) != PacketTypeGameState {
+		return false
+	}
+
+	pos := PacketHeaderSize + 1 // skip state sequence
+	for pos < len(msg) {
+		posChecksum, opcodePos, ok := parseBlockHeader(pos, msg)
+		if !ok {
+			return false
+		}
+
+		for opcodePos < posChecksum {
+			opcode, opcodeLength := parseOpcode(opcodePos, msg, posChecksum)
+			if opcodeLength == 0 {
+				return false
+			}
+			if opcode == OpcodeMapData {
+				return true
+			}
+			opcodePos = opcodePos + opcodeLength
+		}
+
+		pos = posChecksum + 2
+	}
+
+	return false
+}
+
+// parseBlockHeader returns where the checksum of the game state block at pos
+// is, and where its first opcode is. ok is false if the block is too short or
+// does not fit in the packet.
+func parseBlockHeader(pos int, msg []byte) (posChecksum int, opcodePos int, ok bool) {
+	// block length includes length byte, does not include checksum
+	blockLength := int(msg[pos] & 0x7f)
+	if blockLength < 4 {
+		return 0, 0, false
+	}
+	posChecksum = pos + blockLength
+	if posChecksum+2 > len(msg) {
+		return 0, 0, false
+	}
+
+	opcodePos = pos + 2 // skip length and block sequence
+	senderFlags := msg[opcodePos] & 0xf0
+	flags := msg[opcodePos+1]
+	opcodePos = opcodePos + 2
+	if flags&0x80 > 0 {
+		opcodePos = opcodePos + 5
+	}
+	if senderFlags&0xe0 > 0 {
+		opcodePos = opcodePos + 3
+	}
+	return posChecksum, opcodePos, true
 }
 
 func ValidatePacket(packet proxy.UdpPacket) (bool, string) {
@@ -155,6 +263,9 @@ func MarshalPacketTypeD() []byte {
 }
 
 func RewritePacketGameInfo(buffer []byte, ip net.IP) {
+	if len(buffer) < gameInfoPacketSize {
+		return
+	}
 	var pos int = PacketHeaderSize
 	pos = pos + 36 // skip map name
 	buffer[pos+0] = ip[0]
@@ -163,11 +274,25 @@ func RewritePacketGameInfo(buffer []byte, ip net.IP) {
 	buffer[pos+3] = ip[3]
 }
 
-func ParsePacketGameInfo(msg []byte) GameInfo {
+// gameInfoPacketSize is the size of a game info packet, up to and including
+// the password flag.
+const gameInfoPacketSize = PacketHeaderSize + 36 + 8 + 19
+
+// ParsePacketGameInfo parses a Mac Bolo host's game info packet.
+func ParsePacketGameInfo(msg []byte) (GameInfo, error) {
 	var gameInfo GameInfo
 	var pos int = PacketHeaderSize
 
-	gameInfo.MapName = string(msg[pos+1 : pos+1+int(msg[pos])])
+	if len(msg) < gameInfoPacketSize {
+		return gameInfo, fmt.Errorf("game info packet too short (%d)", len(msg))
+	}
+
+	gameInfo.Version = GetVersion(msg)
+	mapNameLength := int(msg[pos])
+	if mapNameLength > 35 {
+		mapNameLength = 35
+	}
+	gameInfo.MapName = string(msg[pos+1 : pos+1+mapNameLength])
 	pos = pos + 36
 
 	copy(gameInfo.GameId[:], msg[pos:pos+8])
@@ -208,57 +333,51 @@ func ParsePacketGameInfo(msg []byte) GameInfo {
 	gameInfo.HasPassword = msg[pos] > 0
 	pos = pos + 1
 
-	return gameInfo
+	return gameInfo, nil
 }
 
-func PrintGameInfo(gameInfo GameInfo) {
-	fmt.Println()
-	fmt.Println("Game Id:", hex.EncodeToString(gameInfo.GameId[:]))
-	fmt.Println("Map Name:", gameInfo.MapName)
-	fmt.Println("Start Timestamp:", ParseBoloTimestamp(gameInfo.StartTimestamp))
-	fmt.Println("Game Type:", gameInfo.GameType)
-	fmt.Println("Allow Hidden Mines:", gameInfo.AllowHiddenMines)
-	fmt.Println("Allow Computer:", gameInfo.AllowComputer)
-	fmt.Println("Computer Advantage:", gameInfo.ComputerAdvantage)
-	fmt.Println("Start Delay:", gameInfo.StartDelay)
-	fmt.Println("Time Limit:", gameInfo.TimeLimit)
-	fmt.Println("Player Count:", gameInfo.PlayerCount)
-	fmt.Println("Neutral Pillbox Count:", gameInfo.NeutralPillboxCount)
-	fmt.Println("Neutral Base Count:", gameInfo.NeutralBaseCount)
-	fmt.Println("Password:", gameInfo.HasPassword)
-	fmt.Println()
+func SprintGameInfo(gameInfo GameInfo) string {
+	var sb strings.Builder
+	fmt.Fprintln(&sb)
+	fmt.Fprintln(&sb, "Game Id:", hex.EncodeToString(gameInfo.GameId[:]))
+	fmt.Fprintln(&sb, "Map Name:", gameInfo.MapName)
+	fmt.Fprintln(&sb, "Start Timestamp:", ParseBoloTimestamp(gameInfo.StartTimestamp))
+	fmt.Fprintln(&sb, "Game Type:", gameInfo.GameType)
+	fmt.Fprintln(&sb, "Allow Hidden Mines:", gameInfo.AllowHiddenMines)
+	fmt.Fprintln(&sb, "Allow Computer:", gameInfo.AllowComputer)
+	fmt.Fprintln(&sb, "Computer Advantage:", gameInfo.ComputerAdvantage)
+	fmt.Fprintln(&sb, "Start Delay:", gameInfo.StartDelay)
+	fmt.Fprintln(&sb, "Time Limit:", gameInfo.TimeLimit)
+	fmt.Fprintln(&sb, "Player Count:", gameInfo.PlayerCount)
+	fmt.Fprintln(&sb, "Neutral Pillbox Count:", gameInfo.NeutralPillboxCount)
+	fmt.Fprintln(&sb, "Neutral Base Count:", gameInfo.NeutralBaseCount)
+	fmt.Fprintln(&sb, "Password:", gameInfo.HasPassword)
+	fmt.Fprintln(&sb)
+	return sb.String()
 }
 
 func ParseBoloTimestamp(timestamp uint32) time.Time {
 	return time.Unix(int64(timestamp-seconds1904ToUnixEpoch), 0)
 }
 
-func rewriteOpcodePlayerInfo(
-	pos int,
-	buffer []byte,
-	proxyPort int,
-	proxyIP net.IP,
-	srcPlayer util.PlayerAddr,
-	playerLeaveGameChannel chan util.PlayerAddr,
-) {
+// rewriteOpcodePlayerInfo points the address in a disconnect opcode at the
+// proxy, and reports whether the sender is leaving the game. end is where the
+// opcode ends.
+func rewriteOpcodePlayerInfo(pos int, end int, buffer []byte, proxyPort int, proxyIPs []net.IP) (leaving bool) {
 	// skip address length, first address
 	pos = pos + 7
-
-	playerPort := binary.BigEndian.Uint16(buffer[pos+4 : pos+6])
-	fmt.Printf("Player disconnecting: %d (NAT %d.%d.%d.%d:%d)\n", proxyPort, buffer[pos+0], buffer[pos+1], buffer[pos+2], buffer[pos+3], playerPort)
-	//if bytes.Equal(srcRoute.PlayerIPAddr.IP, buffer[pos:pos+4]) && int(playerPort) == srcRoute.PlayerIPAddr.Port {
-	if !bytes.Equal(buffer[pos:pos+4], proxyIP) {
-		fmt.Println("Sending LeaveGame event")
-		playerLeaveGameChannel <- srcPlayer
+	if pos+6 > end {
+		return false
 	}
 
-	if !bytes.Equal(proxyIP, buffer[pos:pos+4]) {
-		buffer[pos+0] = proxyIP[0]
-		buffer[pos+1] = proxyIP[1]
-		buffer[pos+2] = proxyIP[2]
-		buffer[pos+3] = proxyIP[3]
+	//if bytes.Equal(srcRoute.PlayerIPAddr.IP, buffer[pos:pos+4]) && int(playerPort) == srcRoute.PlayerIPAddr.Port {
+	if !isProxyIp(buffer[pos:pos+4], proxyIPs) {
+		leaving = true
 		binary.BigEndian.PutUint16(buffer[pos+4:pos+6], uint16(proxyPort))
 	}
+
+	copy(buffer[pos:pos+4], proxyIPs[0])
+	return leaving
 }
 
 func rewriteOpcodeGameInfo(pos int, buffer []byte, proxyPort int, proxyIP net.IP) {
@@ -276,13 +395,25 @@ func rewriteOpcodeGameInfo(pos int, buffer []byte, proxyPort int, proxyIP net.IP
 	*/
 }
 
-// parseOpcode returns the opcode and the length (including the opcode byte(s))
-func parseOpcode(pos int, buffer []byte) (int, int) {
+// parseOpcode returns the opcode at pos and its length (including the opcode
+// byte(s)). The length is 0 if the opcode does not fit before end.
+func parseOpcode(pos int, buffer []byte, end int) (int, int) {
+	if end > len(buffer) {
+		end = len(buffer)
+	}
+	start := pos
+	if pos >= end {
+		return 0, 0
+	}
+
 	opcode := int(buffer[pos])
 	pos = pos + 1
 	offset := 0
 
 	if opcode == 0xff {
+		if pos >= end {
+			return 0, 0
+		}
 		opcode = int(buffer[pos])
 		pos = pos + 1
 		offset = 0x20
@@ -297,13 +428,27 @@ func parseOpcode(pos int, buffer []byte) (int, int) {
 	opcode = opcode + offset
 	opcodeLength := 0
 
+	// operand returns the byte i after the opcode, if it is before end
+	operand := func(i int) (int, bool) {
+		if pos+i >= end {
+			return 0, false
+		}
+		return int(buffer[pos+i]), true
+	}
+
 	switch opcode {
 	case OpcodeDisconnect:
-		addressLength := int(buffer[pos])
+		addressLength, ok := operand(0)
+		if !ok {
+			return opcode, 0
+		}
 		opcodeLength = (addressLength * 3) + 2
 	case OpcodeGameInfo:
-		subcode := int(buffer[pos])
-		count := int(buffer[pos+1])
+		subcode, ok := operand(0)
+		count, ok2 := operand(1)
+		if !ok || !ok2 {
+			return opcode, 0
+		}
 
 		switch subcode {
 		case OpcodeGameInfoSubcodeGame:
@@ -318,88 +463,121 @@ func parseOpcode(pos int, buffer []byte) (int, int) {
 			opcodeLength = 42
 		}
 	case OpcodeMapData:
-		mapDataLength := int(buffer[pos+2])
+		mapDataLength, ok := operand(2)
+		if !ok {
+			return opcode, 0
+		}
 		opcodeLength = mapDataLength + 3
 	case OpcodePlayerName:
-		playerNameLength := int(buffer[pos])
+		playerNameLength, ok := operand(0)
+		if !ok {
+			return opcode, 0
+		}
 		opcodeLength = playerNameLength + 2
 	case OpcodeSendMessage:
-		messageLength := int(buffer[pos+2])
+		messageLength, ok := operand(2)
+		if !ok {
+			return opcode, 0
+		}
 		opcodeLength = messageLength + 4
 	default:
+		if opcode >= len(opcodeLengthLookup) {
+			return opcode, 0
+		}
 		opcodeLength = opcodeLengthLookup[opcode]
 	}
 
+	if opcodeLength <= 0 || start+opcodeLength > end {
+		return opcode, 0
+	}
 	return opcode, opcodeLength
 }
 
+// gameStateChanges are what rewriting a game state packet found out about its
+// sender: names, ids and chat to pass on, and whether they are leaving.
+type gameStateChanges struct {
+	playerInfo []util.PlayerInfoEvent
+	leaving    bool
+}
+
+// rewriteGameStateBlock rewrites the game state block at posStart and returns
+// where the next one starts. A block that does not fit in the packet ends the
+// packet, and is left as it is.
 func rewriteGameStateBlock(
 	packetSequence int,
 	posStart int,
 	buffer []byte,
 	proxyPort int,
-	proxyIP net.IP,
+	proxyIPs []net.IP,
 	srcPlayer util.PlayerAddr,
-	playerInfoEventChannel chan util.PlayerInfoEvent,
-	playerLeaveGameChannel chan util.PlayerAddr,
+	muted []int,
+	changes *gameStateChanges,
 ) int {
-	// block length includes length byte, does not include checksum
 	blockLength := int(buffer[posStart] & 0x7f)
-	posBlockStart := posStart + 1
-	posChecksum := posStart + blockLength
-	posNextBlock := posChecksum + 2
-	rewriteCrc := false
-
-	if blockLength < 4 {
-		if blockLength == 0 {
+	posChecksum, pos, ok := parseBlockHeader(posStart, buffer)
+	if !ok {
+		if blockLength == 0 || posStart+blockLength+2 > len(buffer) {
 			// don't know what this is, can't continue parsing
-			posNextBlock = len(buffer) // skip to end
+			return len(buffer)
 		}
-		return posNextBlock
+		return posStart + blockLength + 2
 	}
+	posNextBlock := posChecksum + 2
+	rewriteCrc := false
 
-	//blockSequence := buffer[posBlockStart]
-	pos := posBlockStart + 1 // skip sequence
-	senderFlags := buffer[pos] & 0xf0
-	sender := buffer[pos] & 0x0f
-	pos = pos + 1
-	flags := buffer[pos]
-	pos = pos + 1
-
-	if flags&0x80 > 0 {
-		pos = pos + 5
-	}
-
-	if senderFlags&0xe0 > 0 {
-		pos = pos + 3
-	}
+	//blockSequence := buffer[posStart+1]
+	sender := buffer[posStart+2] & 0x0f
 
 	for pos < posChecksum {
-		opcode, opcodeLength := parseOpcode(pos, buffer)
+		opcode, opcodeLength := parseOpcode(pos, buffer, posChecksum)
+		if opcodeLength == 0 {
+			// the rest of the block can't be parsed
+			break
+		}
 
 		/*
 			fmt.Printf("PacketLength: %d PacketSequence: 0x%02x BlockSequence: 0x%02x BlockLength: %d RawOpcode: 0x%02x Opcode: 0x%02x OpcodeLength: %d\n",
 				len(buffer), packetSequence, blockSequence, blockLength, buffer[pos], opcode, opcodeLength)
 		*/
 
+		// every opcode below fits in opcodeLength, which fits in the block
 		switch opcode {
 		case OpcodeGameInfo:
 			subcode := int(buffer[pos+1])
 			//pos = pos + 1
 
 			if subcode == OpcodeGameInfoSubcodeGame {
-				rewriteOpcodeGameInfo(pos+2, buffer, proxyPort, proxyIP)
+				rewriteOpcodeGameInfo(pos+2, buffer, proxyPort, proxyIPs[0])
 				rewriteCrc = true
 			}
 		case OpcodePlayerName:
 			if (packetSequence == 0x02) && (buffer[posStart]&0x80 == 0) {
-				playerInfoEventChannel <- util.PlayerInfoEvent{srcPlayer, true, false, int(sender), ""}
+				changes.playerInfo = append(changes.playerInfo, util.PlayerInfoEvent{PlayerAddr: srcPlayer, SetId: true, PlayerId: int(sender)})
 			}
 			nameLength := int(buffer[pos+1])
 			playerName := string(buffer[pos+2 : pos+2+nameLength])
-			playerInfoEventChannel <- util.PlayerInfoEvent{srcPlayer, false, true, int(sender), playerName}
+			changes.playerInfo = append(changes.playerInfo, util.PlayerInfoEvent{PlayerAddr: srcPlayer, SetName: true, PlayerId: int(sender), Name: playerName})
+		case OpcodeSendMessage:
+			// skip the recipient mask
+			messageLength := int(buffer[pos+3])
+			if util.ContainsInt(muted, int(sender)) {
+				blankMessage(buffer[pos+4 : pos+4+messageLength])
+				rewriteCrc = true
+				break
+			}
+			message := string(buffer[pos+4 : pos+4+messageLength])
+			if isLoginCommand(message) {
+				blankMessage(buffer[pos+4 : pos+4+messageLength])
+				rewriteCrc = true
+			} else if profanity.FilterChat(buffer[pos+4 : pos+4+messageLength]) {
+				rewriteCrc = true
+				message = string(buffer[pos+4 : pos+4+messageLength])
+			}
+			changes.playerInfo = append(changes.playerInfo, util.PlayerInfoEvent{PlayerAddr: srcPlayer, Chat: true, PlayerId: int(sender), Message: message})
 		case OpcodeDisconnect:
-			rewriteOpcodePlayerInfo(pos+2, buffer, proxyPort, proxyIP, srcPlayer, playerLeaveGameChannel)
+			if rewriteOpcodePlayerInfo(pos+2, pos+opcodeLength, buffer, proxyPort, proxyIPs) {
+				changes.leaving = true
+			}
 			rewriteCrc = true
 		}
 
@@ -414,15 +592,32 @@ func rewriteGameStateBlock(
 	return posNextBlock
 }
 
+// blankMessage blanks a chat message, which cannot be removed without changing
+// the block length.
+func blankMessage(message []byte) {
+	for i := range message {
+		message[i] = ' '
+	}
+}
+
+// isLoginCommand reports whether message is a LoginCommand.
+func isLoginCommand(message string) bool {
+	fields := strings.Fields(message)
+	return len(fields) > 0 && fields[0] == LoginCommand
+}
+
 func rewritePacketGameState(
 	buffer []byte,
-	proxyIP net.IP,
+	proxyIPs []net.IP,
 	proxyPort int,
 	srcPlayer util.PlayerAddr,
-	playerInfoEventChannel chan util.PlayerInfoEvent,
-	playerLeaveGameChannel chan util.PlayerAddr,
-) {
+	muted []int,
+) gameStateChanges {
+	var changes gameStateChanges
 	pos := PacketHeaderSize
+	if pos >= len(buffer) {
+		return changes
+	}
 	packetSequence := int(buffer[pos])
 	pos = pos + 1 // skip state sequence
 
@@ -432,59 +627,76 @@ func rewritePacketGameState(
 			pos,
 			buffer,
 			proxyPort,
-			proxyIP,
+			proxyIPs,
 			srcPlayer,
-			playerInfoEventChannel,
-			playerLeaveGameChannel,
+			muted,
+			&changes,
 		)
 	}
+	return changes
 }
 
-func rewritePacketFixedPosition(buffer []byte, proxyIP net.IP, proxyPort int, offset int) {
+func rewritePacketFixedPosition(buffer []byte, proxyIPs []net.IP, proxyPort int, offset int) {
+	if len(buffer) < offset+6 {
+		return
+	}
 	packetIP := buffer[offset : offset+4]
-	if !bytes.Equal(packetIP, proxyIP) {
-		port := make([]byte, 2)
-		binary.BigEndian.PutUint16(port, uint16(proxyPort))
-		buffer[offset+0] = proxyIP[0]
-		buffer[offset+1] = proxyIP[1]
-		buffer[offset+2] = proxyIP[2]
-		buffer[offset+3] = proxyIP[3]
-		buffer[offset+4] = port[0]
-		buffer[offset+5] = port[1]
+	if !isProxyIp(packetIP, proxyIPs) {
+		binary.BigEndian.PutUint16(buffer[offset+4:offset+6], uint16(proxyPort))
+	}
+	copy(packetIP, proxyIPs[0])
+}
+
+// isProxyIp reports whether an address found in a packet already points at
+// the proxy, i.e. is one of the addresses it has handed out.
+func isProxyIp(ip []byte, proxyIPs []net.IP) bool {
+	for _, proxyIP := range proxyIPs {
+		if bytes.Equal(ip, proxyIP) {
+			return true
+		}
 	}
+	return false
 }
 
+// RewritePacket points the addresses in a packet at the proxy. proxyIPs are
+// the proxy's own addresses as seen by the receiver (first, and written into
+// the packet) and by the sender. Addresses matching any of them already refer
+// to some player's proxy port and keep their port. Names, ids and chat found
+// in game state packets are sent on playerInfoEventChannel, and the sender on
+// playerLeaveGameChannel if they are leaving, once the packet is rewritten.
 func RewritePacket(
 	buffer []byte,
-	proxyIP net.IP,
+	proxyIPs []net.IP,
 	proxyPort int,
 	srcPlayer util.PlayerAddr,
+	muted []int,
 	playerInfoEventChannel chan util.PlayerInfoEvent,
 	playerLeaveGameChannel chan util.PlayerAddr,
 ) {
-	// only the player who starts the game will send packets with the wrong ip address, and it will
-	// be their own. so we can search for any ip that isn't ours, replace it with ours, and replace
-	// the port with the player's assigned port
-
-	defer func() {
-		if err := recover(); err != nil {
-			fmt.Println(err)
-			fmt.Println(hex.Dump(buffer))
-		}
-	}()
+	changes := rewritePacket(buffer, proxyIPs, proxyPort, srcPlayer, muted)
+	for _, playerInfo := range changes.playerInfo {
+		playerInfoEventChannel <- playerInfo
+	}
+	if changes.leaving {
+		playerLeaveGameChannel <- srcPlayer
+	}
+}
 
-	switch buffer[PacketTypeOffset] {
+// rewritePacket does the work of RewritePacket, touching nothing but buffer.
+func rewritePacket(buffer []byte, proxyIPs []net.IP, proxyPort int, srcPlayer util.PlayerAddr, muted []int) gameStateChanges {
+	switch GetPacketType(buffer) {
 	case PacketType0:
-		rewritePacketFixedPosition(buffer, proxyIP, proxyPort, PacketType0PeerAddrOffset)
+		rewritePacketFixedPosition(buffer, proxyIPs, proxyPort, PacketType0PeerAddrOffset)
 	case PacketType1:
-		rewritePacketFixedPosition(buffer, proxyIP, proxyPort, PacketType1PeerAddrOffset)
+		rewritePacketFixedPosition(buffer, proxyIPs, proxyPort, PacketType1PeerAddrOffset)
 	case PacketTypeGameState:
-		rewritePacketGameState(buffer, proxyIP, proxyPort, srcPlayer, playerInfoEventChannel, playerLeaveGameChannel)
+		return rewritePacketGameState(buffer, proxyIPs, proxyPort, srcPlayer, muted)
 	case PacketType6:
-		rewritePacketFixedPosition(buffer, proxyIP, proxyPort, PacketType6PeerAddrOffset)
+		rewritePacketFixedPosition(buffer, proxyIPs, proxyPort, PacketType6PeerAddrOffset)
 	case PacketType7:
-		rewritePacketFixedPosition(buffer, proxyIP, proxyPort, PacketType7PeerAddrOffset)
+		rewritePacketFixedPosition(buffer, proxyIPs, proxyPort, PacketType7PeerAddrOffset)
 	case PacketType9:
-		rewritePacketFixedPosition(buffer, proxyIP, proxyPort, PacketType9PeerAddrOffset)
+		rewritePacketFixedPosition(buffer, proxyIPs, proxyPort, PacketType9PeerAddrOffset)
 	}
+	return gameStateChanges{}
 }
@@ -0,0 +1,159 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package bolo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"testing"
+
+	"git.astrospark.com/bolorama/util"
+	"github.com/snksoft/crc"
+)
+
+var testProxyIPs = []net.IP{net.IPv4(192, 0, 2, 1).To4(), net.IPv4(192, 0, 2, 2).To4()}
+
+var testSender = util.PlayerAddr{IpAddr: "198.51.100.7", IpPort: 50000, ProxyPort: 40001}
+
+// chatPacket returns a game state packet with one block, in which the
+// player with id sender sends message to everyone.
+func chatPacket(sender byte, message string) []byte {
+	packet := []byte(boloSignature)
+	packet = append(packet, 0x65, 0x99, 0x08, PacketTypeGameState)
+	packet = append(packet, 0x02) // packet sequence
+
+	blockStart := len(packet)
+	// opcodes from 0x10 are written as 0xf0 plus the opcode
+	opcodes := append([]byte{0xf0 | OpcodeSendMessage, 0xff, 0xff, byte(len(message))}, message...)
+	// length, block sequence, sender and flags
+	packet = append(packet, byte(4+len(opcodes)), 0x01, sender, 0x00)
+	packet = append(packet, opcodes...)
+	checksum := crc.CalculateCRC(crc.XMODEM, packet[blockStart:])
+	return append(packet, byte(checksum>>8), byte(checksum))
+}
+
+func TestRewriteBlanksLoginToken(t *testing.T) {
+	const token = "5f0c9a8b7e6d"
+	packet := chatPacket(3, LoginCommand+" "+token)
+
+	changes := rewritePacket(packet, testProxyIPs, 40002, testSender, nil)
+
+	if bytes.Contains(packet, []byte(token)) || bytes.Contains(packet, []byte(LoginCommand)) {
+		t.Errorf("packet sent to peers has the login command: %q", packet)
+	}
+	blockStart := PacketHeaderSize + 1
+	posChecksum := len(packet) - 2
+	checksum := uint16(crc.CalculateCRC(crc.XMODEM, packet[blockStart:posChecksum]))
+	if binary.BigEndian.Uint16(packet[posChecksum:]) != checksum {
+		t.Errorf("block checksum was not rewritten")
+	}
+	if len(changes.playerInfo) != 1 || changes.playerInfo[0].Message != LoginCommand+" "+token {
+		t.Errorf("login was not passed on to the state: %+v", changes.playerInfo)
+	}
+}
+
+func TestRewriteKeepsChat(t *testing.T) {
+	for _, message := range []string{"hello", "/loginx abc", "log in with /login"} {
+		packet := chatPacket(3, message)
+		changes := rewritePacket(packet, testProxyIPs, 40002, testSender, nil)
+		if !bytes.Contains(packet, []byte(message)) {
+			t.Errorf("%q was blanked", message)
+		}
+		if len(changes.playerInfo) != 1 || changes.playerInfo[0].Message != message {
+			t.Errorf("%q was not passed on: %+v", message, changes.playerInfo)
+		}
+	}
+}
+
+func TestRewriteBlanksMutedChat(t *testing.T) {
+	packet := chatPacket(3, "spam")
+	changes := rewritePacket(packet, testProxyIPs, 40002, testSender, []int{3})
+	if bytes.Contains(packet, []byte("spam")) {
+		t.Errorf("muted chat was not blanked: %q", packet)
+	}
+	if len(changes.playerInfo) != 0 {
+		t.Errorf("muted chat was passed on: %+v", changes.playerInfo)
+	}
+}
+
+// Packets from the open internet reach the parsers below before anything else
+// looks at them, so any panic on fuzzed input is a bug. Run a target with e.g.
+//
+//	go test -fuzz FuzzParsePacket ./bolo
+//
+// Seeds are in testdata/fuzz; failing inputs the fuzzer finds land there too,
+// and are then run by go test as regression tests.
+
+// seedPackets are well formed packets of the main types.
+var seedPackets = []string{
+	// game info, as a host sends it to the tracker
+	"426f6c6f6599080e0745766572617264000000000000000000000000000000000000000000000000000000000a0000010001e24001000000000000000000000001000000000000",
+	"426f6c6f6599080500",
+	"426f6c6f65990806",
+	"426f6c6f65990807ffff0123c00002019c42456789ab",
+}
+
+func addSeeds(f *testing.F) {
+	for _, packet := range seedPackets {
+		data, err := hex.DecodeString(packet)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	f.Add(chatPacket(3, "hello"))
+	f.Add(chatPacket(3, LoginCommand+" 5f0c9a8b7e6d"))
+}
+
+// FuzzParsePacket runs a packet through everything that reads packets from
+// the network without changing them.
+func FuzzParsePacket(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		GetPacketType(data)
+		GetVersion(data)
+		GetGameStateSender(data)
+		IsBulkPacket(data)
+		ParsePacketGameInfo(data)
+		ParsePacketWinBoloInfo(data, net.IPv4(198, 51, 100, 7))
+	})
+}
+
+// FuzzDecodePacket runs a packet through the decoder of the decode command,
+// which walks every opcode.
+func FuzzDecodePacket(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		DecodePacket(data)
+	})
+}
+
+// FuzzRewritePacket rewrites a packet as it is forwarded, which writes into
+// it, and checks that its length is left alone.
+func FuzzRewritePacket(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		buffer := append([]byte(nil), data...)
+		rewritePacket(buffer, testProxyIPs, 40001, testSender, []int{1})
+		if len(buffer) != len(data) {
+			t.Errorf("rewriting changed the length from %d to %d", len(data), len(buffer))
+		}
+	})
+}
@@ -0,0 +1,240 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package bolo
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// Decoding takes a packet apart the way the proxy reads it, for protocol
+// debugging (bolorama decode). It never changes the packet, and stops where
+// the packet stops making sense rather than guessing past it.
+
+var packetTypeNames = map[int]string{
+	PacketTypeGameState:    "Game State",
+	PacketTypeGameStateAck: "Game State Acknowledge",
+	PacketType8:            "Password",
+	0x0d:                   "Game Info Request",
+	PacketTypeGameInfo:     "Game Info",
+}
+
+var opcodeNames = map[int]string{
+	OpcodeGameInfo:    "Game Info",
+	OpcodeMapData:     "Map Data",
+	OpcodePlayerName:  "Player Name",
+	OpcodeSendMessage: "Send Message",
+	OpcodeDisconnect:  "Disconnect",
+}
+
+// PacketTypeName returns the name of a packet type, or "" if its purpose is
+// not known.
+func PacketTypeName(packetType int) string {
+	return packetTypeNames[packetType]
+}
+
+// OpcodeName returns the name of a game state opcode, or "" if its purpose is
+// not known.
+func OpcodeName(opcode int) string {
+	return opcodeNames[opcode]
+}
+
+// DecodedPacket is a packet taken apart by DecodePacket.
+type DecodedPacket struct {
+	Version Version
+	Type    int
+	// the address in packet types 0, 1, 6, 7 and 9
+	PeerAddr *net.UDPAddr
+	// set for game info packets, from Mac Bolo hosts or WinBolo servers
+	GameInfo *GameInfo
+	// the sequence number of game state packets and their acknowledgements
+	Sequence int
+	Blocks   []DecodedBlock
+	// why decoding stopped early, if it did
+	Err error
+}
+
+// DecodedBlock is one block of a game state packet.
+type DecodedBlock struct {
+	Offset   int
+	Length   int
+	Sequence int
+	Sender   int
+	Flags    byte
+	Opcodes  []DecodedOpcode
+	Err      error
+}
+
+// DecodedOpcode is one opcode in a game state block. Only the fields the
+// opcode carries are set.
+type DecodedOpcode struct {
+	Offset  int
+	Opcode  int
+	Length  int
+	Subcode int
+	// the pillboxes, bases or starts in game info, or the bytes of map data
+	Count      int
+	MapName    string
+	PlayerName string
+	Message    string
+	// a disconnect's upstream, sender and downstream addresses
+	Addresses []*net.UDPAddr
+}
+
+// DecodePacket takes a Bolo packet apart. Packets that do not have the Bolo
+// signature are reported in Err.
+func DecodePacket(msg []byte) DecodedPacket {
+	var packet DecodedPacket
+
+	if !verifyBoloSignature(msg) {
+		packet.Err = fmt.Errorf("no Bolo signature")
+		return packet
+	}
+	if len(msg) < PacketHeaderSize {
+		packet.Err = fmt.Errorf("shorter than the Bolo header (%d)", len(msg))
+		return packet
+	}
+	packet.Version = GetVersion(msg)
+	packet.Type = GetPacketType(msg)
+
+	switch packet.Type {
+	case PacketType0:
+		packet.PeerAddr, packet.Err = decodeAddr(msg, PacketType0PeerAddrOffset)
+	case PacketType1:
+		packet.PeerAddr, packet.Err = decodeAddr(msg, PacketType1PeerAddrOffset)
+	case PacketType6:
+		packet.PeerAddr, packet.Err = decodeAddr(msg, PacketType6PeerAddrOffset)
+	case PacketType7:
+		packet.PeerAddr, packet.Err = decodeAddr(msg, PacketType7PeerAddrOffset)
+	case PacketType9:
+		packet.PeerAddr, packet.Err = decodeAddr(msg, PacketType9PeerAddrOffset)
+	case PacketTypeGameInfo:
+		var gameInfo GameInfo
+		if IsWinBoloInfoPacket(msg) {
+			gameInfo, packet.Err = ParsePacketWinBoloInfo(msg, net.IPv4zero)
+		} else {
+			gameInfo, packet.Err = ParsePacketGameInfo(msg)
+		}
+		if packet.Err == nil {
+			packet.GameInfo = &gameInfo
+		}
+	case PacketTypeGameStateAck:
+		if len(msg) <= PacketHeaderSize {
+			packet.Err = fmt.Errorf("no sequence number")
+			break
+		}
+		packet.Sequence = int(msg[PacketHeaderSize])
+	case PacketTypeGameState:
+		decodeGameState(msg, &packet)
+	}
+	return packet
+}
+
+// decodeAddr reads the address at offset.
+func decodeAddr(msg []byte, offset int) (*net.UDPAddr, error) {
+	if len(msg) < offset+6 {
+		return nil, fmt.Errorf("too short for an address at %d (%d)", offset, len(msg))
+	}
+	return &net.UDPAddr{
+		IP:   net.IP(append([]byte(nil), msg[offset:offset+4]...)),
+		Port: int(binary.BigEndian.Uint16(msg[offset+4 : offset+6])),
+	}, nil
+}
+
+func decodeGameState(msg []byte, packet *DecodedPacket) {
+	pos := PacketHeaderSize
+	if pos >= len(msg) {
+		packet.Err = fmt.Errorf("no sequence number")
+		return
+	}
+	packet.Sequence = int(msg[pos])
+	pos = pos + 1
+
+	for pos < len(msg) {
+		posChecksum, opcodePos, ok := parseBlockHeader(pos, msg)
+		if !ok {
+			packet.Err = fmt.Errorf("malformed block at %d", pos)
+			return
+		}
+
+		block := DecodedBlock{
+			Offset:   pos,
+			Length:   int(msg[pos] & 0x7f),
+			Sequence: int(msg[pos+1]),
+			Sender:   int(msg[pos+2] & 0x0f),
+			Flags:    msg[pos+3],
+		}
+		for opcodePos < posChecksum {
+			opcode, opcodeLength := parseOpcode(opcodePos, msg, posChecksum)
+			if opcodeLength == 0 {
+				block.Err = fmt.Errorf("opcode 0x%02x at %d does not fit in the block", opcode, opcodePos)
+				break
+			}
+			block.Opcodes = append(block.Opcodes, decodeOpcode(msg, opcodePos, opcode, opcodeLength))
+			opcodePos = opcodePos + opcodeLength
+		}
+		packet.Blocks = append(packet.Blocks, block)
+
+		pos = posChecksum + 2
+	}
+}
+
+// decodeOpcode reads the fields of an opcode, which parseOpcode has found to
+// fit in length.
+func decodeOpcode(msg []byte, pos int, opcode int, length int) DecodedOpcode {
+	decoded := DecodedOpcode{Offset: pos, Opcode: opcode, Length: length}
+	end := pos + length
+
+	switch opcode {
+	case OpcodeGameInfo:
+		decoded.Subcode = int(msg[pos+1])
+		decoded.Count = int(msg[pos+2])
+		if decoded.Subcode == OpcodeGameInfoSubcodeGame {
+			decoded.MapName = pascalString(msg[pos+2:end], 35)
+		}
+	case OpcodeMapData:
+		decoded.Count = int(msg[pos+3])
+	case OpcodePlayerName:
+		decoded.PlayerName = pascalString(msg[pos+1:end], 255)
+	case OpcodeSendMessage:
+		decoded.Message = pascalString(msg[pos+3:end], 255)
+	case OpcodeDisconnect:
+		for addrPos := pos + 3; addrPos+6 <= end; addrPos = addrPos + 6 {
+			addr, _ := decodeAddr(msg, addrPos)
+			decoded.Addresses = append(decoded.Addresses, addr)
+		}
+	}
+	return decoded
+}
+
+// pascalString reads a length prefixed string of at most maxLength bytes from
+// the start of b.
+func pascalString(b []byte, maxLength int) string {
+	if len(b) == 0 {
+		return ""
+	}
+	length := int(b[0])
+	if length > maxLength {
+		length = maxLength
+	}
+	if length > len(b)-1 {
+		length = len(b) - 1
+	}
+	return string(b[1 : 1+length])
+}
@@ -0,0 +1,69 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package bolo
+
+import (
+	"fmt"
+	"sync"
+
+	"git.astrospark.com/bolorama/config"
+	"git.astrospark.com/bolorama/util"
+)
+
+// Version is the three version bytes following the Bolo signature. Mac Bolo
+// sends 0x65 followed by the version in BCD (0x65 0x99 0x08 is 0.99.8);
+// WinBolo sends major, minor and revision as plain numbers (1 1 5 is 1.15).
+type Version [3]byte
+
+const macBoloVersionMarker = 0x65
+
+func (version Version) String() string {
+	if version[0] == macBoloVersionMarker {
+		return fmt.Sprintf("0.%x.%x", version[1], version[2])
+	}
+	return fmt.Sprintf("%d.%d%d", version[0], version[1], version[2])
+}
+
+// GetVersion returns the version in a packet's header, or the zero version if
+// it is too short to have one.
+func GetVersion(msg []byte) Version {
+	var version Version
+	if len(msg) < 7 {
+		return version
+	}
+	copy(version[:], msg[4:7])
+	return version
+}
+
+// VersionsCompatible reports whether players running versions a and b can
+// share a game. Bolo versions differ in their game state encoding, so only
+// identical versions are allowed to play together.
+func VersionsCompatible(a Version, b Version) bool {
+	return a == b
+}
+
+var supportedVersions []string
+var supportedVersionsOnce sync.Once
+
+// versionSupported reports whether the version is one of client_versions.
+func versionSupported(version Version) bool {
+	supportedVersionsOnce.Do(func() {
+		supportedVersions = config.GetValueList("client_versions")
+	})
+	return version[0] == macBoloVersionMarker && util.ContainsString(supportedVersions, version.String())
+}
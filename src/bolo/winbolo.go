@@ -0,0 +1,119 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package bolo
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// WinBolo servers register with a tracker by sending it their game info
+// packet. It has the Bolo signature and packet type but WinBolo's own version
+// (1.x), and the game id also carries the server's port:
+//
+//	header (8) | map name (36) | server ip (4) | server port (2, network order) |
+//	start time (4, unix) | game type | mines | bots | spare |
+//	start delay (4) | time limit (4) | players (2) | free pills (2) |
+//	free bases (2) | password | spare
+//
+// Multi-byte fields other than the port are little endian.
+
+const winBoloVersionMajor = 0x01
+const winBoloInfoPacketSize = PacketHeaderSize + 36 + 10 + 4 + 8 + 6 + 2
+
+// IsWinBoloInfoPacket reports whether msg is a game info packet from a WinBolo
+// server.
+func IsWinBoloInfoPacket(msg []byte) bool {
+	return len(msg) >= winBoloInfoPacketSize &&
+		verifyBoloSignature(msg) &&
+		msg[4] == winBoloVersionMajor &&
+		GetPacketType(msg) == PacketTypeGameInfo
+}
+
+// ParsePacketWinBoloInfo parses a WinBolo server's game info packet. The
+// server is taken to be at srcIp, the address the packet came from, and the
+// port it gives.
+func ParsePacketWinBoloInfo(msg []byte, srcIp net.IP) (GameInfo, error) {
+	var gameInfo GameInfo
+	var pos int = PacketHeaderSize
+
+	if len(msg) < winBoloInfoPacketSize {
+		return gameInfo, fmt.Errorf("WinBolo info packet too short (%d)", len(msg))
+	}
+
+	gameInfo.Version = GetVersion(msg)
+
+	mapNameLength := int(msg[pos])
+	if mapNameLength > 35 {
+		mapNameLength = 35
+	}
+	gameInfo.MapName = string(msg[pos+1 : pos+1+mapNameLength])
+	pos = pos + 36
+
+	// skip the advertised ip, it is often a private address
+	pos = pos + 4
+
+	serverPort := int(binary.BigEndian.Uint16(msg[pos : pos+2]))
+	pos = pos + 2
+	gameInfo.WinBoloServer = &net.UDPAddr{IP: srcIp, Port: serverPort}
+
+	startTime := binary.LittleEndian.Uint32(msg[pos : pos+4])
+	gameInfo.StartTimestamp = startTime + seconds1904ToUnixEpoch
+	pos = pos + 4
+
+	// the same server may restart its game, so the id is the server address
+	// plus start time
+	copy(gameInfo.GameId[0:4], srcIp.To4())
+	binary.BigEndian.PutUint16(gameInfo.GameId[4:6], uint16(serverPort))
+	binary.BigEndian.PutUint16(gameInfo.GameId[6:8], uint16(startTime))
+
+	gameInfo.GameType = int(msg[pos])
+	pos = pos + 1
+
+	gameInfo.AllowHiddenMines = !((msg[pos] & MinesVisibleBitmask) == MinesVisibleBitmask)
+	pos = pos + 1
+
+	gameInfo.AllowComputer = msg[pos] > 0
+	pos = pos + 1
+
+	// spare
+	pos = pos + 1
+
+	gameInfo.StartDelay = binary.LittleEndian.Uint32(msg[pos : pos+4])
+	pos = pos + 4
+
+	gameInfo.TimeLimit = binary.LittleEndian.Uint32(msg[pos : pos+4])
+	pos = pos + 4
+
+	gameInfo.PlayerCount = binary.LittleEndian.Uint16(msg[pos : pos+2])
+	pos = pos + 2
+
+	gameInfo.NeutralPillboxCount = binary.LittleEndian.Uint16(msg[pos : pos+2])
+	pos = pos + 2
+
+	gameInfo.NeutralBaseCount = binary.LittleEndian.Uint16(msg[pos : pos+2])
+	pos = pos + 2
+
+	gameInfo.HasPassword = msg[pos] > 0
+
+	gameInfo.LastSeen = time.Now()
+
+	return gameInfo, nil
+}
@@ -0,0 +1,141 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package clock lets the time the server goes by be replaced, so that a
+// simulation can step through minutes of peer, NAT traversal, ping and idle
+// timeouts instantly and get the same result every run.
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the time and ticks.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker delivers ticks on C every period, dropping ticks for a slow
+// receiver, as a time.Ticker does.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+type real struct{}
+
+func (real) Now() time.Time {
+	return time.Now()
+}
+
+func (real) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	ticker *time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.ticker.C
+}
+
+func (t realTicker) Stop() {
+	t.ticker.Stop()
+}
+
+// Real is the wall clock.
+var Real Clock = real{}
+
+// Since returns the time elapsed on c since t.
+func Since(c Clock, t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+// Mock is a clock that only moves when told to. Its tickers tick as it is
+// advanced past them.
+type Mock struct {
+	mutex   sync.Mutex
+	now     time.Time
+	tickers []*mockTicker
+}
+
+// NewMock returns a clock stopped at start.
+func NewMock(start time.Time) *Mock {
+	return &Mock{now: start}
+}
+
+func (mock *Mock) Now() time.Time {
+	mock.mutex.Lock()
+	defer mock.mutex.Unlock()
+	return mock.now
+}
+
+func (mock *Mock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("clock: non-positive interval for NewTicker")
+	}
+	mock.mutex.Lock()
+	defer mock.mutex.Unlock()
+	ticker := &mockTicker{mock: mock, c: make(chan time.Time, 1), period: d, next: mock.now.Add(d)}
+	mock.tickers = append(mock.tickers, ticker)
+	return ticker
+}
+
+// Advance moves the clock forward by d, ticking each ticker that came due
+// once, however many periods went by.
+func (mock *Mock) Advance(d time.Duration) {
+	mock.mutex.Lock()
+	defer mock.mutex.Unlock()
+	mock.now = mock.now.Add(d)
+	for _, ticker := range mock.tickers {
+		if ticker.next.After(mock.now) {
+			continue
+		}
+		select {
+		case ticker.c <- mock.now:
+		default:
+		}
+		for !ticker.next.After(mock.now) {
+			ticker.next = ticker.next.Add(ticker.period)
+		}
+	}
+}
+
+type mockTicker struct {
+	mock   *Mock
+	c      chan time.Time
+	period time.Duration
+	next   time.Time
+}
+
+func (ticker *mockTicker) C() <-chan time.Time {
+	return ticker.c
+}
+
+func (ticker *mockTicker) Stop() {
+	ticker.mock.mutex.Lock()
+	defer ticker.mock.mutex.Unlock()
+	for i, t := range ticker.mock.tickers {
+		if t == ticker {
+			ticker.mock.tickers = append(ticker.mock.tickers[:i], ticker.mock.tickers[i+1:]...)
+			return
+		}
+	}
+}
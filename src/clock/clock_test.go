@@ -0,0 +1,85 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+var testStart = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func ticked(ticker Ticker) bool {
+	select {
+	case <-ticker.C():
+		return true
+	default:
+		return false
+	}
+}
+
+func TestMockOnlyMovesWhenAdvanced(t *testing.T) {
+	mock := NewMock(testStart)
+	if !mock.Now().Equal(testStart) {
+		t.Fatalf("now is %v, want %v", mock.Now(), testStart)
+	}
+	mock.Advance(90 * time.Second)
+	if since := Since(mock, testStart); since != 90*time.Second {
+		t.Errorf("since start is %v after advancing 90s", since)
+	}
+}
+
+func TestMockTickerTicksWhenDue(t *testing.T) {
+	mock := NewMock(testStart)
+	ticker := mock.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	mock.Advance(9 * time.Second)
+	if ticked(ticker) {
+		t.Fatal("ticked before its period")
+	}
+	mock.Advance(time.Second)
+	if !ticked(ticker) {
+		t.Fatal("did not tick at its period")
+	}
+
+	// many periods at once tick once, as a time.Ticker drops ticks for a
+	// slow receiver
+	mock.Advance(35 * time.Second)
+	if !ticked(ticker) {
+		t.Fatal("did not tick after several periods")
+	}
+	if ticked(ticker) {
+		t.Fatal("ticked more than once for one advance")
+	}
+	// the next tick is at 50s, not 45s + 10s
+	mock.Advance(5 * time.Second)
+	if !ticked(ticker) {
+		t.Fatal("did not tick at the next period")
+	}
+}
+
+func TestMockTickerStop(t *testing.T) {
+	mock := NewMock(testStart)
+	ticker := mock.NewTicker(time.Second)
+	ticker.Stop()
+	mock.Advance(time.Minute)
+	if ticked(ticker) {
+		t.Fatal("stopped ticker ticked")
+	}
+}
@@ -0,0 +1,244 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"git.astrospark.com/bolorama/bolo"
+	"git.astrospark.com/bolorama/record"
+)
+
+// decode pretty-prints Bolo packets given in hex, on the command line or one
+// per line on standard input, or read from a pcap file.
+func decode(args []string) {
+	flags := flag.NewFlagSet("decode", flag.ExitOnError)
+	pcapFile := flags.String("pcap", "", "read the packets from a pcap file")
+	port := flags.Int("port", 0, "with -pcap, only decode packets to or from this UDP port")
+	dump := flags.Bool("x", false, "hexdump each packet too")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: bolorama decode [options] [hex]...")
+		fmt.Fprintln(flags.Output(), "Decodes the packets given in hex, or one per line on standard input.")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *pcapFile != "" {
+		if flags.NArg() > 0 {
+			flags.Usage()
+			os.Exit(2)
+		}
+		if err := decodePcap(*pcapFile, *port, *dump); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if flags.NArg() > 0 {
+		for i, arg := range flags.Args() {
+			if !decodeHex(arg, fmt.Sprintf("#%d", i+1), *dump) {
+				os.Exit(1)
+			}
+		}
+		return
+	}
+
+	failed := false
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if !decodeHex(text, fmt.Sprintf("line %d", line), *dump) {
+			failed = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// decodeHex decodes a packet given in hex. Spaces, colons and a leading 0x
+// are ignored, so hex copied from Wireshark or a hexdump without offsets can
+// be pasted as it is.
+func decodeHex(text string, label string, dump bool) bool {
+	text = strings.TrimPrefix(strings.TrimPrefix(text, "0x"), "0X")
+	text = strings.NewReplacer(" ", "", "\t", "", ":", "").Replace(text)
+	buffer, err := hex.DecodeString(text)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: not hex: %s\n", label, err)
+		return false
+	}
+
+	fmt.Printf("%s (%d bytes)\n", label, len(buffer))
+	printDecodedPacket(buffer, dump)
+	return true
+}
+
+// decodePcap decodes the Bolo packets in a pcap file, skipping other traffic.
+func decodePcap(filename string, port int, dump bool) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader, err := record.NewPcapReader(file)
+	if err != nil {
+		return fmt.Errorf("%s: %s", filename, err)
+	}
+
+	decoded := 0
+	skipped := 0
+	for n := 1; ; n++ {
+		packet, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Println("Capture is truncated:", err)
+			break
+		}
+		if port != 0 && packet.SrcAddr.Port != port && packet.DstAddr.Port != port {
+			continue
+		}
+		if !strings.HasPrefix(string(packet.Buffer), "Bolo") {
+			skipped++
+			continue
+		}
+
+		decoded++
+		fmt.Printf("#%d %s %s -> %s (%d bytes)\n", n, packet.Time.Format("2006-01-02 15:04:05.000000"),
+			packet.SrcAddr.String(), packet.DstAddr.String(), len(packet.Buffer))
+		printDecodedPacket(packet.Buffer, dump)
+	}
+
+	fmt.Printf("Decoded %d Bolo packets, skipped %d other UDP packets\n", decoded, skipped)
+	return nil
+}
+
+func printDecodedPacket(buffer []byte, dump bool) {
+	packet := bolo.DecodePacket(buffer)
+
+	if len(buffer) >= bolo.PacketHeaderSize && string(buffer[:4]) == "Bolo" {
+		fmt.Printf("  Bolo %s, packet type 0x%02x%s\n", packet.Version, packet.Type, nameSuffix(bolo.PacketTypeName(packet.Type)))
+	}
+
+	switch {
+	case packet.PeerAddr != nil:
+		fmt.Printf("  peer %s\n", packet.PeerAddr.String())
+	case packet.GameInfo != nil:
+		printDecodedGameInfo(*packet.GameInfo)
+	case packet.Type == bolo.PacketTypeGameState || packet.Type == bolo.PacketTypeGameStateAck:
+		fmt.Printf("  sequence 0x%02x\n", packet.Sequence)
+	}
+
+	for _, block := range packet.Blocks {
+		fmt.Printf("  block at %d: length %d, sequence 0x%02x, sender %d, flags 0x%02x\n",
+			block.Offset, block.Length, block.Sequence, block.Sender, block.Flags)
+		for _, opcode := range block.Opcodes {
+			fmt.Printf("    opcode 0x%02x%s at %d, %d bytes%s\n",
+				opcode.Opcode, nameSuffix(bolo.OpcodeName(opcode.Opcode)), opcode.Offset, opcode.Length, describeOpcode(opcode))
+		}
+		if block.Err != nil {
+			fmt.Printf("    error: %s\n", block.Err)
+		}
+	}
+
+	if packet.Err != nil {
+		fmt.Printf("  error: %s\n", packet.Err)
+	}
+	if dump {
+		fmt.Print(indent(hex.Dump(buffer), "  "))
+	}
+	fmt.Println()
+}
+
+func printDecodedGameInfo(gameInfo bolo.GameInfo) {
+	fmt.Printf("  game %s, map %q\n", hex.EncodeToString(gameInfo.GameId[:]), gameInfo.MapName)
+	if gameInfo.WinBoloServer != nil {
+		fmt.Printf("  WinBolo server port %d\n", gameInfo.WinBoloServer.Port)
+	}
+	fmt.Printf("  type %d, players %d, free pillboxes %d, free bases %d\n",
+		gameInfo.GameType, gameInfo.PlayerCount, gameInfo.NeutralPillboxCount, gameInfo.NeutralBaseCount)
+	fmt.Printf("  hidden mines %t, computer players %t, computer advantage %t, password %t\n",
+		gameInfo.AllowHiddenMines, gameInfo.AllowComputer, gameInfo.ComputerAdvantage, gameInfo.HasPassword)
+	fmt.Printf("  start delay %d, time limit %d\n", gameInfo.StartDelay, gameInfo.TimeLimit)
+}
+
+// describeOpcode returns the fields of an opcode worth showing.
+func describeOpcode(opcode bolo.DecodedOpcode) string {
+	switch opcode.Opcode {
+	case bolo.OpcodeGameInfo:
+		switch opcode.Subcode {
+		case bolo.OpcodeGameInfoSubcodeGame:
+			return fmt.Sprintf(": game, map %q", opcode.MapName)
+		case bolo.OpcodeGameInfoSubcodePillbox:
+			return fmt.Sprintf(": %d pillboxes", opcode.Count)
+		case bolo.OpcodeGameInfoSubcodeBase:
+			return fmt.Sprintf(": %d bases", opcode.Count)
+		case bolo.OpcodeGameInfoSubcodeStart:
+			return fmt.Sprintf(": %d starts", opcode.Count)
+		}
+		return fmt.Sprintf(": subcode 0x%02x", opcode.Subcode)
+	case bolo.OpcodeMapData:
+		return fmt.Sprintf(": %d bytes of map", opcode.Count)
+	case bolo.OpcodePlayerName:
+		return fmt.Sprintf(": %q", opcode.PlayerName)
+	case bolo.OpcodeSendMessage:
+		return fmt.Sprintf(": %q", opcode.Message)
+	case bolo.OpcodeDisconnect:
+		var addrs []string
+		for _, addr := range opcode.Addresses {
+			addrs = append(addrs, addr.String())
+		}
+		return ": " + strings.Join(addrs, ", ")
+	}
+	return ""
+}
+
+// nameSuffix returns " (name)", or "" for things with no name.
+func nameSuffix(name string) string {
+	if name == "" {
+		return ""
+	}
+	return " (" + name + ")"
+}
+
+func indent(text string, prefix string) string {
+	lines := strings.SplitAfter(text, "\n")
+	for i, line := range lines {
+		if line != "" {
+			lines[i] = prefix + line
+		}
+	}
+	return strings.Join(lines, "")
+}
@@ -0,0 +1,357 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.astrospark.com/bolorama/bolo"
+	"git.astrospark.com/bolorama/metrics"
+)
+
+// The load test runs headless Bolo clients against a server. In each game one
+// client hosts: it sends game info to the tracker port and answers the NAT
+// probes the proxy sends it. The others find the game in the tracker listing
+// by its map name, join it through the host's proxy port, and then every
+// client sends game packets to the others at a steady rate.
+//
+// The game packets are game state acknowledgements, which the proxy forwards
+// as they are, carrying a marker, the sender's number and the time they were
+// sent. Since every client runs here on one clock, the time from sending to
+// receiving is the latency added by the proxy and the network between.
+
+// loadMarker starts the body of a load test game packet.
+var loadMarker = []byte("LOAD")
+
+// loadPacketHeaderSize is the Bolo header, marker, sender and send time.
+const loadPacketHeaderSize = bolo.PacketHeaderSize + 4 + 2 + 8
+
+// loadStats is what the clients count of the packets sent while measuring,
+// from from until until.
+type loadStats struct {
+	from          time.Time
+	until         time.Time
+	sent          uint64
+	received      uint64
+	receivedBytes uint64
+	maxLatency    int64 // nanoseconds
+	latency       *metrics.Histogram
+}
+
+func (stats *loadStats) counts(sentAt time.Time) bool {
+	return !sentAt.Before(stats.from) && sentAt.Before(stats.until)
+}
+
+func (stats *loadStats) observe(latency time.Duration, size int) {
+	atomic.AddUint64(&stats.received, 1)
+	atomic.AddUint64(&stats.receivedBytes, uint64(size))
+	stats.latency.Observe(latency)
+	for {
+		max := atomic.LoadInt64(&stats.maxLatency)
+		if int64(latency) <= max || atomic.CompareAndSwapInt64(&stats.maxLatency, max, int64(latency)) {
+			return
+		}
+	}
+}
+
+// loadClient is one headless Bolo client.
+type loadClient struct {
+	index   int
+	game    int
+	host    bool
+	conn    *net.UDPConn
+	server  net.IP
+	tracker *net.UDPAddr
+	stats   *loadStats
+	joined  int32 // accessed atomically
+	mutex   sync.Mutex
+	peers   map[string]*net.UDPAddr // proxy ports to send game packets to
+}
+
+func (client *loadClient) addPeer(addr *net.UDPAddr) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.peers[addr.String()] = addr
+}
+
+func (client *loadClient) peerAddrs() []*net.UDPAddr {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	addrs := make([]*net.UDPAddr, 0, len(client.peers))
+	for _, addr := range client.peers {
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// loadtest runs clients against a server and reports how it coped.
+func loadtest(args []string) {
+	flags := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	clients := flags.Int("clients", 8, "number of clients")
+	perGame := flags.Int("players", 4, "players per game, counting the host")
+	port := flags.Int("port", 50000, "tracker port of the server")
+	duration := flags.Duration("duration", 30*time.Second, "how long to measure for")
+	warmup := flags.Duration("warmup", 5*time.Second, "time for the clients to join before measuring")
+	rate := flags.Int("rate", 20, "game packets per second each client sends to each other player")
+	size := flags.Int("size", 100, "size of the game packets in bytes")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: bolorama loadtest [options] <server>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 || *clients < 2 || *perGame < 2 || *rate < 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if *size < loadPacketHeaderSize {
+		*size = loadPacketHeaderSize
+	}
+
+	ips, err := net.LookupIP(flags.Arg(0))
+	var server net.IP
+	for _, ip := range ips {
+		if server = ip.To4(); server != nil {
+			break
+		}
+	}
+	if server == nil {
+		fmt.Println("cannot find an IPv4 address for", flags.Arg(0), err)
+		os.Exit(1)
+	}
+	tracker := &net.UDPAddr{IP: server, Port: *port}
+
+	from := time.Now().Add(*warmup)
+	stats := &loadStats{from: from, until: from.Add(*duration), latency: metrics.NewHistogram()}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	var all []*loadClient
+	games := (*clients + *perGame - 1) / *perGame
+	for i := 0; i < *clients; i++ {
+		conn, err := net.ListenUDP("udp4", nil)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		defer conn.Close()
+		client := &loadClient{
+			index:   i,
+			game:    i / *perGame,
+			host:    i%*perGame == 0,
+			conn:    conn,
+			server:  server,
+			tracker: tracker,
+			stats:   stats,
+			peers:   make(map[string]*net.UDPAddr),
+		}
+		all = append(all, client)
+		wg.Add(2)
+		go client.receive(&wg)
+		go client.run(&wg, stop, *rate, *size, *port)
+	}
+
+	fmt.Printf("Running %d clients in %d games against %s\n", *clients, games, tracker)
+	time.Sleep(time.Until(stats.from))
+	joined := 0
+	for _, client := range all {
+		if client.host || atomic.LoadInt32(&client.joined) != 0 {
+			joined++
+		}
+	}
+	fmt.Printf("%d of %d clients in their games, measuring for %s\n", joined, *clients, *duration)
+
+	time.Sleep(time.Until(stats.until))
+	close(stop)
+
+	// let packets in flight arrive
+	time.Sleep(time.Second)
+	for _, client := range all {
+		client.conn.Close()
+	}
+	wg.Wait()
+
+	sent := atomic.LoadUint64(&stats.sent)
+	received := atomic.LoadUint64(&stats.received)
+	seconds := duration.Seconds()
+	fmt.Println()
+	fmt.Printf("Sent %d game packets, received %d", sent, received)
+	if sent > 0 {
+		fmt.Printf(" (%.2f%% lost)", 100*(1-float64(received)/float64(sent)))
+	}
+	fmt.Println()
+	fmt.Printf("Throughput: %.0f packets/s, %.1f kB/s\n", float64(received)/seconds, float64(atomic.LoadUint64(&stats.receivedBytes))/seconds/1000)
+	snapshot := stats.latency.Snapshot()
+	if snapshot.Count > 0 {
+		// quantiles are the upper bounds of histogram buckets
+		max := time.Duration(atomic.LoadInt64(&stats.maxLatency))
+		quantile := func(q float64) time.Duration {
+			if d := snapshot.Quantile(q); d < max {
+				return d
+			}
+			return max
+		}
+		fmt.Printf("Latency: mean %s, p50 %s, p99 %s, max %s\n", snapshot.Mean(), quantile(0.5), quantile(0.99), max)
+	}
+}
+
+// run announces or joins the client's game, then sends game packets until
+// stop is closed.
+func (client *loadClient) run(wg *sync.WaitGroup, stop chan struct{}, rate int, size int, trackerPort int) {
+	defer wg.Done()
+
+	mapName := fmt.Sprintf("Load %d", client.game)
+	gameInfo := loadGameInfo(mapName, client.game)
+	announce := time.NewTicker(5 * time.Second)
+	defer announce.Stop()
+	if client.host {
+		client.conn.WriteToUDP(gameInfo, client.tracker)
+	}
+
+	tick := time.NewTicker(time.Second / time.Duration(rate))
+	defer tick.Stop()
+	packet := make([]byte, size)
+	copy(packet, bolo.MarshalPacketTypeD()[:bolo.PacketHeaderSize])
+	packet[bolo.PacketTypeOffset] = bolo.PacketTypeGameStateAck
+	copy(packet[bolo.PacketHeaderSize:], loadMarker)
+	binary.BigEndian.PutUint16(packet[bolo.PacketHeaderSize+4:], uint16(client.index))
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-announce.C:
+			if client.host {
+				client.conn.WriteToUDP(gameInfo, client.tracker)
+			}
+		case <-tick.C:
+			if !client.host && atomic.LoadInt32(&client.joined) == 0 {
+				client.join(mapName, trackerPort)
+				continue
+			}
+			for _, peer := range client.peerAddrs() {
+				sentAt := time.Now()
+				binary.BigEndian.PutUint64(packet[bolo.PacketHeaderSize+6:], uint64(sentAt.UnixNano()))
+				if _, err := client.conn.WriteToUDP(packet, peer); err == nil && client.stats.counts(sentAt) {
+					atomic.AddUint64(&client.stats.sent, 1)
+				}
+			}
+		}
+	}
+}
+
+var loadListingPattern = regexp.MustCompile(`Host: \S+ \{(\d+)\}[^\r]*\rMap: (.*?)  Game:`)
+
+// join looks for the client's game in the tracker listing, and if it is
+// there, sends a join to the host's proxy port.
+func (client *loadClient) join(mapName string, trackerPort int) {
+	conn, err := net.DialTimeout("tcp4", (&net.TCPAddr{IP: client.server, Port: trackerPort}).String(), time.Second)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	listing, _ := ioutil.ReadAll(conn)
+
+	for _, match := range loadListingPattern.FindAllSubmatch(listing, -1) {
+		if string(match[2]) != mapName {
+			continue
+		}
+		port, _ := strconv.Atoi(string(match[1]))
+		host := &net.UDPAddr{IP: client.server, Port: port}
+		client.addPeer(host)
+		joinPacket := append(bolo.MarshalPacketTypeD()[:bolo.PacketHeaderSize], 0)
+		joinPacket[bolo.PacketTypeOffset] = bolo.PacketType5
+		client.conn.WriteToUDP(joinPacket, host)
+		atomic.StoreInt32(&client.joined, 1)
+		return
+	}
+}
+
+// receive answers NAT probes and counts game packets until the socket is
+// closed.
+func (client *loadClient) receive(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	buffer := make([]byte, 2048)
+	for {
+		n, addr, err := client.conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		received := time.Now()
+		packet := buffer[:n]
+		if n < bolo.PacketHeaderSize {
+			continue
+		}
+
+		switch bolo.GetPacketType(packet) {
+		case bolo.PacketType6:
+			// answer on the port the probe names, at the server's address
+			// since the proxy's may not be reachable from here
+			if n < bolo.PacketType6PeerPortOffset+2 {
+				continue
+			}
+			port := int(binary.BigEndian.Uint16(packet[bolo.PacketType6PeerPortOffset:]))
+			reply := append([]byte(nil), packet...)
+			reply[bolo.PacketTypeOffset] = bolo.PacketType7
+			peer := &net.UDPAddr{IP: client.server, Port: port}
+			client.conn.WriteToUDP(reply, peer)
+			if client.host && port != client.tracker.Port {
+				client.addPeer(peer)
+			}
+		case bolo.PacketTypeGameStateAck:
+			if n < loadPacketHeaderSize || !bytes.Equal(packet[bolo.PacketHeaderSize:bolo.PacketHeaderSize+4], loadMarker) {
+				continue
+			}
+			if client.host {
+				client.addPeer(addr)
+			}
+			sentAt := time.Unix(0, int64(binary.BigEndian.Uint64(packet[bolo.PacketHeaderSize+6:])))
+			if client.stats.counts(sentAt) {
+				client.stats.observe(received.Sub(sentAt), n)
+			}
+		}
+	}
+}
+
+// loadGameInfo returns a game info packet for a game with the given map name.
+// The game id is made from the game's number so that it is the same each time
+// the host announces it.
+func loadGameInfo(mapName string, game int) []byte {
+	packet := append(bolo.MarshalPacketTypeD()[:bolo.PacketHeaderSize], make([]byte, 63)...)
+	packet[bolo.PacketTypeOffset] = bolo.PacketTypeGameInfo
+	pos := bolo.PacketHeaderSize
+	packet[pos] = byte(copy(packet[pos+1:pos+36], mapName))
+	pos += 36
+	copy(packet[pos:], []byte{198, 51, 100, byte(game)}) // host address, part of the game id
+	binary.BigEndian.PutUint32(packet[pos+4:], uint32(time.Now().Unix())+uint32(game))
+	pos += 8
+	packet[pos] = 1                                   // game type
+	binary.LittleEndian.PutUint16(packet[pos+12:], 1) // player count
+	return packet
+}
@@ -18,32 +18,64 @@
 package main
 
 import (
-	"bytes"
-	"database/sql"
+	"flag"
 	"fmt"
 	"net"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
-	"time"
 
-	"git.astrospark.com/bolorama/bolo"
 	"git.astrospark.com/bolorama/config"
-	"git.astrospark.com/bolorama/data"
+	"git.astrospark.com/bolorama/logfile"
 	"git.astrospark.com/bolorama/proxy"
+	"git.astrospark.com/bolorama/server"
 	"git.astrospark.com/bolorama/state"
-	"git.astrospark.com/bolorama/stats"
-	"git.astrospark.com/bolorama/tracker"
-	"git.astrospark.com/bolorama/util"
 )
 
-func initSignalHandler(shutdownChannel chan struct{}) {
-	signalChannel := make(chan os.Signal)
+func initSignalHandler(shutdown func()) {
+	signalChannel := make(chan os.Signal, 1)
 	signal.Notify(signalChannel, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
 	go func() {
 		<-signalChannel
-		close(shutdownChannel)
+		shutdown()
+	}()
+}
+
+// initDrainSignalHandler starts draining on drainSignals (SIGUSR2 where there
+// is one).
+func initDrainSignalHandler(context *state.ServerContext) {
+	if len(drainSignals) == 0 {
+		return
+	}
+	signalChannel := make(chan os.Signal, 1)
+	signal.Notify(signalChannel, drainSignals...)
+	go func() {
+		for range signalChannel {
+			state.Do(context, func(s *state.State) {
+				state.ServerDrain(s, true)
+			})
+		}
+	}()
+}
+
+// initDumpSignalHandler writes a state dump on dumpSignals (SIGUSR1 where
+// there is one).
+func initDumpSignalHandler(context *state.ServerContext) {
+	if len(dumpSignals) == 0 {
+		return
+	}
+	signalChannel := make(chan os.Signal, 1)
+	signal.Notify(signalChannel, dumpSignals...)
+	go func() {
+		for range signalChannel {
+			filename, err := state.Dump(context)
+			if err != nil {
+				fmt.Println("Failed to dump state:", err)
+				continue
+			}
+			fmt.Println("Dumped state to", filename)
+		}
 	}()
 }
 
@@ -60,7 +92,7 @@ func listenNetShutdown(shutdownChannel chan struct{}) {
 		return
 	}
 
-	buffer := make([]byte, util.MaxUdpPacketSize)
+	buffer := make([]byte, proxy.BufferSize())
 
 	_, _, err = connection.ReadFromUDP(buffer)
 	if err != nil {
@@ -74,226 +106,131 @@ func listenNetShutdown(shutdownChannel chan struct{}) {
 	close(shutdownChannel)
 }
 
-func main() {
-	proxyHostname := config.GetValueString("hostname")
-	trackerPort := config.GetValueInt("tracker_port")
-
-	context := state.InitContext(trackerPort)
-	playerInfoEventChannel := make(chan util.PlayerInfoEvent)
-	playerLeaveGameChannel := make(chan util.PlayerAddr)
-	startPlayerPingChannel := make(chan state.Player)
-	beginShutdownChannel := make(chan struct{})
-	mainShutdownChannel := make(chan struct{})
-
-	fmt.Println("Hostname:", proxyHostname)
-	fmt.Println("IP Address:", context.ProxyIpAddr)
+const kUsage = `Usage: bolorama [command]
+
+Commands:
+  serve [flags]              run the server (the default); -h for the flags
+  status                     show the state of the server running here
+  top                        show its games and players live, with packet rates
+  bans list                  list kicked and banned addresses
+  bans add <ip> [duration]   ban an address (minutes, or e.g. 90m, 24h, 7d)
+  bans rm <ip>               lift a ban
+  config check [file]        check the config file (default config.conf or config.txt)
+                             and try the ports, proxy IP and ban file without serving
+  replay [options] <file>    replay a recorded game
+  simulate [options] <file>  run a scripted simulation and check its expectations
+  loadtest [options] <host>  run headless clients against a server and report on it
+  decode [options] [hex]...  decode Bolo packets given in hex, or from a pcap file (-pcap)
+
+status, top and bans use the admin console of the running server (admin_port).
+`
 
-	defer func() {
-		fmt.Println("Shutdown completed")
-	}()
-
-	initSignalHandler(beginShutdownChannel)
-	//go listenNetShutdown(beginShutdownChannel)
-
-	var db *sql.DB = nil
-
-	if config.GetValueBool("enable_statistics") {
-		db = data.Init()
-	}
-
-	context.WaitGroup.Add(1)
-	go stats.Logger(context, db)
-
-	context.WaitGroup.Add(1)
-	go tracker.Tracker(context, startPlayerPingChannel)
-
-	go func() {
-		<-beginShutdownChannel
-		fmt.Println("Shutting down")
-		close(context.ShutdownChannel)
-		context.WaitGroup.Wait()
-		close(mainShutdownChannel)
-	}()
-
-loop:
-	for {
-		select {
-		case _, ok := <-mainShutdownChannel:
-			if !ok {
-				break loop
-			}
-		case playerInfo := <-playerInfoEventChannel:
-			if playerInfo.SetId {
-				state.PlayerSetId(context, playerInfo.PlayerAddr, playerInfo.PlayerId, true)
-			} else if playerInfo.SetName {
-				state.PlayerSetName(context, playerInfo.PlayerAddr, playerInfo.PlayerId, playerInfo.Name)
-			}
-		case playerPort := <-playerLeaveGameChannel:
-			state.PlayerDelete(context, playerPort, true)
-			state.PrintServerState(context, true)
-		case packet := <-context.RxChannel:
-			processPacket(context, packet, startPlayerPingChannel, playerInfoEventChannel, playerLeaveGameChannel)
-		}
-	}
-
-	if db != nil {
-		db.Close()
+func main() {
+	command := "serve"
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	switch command {
+	case "serve":
+		parseServeFlags(args)
+		serve()
+	case "status":
+		loadConfig()
+		status(args)
+	case "top":
+		loadConfig()
+		top(args)
+	case "bans":
+		loadConfig()
+		bans(args)
+	case "config":
+		checkConfig(args)
+	case "replay":
+		loadConfig()
+		replay(args)
+	case "simulate":
+		loadConfig()
+		simulate(args)
+	case "loadtest":
+		loadtest(args)
+	case "decode":
+		decode(args)
+	case "help", "-h", "-help", "--help":
+		fmt.Print(kUsage)
+	default:
+		fmt.Fprint(os.Stderr, kUsage)
+		os.Exit(2)
 	}
 }
 
-func processPacket(
-	context *state.ServerContext,
-	packet proxy.UdpPacket,
-	startPlayerPingChannel chan state.Player,
-	playerInfoEventChannel chan util.PlayerInfoEvent,
-	playerLeaveGameChannel chan util.PlayerAddr,
-) {
-	valid, _ := bolo.ValidatePacket(packet)
-	if !valid {
-		// skip non-bolo packets
-		return
-	}
-
-	packetType := bolo.GetPacketType(packet.Buffer)
-
-	context.Mutex.Lock()
-
-	// get destination player ip by proxy port
-	dstPlayer, err := state.PlayerGetByPort(context, packet.DstPort, false)
-	if err != nil {
-		// normally won't happen, but there could be a pending packet incoming from a player that was subsequently deleted
-		fmt.Println(err)
-		context.Mutex.Unlock()
-		return
-	}
-
-	srcPlayer, err := state.PlayerGetByAddr(context, packet.SrcAddr, false)
-	if err != nil {
-		srcPlayer = state.PlayerNew(context, packet.SrcAddr, dstPlayer.GameId, dstPlayer.ProxyPort, false)
-		startPlayerPingChannel <- srcPlayer
-		state.PrintServerState(context, false)
-	}
-
-	context.PlayerPongChannel <- util.PlayerAddr{IpAddr: srcPlayer.IpAddr.String(), IpPort: srcPlayer.IpPort, ProxyPort: srcPlayer.ProxyPort}
-
-	if packetType == bolo.PacketType5 {
-		if srcPlayer.GameId != dstPlayer.GameId {
-			state.PlayerJoinGame(context, srcPlayer.ProxyPort, dstPlayer.GameId, false)
+// parseServeFlags sets config properties from the command line, e.g.
+// -http_port 8080, overriding the config file and environment.
+func parseServeFlags(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	configFile := flags.String("config", "", "config file (default config.conf, or config.txt)")
+	for _, name := range config.Names() {
+		flags.String(name, "", "sets "+name+" (or "+config.EnvName(name)+")")
+	}
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: bolorama [serve] [-config <file>] [-<property> <value>]...")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "config" {
+			config.UseFile(*configFile)
+		} else if err := config.Set(f.Name, f.Value.String()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
 		}
-	}
-
-	if context.Debug {
-		if packetType == bolo.PacketType5 || packetType == bolo.PacketType6 || packetType == bolo.PacketType7 {
-			srcTimestamp := srcPlayer.Peers[dstPlayer.ProxyPort]
-			dstTimestamp := dstPlayer.Peers[srcPlayer.ProxyPort]
-			timestamp := util.MaxTime(srcTimestamp, dstTimestamp)
-
-			natStatus := "?"
-			if time.Since(timestamp).Seconds() < 20 {
-				natStatus = "*"
-			}
-
-			fmt.Printf("%s PacketType=%d %d (%s:%d) -> %d (%s:%d)\n", natStatus, packetType,
-				srcPlayer.ProxyPort, srcPlayer.IpAddr.String(), srcPlayer.IpPort,
-				dstPlayer.ProxyPort, dstPlayer.IpAddr.String(), dstPlayer.IpPort,
-			)
-			fmt.Printf("    Timestamp=%s\n", timestamp)
-		}
-	}
-
-	if packetType == bolo.PacketType7 {
-		if bytes.Equal(packet.Buffer[10:12], []byte{0x01, 0x23}) {
-			if bytes.Equal(packet.Buffer[18:22], []byte{0x45, 0x67, 0x89, 0xab}) {
-				savedPacket, ok := srcPlayer.PeerPackets[dstPlayer.ProxyPort]
-				if !ok {
-					fmt.Printf("received nat probe reply (%d -> %d, %s:%d -> %s:%d)\n", srcPlayer.ProxyPort, dstPlayer.ProxyPort, srcPlayer.IpAddr.String(), srcPlayer.IpPort, dstPlayer.IpAddr.String(), dstPlayer.IpPort)
-					fmt.Println("  error: no saved packet")
-					context.Mutex.Unlock()
-					return
-				}
-				if context.Debug {
-					fmt.Printf("received nat probe reply (%d -> %d, %s:%d -> %s:%d)\n", srcPlayer.ProxyPort, dstPlayer.ProxyPort, srcPlayer.IpAddr.String(), srcPlayer.IpPort, dstPlayer.IpAddr.String(), dstPlayer.IpPort)
-					fmt.Printf("  packet length = %d\n", len(savedPacket.Buffer))
-					fmt.Printf("  forwarding PacketType=%d (%d -> %d, %s:%d -> %s:%d)\n", bolo.GetPacketType(savedPacket.Buffer), dstPlayer.ProxyPort, srcPlayer.ProxyPort, dstPlayer.IpAddr.String(), dstPlayer.IpPort, srcPlayer.IpAddr.String(), srcPlayer.IpPort)
-				}
-				delete(srcPlayer.PeerPackets, dstPlayer.ProxyPort)
-				srcPlayer.Peers[dstPlayer.ProxyPort] = time.Now()
-				context.Mutex.Unlock()
-				go forwardPacket(savedPacket, context.ProxyIpAddr, dstPlayer, srcPlayer, playerInfoEventChannel, playerLeaveGameChannel)
-				return
-			}
-		}
-	}
-
-	if srcPlayer.NatPort != context.ProxyPort {
-		natProbe(context, srcPlayer, context.ProxyPort, false)
-	}
-
-	// if the player is talking to themselves (happens when they are the last player in the game), no nat traversal is needed
-	if srcPlayer.ProxyPort != dstPlayer.ProxyPort {
-		srcTimestamp := srcPlayer.Peers[dstPlayer.ProxyPort]
-		dstTimestamp := dstPlayer.Peers[srcPlayer.ProxyPort]
-		timestamp := util.MaxTime(srcTimestamp, dstTimestamp)
-		if time.Since(timestamp).Seconds() > 20 {
-			dstPlayer.PeerPackets[srcPlayer.ProxyPort] = packet
-			natProbe(context, dstPlayer, srcPlayer.ProxyPort, false)
-			context.Mutex.Unlock()
-			return
-		}
-
-		srcPlayer.Peers[dstPlayer.ProxyPort] = time.Now()
-	}
-
-	context.Mutex.Unlock()
-
-	go forwardPacket(packet, context.ProxyIpAddr, srcPlayer, dstPlayer, playerInfoEventChannel, playerLeaveGameChannel)
+	})
 }
 
-func natProbe(context *state.ServerContext, dstPlayer state.Player, targetProxyPort int, lock bool) {
-	trackerPort := config.GetValueInt("tracker_port")
-	buffer := bolo.MarshalPacketType6(context.ProxyIpAddr, targetProxyPort)
-	dstAddr := &net.UDPAddr{IP: dstPlayer.IpAddr, Port: dstPlayer.IpPort}
-
-	if context.Debug {
-		fmt.Printf("sending nat probe to %s:%d (target port: %d)\n", dstPlayer.IpAddr.String(), dstPlayer.IpPort, targetProxyPort)
+// loadConfig loads the config, stopping on its problems.
+func loadConfig() {
+	if err := config.Load(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
+}
 
-	if dstPlayer.NatPort == trackerPort {
-		if context.Debug {
-			fmt.Printf("  (nat probe source port: %d)\n", trackerPort)
-		}
-		context.UdpConnection.WriteToUDP(buffer, dstAddr)
-	} else {
-		natPlayer, err := state.PlayerGetByPort(context, dstPlayer.NatPort, lock)
+// serve runs the server until it is signalled to stop.
+func serve() {
+	loadConfig()
+	if config.HasValue("log_file") {
+		logFile, err := logfile.Open("log")
 		if err != nil {
-			fmt.Println(err)
-			return
+			fmt.Fprintln(os.Stderr, "Failed to open log:", err)
+			os.Exit(1)
 		}
-		if context.Debug {
-			fmt.Printf("  (nat probe source port: %d)\n", natPlayer.ProxyPort)
+		restore, err := logfile.Redirect(logFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to redirect log:", err)
+			os.Exit(1)
 		}
-		natPlayer.TxChannel <- proxy.UdpPacket{DstAddr: *dstAddr, Buffer: buffer}
+		// deferred first, so it runs after everything else has been logged
+		defer restore()
+	}
+
+	srv, err := server.New(nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
-}
 
-func forwardPacket(
-	packet proxy.UdpPacket,
-	proxyIP net.IP,
-	srcPlayer state.Player,
-	dstPlayer state.Player,
-	playerInfoEventChannel chan util.PlayerInfoEvent,
-	playerLeaveGameChannel chan util.PlayerAddr,
-) {
-	srcPlayerAddr := util.PlayerAddr{IpAddr: srcPlayer.IpAddr.String(), IpPort: srcPlayer.IpPort, ProxyPort: srcPlayer.ProxyPort}
-	bolo.RewritePacket(
-		packet.Buffer,
-		proxyIP,
-		srcPlayer.ProxyPort,
-		srcPlayerAddr,
-		playerInfoEventChannel,
-		playerLeaveGameChannel,
-	)
+	defer func() {
+		fmt.Println("Shutdown completed")
+	}()
 
-	packet.DstAddr = net.UDPAddr{IP: dstPlayer.IpAddr, Port: dstPlayer.IpPort}
-	srcPlayer.TxChannel <- packet
+	initSignalHandler(srv.Shutdown)
+	initDrainSignalHandler(srv.Context)
+	initDumpSignalHandler(srv.Context)
+	srv.Run()
 }
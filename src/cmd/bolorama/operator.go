@@ -0,0 +1,218 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"git.astrospark.com/bolorama/admin"
+	"git.astrospark.com/bolorama/alert"
+	"git.astrospark.com/bolorama/config"
+	"git.astrospark.com/bolorama/proxy"
+	"git.astrospark.com/bolorama/state"
+)
+
+// The operator commands. status and bans talk to the running server through
+// its admin console, so that it keeps its bans and state to itself.
+
+func status(args []string) {
+	if len(args) != 0 {
+		usageExit()
+	}
+	sendExit("status")
+}
+
+func bans(args []string) {
+	switch {
+	case len(args) == 1 && args[0] == "list":
+		sendExit("unkick")
+	case (len(args) == 2 || len(args) == 3) && args[0] == "add":
+		sendExit("ban " + strings.Join(args[1:], " "))
+	case len(args) == 2 && args[0] == "rm":
+		sendExit("unkick " + args[1])
+	default:
+		usageExit()
+	}
+}
+
+func checkConfig(args []string) {
+	if len(args) < 1 || len(args) > 2 || args[0] != "check" {
+		usageExit()
+	}
+	filename := config.DefaultFilename()
+	if len(args) == 2 {
+		filename = args[1]
+	}
+
+	problems, err := config.Check(filename)
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+
+	// the settings are sound, so they can be loaded without the server
+	// stopping on them
+	if len(args) == 2 {
+		config.UseFile(filename)
+	}
+	problems = dryRun()
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+	fmt.Printf("%s: ok\n", filename)
+}
+
+// dryRun does what the server does at startup short of serving: resolves the
+// proxy IP, binds the ports and reads the ban file, returning what failed.
+func dryRun() []string {
+	var problems []string
+
+	if proxyIp, err := config.GetProxyIp(log.Default()); err != nil {
+		problems = append(problems, fmt.Sprintf("proxy IP: %s", err))
+	} else {
+		fmt.Println("Proxy IP:", proxyIp)
+	}
+
+	trackerPort := config.GetValueInt("tracker_port")
+	connections, err := proxy.ListenUdp(trackerPort, log.Default())
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("tracker_port: %s", err))
+	}
+	for _, connection := range connections {
+		connection.Close()
+	}
+
+	bindAddresses, err := config.GetBindAddresses()
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+	if len(bindAddresses) == 0 {
+		bindAddresses = []net.IP{nil}
+	}
+	if config.HasValue("external_tracker") {
+		// the tracker does not listen on TCP then
+		bindAddresses = nil
+	}
+	for _, ip := range bindAddresses {
+		for _, name := range []string{"tracker_port", "tracker_debug_port"} {
+			if err := tryListen(ip, config.GetValueInt(name)); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %s", name, err))
+			}
+		}
+	}
+
+	trackers, err := config.GetTrackers()
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("trackers: %s", err))
+	}
+	for _, t := range trackers {
+		connections, err := proxy.ListenUdp(t.Port, log.Default())
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("trackers: %s: %s", t.Name, err))
+		}
+		for _, connection := range connections {
+			connection.Close()
+		}
+		for _, ip := range bindAddresses {
+			for _, port := range []int{t.Port, t.Scope.GetValueInt("tracker_debug_port")} {
+				if port == 0 {
+					continue
+				}
+				if err := tryListen(ip, port); err != nil {
+					problems = append(problems, fmt.Sprintf("trackers: %s: %s", t.Name, err))
+				}
+			}
+		}
+	}
+
+	if port := config.GetValueInt("http_port"); port > 0 {
+		if err := tryListen(nil, port); err != nil {
+			problems = append(problems, fmt.Sprintf("http_port: %s", err))
+		}
+	}
+	if port := config.GetValueInt("https_port"); port > 0 {
+		if err := tryListen(nil, port); err != nil {
+			problems = append(problems, fmt.Sprintf("https_port: %s", err))
+		}
+	}
+	if port := config.GetValueInt("admin_port"); port > 0 {
+		if err := tryListen(net.IPv4(127, 0, 0, 1), port); err != nil {
+			problems = append(problems, fmt.Sprintf("admin_port: %s", err))
+		}
+	}
+	if port := config.GetValueInt("pprof_port"); port > 0 {
+		if err := tryListen(net.IPv4(127, 0, 0, 1), port); err != nil {
+			problems = append(problems, fmt.Sprintf("pprof_port: %s", err))
+		}
+	}
+
+	if _, err := proxy.ParsePinnedPorts(config.GetValueList("pinned_ports")); err != nil {
+		problems = append(problems, fmt.Sprintf("pinned_ports: %s", err))
+	}
+	if _, err := proxy.ParseDscp(config.GetValueString("dscp")); err != nil {
+		problems = append(problems, fmt.Sprintf("dscp: %s", err))
+	}
+	if _, err := alert.ParseRules(config.GetValueList("alert_rules")); err != nil {
+		problems = append(problems, fmt.Sprintf("alert_rules: %s", err))
+	}
+
+	banProblems, err := state.CheckBans()
+	problems = append(problems, banProblems...)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("ban_file: %s", err))
+	}
+	return problems
+}
+
+// tryListen opens and closes a TCP listener on ip and port.
+func tryListen(ip net.IP, port int) error {
+	listener, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: ip, Port: port})
+	if err != nil {
+		return err
+	}
+	return listener.Close()
+}
+
+// sendExit runs command on the admin console and prints its output. Exits
+// with status 1 if the server could not be reached.
+func sendExit(command string) {
+	output, err := admin.Send(command)
+	if err != nil {
+		fmt.Println("Failed to reach the server's admin console:", err)
+		os.Exit(1)
+	}
+	fmt.Print(output)
+}
+
+func usageExit() {
+	fmt.Fprint(os.Stderr, kUsage)
+	os.Exit(2)
+}
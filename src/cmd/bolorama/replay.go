@@ -0,0 +1,265 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"git.astrospark.com/bolorama/bolo"
+	"git.astrospark.com/bolorama/config"
+	"git.astrospark.com/bolorama/proxy"
+	"git.astrospark.com/bolorama/record"
+	"git.astrospark.com/bolorama/server"
+	"git.astrospark.com/bolorama/state"
+)
+
+// replayComparer checks the packets the proxy sends during a replay against
+// the ones it sent when the game was recorded.
+type replayComparer struct {
+	mutex       sync.Mutex
+	expected    map[string]int
+	transmitted int
+	matched     int
+	verbose     bool
+}
+
+func replayKey(proxyPort int, addr net.UDPAddr, buffer []byte) string {
+	return fmt.Sprintf("%d %s %x", proxyPort, addr.String(), buffer)
+}
+
+func (comparer *replayComparer) transmit(proxyPort int, packet proxy.UdpPacket) {
+	comparer.mutex.Lock()
+	defer comparer.mutex.Unlock()
+
+	comparer.transmitted++
+	key := replayKey(proxyPort, packet.DstAddr, packet.Buffer)
+	if comparer.expected[key] > 0 {
+		comparer.expected[key]--
+		comparer.matched++
+		return
+	}
+
+	if comparer.verbose {
+		fmt.Printf("unexpected packet %d -> %s:\n%s", proxyPort, packet.DstAddr.String(), hex.Dump(packet.Buffer))
+	}
+}
+
+// replay feeds the packets players sent in a recorded game through the packet
+// handling again, with stub routes in place of sockets, and reports how many
+// of the resulting packets match the recording.
+func replay(args []string) {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	speed := flags.Float64("speed", 1, "playback speed multiplier, 0 to replay as fast as possible")
+	proxyIp := flags.String("proxy-ip", "", "proxy address the game was recorded with (default: as configured)")
+	verbose := flags.Bool("v", false, "hexdump packets that differ from the recording")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: bolorama replay [options] <file>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	packets, gameId, err := readRecording(flags.Arg(0))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	var ip net.IP
+	if *proxyIp != "" {
+		ip = net.ParseIP(*proxyIp).To4()
+		if ip == nil {
+			fmt.Println("not an IPv4 address:", *proxyIp)
+			os.Exit(2)
+		}
+	} else if ip, err = config.GetProxyIp(log.Default()); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	comparer := &replayComparer{expected: make(map[string]int), verbose: *verbose}
+	var inbound []record.Packet
+	var joined []record.Packet
+	versions := make(map[string]bolo.Version)
+	for _, packet := range packets {
+		switch packet.Direction {
+		case record.Inbound:
+			inbound = append(inbound, packet)
+			if _, ok := versions[packet.PlayerAddr.String()]; !ok && len(packet.Buffer) >= bolo.PacketHeaderSize {
+				versions[packet.PlayerAddr.String()] = bolo.GetVersion(packet.Buffer)
+			}
+		case record.Outbound:
+			comparer.expected[replayKey(packet.ProxyPort, packet.PlayerAddr, packet.Buffer)]++
+		case record.Joined:
+			joined = append(joined, packet)
+		}
+	}
+
+	trackerPort := config.GetValueInt("tracker_port")
+	context := state.InitReplayContext(trackerPort, ip)
+	context.Ports.UseStubRoutes(comparer.transmit)
+	startPlayerPingChannel := make(chan state.Player)
+	router := server.NewRouter(context, startPlayerPingChannel, 0)
+
+	context.State.WaitGroup.Add(1)
+	go state.Run(context)
+
+	// nothing answers pings during a replay
+	go func() {
+		for range context.PlayerPongChannel {
+		}
+	}()
+	go func() {
+		for range startPlayerPingChannel {
+		}
+	}()
+
+	replaySeedPlayers(context, gameId, joined, versions)
+
+	feedChannel := make(chan proxy.UdpPacket)
+	go replayFeed(inbound, *speed, feedChannel)
+
+	router.Run(feedChannel, nil)
+
+	// let the forwarding goroutines finish
+	time.Sleep(100 * time.Millisecond)
+	state.Shutdown(context)
+
+	comparer.mutex.Lock()
+	defer comparer.mutex.Unlock()
+	expected := 0
+	for _, count := range comparer.expected {
+		expected += count
+	}
+	expected += comparer.matched
+	fmt.Println()
+	fmt.Printf("Replayed %d packets from players\n", len(inbound))
+	fmt.Printf("Sent %d packets, %d of %d recorded packets matched\n", comparer.transmitted, comparer.matched, expected)
+}
+
+func readRecording(filename string) ([]record.Packet, bolo.GameId, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, bolo.GameId{}, err
+	}
+	defer file.Close()
+
+	reader, err := record.NewReader(file)
+	if err != nil {
+		return nil, bolo.GameId{}, err
+	}
+
+	var packets []record.Packet
+	for {
+		packet, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Println("Recording is truncated:", err)
+			break
+		}
+		packets = append(packets, packet)
+	}
+	return packets, reader.GameId, nil
+}
+
+// replaySeedPlayers creates every player seen joining the recorded game, on
+// the proxy port they had at the time. The first is treated as the host.
+func replaySeedPlayers(context *state.ServerContext, gameId bolo.GameId, joined []record.Packet, versions map[string]bolo.Version) {
+	sort.SliceStable(joined, func(i, j int) bool {
+		return joined[i].ProxyPort < joined[j].ProxyPort
+	})
+
+	ports := make(map[int]bool)
+	for _, packet := range joined {
+		ports[packet.ProxyPort] = true
+	}
+	if len(joined) > 0 {
+		for port := proxy.FirstPlayerPort(); port < joined[len(joined)-1].ProxyPort; port++ {
+			if !ports[port] {
+				context.Ports.ReservePort(port)
+			}
+		}
+	}
+
+	natPort := context.ProxyPort
+	state.Do(context, func(s *state.State) {
+		seeded := make(map[int]bool)
+		for _, packet := range joined {
+			if seeded[packet.ProxyPort] {
+				// a later address for the same player, the replay migrates it
+				continue
+			}
+			seeded[packet.ProxyPort] = true
+
+			version, ok := versions[packet.PlayerAddr.String()]
+			if !ok {
+				version = bolo.Version{0x65, 0x99, 0x08}
+			}
+			player, err := state.PlayerNew(s, packet.PlayerAddr, gameId, natPort, version)
+			if err != nil {
+				fmt.Printf("Player %s not seeded: %s\n", packet.PlayerAddr.String(), err)
+				continue
+			}
+			if player.ProxyPort != packet.ProxyPort {
+				fmt.Printf("Player %s got proxy port %d, was %d\n", packet.PlayerAddr.String(), player.ProxyPort, packet.ProxyPort)
+			}
+			if natPort == context.ProxyPort {
+				s.Games[gameId] = bolo.GameInfo{GameId: gameId, ServerStartTimestamp: time.Now(), Version: version}
+				natPort = player.ProxyPort
+			}
+		}
+		state.PrintServerState(s)
+	})
+}
+
+func replayFeed(packets []record.Packet, speed float64, feedChannel chan proxy.UdpPacket) {
+	defer close(feedChannel)
+
+	if len(packets) == 0 {
+		return
+	}
+
+	start := time.Now()
+	first := packets[0].Time
+	for _, packet := range packets {
+		if speed > 0 {
+			due := start.Add(time.Duration(float64(packet.Time.Sub(first)) / speed))
+			time.Sleep(time.Until(due))
+		}
+		feedChannel <- proxy.UdpPacket{
+			SrcAddr: packet.PlayerAddr,
+			DstPort: packet.ProxyPort,
+			Len:     len(packet.Buffer),
+			Buffer:  packet.Buffer,
+		}
+	}
+}
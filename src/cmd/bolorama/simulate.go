@@ -0,0 +1,442 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.astrospark.com/bolorama/clock"
+	"git.astrospark.com/bolorama/config"
+	"git.astrospark.com/bolorama/proxy"
+	"git.astrospark.com/bolorama/server"
+	"git.astrospark.com/bolorama/state"
+	"git.astrospark.com/bolorama/tracker"
+)
+
+// A simulation script is a list of commands, one per line. Blank lines and
+// lines starting with # are skipped.
+//
+//	send <ip:port> <port> <hex>        a player sends a packet to a port
+//	advance <duration>                 move the clock, e.g. 25s
+//	expect players <n>                 how many players there are
+//	expect games <n>                   how many games there are
+//	expect player <ip:port> [port <n>] [nat <n>] [game <hex>] [id <n>] [name <name>]
+//	                                   a player at the address, and its details
+//	expect noplayer <ip:port>          no player at the address
+//	expect peer <port> <port>          the player on the first proxy port has
+//	                                   sent to the second within 20 seconds
+//	expect nopeer <port> <port>        or has not
+//	expect route <port> <ip:port>      where the route of a proxy port sends
+//	expect sent <port> <ip:port> [hex] a packet was sent from a port (the
+//	                                   tracker port or a proxy port) to the
+//	                                   address, starting with hex if given
+//	expect nothing-sent                no other packets were sent
+//
+// Packets sent to the tracker port are handled as the tracker would, and all
+// others as the proxy would. expect sent takes each packet it matches off the
+// list of packets sent, so the same packet can't be matched twice.
+
+// simulationStart is where the clock of a simulation starts, so that runs are
+// the same whenever they happen.
+var simulationStart = time.Date(2021, 3, 1, 20, 0, 0, 0, time.UTC)
+
+// simulationSentWait is how long expect sent waits for a packet, since the
+// proxy's transmitters run on goroutines of their own.
+const simulationSentWait = time.Second
+
+type simulatedPacket struct {
+	from    int
+	dstAddr net.UDPAddr
+	buffer  []byte
+}
+
+// simulation holds the packets sent during a simulation.
+type simulation struct {
+	mutex sync.Mutex
+	sent  []simulatedPacket
+	added chan struct{}
+}
+
+func (sim *simulation) transmit(proxyPort int, packet proxy.UdpPacket) {
+	sim.mutex.Lock()
+	sim.sent = append(sim.sent, simulatedPacket{
+		from:    proxyPort,
+		dstAddr: packet.DstAddr,
+		buffer:  append([]byte(nil), packet.Buffer...),
+	})
+	sim.mutex.Unlock()
+
+	select {
+	case sim.added <- struct{}{}:
+	default:
+	}
+}
+
+// take removes and returns the first packet sent from port to addr starting
+// with prefix, waiting up to simulationSentWait for it.
+func (sim *simulation) take(port int, addr net.UDPAddr, prefix []byte) bool {
+	deadline := time.After(simulationSentWait)
+	for {
+		sim.mutex.Lock()
+		for i, packet := range sim.sent {
+			if packet.from == port && packet.dstAddr.String() == addr.String() && bytes.HasPrefix(packet.buffer, prefix) {
+				sim.sent = append(sim.sent[:i], sim.sent[i+1:]...)
+				sim.mutex.Unlock()
+				return true
+			}
+		}
+		sim.mutex.Unlock()
+
+		select {
+		case <-sim.added:
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+func (sim *simulation) remaining() []simulatedPacket {
+	sim.mutex.Lock()
+	defer sim.mutex.Unlock()
+	return append([]simulatedPacket(nil), sim.sent...)
+}
+
+// simulate runs a script of packets against the packet handling, with stub
+// routes in place of sockets and a clock that only moves when the script
+// says, and checks the resulting players, games and routes against the
+// script's expectations.
+func simulate(args []string) {
+	flags := flag.NewFlagSet("simulate", flag.ExitOnError)
+	proxyIp := flags.String("proxy-ip", "192.0.2.1", "proxy address to simulate")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: bolorama simulate [options] <script>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	ip := net.ParseIP(*proxyIp).To4()
+	if ip == nil {
+		fmt.Println("not an IPv4 address:", *proxyIp)
+		os.Exit(2)
+	}
+
+	failures, err := runSimulation(flags.Arg(0), ip)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	if failures > 0 {
+		os.Exit(1)
+	}
+}
+
+// runSimulation runs a script and returns how many expectations failed. Each
+// run has a context and proxy ports of its own, so scripts do not affect one
+// another.
+func runSimulation(filename string, ip net.IP) (int, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	sim := &simulation{added: make(chan struct{}, 1)}
+	mock := clock.NewMock(simulationStart)
+	trackerPort := config.GetValueInt("tracker_port")
+	context := state.InitReplayContext(trackerPort, ip)
+	context.Ports.UseStubRoutes(sim.transmit)
+	context.Clock = mock
+
+	startPlayerPingChannel := make(chan state.Player)
+	// buffered, so that forwarding never waits for the loop below
+	router := server.NewRouter(context, startPlayerPingChannel, 64)
+	router.SetInline()
+
+	context.State.WaitGroup.Add(1)
+	go state.Run(context)
+	defer state.Shutdown(context)
+
+	// nothing answers pings during a simulation
+	go func() {
+		for range context.PlayerPongChannel {
+		}
+	}()
+	go func() {
+		for range startPlayerPingChannel {
+		}
+	}()
+
+	expectations := 0
+	failures := 0
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		var problem string
+		switch fields[0] {
+		case "send":
+			packet, err := parseSimulatedPacket(fields[1:])
+			if err != nil {
+				return failures, fmt.Errorf("%s:%d: %s", filename, line, err)
+			}
+			packet.Received = mock.Now()
+			if packet.DstPort == trackerPort {
+				tracker.HandlePacket(context, packet)
+			} else {
+				router.Route(packet)
+			}
+			router.DrainPlayerEvents()
+			continue
+		case "advance":
+			if len(fields) != 2 {
+				return failures, fmt.Errorf("%s:%d: usage: advance <duration>", filename, line)
+			}
+			d, err := time.ParseDuration(fields[1])
+			if err != nil {
+				return failures, fmt.Errorf("%s:%d: %s", filename, line, err)
+			}
+			mock.Advance(d)
+			continue
+		case "expect":
+			expectations++
+			problem, err = checkExpectation(context, sim, fields[1:])
+			if err != nil {
+				return failures, fmt.Errorf("%s:%d: %s", filename, line, err)
+			}
+		default:
+			return failures, fmt.Errorf("%s:%d: unknown command %s", filename, line, fields[0])
+		}
+
+		if problem != "" {
+			failures++
+			fmt.Printf("%s:%d: FAIL %s: %s\n", filename, line, strings.Join(fields, " "), problem)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return failures, err
+	}
+
+	fmt.Printf("%s: %d of %d expectations met\n", filename, expectations-failures, expectations)
+	return failures, nil
+}
+
+func parseSimulatedPacket(fields []string) (proxy.UdpPacket, error) {
+	if len(fields) != 3 {
+		return proxy.UdpPacket{}, fmt.Errorf("usage: send <ip:port> <port> <hex>")
+	}
+	srcAddr, err := net.ResolveUDPAddr("udp4", fields[0])
+	if err != nil {
+		return proxy.UdpPacket{}, err
+	}
+	port, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return proxy.UdpPacket{}, err
+	}
+	buffer, err := hex.DecodeString(fields[2])
+	if err != nil {
+		return proxy.UdpPacket{}, err
+	}
+	return proxy.UdpPacket{SrcAddr: *srcAddr, DstPort: port, Len: len(buffer), Buffer: buffer}, nil
+}
+
+// checkExpectation returns what is wrong with an expectation, or "" if it is
+// met. The error is for a malformed one.
+func checkExpectation(context *state.ServerContext, sim *simulation, fields []string) (string, error) {
+	if len(fields) == 0 {
+		return "", fmt.Errorf("expect what?")
+	}
+
+	switch fields[0] {
+	case "players", "games":
+		if len(fields) != 2 {
+			return "", fmt.Errorf("usage: expect %s <n>", fields[0])
+		}
+		want, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return "", err
+		}
+		var got int
+		state.Do(context, func(s *state.State) {
+			if fields[0] == "players" {
+				got = len(s.Players)
+			} else {
+				got = len(s.Games)
+			}
+		})
+		if got != want {
+			return fmt.Sprintf("there are %d", got), nil
+		}
+		return "", nil
+
+	case "player", "noplayer":
+		if len(fields) < 2 || (fields[0] == "player" && len(fields)%2 != 0) {
+			return "", fmt.Errorf("usage: expect player <ip:port> [<detail> <value>]...")
+		}
+		addr, err := net.ResolveUDPAddr("udp4", fields[1])
+		if err != nil {
+			return "", err
+		}
+		var player state.Player
+		state.Do(context, func(s *state.State) {
+			player, err = state.PlayerGetByAddr(s, *addr)
+		})
+		if fields[0] == "noplayer" {
+			if err == nil {
+				return fmt.Sprintf("there is one, on proxy port %d", player.ProxyPort), nil
+			}
+			return "", nil
+		}
+		if err != nil {
+			return "there is none", nil
+		}
+		return checkPlayer(player, fields[2:])
+
+	case "peer", "nopeer":
+		if len(fields) != 3 {
+			return "", fmt.Errorf("usage: expect %s <port> <port>", fields[0])
+		}
+		port, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return "", err
+		}
+		peerPort, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return "", err
+		}
+		var player state.Player
+		state.Do(context, func(s *state.State) {
+			player, err = state.PlayerGetByPort(s, port)
+		})
+		if err != nil {
+			return "there is no player on that port", nil
+		}
+		timestamp, ok := player.Peers[peerPort]
+		recent := ok && clock.Since(context.Clock, timestamp).Seconds() <= 20
+		switch {
+		case fields[0] == "peer" && !ok:
+			return "never sent to it", nil
+		case fields[0] == "peer" && !recent:
+			return fmt.Sprintf("last sent to it %s ago", clock.Since(context.Clock, timestamp)), nil
+		case fields[0] == "nopeer" && recent:
+			return fmt.Sprintf("sent to it %s ago", clock.Since(context.Clock, timestamp)), nil
+		}
+		return "", nil
+
+	case "route":
+		if len(fields) != 3 {
+			return "", fmt.Errorf("usage: expect route <port> <ip:port>")
+		}
+		port, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return "", err
+		}
+		addr, err := net.ResolveUDPAddr("udp4", fields[2])
+		if err != nil {
+			return "", err
+		}
+		var player state.Player
+		state.Do(context, func(s *state.State) {
+			player, err = state.PlayerGetByPort(s, port)
+		})
+		if err != nil {
+			return "there is no route on that port", nil
+		}
+		routeAddr := player.Route.PlayerAddr()
+		if routeAddr.String() != addr.String() {
+			return fmt.Sprintf("it sends to %s", routeAddr.String()), nil
+		}
+		return "", nil
+
+	case "sent":
+		if len(fields) != 3 && len(fields) != 4 {
+			return "", fmt.Errorf("usage: expect sent <port> <ip:port> [hex]")
+		}
+		port, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return "", err
+		}
+		addr, err := net.ResolveUDPAddr("udp4", fields[2])
+		if err != nil {
+			return "", err
+		}
+		var prefix []byte
+		if len(fields) == 4 {
+			if prefix, err = hex.DecodeString(fields[3]); err != nil {
+				return "", err
+			}
+		}
+		if !sim.take(port, *addr, prefix) {
+			return fmt.Sprintf("no such packet among %d sent", len(sim.remaining())), nil
+		}
+		return "", nil
+
+	case "nothing-sent":
+		// give the transmitters a moment to catch up
+		time.Sleep(10 * time.Millisecond)
+		if remaining := sim.remaining(); len(remaining) > 0 {
+			packet := remaining[0]
+			return fmt.Sprintf("%d sent, the first from %d to %s: %x", len(remaining), packet.from, packet.dstAddr.String(), packet.buffer), nil
+		}
+		return "", nil
+	}
+
+	return "", fmt.Errorf("unknown expectation %s", fields[0])
+}
+
+func checkPlayer(player state.Player, details []string) (string, error) {
+	var problems []string
+	for i := 0; i < len(details); i += 2 {
+		detail, want := details[i], details[i+1]
+		var got string
+		switch detail {
+		case "port":
+			got = strconv.Itoa(player.ProxyPort)
+		case "nat":
+			got = strconv.Itoa(player.NatPort)
+		case "game":
+			got = hex.EncodeToString(player.GameId[:])
+		case "id":
+			got = strconv.Itoa(player.PlayerId)
+		case "name":
+			got = player.Name
+		default:
+			return "", fmt.Errorf("unknown player detail %s", detail)
+		}
+		if got != want {
+			problems = append(problems, fmt.Sprintf("%s is %s", detail, got))
+		}
+	}
+	return strings.Join(problems, ", "), nil
+}
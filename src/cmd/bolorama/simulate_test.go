@@ -0,0 +1,57 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"git.astrospark.com/bolorama/config"
+)
+
+func TestMain(m *testing.M) {
+	config.Set("hostname", "test")
+	config.Set("audit_file", "")
+	config.Set("ban_file", "")
+	os.Exit(m.Run())
+}
+
+// TestSimulations runs the scripts in testdata, each from a fresh context.
+func TestSimulations(t *testing.T) {
+	scripts, err := filepath.Glob(filepath.Join("testdata", "*.sim"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scripts) == 0 {
+		t.Fatal("no scripts in testdata")
+	}
+	for _, script := range scripts {
+		script := script
+		t.Run(filepath.Base(script), func(t *testing.T) {
+			failures, err := runSimulation(script, net.IPv4(192, 0, 2, 1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if failures > 0 {
+				t.Errorf("%d expectations failed", failures)
+			}
+		})
+	}
+}
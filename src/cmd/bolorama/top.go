@@ -0,0 +1,281 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"git.astrospark.com/bolorama/admin"
+)
+
+// bolorama top shows the server running here, refreshed every second, from
+// "status json" on its admin console. Packet rates are worked out from the
+// counts of successive snapshots.
+
+const kTopInterval = time.Second
+
+type topColumn struct {
+	title string
+	width int
+	value func(route topRoute) string
+	less  func(a topRoute, b topRoute) bool
+}
+
+type topRoute struct {
+	admin.RouteStatus
+	rxRate float64 // packets per second
+	txRate float64
+}
+
+var topColumns = []topColumn{
+	{"PORT", 6, func(r topRoute) string { return strconv.Itoa(r.ProxyPort) },
+		func(a, b topRoute) bool { return a.ProxyPort < b.ProxyPort }},
+	{"NAME", 16, func(r topRoute) string { return r.Name },
+		func(a, b topRoute) bool { return strings.ToLower(a.Name) < strings.ToLower(b.Name) }},
+	{"GAME", 9, func(r topRoute) string { return r.GameId[:8] },
+		func(a, b topRoute) bool { return a.GameId < b.GameId }},
+	{"ADDRESS", 22, func(r topRoute) string { return r.Address },
+		func(a, b topRoute) bool { return a.Address < b.Address }},
+	{"RTT", 7, func(r topRoute) string { return formatRtt(r.RttMs) },
+		func(a, b topRoute) bool { return a.RttMs < b.RttMs }},
+	{"RX/S", 7, func(r topRoute) string { return fmt.Sprintf("%.0f", r.rxRate) },
+		func(a, b topRoute) bool { return a.rxRate < b.rxRate }},
+	{"TX/S", 7, func(r topRoute) string { return fmt.Sprintf("%.0f", r.txRate) },
+		func(a, b topRoute) bool { return a.txRate < b.txRate }},
+	{"IDLE", 6, func(r topRoute) string { return fmt.Sprintf("%ds", r.IdleSeconds) },
+		func(a, b topRoute) bool { return a.IdleSeconds < b.IdleSeconds }},
+	{"QUEUE", 6, func(r topRoute) string { return strconv.Itoa(r.QueuedPackets) },
+		func(a, b topRoute) bool { return a.QueuedPackets < b.QueuedPackets }},
+	{"DROPS", 6, func(r topRoute) string { return strconv.FormatUint(r.DroppedPackets, 10) },
+		func(a, b topRoute) bool { return a.DroppedPackets < b.DroppedPackets }},
+}
+
+const kTopHelp = "1-9, 0: sort by column (again to reverse)   q: quit"
+
+func top(args []string) {
+	if len(args) != 0 {
+		usageExit()
+	}
+
+	restore := rawTerminal()
+	defer restore()
+
+	keys := make(chan byte)
+	go func() {
+		buffer := make([]byte, 1)
+		for {
+			if _, err := os.Stdin.Read(buffer); err != nil {
+				close(keys)
+				return
+			}
+			keys <- buffer[0]
+		}
+	}()
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+
+	sortColumn, reverse := 0, false
+	var previous *admin.Status
+	var current admin.Status
+	var routes []topRoute
+	var fetchErr error
+	ticker := time.NewTicker(kTopInterval)
+	defer ticker.Stop()
+
+	fetch := func() {
+		output, err := admin.Send("status json")
+		if err == nil {
+			var status admin.Status
+			if status, err = admin.ParseStatus(output); err == nil {
+				if fetchErr == nil && !current.Time.IsZero() {
+					last := current
+					previous = &last
+				}
+				current = status
+				routes = topRoutes(previous, current)
+			}
+		}
+		fetchErr = err
+	}
+
+	fetch()
+	for {
+		sortRoutes(routes, sortColumn, reverse)
+		drawTop(current, routes, sortColumn, reverse, fetchErr)
+
+		select {
+		case <-ticker.C:
+			fetch()
+		case <-interrupt:
+			return
+		case key, ok := <-keys:
+			if !ok || key == 'q' {
+				return
+			}
+			if key >= '0' && key <= '9' {
+				column := int(key-'0'+9) % 10
+				if column < len(topColumns) {
+					reverse = column == sortColumn && !reverse
+					sortColumn = column
+				}
+			}
+		}
+	}
+}
+
+// topRoutes works out each route's packet rates since the previous snapshot.
+func topRoutes(previous *admin.Status, current admin.Status) []topRoute {
+	before := make(map[int]admin.RouteStatus)
+	elapsed := 0.0
+	if previous != nil {
+		elapsed = current.Time.Sub(previous.Time).Seconds()
+		for _, route := range previous.Routes {
+			before[route.ProxyPort] = route
+		}
+	}
+
+	routes := make([]topRoute, 0, len(current.Routes))
+	for _, route := range current.Routes {
+		r := topRoute{RouteStatus: route}
+		if b, ok := before[route.ProxyPort]; ok && elapsed > 0 && route.RxPackets >= b.RxPackets && route.TxPackets >= b.TxPackets {
+			r.rxRate = float64(route.RxPackets-b.RxPackets) / elapsed
+			r.txRate = float64(route.TxPackets-b.TxPackets) / elapsed
+		}
+		routes = append(routes, r)
+	}
+	return routes
+}
+
+func sortRoutes(routes []topRoute, column int, reverse bool) {
+	less := topColumns[column].less
+	sort.SliceStable(routes, func(i, j int) bool {
+		if reverse {
+			return less(routes[j], routes[i])
+		}
+		return less(routes[i], routes[j])
+	})
+}
+
+func drawTop(status admin.Status, routes []topRoute, sortColumn int, reverse bool, err error) {
+	var b strings.Builder
+	// home the cursor and clear the screen, and each line to its end
+	b.WriteString("\x1b[H\x1b[2J")
+	line := func(format string, args ...interface{}) {
+		fmt.Fprintf(&b, format, args...)
+		b.WriteString("\x1b[K\r\n")
+	}
+
+	if err != nil {
+		line("bolorama top: %s", err)
+	}
+	line("%s   games: %d   players: %d   %s", status.Time.Local().Format("15:04:05"), len(status.Games), len(status.Routes), status.Drain)
+	if status.Restart != nil {
+		line("restart: %s", status.Restart.Local().Format(time.RFC1123))
+	}
+	if status.Broadcast != "" {
+		line("broadcast: %s", status.Broadcast)
+	}
+	line("")
+
+	for _, game := range status.Games {
+		name := game.MapName
+		if game.Title != "" {
+			name = game.Title + " (" + game.MapName + ")"
+		}
+		line("%-9s %-40s %d players", game.GameId[:8], truncate(name, 40), game.Players)
+	}
+	if len(status.Games) > 0 {
+		line("")
+	}
+
+	var header strings.Builder
+	for i, column := range topColumns {
+		title := column.title
+		if i == sortColumn {
+			if reverse {
+				title += "^"
+			} else {
+				title += "v"
+			}
+		}
+		fmt.Fprintf(&header, "%-*s ", column.width, title)
+	}
+	line("\x1b[7m%s\x1b[0m", strings.TrimRight(header.String(), " "))
+	for _, route := range routes {
+		var row strings.Builder
+		for _, column := range topColumns {
+			fmt.Fprintf(&row, "%-*s ", column.width, truncate(column.value(route), column.width))
+		}
+		if route.Disconnected {
+			row.WriteString("(disconnected)")
+		}
+		line("%s", strings.TrimRight(row.String(), " "))
+	}
+	line("")
+	line("%s", kTopHelp)
+	os.Stdout.WriteString(b.String())
+}
+
+func formatRtt(ms int64) string {
+	if ms == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%dms", ms)
+}
+
+func truncate(s string, width int) string {
+	if len(s) > width {
+		return s[:width]
+	}
+	return s
+}
+
+// rawTerminal turns off line buffering and echo, so that keys are read as
+// they are pressed, and returns a function that restores the terminal. Where
+// there is no stty, keys take effect after Enter.
+func rawTerminal() func() {
+	stty := func(args ...string) (string, error) {
+		cmd := exec.Command("stty", args...)
+		cmd.Stdin = os.Stdin
+		output, err := cmd.Output()
+		return strings.TrimSpace(string(output)), err
+	}
+
+	saved, err := stty("-g")
+	if err != nil {
+		return func() {}
+	}
+	if _, err := stty("-icanon", "-echo", "min", "1"); err != nil {
+		return func() {}
+	}
+	// hide the cursor
+	os.Stdout.WriteString("\x1b[?25l")
+	return func() {
+		os.Stdout.WriteString("\x1b[?25h\r\n")
+		stty(saved)
+	}
+}
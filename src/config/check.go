@@ -0,0 +1,245 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"git.astrospark.com/bolorama/util"
+)
+
+// properties read with GetValueString that must be set
+var required = []string{"hostname"}
+
+// properties with a fixed set of values, checked by the packages that use them
+var choices = map[string][]string{
+	"acme_challenge": {"tls-alpn-01", "http-01"},
+	"privacy_mode":   {"off", "hash", "truncate"},
+	"profanity_chat": {"off", "mask", "blank"},
+}
+
+// Check reads the config file, secrets_file if it is set, and the BOLORAMA_
+// environment variables, and returns their problems: malformed lines, unknown
+// properties, repeated properties, values of the wrong type, judged from the
+// defaults, and a secrets file others can read.
+func Check(filename string) ([]string, error) {
+	entries, problems, err := readFile(filename)
+	// as in loadFile, the default file may be left out
+	if os.IsNotExist(err) && (filename == Filename || filename == TypedFilename) {
+		err = nil
+	}
+	if err != nil {
+		return problems, err
+	}
+	seen := make(map[string]int)
+	problems = append(problems, checkEntries(filename, entries, seen)...)
+
+	secrets, ok := os.LookupEnv(EnvName("secrets_file"))
+	for _, e := range entries {
+		if e.name == "secrets_file" && !ok {
+			secrets = e.value
+		}
+	}
+	if secrets != "" {
+		if err := CheckPermissions(secrets); err != nil {
+			problems = append(problems, err.Error())
+		}
+		entries, secretsProblems, err := readFile(secrets)
+		problems = append(problems, secretsProblems...)
+		if err != nil && !os.IsNotExist(err) {
+			return problems, err
+		}
+		secretsSeen := make(map[string]int)
+		problems = append(problems, checkEntries(secrets, entries, secretsSeen)...)
+		for name := range secretsSeen {
+			seen[name] = 0
+		}
+	}
+
+	for _, variable := range os.Environ() {
+		s := strings.SplitN(variable, "=", 2)
+		if !strings.HasPrefix(s[0], kEnvPrefix) {
+			continue
+		}
+		name := strings.ToLower(strings.TrimPrefix(s[0], kEnvPrefix))
+		if !util.ContainsString(valid, name) {
+			problems = append(problems, fmt.Sprintf("environment: unknown property %s", s[0]))
+			continue
+		}
+		seen[name] = 0
+		if err := checkValue(name, s[1]); err != nil {
+			problems = append(problems, fmt.Sprintf("environment: %s: %s", s[0], err))
+		}
+	}
+
+	for _, name := range required {
+		if _, ok := seen[name]; !ok {
+			problems = append(problems, fmt.Sprintf("%s is not set", name))
+		}
+	}
+	return problems, nil
+}
+
+// checkEntries returns the problems of the settings read from filename,
+// recording in seen the line each is set on.
+func checkEntries(filename string, entries []entry, seen map[string]int) []string {
+	var problems []string
+	for _, e := range entries {
+		report := func(format string, args ...interface{}) {
+			problems = append(problems, fmt.Sprintf("%s:%d: ", filename, e.line)+fmt.Sprintf(format, args...))
+		}
+		if !util.ContainsString(valid, e.name) {
+			report("unknown property %s", e.name)
+			continue
+		}
+		if previous, ok := seen[e.name]; ok {
+			report("%s already set on line %d", e.name, previous)
+		}
+		seen[e.name] = e.line
+
+		if err := checkValue(e.name, e.value); err != nil {
+			report("%s: %s", e.name, err)
+		}
+	}
+	return problems
+}
+
+func checkValue(name string, value string) error {
+	if options, ok := choices[name]; ok {
+		if !util.ContainsString(options, strings.ToLower(value)) {
+			return fmt.Errorf("not one of %s", strings.Join(options, ", "))
+		}
+		return nil
+	}
+
+	switch name {
+	case "proxy_ip", "self_probe_address":
+		if net.ParseIP(value).To4() == nil {
+			return fmt.Errorf("not an IPv4 address")
+		}
+		return nil
+	case "bind_addresses":
+		for _, item := range splitList(value) {
+			if net.ParseIP(item).To4() == nil {
+				return fmt.Errorf("not an IPv4 address: %s", item)
+			}
+		}
+		return nil
+	case "webhook_urls", "alert_webhook_urls", "otlp_endpoint":
+		for _, item := range splitList(value) {
+			u, err := url.Parse(item)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("not an http or https URL: %s", item)
+			}
+		}
+		return nil
+	case "api_tokens":
+		for _, item := range splitList(value) {
+			s := strings.SplitN(item, ":", 3)
+			if len(s) < 3 || s[0] == "" || s[2] == "" {
+				return fmt.Errorf("not name:role:token: %s", strings.SplitN(item, ":", 2)[0])
+			}
+			if !util.ContainsString([]string{"read", "moderator", "admin"}, s[1]) {
+				return fmt.Errorf("%s: role is not one of read, moderator, admin", s[0])
+			}
+		}
+		return nil
+	case "nats_url":
+		u, err := url.Parse(value)
+		if err != nil || (u.Scheme != "nats" && u.Scheme != "tls") || u.Host == "" {
+			return fmt.Errorf("not a nats:// or tls:// URL")
+		}
+		return nil
+	case "mqtt_url":
+		u, err := url.Parse(value)
+		if err != nil || (u.Scheme != "mqtt" && u.Scheme != "mqtts") || u.Host == "" {
+			return fmt.Errorf("not an mqtt:// or mqtts:// URL")
+		}
+		return nil
+	case "cors_origins":
+		for _, item := range splitList(value) {
+			u, err := url.Parse(item)
+			if item != "*" && (err != nil || u.Scheme == "" || u.Host == "" || u.Path != "") {
+				return fmt.Errorf("not * or an origin such as https://example.com: %s", item)
+			}
+		}
+		return nil
+	case "pinned_ports":
+		for _, item := range splitList(value) {
+			s := strings.SplitN(item, "=", 2)
+			if len(s) < 2 {
+				return fmt.Errorf("not address=port: %s", item)
+			}
+			address := strings.TrimSpace(s[0])
+			if host, _, err := net.SplitHostPort(address); err == nil {
+				address = host
+			}
+			if net.ParseIP(address).To4() == nil {
+				return fmt.Errorf("not an IPv4 address, or address and port: %s", item)
+			}
+			if _, err := strconv.Atoi(strings.TrimSpace(s[1])); err != nil {
+				return fmt.Errorf("not address=port: %s", item)
+			}
+		}
+		return nil
+	case "advertise_rules":
+		for _, item := range splitList(value) {
+			s := strings.SplitN(item, "=", 2)
+			if len(s) < 2 {
+				return fmt.Errorf("not subnet=address: %s", item)
+			}
+			_, _, err := net.ParseCIDR(strings.TrimSpace(s[0]))
+			if err != nil || net.ParseIP(strings.TrimSpace(s[1])).To4() == nil {
+				return fmt.Errorf("not subnet=address: %s", item)
+			}
+		}
+		return nil
+	case "trackers":
+		for _, item := range splitList(value) {
+			if _, _, _, err := parseTracker(item); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "udp_buffer_bytes":
+		// the least is what IPv4 guarantees to reassemble, the most its
+		// largest UDP payload
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 548 || size > 65507 {
+			return fmt.Errorf("not an integer from 548 to 65507")
+		}
+		return nil
+	}
+
+	defaultValue := defaults[name]
+	if _, ok := mapBoolValue[defaultValue]; ok {
+		if _, ok := mapBoolValue[strings.ToLower(value)]; !ok {
+			return fmt.Errorf("not a boolean")
+		}
+	} else if _, err := strconv.Atoi(defaultValue); err == nil {
+		if _, err := strconv.Atoi(value); err != nil {
+			return fmt.Errorf("not an integer")
+		}
+	}
+	return nil
+}
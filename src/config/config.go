@@ -18,40 +18,281 @@
 package config
 
 import (
-	"bufio"
+	"fmt"
 	"log"
 	"net"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
+	"git.astrospark.com/bolorama/stun"
 	"git.astrospark.com/bolorama/util"
 )
 
-const configFilename = "config.txt"
+// Filename is the config file, read from the working directory.
+const Filename = "config.txt"
+const stunTimeout = 5 * time.Second
+
+// Settings are taken, from lowest to highest precedence, from the defaults,
+// the config file, environment variables named BOLORAMA_ and the setting in
+// upper case (e.g. BOLORAMA_HTTP_PORT), and Set (the command line flags).
+const kEnvPrefix = "BOLORAMA_"
+
+var filename = Filename
+var filenameGiven = false
+var overrides = make(map[string]string)
 
 var configMap map[string]string = nil
 
 var valid []string = []string{
+	"account_login_grace_seconds",
+	"accounts",
+	"acme_cache_directory",
+	"acme_challenge",
+	"acme_directory_url",
+	"acme_domains",
+	"acme_email",
+	"admin_port",
+	"advertise_lan_address",
+	"advertise_rules",
+	"alert_check_seconds",
+	"alert_rules",
+	"alert_webhook_urls",
+	"api_tokens",
+	"audit_file",
+	"audit_secret",
+	"ban_file",
+	"bind_addresses",
+	"client_versions",
+	"chat_log_compress",
+	"chat_log_file",
+	"chat_log_keep",
+	"chat_log_max_bytes",
+	"chat_log_rotate_hours",
+	"consistency_check_seconds",
+	"consistency_repair",
+	"cors_origins",
 	"database_filename",
 	"debug",
+	"dedup_by_default",
+	"dedup_window_ms",
+	"dscp",
+	"dump_directory",
 	"enable_statistics",
+	"event_log_chat",
+	"event_log_compress",
+	"event_log_file",
+	"event_log_keep",
+	"event_log_max_bytes",
+	"event_log_rotate_hours",
+	"external_tracker",
+	"hook_command",
 	"hostname",
+	"http_port",
+	"https_port",
+	"keepalive_seconds",
+	"log_compress",
+	"log_file",
+	"log_keep",
+	"log_max_bytes",
+	"log_repeat_seconds",
+	"log_rotate_hours",
+	"master_register_seconds",
+	"master_url",
+	"max_games",
+	"max_players_per_game",
+	"max_players_per_ip",
+	"max_players_per_subnet",
+	"federation",
+	"flood_blacklist_seconds",
+	"flood_max_packets_per_second",
+	"federation_key_file",
+	"federation_peers",
+	"federation_poll_seconds",
+	"federation_ttl_seconds",
+	"forward_workers",
+	"game_idle_timeout_minutes",
+	"geoip_allow_countries",
+	"geoip_database",
+	"geoip_deny_countries",
 	"game_info_ping_seconds",
+	"mqtt_topic",
+	"mqtt_url",
+	"nats_subject",
+	"nats_url",
+	"otlp_endpoint",
+	"otlp_sample_packets",
+	"pcap_directory",
+	"pcap_max_bytes",
+	"pinned_ports",
+	"player_rate_limit_burst_bytes",
+	"player_rate_limit_kbps",
+	"player_timeout_rtt_multiplier",
 	"player_timeout_seconds",
+	"port_mapping",
+	"port_mapping_gateway",
+	"pprof_port",
+	"privacy_mode",
+	"public_ip_refresh_seconds",
+	"reconnect_grace_seconds",
+	"record_directory",
+	"secrets_file",
+	"security_log",
+	"self_probe_address",
+	"self_probe_minutes",
+	"self_probe_timeout_seconds",
+	"shutdown_timeout_seconds",
+	"socket_pool_size",
+	"socket_receive_buffer_bytes",
+	"socket_send_buffer_bytes",
+	"statsd_address",
+	"statsd_interval_seconds",
+	"statsd_prefix",
+	"stun_server",
 	"tracker_debug_port",
 	"tracker_port",
+	"trackers",
+	"tx_queue_depth",
+	"udp_allow_fragmentation",
+	"udp_batch_size",
+	"udp_buffer_bytes",
+	"watchdog_seconds",
+	"webhook_secret",
+	"webhook_urls",
+	"winbolo_timeout_seconds",
+	"profanity_chat",
+	"profanity_wordlist",
+	"public_scheduling",
+	"pure_tracker",
 	"proxy_ip",
 }
 
 var defaults = map[string]string{
-	"database_filename":      "db.sqlite",
-	"debug":                  "false",
-	"enable_statistics":      "false",
-	"game_info_ping_seconds": "20",
-	"player_timeout_seconds": "60",
-	"tracker_debug_port":     "50001",
-	"tracker_port":           "50000",
+	"account_login_grace_seconds":   "60",
+	"accounts":                      "false",
+	"acme_cache_directory":          "acme",
+	"acme_challenge":                "tls-alpn-01",
+	"acme_directory_url":            "https://acme-v02.api.letsencrypt.org/directory",
+	"acme_domains":                  "",
+	"acme_email":                    "",
+	"admin_port":                    "0",
+	"advertise_lan_address":         "true",
+	"advertise_rules":               "",
+	"alert_check_seconds":           "60",
+	"alert_rules":                   "",
+	"alert_webhook_urls":            "",
+	"api_tokens":                    "",
+	"audit_file":                    "audit.log",
+	"audit_secret":                  "",
+	"ban_file":                      "bans.txt",
+	"bind_addresses":                "",
+	"client_versions":               "0.99.8",
+	"chat_log_compress":             "false",
+	"chat_log_file":                 "",
+	"chat_log_keep":                 "5",
+	"chat_log_max_bytes":            "104857600",
+	"chat_log_rotate_hours":         "0",
+	"consistency_check_seconds":     "60",
+	"consistency_repair":            "false",
+	"cors_origins":                  "",
+	"database_filename":             "db.sqlite",
+	"debug":                         "false",
+	"dedup_by_default":              "false",
+	"dedup_window_ms":               "0",
+	"dscp":                          "",
+	"dump_directory":                "",
+	"enable_statistics":             "false",
+	"event_log_chat":                "false",
+	"event_log_compress":            "false",
+	"event_log_file":                "",
+	"event_log_keep":                "5",
+	"event_log_max_bytes":           "104857600",
+	"event_log_rotate_hours":        "0",
+	"external_tracker":              "",
+	"federation":                    "false",
+	"federation_key_file":           "federation.key",
+	"federation_peers":              "",
+	"federation_poll_seconds":       "60",
+	"federation_ttl_seconds":        "180",
+	"flood_blacklist_seconds":       "60",
+	"flood_max_packets_per_second":  "50",
+	"forward_workers":               "0",
+	"game_idle_timeout_minutes":     "30",
+	"game_info_ping_seconds":        "20",
+	"geoip_allow_countries":         "",
+	"geoip_database":                "",
+	"geoip_deny_countries":          "",
+	"hook_command":                  "",
+	"http_port":                     "0",
+	"https_port":                    "0",
+	"keepalive_seconds":             "0",
+	"log_compress":                  "false",
+	"log_file":                      "",
+	"log_keep":                      "5",
+	"log_max_bytes":                 "104857600",
+	"log_repeat_seconds":            "30",
+	"log_rotate_hours":              "0",
+	"master_register_seconds":       "300",
+	"master_url":                    "",
+	"max_games":                     "0",
+	"max_players_per_game":          "0",
+	"max_players_per_ip":            "0",
+	"max_players_per_subnet":        "0",
+	"mqtt_topic":                    "bolorama",
+	"mqtt_url":                      "",
+	"nats_subject":                  "bolorama.events",
+	"nats_url":                      "",
+	"otlp_endpoint":                 "",
+	"otlp_sample_packets":           "100",
+	"pcap_directory":                "",
+	"pcap_max_bytes":                "10485760",
+	"pinned_ports":                  "",
+	"player_rate_limit_burst_bytes": "16384",
+	"player_rate_limit_kbps":        "0",
+	"player_timeout_rtt_multiplier": "0",
+	"player_timeout_seconds":        "60",
+	"port_mapping":                  "false",
+	"port_mapping_gateway":          "",
+	"pprof_port":                    "0",
+	"privacy_mode":                  "off",
+	"profanity_chat":                "off",
+	"profanity_wordlist":            "",
+	"public_ip_refresh_seconds":     "300",
+	"public_scheduling":             "false",
+	"pure_tracker":                  "false",
+	"reconnect_grace_seconds":       "0",
+	"record_directory":              "",
+	"secrets_file":                  "",
+	"security_log":                  "",
+	"self_probe_address":            "",
+	"self_probe_minutes":            "0",
+	"self_probe_timeout_seconds":    "5",
+	"shutdown_timeout_seconds":      "5",
+	"socket_pool_size":              "0",
+	"socket_receive_buffer_bytes":   "0",
+	"socket_send_buffer_bytes":      "0",
+	"statsd_address":                "",
+	"statsd_interval_seconds":       "10",
+	"statsd_prefix":                 "bolorama",
+	"stun_server":                   "",
+	"tracker_debug_port":            "50001",
+	"tracker_port":                  "50000",
+	"trackers":                      "",
+	"tx_queue_depth":                "64",
+	"udp_allow_fragmentation":       "true",
+	"udp_batch_size":                "8",
+	"udp_buffer_bytes":              "2048",
+	"watchdog_seconds":              "10",
+	"webhook_secret":                "",
+	"webhook_urls":                  "",
+	"winbolo_timeout_seconds":       "300",
+}
+
+// AdvertiseRule gives the proxy address to advertise to players in Subnet.
+type AdvertiseRule struct {
+	Subnet *net.IPNet
+	Ip     net.IP
 }
 
 var mapBoolValue = map[string]bool{
@@ -59,54 +300,167 @@ var mapBoolValue = map[string]bool{
 	"false": false,
 }
 
+// GetValueString returns the setting. Reading a setting loads the config
+// first (see Load), and panics if it cannot be loaded or name is not a
+// setting.
 func GetValueString(name string) string {
 	load()
 	value, ok := configMap[name]
 	if !ok {
-		log.Fatalln("Config property is not present:", name)
+		panic(fmt.Sprintf("config property is not present: %s", name))
 	}
 	return value
 }
 
 func GetValueInt(name string) int {
 	load()
-	valueString := GetValueString(name)
+	return intValue(name, GetValueString(name))
+}
+
+func GetValueBool(name string) bool {
+	load()
+	return boolValue(name, GetValueString(name))
+}
+
+// intValue returns the integer setting, which Load has checked.
+func intValue(name string, valueString string) int {
 	value, err := strconv.Atoi(valueString)
 	if err != nil {
-		log.Fatalln("Config property is not an integer:", name)
+		panic(fmt.Sprintf("config property is not an integer: %s", name))
 	}
 	return value
 }
 
-func GetValueBool(name string) bool {
-	load()
-	valueString := strings.ToLower(GetValueString(name))
-	valueBool, ok := mapBoolValue[valueString]
+// boolValue returns the boolean setting, which Load has checked.
+func boolValue(name string, valueString string) bool {
+	valueBool, ok := mapBoolValue[strings.ToLower(valueString)]
 	if !ok {
-		log.Fatalln("Config property is not a boolean:", name)
+		panic(fmt.Sprintf("config property is not a boolean: %s", name))
 	}
 	return valueBool
 }
 
-func GetProxyIp() net.IP {
-	var proxyIp net.IP
+// HasValue reports whether the property was set in the config file or has a
+// non-empty default.
+func HasValue(name string) bool {
+	load()
+	value, ok := configMap[name]
+	return ok && value != ""
+}
 
+// GetProxyIp returns proxy_ip, or else the public address found with
+// stun_server, or else the address of the interface with the default route.
+// A failed STUN query is logged to logger.
+func GetProxyIp(logger *log.Logger) (net.IP, error) {
 	load()
 	value, ok := configMap["proxy_ip"]
-    if ok {
-    	proxyIp = net.ParseIP(value).To4()
-        if proxyIp == nil {
-            log.Fatalln("Config property is not an IPv4 address: proxy_ip")
-        }
-    } else {
-        proxyIp = util.GetOutboundIp()
-    }
-    return proxyIp
+	if ok {
+		proxyIp := net.ParseIP(value).To4()
+		if proxyIp == nil {
+			return nil, fmt.Errorf("proxy_ip: not an IPv4 address")
+		}
+		return proxyIp, nil
+	}
+	if HasValue("stun_server") {
+		proxyIp, err := stun.Discover(configMap["stun_server"], stunTimeout)
+		if err == nil {
+			return proxyIp, nil
+		}
+		logger.Println("Public IP discovery failed, using outbound IP:", err)
+	}
+	return util.GetOutboundIp()
 }
 
-func load() {
+// GetValueList splits a comma separated property, dropping empty items.
+func GetValueList(name string) []string {
+	return splitList(GetValueString(name))
+}
+
+// GetBindAddresses returns the local addresses to listen on, or nil to listen
+// on all interfaces.
+func GetBindAddresses() ([]net.IP, error) {
+	var addresses []net.IP
+	for _, value := range splitList(GetValueString("bind_addresses")) {
+		ip := net.ParseIP(value).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("bind_addresses: not an IPv4 address: %s", value)
+		}
+		addresses = append(addresses, ip)
+	}
+	return addresses, nil
+}
+
+// GetAdvertiseRules parses advertise_rules, a comma separated list of
+// subnet=address entries. The first matching rule wins.
+func GetAdvertiseRules() ([]AdvertiseRule, error) {
+	var rules []AdvertiseRule
+	for _, value := range splitList(GetValueString("advertise_rules")) {
+		s := strings.SplitN(value, "=", 2)
+		if len(s) < 2 {
+			return nil, fmt.Errorf("advertise_rules: not subnet=address: %s", value)
+		}
+		_, subnet, err := net.ParseCIDR(strings.TrimSpace(s[0]))
+		ip := net.ParseIP(strings.TrimSpace(s[1])).To4()
+		if err != nil || ip == nil {
+			return nil, fmt.Errorf("advertise_rules: not subnet=address: %s", value)
+		}
+		rules = append(rules, AdvertiseRule{Subnet: subnet, Ip: ip})
+	}
+	return rules, nil
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// DiscoverPublicIp asks the configured STUN server for our public address.
+func DiscoverPublicIp() (net.IP, error) {
+	return stun.Discover(GetValueString("stun_server"), stunTimeout)
+}
+
+// Names returns the names of the settings.
+func Names() []string {
+	return append([]string(nil), valid...)
+}
+
+// UseFile reads the settings from name rather than Filename, which then must
+// exist. Must be called before any setting is read.
+func UseFile(name string) {
+	filename = name
+	filenameGiven = true
+}
+
+// Set overrides the setting, wherever else it is set. Must be called before
+// any setting is read.
+func Set(name string, value string) error {
+	if !util.ContainsString(valid, name) {
+		return fmt.Errorf("unknown config property: %s", name)
+	}
+	overrides[name] = value
+	return nil
+}
+
+// EnvName returns the environment variable that sets the setting.
+func EnvName(name string) string {
+	return kEnvPrefix + strings.ToUpper(name)
+}
+
+// Load reads the config file, secrets_file if it is set, the BOLORAMA_
+// environment variables and the settings given with Set, and checks them: it
+// fails on malformed lines, unknown properties and values of the wrong type.
+// The first read of a setting loads the
+// config if this has not been called, and panics if that fails, so call it
+// first to handle the error. Once loaded, the config does not change.
+func Load() error {
 	if configMap != nil {
-		return
+		return nil
 	}
 
 	configMap = make(map[string]string)
@@ -114,28 +468,114 @@ func load() {
 		configMap[key] = value
 	}
 
-	file, err := os.Open(configFilename)
-	if err != nil {
-		log.Fatalln("Failed to open config file:", configFilename)
+	if err := loadFile(); err != nil {
+		configMap = nil
+		return err
 	}
 
-	scanner := bufio.NewScanner(file)
-	scanner.Split(bufio.ScanLines)
+	var problems []string
+	for _, name := range valid {
+		if value, ok := os.LookupEnv(EnvName(name)); ok {
+			if err := checkValue(name, value); err != nil {
+				problems = append(problems, fmt.Sprintf("environment: %s: %s", EnvName(name), err))
+			}
+			configMap[name] = value
+		}
+	}
+	for name, value := range overrides {
+		if err := checkValue(name, value); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", name, err))
+		}
+		configMap[name] = value
+	}
+	if len(problems) > 0 {
+		configMap = nil
+		return fmt.Errorf("%s", strings.Join(problems, "\n"))
+	}
+	return nil
+}
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		if len(line) == 0 {
-			// skip blank lines
-			continue
+// CheckRequired returns an error if a setting the server needs is not set.
+func CheckRequired() error {
+	for _, name := range required {
+		if !HasValue(name) {
+			return fmt.Errorf("%s is not set", name)
 		}
-		s := strings.SplitN(line, "=", 2)
-		if len(s) < 2 {
-			log.Fatalln("Malformed config:", line)
+	}
+	return nil
+}
+
+func load() {
+	if err := Load(); err != nil {
+		panic(err)
+	}
+}
+
+// loadFile reads the config file, then secrets_file if set. It may be left
+// out when the settings come from the environment or command line, unless
+// named with UseFile.
+func loadFile() error {
+	name := filename
+	if !filenameGiven {
+		name = DefaultFilename()
+	}
+	if err := readSettings(name, !filenameGiven); err != nil {
+		return err
+	}
+
+	if secrets := secretsFilename(); secrets != "" {
+		if err := CheckPermissions(secrets); err != nil {
+			return fmt.Errorf("refusing to read secrets file: %s", err)
+		}
+		return readSettings(secrets, false)
+	}
+	return nil
+}
+
+// readSettings sets the properties in the file, failing on unknown
+// properties and bad values. A missing file is skipped if optional.
+func readSettings(name string, optional bool) error {
+	entries, problems, err := readFile(name)
+	if os.IsNotExist(err) && optional {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %s", err)
+	}
+
+	for _, e := range entries {
+		if !util.ContainsString(valid, e.name) {
+			problems = append(problems, fmt.Sprintf("%s:%d: unknown property %s", name, e.line, e.name))
+			continue
 		}
-		if util.ContainsString(valid, s[0]) {
-			configMap[s[0]] = s[1]
+		if err := checkValue(e.name, e.value); err != nil {
+			problems = append(problems, fmt.Sprintf("%s:%d: %s: %s", name, e.line, e.name, err))
+			continue
 		}
+		configMap[e.name] = e.value
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+// DefaultFilename returns TypedFilename if it exists, otherwise Filename.
+func DefaultFilename() string {
+	if _, err := os.Stat(TypedFilename); err == nil {
+		return TypedFilename
 	}
+	return Filename
+}
 
-	file.Close()
+// IgnoredFilename returns Filename if it exists but TypedFilename is read in
+// its place, so the server can say so, otherwise "".
+func IgnoredFilename() string {
+	if filenameGiven || DefaultFilename() != TypedFilename {
+		return ""
+	}
+	if _, err := os.Stat(Filename); err != nil {
+		return ""
+	}
+	return Filename
 }
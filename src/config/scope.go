@@ -0,0 +1,152 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"git.astrospark.com/bolorama/util"
+)
+
+// Besides the main tracker on tracker_port, a server can run the trackers
+// listed in trackers, each as name:port or name:port:file. Each has its own
+// port, players and games, and may override some properties in a file of
+// its own (scopedProperties); everything else is shared with the main
+// tracker. Their debug port is off unless their file sets one.
+
+// properties a tracker's file may set
+var scopedProperties = []string{
+	"dedup_by_default",
+	"dedup_window_ms",
+	"game_idle_timeout_minutes",
+	"game_info_ping_seconds",
+	"hostname",
+	"max_games",
+	"max_players_per_game",
+	"max_players_per_ip",
+	"max_players_per_subnet",
+	"player_timeout_rtt_multiplier",
+	"player_timeout_seconds",
+	"reconnect_grace_seconds",
+	"tracker_debug_port",
+	"winbolo_timeout_seconds",
+}
+
+// Scope is the config as one tracker sees it: the properties its file sets,
+// over the config of the server. The nil Scope is the main tracker's, which
+// sees the config unchanged.
+type Scope struct {
+	values map[string]string
+}
+
+// Tracker is one of the trackers set in trackers.
+type Tracker struct {
+	Name  string
+	Port  int
+	Scope *Scope
+}
+
+// parseTracker splits a trackers entry into its name, port and file, which
+// may be empty.
+func parseTracker(item string) (string, int, string, error) {
+	s := strings.SplitN(item, ":", 3)
+	if len(s) < 2 || s[0] == "" {
+		return "", 0, "", fmt.Errorf("not name:port or name:port:file: %s", item)
+	}
+	port, err := strconv.Atoi(s[1])
+	if err != nil || port <= 0 || port > 65535 {
+		return "", 0, "", fmt.Errorf("%s: not a port number: %s", s[0], s[1])
+	}
+	filename := ""
+	if len(s) == 3 {
+		filename = s[2]
+	}
+	return s[0], port, filename, nil
+}
+
+// GetTrackers returns the trackers set in trackers, with their files read.
+func GetTrackers() ([]Tracker, error) {
+	var trackers []Tracker
+	names := make(map[string]bool)
+	ports := map[int]bool{GetValueInt("tracker_port"): true}
+	for _, item := range GetValueList("trackers") {
+		name, port, filename, err := parseTracker(item)
+		if err != nil {
+			return nil, err
+		}
+		if names[name] {
+			return nil, fmt.Errorf("%s: named twice", name)
+		}
+		if ports[port] {
+			return nil, fmt.Errorf("%s: port %d is already a tracker's", name, port)
+		}
+		names[name] = true
+		ports[port] = true
+
+		scope := &Scope{values: map[string]string{"tracker_debug_port": "0"}}
+		if filename != "" {
+			if err := scope.readFile(filename); err != nil {
+				return nil, fmt.Errorf("%s: %s", name, err)
+			}
+		}
+		trackers = append(trackers, Tracker{Name: name, Port: port, Scope: scope})
+	}
+	return trackers, nil
+}
+
+// readFile sets the properties in a tracker's file, failing on any problem.
+func (scope *Scope) readFile(filename string) error {
+	entries, problems, err := readFile(filename)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !util.ContainsString(scopedProperties, e.name) {
+			problems = append(problems, fmt.Sprintf("%s:%d: %s cannot be set per tracker", filename, e.line, e.name))
+			continue
+		}
+		if err := checkValue(e.name, e.value); err != nil {
+			problems = append(problems, fmt.Sprintf("%s:%d: %s: %s", filename, e.line, e.name, err))
+			continue
+		}
+		scope.values[e.name] = e.value
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func (scope *Scope) GetValueString(name string) string {
+	if scope != nil {
+		if value, ok := scope.values[name]; ok {
+			return value
+		}
+	}
+	return GetValueString(name)
+}
+
+func (scope *Scope) GetValueInt(name string) int {
+	return intValue(name, scope.GetValueString(name))
+}
+
+func (scope *Scope) GetValueBool(name string) bool {
+	return boolValue(name, scope.GetValueString(name))
+}
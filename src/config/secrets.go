@@ -0,0 +1,76 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"runtime"
+)
+
+// Secrets such as webhook_secret can be kept out of the config file in two
+// ways. A value may name environment variables, as ${NAME}, which are
+// substituted when the file is read. Or they may be set in secrets_file, read
+// like the config file after it, which must not be readable by other users.
+
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv substitutes the environment variables named in value as ${NAME}.
+// Naming one that is not set is an error, so that a secret is not silently
+// left empty.
+func expandEnv(value string) (string, error) {
+	var err error
+	expanded := envReference.ReplaceAllStringFunc(value, func(reference string) string {
+		name := envReference.FindStringSubmatch(reference)[1]
+		variable, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable %s is not set", name)
+		}
+		return variable
+	})
+	return expanded, err
+}
+
+// secretsFilename returns secrets_file as set in the config file, the
+// environment or on the command line, or "" if it is not set.
+func secretsFilename() string {
+	if value, ok := overrides["secrets_file"]; ok {
+		return value
+	}
+	if value, ok := os.LookupEnv(EnvName("secrets_file")); ok {
+		return value
+	}
+	return configMap["secrets_file"]
+}
+
+// CheckPermissions returns an error if the file can be read or written by
+// users other than its owner. Windows permissions are not checked.
+func CheckPermissions(filename string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	if mode := info.Mode().Perm(); mode&0077 != 0 {
+		return fmt.Errorf("%s is accessible to other users (mode %04o); chmod 600 it", filename, mode)
+	}
+	return nil
+}
@@ -0,0 +1,254 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"git.astrospark.com/bolorama/util"
+)
+
+// Config files ending in .conf are read in the typed format: one
+// "name = value" per line, with strings quoted, integers and booleans bare and
+// lists as arrays of strings, e.g. bind_addresses = ["192.0.2.1", "198.51.100.1"].
+// There are no sections, and arrays must fit on one line. Other files are
+// read in the original format, "name=value" with nothing quoted and lists
+// comma separated.
+
+// TypedFilename is read in place of Filename when it exists.
+const TypedFilename = "config.conf"
+
+// properties taking comma separated lists, given as arrays in the typed format
+var listProperties = []string{
+	"acme_domains",
+	"advertise_rules",
+	"alert_rules",
+	"alert_webhook_urls",
+	"api_tokens",
+	"bind_addresses",
+	"client_versions",
+	"cors_origins",
+	"federation_peers",
+	"geoip_allow_countries",
+	"geoip_deny_countries",
+	"pinned_ports",
+	"trackers",
+	"webhook_urls",
+}
+
+type entry struct {
+	name  string
+	value string // as in the original format
+	line  int
+}
+
+var bareKey = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// readFile returns the settings in the config file, and a problem for each
+// line that could not be read.
+func readFile(name string) ([]entry, []string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	typed := strings.EqualFold(filepath.Ext(name), ".conf")
+	var entries []entry
+	var problems []string
+	scanner := bufio.NewScanner(file)
+	for number := 1; scanner.Scan(); number++ {
+		var e entry
+		var err error
+		if typed {
+			e, err = parseTypedLine(scanner.Text())
+		} else {
+			e, err = parseLine(scanner.Text())
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s:%d: %s", name, number, err))
+			continue
+		}
+		if e.name == "" {
+			continue
+		}
+		if e.value, err = expandEnv(e.value); err != nil {
+			problems = append(problems, fmt.Sprintf("%s:%d: %s: %s", name, number, e.name, err))
+			continue
+		}
+		e.line = number
+		entries = append(entries, e)
+	}
+	return entries, problems, scanner.Err()
+}
+
+// parseLine reads a line of the original format. Blank lines give an empty
+// entry.
+func parseLine(line string) (entry, error) {
+	if len(line) == 0 {
+		return entry{}, nil
+	}
+	s := strings.SplitN(line, "=", 2)
+	if len(s) < 2 {
+		return entry{}, fmt.Errorf("not name=value: %s", line)
+	}
+	return entry{name: s[0], value: s[1]}, nil
+}
+
+// parseTypedLine reads a line of the typed format. Blank lines and comments give an empty
+// entry.
+func parseTypedLine(line string) (entry, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return entry{}, nil
+	}
+	if strings.HasPrefix(line, "[") {
+		return entry{}, fmt.Errorf("sections are not supported")
+	}
+
+	s := strings.SplitN(line, "=", 2)
+	if len(s) < 2 {
+		return entry{}, fmt.Errorf("not name = value: %s", line)
+	}
+	name := strings.TrimSpace(s[0])
+	if unquoted, err := strconv.Unquote(name); err == nil {
+		name = unquoted
+	} else if !bareKey.MatchString(name) {
+		return entry{}, fmt.Errorf("malformed name: %s", name)
+	}
+
+	value, kind, rest, err := parseTypedValue(strings.TrimSpace(s[1]))
+	if err != nil {
+		return entry{}, fmt.Errorf("%s: %s", name, err)
+	}
+	rest = strings.TrimSpace(rest)
+	if rest != "" && !strings.HasPrefix(rest, "#") {
+		return entry{}, fmt.Errorf("%s: unexpected %s after the value", name, rest)
+	}
+
+	if want := propertyKind(name); want != "" && kind != want {
+		return entry{}, fmt.Errorf("%s: expected %s, got %s", name, want, kind)
+	}
+	return entry{name: name, value: value}, nil
+}
+
+const (
+	kindString  = "a string"
+	kindInteger = "an integer"
+	kindBoolean = "a boolean"
+	kindArray   = "an array of strings"
+)
+
+// propertyKind returns the kind of value a property takes, judged from
+// its default, or "" if it is unknown.
+func propertyKind(name string) string {
+	defaultValue, ok := defaults[name]
+	switch {
+	case util.ContainsString(listProperties, name):
+		return kindArray
+	case !ok && !util.ContainsString(valid, name):
+		return ""
+	}
+	if _, ok := mapBoolValue[defaultValue]; ok {
+		return kindBoolean
+	}
+	if _, err := strconv.Atoi(defaultValue); err == nil {
+		return kindInteger
+	}
+	return kindString
+}
+
+// parseTypedValue reads the value at the start of text, returning it as in
+// the original format, its kind and the rest of text.
+func parseTypedValue(text string) (string, string, string, error) {
+	switch {
+	case strings.HasPrefix(text, `"`), strings.HasPrefix(text, "'"):
+		value, rest, err := parseQuotedString(text)
+		return value, kindString, rest, err
+	case strings.HasPrefix(text, "["):
+		var items []string
+		text = strings.TrimSpace(text[1:])
+		for !strings.HasPrefix(text, "]") {
+			if text == "" || strings.HasPrefix(text, "#") {
+				return "", "", "", fmt.Errorf("arrays must end on the line they start")
+			}
+			item, rest, err := parseQuotedString(text)
+			if err != nil {
+				return "", "", "", fmt.Errorf("array items must be strings")
+			}
+			if strings.Contains(item, ",") {
+				return "", "", "", fmt.Errorf("array items cannot contain commas: %s", item)
+			}
+			items = append(items, item)
+			text = strings.TrimSpace(rest)
+			if strings.HasPrefix(text, ",") {
+				text = strings.TrimSpace(text[1:])
+			} else if !strings.HasPrefix(text, "]") {
+				return "", "", "", fmt.Errorf("expected , or ] in array")
+			}
+		}
+		return strings.Join(items, ","), kindArray, text[1:], nil
+	}
+
+	end := strings.IndexAny(text, " \t#")
+	if end < 0 {
+		end = len(text)
+	}
+	word, rest := text[:end], text[end:]
+	if word == "true" || word == "false" {
+		return word, kindBoolean, rest, nil
+	}
+	if value, err := strconv.ParseInt(strings.ReplaceAll(word, "_", ""), 10, 64); err == nil {
+		return strconv.FormatInt(value, 10), kindInteger, rest, nil
+	}
+	return "", "", "", fmt.Errorf("not a string, integer, boolean or array of strings: %s", word)
+}
+
+// parseQuotedString reads the basic ("...") or literal ('...') string at the
+// start of text.
+func parseQuotedString(text string) (string, string, error) {
+	if strings.HasPrefix(text, "'") {
+		end := strings.Index(text[1:], "'")
+		if end < 0 {
+			return "", "", fmt.Errorf("unterminated string")
+		}
+		return text[1 : end+1], text[end+2:], nil
+	}
+	if !strings.HasPrefix(text, `"`) {
+		return "", "", fmt.Errorf("not a string")
+	}
+	for i := 1; i < len(text); i++ {
+		switch text[i] {
+		case '\\':
+			i++
+		case '"':
+			value, err := strconv.Unquote(text[:i+1])
+			if err != nil {
+				return "", "", fmt.Errorf("malformed string: %s", text[:i+1])
+			}
+			return value, text[i+1:], nil
+		}
+	}
+	return "", "", fmt.Errorf("unterminated string")
+}
@@ -0,0 +1,97 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package data
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+func createAccountTable(db *sql.DB) error {
+	_, err := db.Exec(
+		"CREATE TABLE account (" +
+			"name TEXT PRIMARY KEY COLLATE NOCASE, " +
+			"token_hash TEXT NOT NULL UNIQUE, " +
+			"created_at TEXT NOT NULL" +
+			")",
+	)
+	if err != nil {
+		return fmt.Errorf("sqlite error: %s", err)
+	}
+	return nil
+}
+
+// InsertAccount reserves name for the holder of the token with tokenHash.
+// Returns false if the name is taken.
+func InsertAccount(db *sql.DB, name string, tokenHash string) (bool, error) {
+	result, err := db.Exec(
+		"INSERT INTO account (name, token_hash, created_at) "+
+			"VALUES ($1, $2, datetime('now')) "+
+			"ON CONFLICT DO NOTHING",
+		name,
+		tokenHash,
+	)
+	if err != nil {
+		return false, fmt.Errorf("sqlite error: %s", err)
+	}
+	rowCount, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("sqlite error: %s", err)
+	}
+	return rowCount == 1, nil
+}
+
+// DeleteAccount frees the name. Returns false if it was not registered.
+func DeleteAccount(db *sql.DB, name string) (bool, error) {
+	result, err := db.Exec("DELETE FROM account WHERE name = $1", name)
+	if err != nil {
+		return false, fmt.Errorf("sqlite error: %s", err)
+	}
+	rowCount, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("sqlite error: %s", err)
+	}
+	return rowCount == 1, nil
+}
+
+// SelectAccountTokenHash returns the token hash of the account with name,
+// compared case insensitively.
+func SelectAccountTokenHash(db *sql.DB, name string) (string, bool, error) {
+	var tokenHash string
+	err := db.QueryRow("SELECT token_hash FROM account WHERE name = $1", name).Scan(&tokenHash)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("sqlite error: %s", err)
+	}
+	return tokenHash, true, nil
+}
+
+// SelectAccountName returns the name registered with the token hash.
+func SelectAccountName(db *sql.DB, tokenHash string) (string, bool, error) {
+	var name string
+	err := db.QueryRow("SELECT name FROM account WHERE token_hash = $1", tokenHash).Scan(&name)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("sqlite error: %s", err)
+	}
+	return name, true, nil
+}
@@ -19,15 +19,14 @@ package data
 
 import (
 	"database/sql"
-	"log"
-	"runtime/debug"
+	"fmt"
 	"strings"
 
 	"git.astrospark.com/bolorama/config"
 	_ "github.com/mattn/go-sqlite3"
 )
 
-const kDataSchemaVersion = 1
+const kDataSchemaVersion = 5
 
 type DataGame struct {
 	GameId               string
@@ -36,31 +35,75 @@ type DataGame struct {
 	EndTimestamp         sql.NullString
 	MaxPlayerCount       int
 	ElapsedPlayerMinutes int
+	Tracker              string // the name of the tracker in trackers, "" for the main tracker
 }
 
-func Init() *sql.DB {
+// Init opens the database_filename database, creating it if needed, and
+// brings its schema up to date.
+func Init() (*sql.DB, error) {
 	db_filename := config.GetValueString("database_filename")
 	db, err := sql.Open("sqlite3", db_filename+"?Mode=rwc")
 	if err != nil {
-		debug.PrintStack()
-		log.Fatalf("failed to open/create database (%s): %s\n", db_filename, err)
+		return nil, fmt.Errorf("failed to open/create database (%s): %s", db_filename, err)
 	}
 
 	var count int
 	err = db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'config' and type = 'table'").Scan(&count)
+	if err == nil && count == 0 {
+		err = InitTables(db)
+	}
+	if err == nil {
+		err = migrate(db)
+	}
 	if err != nil {
-		debug.PrintStack()
-		log.Fatalln("sqlite error", err)
+		db.Close()
+		return nil, fmt.Errorf("database %s: %s", db_filename, err)
 	}
 
-	if count == 0 {
-		InitTables(db)
+	return db, nil
+}
+
+// migrate brings the schema from the version recorded in the config table up
+// to kDataSchemaVersion.
+func migrate(db *sql.DB) error {
+	var version int
+	err := db.QueryRow("SELECT value FROM config WHERE name = 'schema_version'").Scan(&version)
+	if err != nil {
+		return fmt.Errorf("sqlite error: %s", err)
+	}
+
+	if version < 2 {
+		if err := createPlayerStatsTable(db); err != nil {
+			return err
+		}
+	}
+	if version < 3 {
+		if err := createPlayerRatingTable(db); err != nil {
+			return err
+		}
+	}
+	if version < 4 {
+		if err := createAccountTable(db); err != nil {
+			return err
+		}
+	}
+	if version < 5 {
+		_, err = db.Exec("ALTER TABLE game ADD COLUMN tracker TEXT NOT NULL DEFAULT ''")
+		if err != nil {
+			return fmt.Errorf("sqlite error: %s", err)
+		}
 	}
 
-	return db
+	if version < kDataSchemaVersion {
+		_, err = db.Exec("UPDATE config SET value = $1 WHERE name = 'schema_version'", kDataSchemaVersion)
+		if err != nil {
+			return fmt.Errorf("sqlite error: %s", err)
+		}
+	}
+	return nil
 }
 
-func InitTables(db *sql.DB) {
+func InitTables(db *sql.DB) error {
 	_, err := db.Exec(
 		"CREATE TABLE game (" +
 			"id TEXT PRIMARY KEY, " +
@@ -72,8 +115,7 @@ func InitTables(db *sql.DB) {
 			")",
 	)
 	if err != nil {
-		debug.PrintStack()
-		log.Fatalln("sqlite error", err)
+		return fmt.Errorf("sqlite error: %s", err)
 	}
 
 	_, err = db.Exec(
@@ -85,35 +127,33 @@ func InitTables(db *sql.DB) {
 			")",
 	)
 	if err != nil {
-		debug.PrintStack()
-		log.Fatalln("sqlite error", err)
+		return fmt.Errorf("sqlite error: %s", err)
 	}
 
 	_, err = db.Exec("CREATE TABLE config (name TEXT PRIMARY KEY, value TEXT)")
 	if err != nil {
-		debug.PrintStack()
-		log.Fatalln("sqlite error", err)
+		return fmt.Errorf("sqlite error: %s", err)
 	}
 
 	statement, err := db.Prepare("INSERT INTO config (name, value) VALUES ($1, $2)")
 	if err != nil {
-		debug.PrintStack()
-		log.Fatalln("sqlite error", err)
+		return fmt.Errorf("sqlite error: %s", err)
 	}
 	defer statement.Close()
 
-	_, err = statement.Exec("schema_version", kDataSchemaVersion)
+	// the tables of schema version 1; migrate adds the rest
+	_, err = statement.Exec("schema_version", 1)
 	if err != nil {
-		debug.PrintStack()
-		log.Fatalln("sqlite error", err)
+		return fmt.Errorf("sqlite error: %s", err)
 	}
+	return nil
 }
 
-func SelectGames(db *sql.DB, gameIds []string) []DataGame {
+func SelectGames(db *sql.DB, gameIds []string) ([]DataGame, error) {
 	var games []DataGame
 
 	if len(gameIds) == 0 {
-		return games
+		return games, nil
 	}
 
 	args := make([]interface{}, len(gameIds))
@@ -134,9 +174,7 @@ func SelectGames(db *sql.DB, gameIds []string) []DataGame {
 
 	rows, err := db.Query(sql, args...)
 	if err != nil {
-		debug.PrintStack()
-		log.Println("sqlite error", err)
-		return games
+		return games, fmt.Errorf("sqlite error: %s", err)
 	}
 	defer rows.Close()
 
@@ -151,51 +189,45 @@ func SelectGames(db *sql.DB, gameIds []string) []DataGame {
 			&game.ElapsedPlayerMinutes,
 		)
 		if err != nil {
-			debug.PrintStack()
-			log.Println("sqlite error", err)
-			return games
+			return games, fmt.Errorf("sqlite error: %s", err)
 		}
 		games = append(games, game)
 	}
 
 	err = rows.Err()
 	if err != nil {
-		debug.PrintStack()
-		log.Println("sqlite error", err)
+		return games, fmt.Errorf("sqlite error: %s", err)
 	}
 
-	return games
+	return games, nil
 }
 
-func InsertGame(db *sql.DB, game DataGame) {
+func InsertGame(db *sql.DB, game DataGame) error {
 	result, err := db.Exec(
 		"INSERT INTO game "+
-			"(id, map_name, started_at, max_player_count, elapsed_player_minutes) "+
-			"VALUES ($1, $2, datetime($3, 'unixepoch'), $4, $5)",
+			"(id, map_name, started_at, max_player_count, elapsed_player_minutes, tracker) "+
+			"VALUES ($1, $2, datetime($3, 'unixepoch'), $4, $5, $6)",
 		game.GameId,
 		game.MapName,
 		game.StartTimestamp,
 		game.MaxPlayerCount,
 		game.ElapsedPlayerMinutes,
+		game.Tracker,
 	)
 	if err != nil {
-		debug.PrintStack()
-		log.Println("sqlite error", err)
-		return
+		return fmt.Errorf("sqlite error: %s", err)
 	}
 	rowCount, err := result.RowsAffected()
 	if err != nil {
-		debug.PrintStack()
-		log.Println("sqlite error", err)
-		return
+		return fmt.Errorf("sqlite error: %s", err)
 	}
 	if rowCount != 1 {
-		debug.PrintStack()
-		log.Println("sql insert game failed")
+		return fmt.Errorf("sql insert game: %d rows changed", rowCount)
 	}
+	return nil
 }
 
-func UpdateGame(db *sql.DB, game DataGame) {
+func UpdateGame(db *sql.DB, game DataGame) error {
 	result, err := db.Exec(
 		"UPDATE game "+
 			"SET "+
@@ -207,23 +239,19 @@ func UpdateGame(db *sql.DB, game DataGame) {
 		game.GameId,
 	)
 	if err != nil {
-		debug.PrintStack()
-		log.Println("sqlite error", err)
-		return
+		return fmt.Errorf("sqlite error: %s", err)
 	}
 	rowCount, err := result.RowsAffected()
 	if err != nil {
-		debug.PrintStack()
-		log.Println("sqlite error", err)
-		return
+		return fmt.Errorf("sqlite error: %s", err)
 	}
 	if rowCount != 1 {
-		debug.PrintStack()
-		log.Println("sql update game failed")
+		return fmt.Errorf("sql update game: %d rows changed", rowCount)
 	}
+	return nil
 }
 
-func EndGame(db *sql.DB, gameId string) {
+func EndGame(db *sql.DB, gameId string) error {
 	result, err := db.Exec(
 		"UPDATE game "+
 			"SET "+
@@ -232,23 +260,19 @@ func EndGame(db *sql.DB, gameId string) {
 		gameId,
 	)
 	if err != nil {
-		debug.PrintStack()
-		log.Println("sqlite error", err)
-		return
+		return fmt.Errorf("sqlite error: %s", err)
 	}
 	rowCount, err := result.RowsAffected()
 	if err != nil {
-		debug.PrintStack()
-		log.Println("sqlite error", err)
-		return
+		return fmt.Errorf("sqlite error: %s", err)
 	}
 	if rowCount != 1 {
-		debug.PrintStack()
-		log.Println("sql update game failed")
+		return fmt.Errorf("sql update game: %d rows changed", rowCount)
 	}
+	return nil
 }
 
-func InsertPlayerSession(db *sql.DB, playerId string) {
+func InsertPlayerSession(db *sql.DB, playerId string) error {
 	result, err := db.Exec(
 		"INSERT INTO player_session "+
 			"(player_id, joined_at) "+
@@ -256,23 +280,19 @@ func InsertPlayerSession(db *sql.DB, playerId string) {
 		playerId,
 	)
 	if err != nil {
-		debug.PrintStack()
-		log.Println("sqlite error", err)
-		return
+		return fmt.Errorf("sqlite error: %s", err)
 	}
 	rowCount, err := result.RowsAffected()
 	if err != nil {
-		debug.PrintStack()
-		log.Println("sqlite error", err)
-		return
+		return fmt.Errorf("sqlite error: %s", err)
 	}
 	if rowCount != 1 {
-		debug.PrintStack()
-		log.Println("sql insert player session failed")
+		return fmt.Errorf("sql insert player session: %d rows changed", rowCount)
 	}
+	return nil
 }
 
-func EndPlayerSession(db *sql.DB, playerId string) {
+func EndPlayerSession(db *sql.DB, playerId string) error {
 	sql := "UPDATE player_session " +
 		"SET " +
 		"left_at = datetime('now') " +
@@ -281,18 +301,14 @@ func EndPlayerSession(db *sql.DB, playerId string) {
 
 	result, err := db.Exec(sql, playerId)
 	if err != nil {
-		debug.PrintStack()
-		log.Println("sqlite error", err)
-		return
+		return fmt.Errorf("sqlite error: %s", err)
 	}
 	rowCount, err := result.RowsAffected()
 	if err != nil {
-		debug.PrintStack()
-		log.Println("sqlite error", err)
-		return
+		return fmt.Errorf("sqlite error: %s", err)
 	}
 	if rowCount != 1 {
-		debug.PrintStack()
-		log.Println("sql end player session failed")
+		return fmt.Errorf("sql end player session: %d rows changed", rowCount)
 	}
+	return nil
 }
@@ -0,0 +1,232 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package data
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// DataPlayerStats is the lifetime totals of the players using one name.
+// Players are only known by the name they choose, so anyone using the same
+// name shares a row.
+type DataPlayerStats struct {
+	Name        string
+	Sessions    int
+	PlaySeconds int
+	GamesHosted int
+	LastSeen    string
+}
+
+func createPlayerStatsTable(db *sql.DB) error {
+	_, err := db.Exec(
+		"CREATE TABLE player_stats (" +
+			"name TEXT PRIMARY KEY, " +
+			"sessions INTEGER NOT NULL, " +
+			"play_seconds INTEGER NOT NULL, " +
+			"games_hosted INTEGER NOT NULL, " +
+			"last_seen TEXT NOT NULL" +
+			")",
+	)
+	if err != nil {
+		return fmt.Errorf("sqlite error: %s", err)
+	}
+	return nil
+}
+
+// AddPlayerSession adds one finished session to the player's totals.
+func AddPlayerSession(db *sql.DB, name string, playSeconds int, hosted bool) error {
+	gamesHosted := 0
+	if hosted {
+		gamesHosted = 1
+	}
+
+	_, err := db.Exec(
+		"INSERT INTO player_stats "+
+			"(name, sessions, play_seconds, games_hosted, last_seen) "+
+			"VALUES ($1, 1, $2, $3, datetime('now')) "+
+			"ON CONFLICT (name) DO UPDATE SET "+
+			"sessions = sessions + 1, "+
+			"play_seconds = play_seconds + excluded.play_seconds, "+
+			"games_hosted = games_hosted + excluded.games_hosted, "+
+			"last_seen = excluded.last_seen",
+		name,
+		playSeconds,
+		gamesHosted,
+	)
+	if err != nil {
+		return fmt.Errorf("sqlite error: %s", err)
+	}
+	return nil
+}
+
+// SelectLeaderboard returns the players with the most play time.
+func SelectLeaderboard(db *sql.DB, limit int) ([]DataPlayerStats, error) {
+	var players []DataPlayerStats
+
+	rows, err := db.Query(
+		"SELECT name, sessions, play_seconds, games_hosted, last_seen "+
+			"FROM player_stats "+
+			"ORDER BY play_seconds DESC "+
+			"LIMIT $1",
+		limit,
+	)
+	if err != nil {
+		return players, fmt.Errorf("sqlite error: %s", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var player DataPlayerStats
+		err = rows.Scan(
+			&player.Name,
+			&player.Sessions,
+			&player.PlaySeconds,
+			&player.GamesHosted,
+			&player.LastSeen,
+		)
+		if err != nil {
+			return players, fmt.Errorf("sqlite error: %s", err)
+		}
+		players = append(players, player)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return players, fmt.Errorf("sqlite error: %s", err)
+	}
+
+	return players, nil
+}
+
+// DataPlayerRating is the rating of the player using one name, from the
+// results reported for them.
+type DataPlayerRating struct {
+	Name   string
+	Rating float64
+	Games  int
+}
+
+func createPlayerRatingTable(db *sql.DB) error {
+	_, err := db.Exec(
+		"CREATE TABLE player_rating (" +
+			"name TEXT PRIMARY KEY, " +
+			"rating REAL NOT NULL, " +
+			"games INTEGER NOT NULL" +
+			")",
+	)
+	if err != nil {
+		return fmt.Errorf("sqlite error: %s", err)
+	}
+	return nil
+}
+
+// SelectRating returns the player's rating, or ok false if they have none.
+func SelectRating(db *sql.DB, name string) (DataPlayerRating, bool, error) {
+	player := DataPlayerRating{Name: name}
+	err := db.QueryRow("SELECT rating, games FROM player_rating WHERE name = $1", name).Scan(&player.Rating, &player.Games)
+	if err == sql.ErrNoRows {
+		return player, false, nil
+	}
+	if err != nil {
+		return player, false, fmt.Errorf("sqlite error: %s", err)
+	}
+	return player, true, nil
+}
+
+// UpdateRatings stores the ratings of both players of a result at once.
+func UpdateRatings(db *sql.DB, players ...DataPlayerRating) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("sqlite error: %s", err)
+	}
+
+	for _, player := range players {
+		_, err = tx.Exec(
+			"INSERT INTO player_rating (name, rating, games) VALUES ($1, $2, $3) "+
+				"ON CONFLICT (name) DO UPDATE SET rating = excluded.rating, games = excluded.games",
+			player.Name,
+			player.Rating,
+			player.Games,
+		)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("sqlite error: %s", err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("sqlite error: %s", err)
+	}
+	return nil
+}
+
+// SelectRatings returns all rated players, best first.
+func SelectRatings(db *sql.DB) ([]DataPlayerRating, error) {
+	var players []DataPlayerRating
+
+	rows, err := db.Query("SELECT name, rating, games FROM player_rating ORDER BY rating DESC")
+	if err != nil {
+		return players, fmt.Errorf("sqlite error: %s", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var player DataPlayerRating
+		err = rows.Scan(&player.Name, &player.Rating, &player.Games)
+		if err != nil {
+			return players, fmt.Errorf("sqlite error: %s", err)
+		}
+		players = append(players, player)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return players, fmt.Errorf("sqlite error: %s", err)
+	}
+
+	return players, nil
+}
+
+// DeletePlayer erases everything stored about the players using name: their
+// statistics, rating and account. Returns false if there was nothing.
+func DeletePlayer(db *sql.DB, name string) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("sqlite error: %s", err)
+	}
+
+	var rowCount int64
+	for _, table := range []string{"player_stats", "player_rating", "account"} {
+		result, err := tx.Exec("DELETE FROM "+table+" WHERE name = $1", name)
+		if err == nil {
+			var count int64
+			count, err = result.RowsAffected()
+			rowCount += count
+		}
+		if err != nil {
+			tx.Rollback()
+			return false, fmt.Errorf("sqlite error: %s", err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return false, fmt.Errorf("sqlite error: %s", err)
+	}
+	return rowCount > 0, nil
+}
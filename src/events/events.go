@@ -0,0 +1,239 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package events
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.astrospark.com/bolorama/bolo"
+	"git.astrospark.com/bolorama/util"
+)
+
+type Type int
+
+const (
+	PlayerJoined Type = iota
+	PlayerLeft
+	GameStarted
+	GameEnded
+	NameChanged
+	PlayerMigrated
+	PlayerRefused
+	ChatMessage
+	GameScheduled
+	PlayerLogin
+	NameCollision
+	ServerRestart
+	ServerBroadcast
+	Moderation
+	Alert
+)
+
+var typeName = map[Type]string{
+	PlayerJoined:    "PlayerJoined",
+	PlayerLeft:      "PlayerLeft",
+	GameStarted:     "GameStarted",
+	GameEnded:       "GameEnded",
+	NameChanged:     "NameChanged",
+	PlayerMigrated:  "PlayerMigrated",
+	PlayerRefused:   "PlayerRefused",
+	ChatMessage:     "ChatMessage",
+	GameScheduled:   "GameScheduled",
+	PlayerLogin:     "PlayerLogin",
+	NameCollision:   "NameCollision",
+	ServerRestart:   "ServerRestart",
+	ServerBroadcast: "ServerBroadcast",
+	Moderation:      "Moderation",
+	Alert:           "Alert",
+}
+
+func (t Type) String() string {
+	return typeName[t]
+}
+
+// Event describes something that happened to a player or game. Which fields
+// are meaningful depends on Type: player events carry PlayerAddr, game events
+// carry GameId, and NameChanged carries both plus PlayerId and Name.
+// PlayerMigrated carries the player's old address in PreviousAddr.
+// PlayerRefused carries the address (with no proxy port), the game the player
+// tried to join and the Reason. PlayerLeft has Reason "timeout" if the player
+// stopped answering pings, "kicked", "orphaned" if the consistency checker
+// removed them, "stuck" if the watchdog dropped their route, "crashed" if
+// handling their packets panicked, or "probe" for the self-probe's player. ChatMessage carries the sender like
+// NameChanged does, and the Text. GameScheduled carries the map in Name and an
+// announcement in Text. PlayerLogin carries the player like ChatMessage, with
+// the hash of the account token they sent in Text. NameCollision carries the
+// player like NameChanged, with the name given to them in Name and the one
+// they claimed, already in use in the game, in Text. ServerRestart carries an
+// announcement of a scheduled restart in Text, and ServerBroadcast the
+// operator's message to players. Moderation is an audited admin console
+// command: who ran it in Name, the command in Text, and the reason given.
+// Alert is raised by a monitor that found the server broken: the monitor in
+// Name, what is wrong in Text, and Reason "firing", or "resolved" once it
+// works again.
+type Event struct {
+	Type         Type
+	Timestamp    time.Time
+	PlayerAddr   util.PlayerAddr
+	PreviousAddr util.PlayerAddr
+	GameId       bolo.GameId
+	PlayerId     int
+	Name         string
+	Reason       string
+	Text         string
+}
+
+// Bus fans events out to any number of subscribers. Publish never blocks on a
+// slow subscriber; each subscription has its own queue of up to MaxBacklog
+// events, and events arriving while it is full are dropped and counted (see
+// Dropped). A queue growing past kSlowSubscriberBacklog is logged, again each
+// time it doubles, and once more when the subscriber has caught up.
+type Bus struct {
+	mutex         sync.RWMutex
+	subscriptions []*subscription
+	logger        *log.Logger
+}
+
+const kSlowSubscriberBacklog = 1000
+
+// MaxBacklog is the most events queued for a subscriber.
+const MaxBacklog = 64 * kSlowSubscriberBacklog
+
+type subscription struct {
+	// accessed atomically; kept first for alignment
+	backlog int64 // events queued
+	dropped int64 // events dropped as the queue was full
+
+	name string
+	ctx  context.Context
+	in   chan Event
+}
+
+// NewBus returns a bus that logs slow subscribers to logger.
+func NewBus(logger *log.Logger) *Bus {
+	return &Bus{logger: logger}
+}
+
+// Subscribe returns a channel that receives every event published after the
+// call. When ctx is done, events already queued are delivered and then the
+// channel is closed, so a subscriber can range over it until the end. The
+// name identifies the subscriber in Backlogs and the log.
+func (bus *Bus) Subscribe(ctx context.Context, name string) <-chan Event {
+	sub := &subscription{name: name, ctx: ctx, in: make(chan Event)}
+	out := make(chan Event)
+
+	bus.mutex.Lock()
+	bus.subscriptions = append(bus.subscriptions, sub)
+	bus.mutex.Unlock()
+
+	go pump(sub, out, bus.logger)
+
+	return out
+}
+
+func (bus *Bus) Publish(event Event) {
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+
+	bus.mutex.RLock()
+	defer bus.mutex.RUnlock()
+
+	for _, sub := range bus.subscriptions {
+		select {
+		case sub.in <- event:
+		case <-sub.ctx.Done():
+		}
+	}
+}
+
+// Backlogs returns how many events are queued for each subscriber, by name.
+// Subscribers sharing a name are added up.
+func (bus *Bus) Backlogs() map[string]int {
+	bus.mutex.RLock()
+	defer bus.mutex.RUnlock()
+
+	backlogs := make(map[string]int)
+	for _, sub := range bus.subscriptions {
+		backlogs[sub.name] += int(atomic.LoadInt64(&sub.backlog))
+	}
+	return backlogs
+}
+
+// Dropped returns how many events have been dropped for each subscriber, by
+// name, because its queue was full.
+func (bus *Bus) Dropped() map[string]int {
+	bus.mutex.RLock()
+	defer bus.mutex.RUnlock()
+
+	dropped := make(map[string]int)
+	for _, sub := range bus.subscriptions {
+		dropped[sub.name] += int(atomic.LoadInt64(&sub.dropped))
+	}
+	return dropped
+}
+
+func pump(sub *subscription, out chan Event, logger *log.Logger) {
+	var queue []Event
+	warnAt := kSlowSubscriberBacklog
+	dropping := false
+
+	for {
+		var sendChannel chan Event
+		var next Event
+		if len(queue) > 0 {
+			sendChannel = out
+			next = queue[0]
+		}
+
+		select {
+		case event := <-sub.in:
+			if len(queue) >= MaxBacklog {
+				atomic.AddInt64(&sub.dropped, 1)
+				if !dropping {
+					logger.Printf("Events: dropping events for %s, %d are waiting\n", sub.name, len(queue))
+					dropping = true
+				}
+				continue
+			}
+			queue = append(queue, event)
+			if len(queue) >= warnAt {
+				logger.Printf("Events: %d waiting for %s, which is not keeping up\n", len(queue), sub.name)
+				warnAt *= 2
+			}
+		case sendChannel <- next:
+			queue = queue[1:]
+			if len(queue) == 0 && warnAt > kSlowSubscriberBacklog {
+				logger.Printf("Events: %s has caught up\n", sub.name)
+				warnAt = kSlowSubscriberBacklog
+				dropping = false
+			}
+		case <-sub.ctx.Done():
+			for _, event := range queue {
+				out <- event
+			}
+			close(out)
+			return
+		}
+		atomic.StoreInt64(&sub.backlog, int64(len(queue)))
+	}
+}
@@ -0,0 +1,48 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package events
+
+import (
+	"context"
+	"io"
+	"log"
+	"testing"
+	"time"
+)
+
+func TestFullQueueDropsEvents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bus := NewBus(log.New(io.Discard, "", 0))
+	bus.Subscribe(ctx, "stuck")
+
+	for i := 0; i < MaxBacklog+5; i++ {
+		bus.Publish(Event{Type: ChatMessage})
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for bus.Dropped()["stuck"] < 5 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if dropped := bus.Dropped()["stuck"]; dropped != 5 {
+		t.Fatalf("dropped %d events, want 5", dropped)
+	}
+	if backlog := bus.Backlogs()["stuck"]; backlog != MaxBacklog {
+		t.Fatalf("backlog is %d, want %d", backlog, MaxBacklog)
+	}
+}
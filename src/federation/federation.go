@@ -0,0 +1,242 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package federation
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"git.astrospark.com/bolorama/bolo"
+	"git.astrospark.com/bolorama/config"
+	"git.astrospark.com/bolorama/state"
+	"git.astrospark.com/bolorama/tracker"
+)
+
+// Bolorama servers peer by fetching each other's game listing over HTTP. A
+// listing is signed with the publishing server's Ed25519 key and is only
+// good for its TTL, so a peer that goes away drops out of the listing, and
+// a listing cannot be altered or replayed later by whoever relays it.
+//
+//	GET /api/federation/games
+//	{"listing": "<base64 JSON Listing>", "signature": "<base64 Ed25519 signature of the listing bytes>"}
+
+const ListingPath = "/api/federation/games"
+
+// Envelope carries a listing with its signature. The listing is kept as
+// encoded bytes so the signature can be checked before parsing.
+type Envelope struct {
+	Listing   string `json:"listing"`
+	Signature string `json:"signature"`
+}
+
+// Listing is the games running on one server. Only games hosted locally are
+// listed, never those learned from other peers, so listings cannot loop.
+type Listing struct {
+	Server     string `json:"server"`
+	Issued     int64  `json:"issued"` // unix seconds
+	TtlSeconds int    `json:"ttl_seconds"`
+	Games      []Game `json:"games"`
+}
+
+type Game struct {
+	GameId       string   `json:"game_id"`
+	Host         string   `json:"host"`
+	Port         int      `json:"port"`
+	MapName      string   `json:"map_name"`
+	Version      string   `json:"version"` // 3 bytes, hex, as in the packet header
+	GameType     int      `json:"game_type"`
+	HiddenMines  bool     `json:"hidden_mines"`
+	Bots         bool     `json:"bots"`
+	Password     bool     `json:"password"`
+	PlayerCount  int      `json:"player_count"`
+	NeutralPills int      `json:"neutral_pills"`
+	NeutralBases int      `json:"neutral_bases"`
+	Players      []string `json:"players"`
+	Title        string   `json:"title,omitempty"`
+	Started      int64    `json:"started"` // unix seconds
+}
+
+var privateKey ed25519.PrivateKey
+var privateKeyOnce sync.Once
+
+// PrivateKey loads the server's key from federation_key_file, creating the
+// file with a new key if it does not exist, and logs any problem to logger.
+func PrivateKey(logger *log.Logger) ed25519.PrivateKey {
+	privateKeyOnce.Do(func() {
+		filename := config.GetValueString("federation_key_file")
+		seed, err := ioutil.ReadFile(filename)
+		if os.IsNotExist(err) {
+			_, key, err := ed25519.GenerateKey(rand.Reader)
+			if err != nil {
+				logger.Println(err)
+				return
+			}
+			seed = []byte(hex.EncodeToString(key.Seed()))
+			if err := ioutil.WriteFile(filename, seed, 0600); err != nil {
+				logger.Println(err)
+				return
+			}
+			logger.Println("Created federation key", filename)
+		} else if err != nil {
+			logger.Println(err)
+			return
+		} else if err := config.CheckPermissions(filename); err != nil {
+			logger.Println(err)
+		}
+
+		seedBytes, err := hex.DecodeString(strings.TrimSpace(string(seed)))
+		if err != nil || len(seedBytes) != ed25519.SeedSize {
+			logger.Println("Malformed federation key file:", filename)
+			return
+		}
+		privateKey = ed25519.NewKeyFromSeed(seedBytes)
+	})
+	return privateKey
+}
+
+// PublicKey returns the key peers need to verify our listing, base64 encoded
+// as it is given in their federation_peers.
+func PublicKey(logger *log.Logger) string {
+	key := PrivateKey(logger)
+	if key == nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+}
+
+// HandleListing serves our signed listing to peers.
+func HandleListing(context *state.ServerContext) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := PrivateKey(context.Logger)
+		if key == nil {
+			http.Error(w, "no federation key", http.StatusInternalServerError)
+			return
+		}
+
+		listing := localListing(context)
+		listingBytes, err := json.Marshal(listing)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		envelope := Envelope{
+			Listing:   base64.StdEncoding.EncodeToString(listingBytes),
+			Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(key, listingBytes)),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(envelope)
+	}
+}
+
+func localListing(context *state.ServerContext) Listing {
+	hostname := config.GetValueString("hostname")
+
+	var listed []tracker.ListedGame
+	state.Do(context, func(s *state.State) {
+		listed = tracker.ListLocalGames(s, hostname)
+	})
+
+	listing := Listing{
+		Server:     hostname,
+		Issued:     time.Now().Unix(),
+		TtlSeconds: config.GetValueInt("federation_ttl_seconds"),
+		Games:      make([]Game, 0, len(listed)),
+	}
+	for _, game := range listed {
+		info := game.Info
+		listing.Games = append(listing.Games, Game{
+			GameId:       hex.EncodeToString(info.GameId[:]),
+			Host:         game.Host,
+			Port:         game.Port,
+			MapName:      info.MapName,
+			Version:      hex.EncodeToString(info.Version[:]),
+			GameType:     info.GameType,
+			HiddenMines:  info.AllowHiddenMines,
+			Bots:         info.AllowComputer,
+			Password:     info.HasPassword,
+			PlayerCount:  int(info.PlayerCount),
+			NeutralPills: int(info.NeutralPillboxCount),
+			NeutralBases: int(info.NeutralBaseCount),
+			Players:      game.Players,
+			Title:        game.Title,
+			Started:      info.ServerStartTimestamp.Unix(),
+		})
+	}
+	return listing
+}
+
+// openEnvelope checks the signature and decodes the listing.
+func openEnvelope(envelope Envelope, publicKey ed25519.PublicKey) (Listing, error) {
+	var listing Listing
+
+	listingBytes, err := base64.StdEncoding.DecodeString(envelope.Listing)
+	if err != nil {
+		return listing, err
+	}
+	signature, err := base64.StdEncoding.DecodeString(envelope.Signature)
+	if err != nil {
+		return listing, err
+	}
+	if !ed25519.Verify(publicKey, listingBytes, signature) {
+		return listing, errors.New("bad signature")
+	}
+
+	err = json.Unmarshal(listingBytes, &listing)
+	return listing, err
+}
+
+// remoteGame converts a listed game back to what the tracker shows.
+func remoteGame(game Game, expires time.Time) (state.RemoteGame, error) {
+	var info bolo.GameInfo
+
+	gameId, err := hex.DecodeString(game.GameId)
+	if err != nil || len(gameId) != len(info.GameId) {
+		return state.RemoteGame{}, fmt.Errorf("malformed game id %s", game.GameId)
+	}
+	version, err := hex.DecodeString(game.Version)
+	if err != nil || len(version) != len(info.Version) {
+		return state.RemoteGame{}, fmt.Errorf("malformed version %s", game.Version)
+	}
+
+	copy(info.GameId[:], gameId)
+	copy(info.Version[:], version)
+	info.MapName = game.MapName
+	info.GameType = game.GameType
+	info.AllowHiddenMines = game.HiddenMines
+	info.AllowComputer = game.Bots
+	info.HasPassword = game.Password
+	info.PlayerCount = uint16(game.PlayerCount)
+	info.NeutralPillboxCount = uint16(game.NeutralPills)
+	info.NeutralBaseCount = uint16(game.NeutralBases)
+	info.ServerStartTimestamp = time.Unix(game.Started, 0)
+
+	return state.RemoteGame{Info: info, Host: game.Host, Port: game.Port, Players: game.Players, Title: game.Title, Expires: expires}, nil
+}
@@ -0,0 +1,143 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package federation
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"git.astrospark.com/bolorama/config"
+	"git.astrospark.com/bolorama/state"
+)
+
+const kFetchTimeout = 10 * time.Second
+
+// the longest TTL accepted from a peer, so a bad clock cannot pin a game
+const kMaxTtl = time.Hour
+
+// Peer is a server in federation_peers.
+type Peer struct {
+	url       string
+	publicKey ed25519.PublicKey
+}
+
+// Peers polls peers for their listings and keeps s.RemoteGames up to date.
+// Does nothing if there are none.
+func Peers(context *state.ServerContext, peers []Peer) {
+	defer context.Network.WaitGroup.Done()
+
+	if len(peers) == 0 {
+		return
+	}
+
+	client := &http.Client{Timeout: kFetchTimeout}
+	interval := time.Duration(config.GetValueInt("federation_poll_seconds")) * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for _, p := range peers {
+			fetch(context, client, p)
+		}
+
+		select {
+		case <-context.Network.Ctx.Done():
+			context.Logger.Println("Stopped federation")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ParsePeers parses federation_peers, a comma separated list of url=key
+// entries, where key is the peer's base64 public key.
+func ParsePeers() ([]Peer, error) {
+	var peers []Peer
+	for _, value := range config.GetValueList("federation_peers") {
+		s := strings.SplitN(value, "=", 2)
+		if len(s) < 2 {
+			return nil, fmt.Errorf("malformed federation_peers entry: %s", value)
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s[1]))
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("malformed federation_peers key: %s", value)
+		}
+		peers = append(peers, Peer{url: strings.TrimSpace(s[0]), publicKey: key})
+	}
+	return peers, nil
+}
+
+func fetch(context *state.ServerContext, client *http.Client, p Peer) {
+	request, err := http.NewRequestWithContext(context.Network.Ctx, "GET", p.url, nil)
+	if err != nil {
+		context.Logger.Println(err)
+		return
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		context.Logger.Println("Federation peer:", err)
+		return
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		context.Logger.Printf("Federation peer %s: %s\n", p.url, response.Status)
+		return
+	}
+
+	var envelope Envelope
+	if err := json.NewDecoder(response.Body).Decode(&envelope); err != nil {
+		context.Logger.Printf("Federation peer %s: %s\n", p.url, err)
+		return
+	}
+	listing, err := openEnvelope(envelope, p.publicKey)
+	if err != nil {
+		context.Logger.Printf("Federation peer %s: %s\n", p.url, err)
+		return
+	}
+
+	ttl := time.Duration(listing.TtlSeconds) * time.Second
+	if ttl > kMaxTtl {
+		ttl = kMaxTtl
+	}
+	expires := time.Unix(listing.Issued, 0).Add(ttl)
+	if time.Now().After(expires) {
+		context.Logger.Printf("Federation peer %s: listing has expired\n", p.url)
+		return
+	}
+
+	var games []state.RemoteGame
+	for _, game := range listing.Games {
+		remote, err := remoteGame(game, expires)
+		if err != nil {
+			context.Logger.Printf("Federation peer %s: %s\n", p.url, err)
+			continue
+		}
+		games = append(games, remote)
+	}
+
+	state.Do(context, func(s *state.State) {
+		s.RemoteGames[p.url] = games
+	})
+}
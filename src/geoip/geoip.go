@@ -0,0 +1,109 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package geoip
+
+import (
+	"log"
+	"net"
+	"sync"
+
+	"git.astrospark.com/bolorama/config"
+)
+
+// Location is where an address is, as far as the GeoIP database knows. Codes
+// are empty when unknown.
+type Location struct {
+	Continent string // two letter code, e.g. "EU"
+	Country   string // ISO 3166-1 alpha-2 code, e.g. "DE"
+	Region    string // name of the first subdivision, e.g. "Bavaria"
+}
+
+var continentName = map[string]string{
+	"AF": "Africa",
+	"AN": "Antarctica",
+	"AS": "Asia",
+	"EU": "Europe",
+	"NA": "North America",
+	"OC": "Oceania",
+	"SA": "South America",
+}
+
+// ContinentName returns the English name of a continent code, or "Unknown".
+func ContinentName(code string) string {
+	name, ok := continentName[code]
+	if !ok {
+		return "Unknown"
+	}
+	return name
+}
+
+var database *Database
+var databaseOnce sync.Once
+
+// Lookup finds the location of ip in the database named by geoip_database,
+// which may be a GeoLite2 or GeoIP2 Country or City database. Returns an
+// empty Location if no database is configured. Problems with the database
+// are logged to logger.
+func Lookup(ip net.IP, logger *log.Logger) Location {
+	databaseOnce.Do(func() {
+		filename := config.GetValueString("geoip_database")
+		if filename == "" {
+			return
+		}
+		var err error
+		database, err = Open(filename)
+		if err != nil {
+			logger.Println("GeoIP disabled:", err)
+			database = nil
+		}
+	})
+
+	if database == nil {
+		return Location{}
+	}
+
+	record, err := database.Lookup(ip)
+	if err != nil {
+		logger.Println(err)
+		return Location{}
+	}
+
+	var location Location
+	location.Continent = stringAt(record, "continent", "code")
+	location.Country = stringAt(record, "country", "iso_code")
+	if subdivisions, ok := field(record, "subdivisions").([]interface{}); ok && len(subdivisions) > 0 {
+		location.Region = stringAt(subdivisions[0], "names", "en")
+	}
+	return location
+}
+
+func field(record interface{}, name string) interface{} {
+	m, ok := record.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	return m[name]
+}
+
+func stringAt(record interface{}, path ...string) string {
+	for _, name := range path {
+		record = field(record, name)
+	}
+	s, _ := record.(string)
+	return s
+}
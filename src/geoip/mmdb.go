@@ -0,0 +1,290 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+)
+
+// A MaxMind DB file is a binary search tree over the bits of the address,
+// followed by a data section holding the records the tree points to and a
+// metadata section. See https://maxmind.github.io/MaxMind-DB/ for the format.
+
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+const kMetadataMaxSize = 128 * 1024
+const kDataSectionSeparatorSize = 16
+
+const (
+	typeExtended  = 0
+	typePointer   = 1
+	typeString    = 2
+	typeDouble    = 3
+	typeBytes     = 4
+	typeUint16    = 5
+	typeUint32    = 6
+	typeMap       = 7
+	typeInt32     = 8
+	typeUint64    = 9
+	typeUint128   = 10
+	typeArray     = 11
+	typeContainer = 12
+	typeEndMarker = 13
+	typeBoolean   = 14
+	typeFloat     = 15
+)
+
+// Database is a MaxMind DB file loaded into memory.
+type Database struct {
+	buffer     []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	data       []byte
+	ipv4Start  uint
+}
+
+// Open loads a MaxMind DB file.
+func Open(filename string) (*Database, error) {
+	buffer, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	searchStart := 0
+	if len(buffer) > kMetadataMaxSize {
+		searchStart = len(buffer) - kMetadataMaxSize
+	}
+	markerPos := bytes.LastIndex(buffer[searchStart:], metadataMarker)
+	if markerPos < 0 {
+		return nil, fmt.Errorf("%s is not a MaxMind DB file", filename)
+	}
+	metadataStart := searchStart + markerPos + len(metadataMarker)
+
+	metadata, _, err := decode(buffer[metadataStart:], 0)
+	if err != nil {
+		return nil, err
+	}
+	fields, ok := metadata.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("malformed MaxMind DB metadata")
+	}
+
+	db := &Database{
+		buffer:     buffer,
+		nodeCount:  uint(toUint(fields["node_count"])),
+		recordSize: uint(toUint(fields["record_size"])),
+		ipVersion:  uint(toUint(fields["ip_version"])),
+	}
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported MaxMind DB record size %d", db.recordSize)
+	}
+
+	treeSize := db.nodeCount * db.recordSize / 4
+	if treeSize+kDataSectionSeparatorSize > uint(metadataStart) {
+		return nil, errors.New("malformed MaxMind DB search tree")
+	}
+	db.data = buffer[treeSize+kDataSectionSeparatorSize : searchStart+markerPos]
+
+	// IPv4 addresses live under ::/96 in an IPv6 tree
+	if db.ipVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < db.nodeCount; i++ {
+			node = db.record(node, 0)
+		}
+		db.ipv4Start = node
+	}
+
+	return db, nil
+}
+
+// Lookup returns the record for the address, or nil if there is none.
+func (db *Database) Lookup(ip net.IP) (interface{}, error) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return nil, errors.New("only IPv4 addresses are supported")
+	}
+
+	node := db.ipv4Start
+	for i := 0; i < 32 && node < db.nodeCount; i++ {
+		bit := uint(ip4[i/8]>>(7-uint(i%8))) & 1
+		node = db.record(node, bit)
+	}
+
+	if node <= db.nodeCount {
+		// node == nodeCount means no data for this address
+		return nil, nil
+	}
+
+	offset := int(node - db.nodeCount - kDataSectionSeparatorSize)
+	if offset >= len(db.data) {
+		return nil, errors.New("malformed MaxMind DB search tree")
+	}
+	value, _, err := decode(db.data, offset)
+	return value, err
+}
+
+// record returns the left (bit 0) or right (bit 1) record of a tree node.
+func (db *Database) record(node uint, bit uint) uint {
+	switch db.recordSize {
+	case 24:
+		b := db.buffer[node*6+bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := db.buffer[node*7:]
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(db.buffer[node*8+bit*4:]))
+	}
+}
+
+// decode decodes the value at offset in the data section and returns it
+// with the offset following it. Maps decode to map[string]interface{},
+// arrays to []interface{}, and numbers to uint64, int64 or float64.
+func decode(data []byte, offset int) (value interface{}, next int, err error) {
+	defer func() {
+		if recover() != nil {
+			err = errors.New("malformed MaxMind DB data")
+		}
+	}()
+	return decodeValue(data, offset)
+}
+
+func decodeValue(data []byte, offset int) (interface{}, int, error) {
+	control := data[offset]
+	offset++
+
+	dataType := int(control >> 5)
+	if dataType == typePointer {
+		pointer, next := decodePointer(data, control, offset)
+		value, _, err := decodeValue(data, pointer)
+		return value, next, err
+	}
+	if dataType == typeExtended {
+		dataType = 7 + int(data[offset])
+		offset++
+	}
+
+	size := int(control & 0x1f)
+	switch size {
+	case 29:
+		size = 29 + int(data[offset])
+		offset++
+	case 30:
+		size = 285 + (int(data[offset])<<8 | int(data[offset+1]))
+		offset += 2
+	case 31:
+		size = 65821 + (int(data[offset])<<16 | int(data[offset+1])<<8 | int(data[offset+2]))
+		offset += 3
+	}
+
+	switch dataType {
+	case typeString:
+		return string(data[offset : offset+size]), offset + size, nil
+	case typeDouble:
+		return math.Float64frombits(binary.BigEndian.Uint64(data[offset : offset+8])), offset + 8, nil
+	case typeFloat:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(data[offset : offset+4]))), offset + 4, nil
+	case typeBytes:
+		return data[offset : offset+size], offset + size, nil
+	case typeUint16, typeUint32, typeUint64:
+		return decodeUint(data[offset : offset+size]), offset + size, nil
+	case typeUint128:
+		// wider than any value needed here; keep the low 64 bits
+		if size > 8 {
+			offset += size - 8
+			size = 8
+		}
+		return decodeUint(data[offset : offset+size]), offset + size, nil
+	case typeInt32:
+		return int64(int32(decodeUint(data[offset : offset+size]))), offset + size, nil
+	case typeBoolean:
+		return size != 0, offset, nil
+	case typeMap:
+		m := make(map[string]interface{}, size)
+		for i := 0; i < size; i++ {
+			key, next, err := decodeValue(data, offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			keyString, ok := key.(string)
+			if !ok {
+				return nil, 0, errors.New("MaxMind DB map key is not a string")
+			}
+			value, next, err := decodeValue(data, next)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[keyString] = value
+			offset = next
+		}
+		return m, offset, nil
+	case typeArray:
+		a := make([]interface{}, 0, size)
+		for i := 0; i < size; i++ {
+			value, next, err := decodeValue(data, offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+			offset = next
+		}
+		return a, offset, nil
+	}
+
+	return nil, 0, fmt.Errorf("unsupported MaxMind DB data type %d", dataType)
+}
+
+// decodePointer returns the offset a pointer points to and the offset
+// following the pointer.
+func decodePointer(data []byte, control byte, offset int) (int, int) {
+	size := int(control>>3) & 0x3
+	high := int(control & 0x7)
+	switch size {
+	case 0:
+		return high<<8 | int(data[offset]), offset + 1
+	case 1:
+		return (high<<16 | int(data[offset])<<8 | int(data[offset+1])) + 2048, offset + 2
+	case 2:
+		return (high<<24 | int(data[offset])<<16 | int(data[offset+1])<<8 | int(data[offset+2])) + 526336, offset + 3
+	default:
+		return int(binary.BigEndian.Uint32(data[offset : offset+4])), offset + 4
+	}
+}
+
+func decodeUint(b []byte) uint64 {
+	var value uint64
+	for _, c := range b {
+		value = value<<8 | uint64(c)
+	}
+	return value
+}
+
+func toUint(value interface{}) uint64 {
+	v, _ := value.(uint64)
+	return v
+}
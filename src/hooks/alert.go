@@ -0,0 +1,86 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package hooks
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"git.astrospark.com/bolorama/config"
+	"git.astrospark.com/bolorama/events"
+	"git.astrospark.com/bolorama/state"
+)
+
+// Alert notifiers post Alert events to chat, as a message a person reads
+// rather than the JSON sent to webhook_urls. The body carries the message as
+// both "content", for Discord webhooks, and "text", for Slack and Mattermost
+// incoming webhooks, so the same setting works with any of them:
+//
+//	{"content":"bolo.example.com: self-probe failed at echo: ...","text":"..."}
+//
+// Delivery is retried like webhooks are.
+
+type alertMessage struct {
+	Content string `json:"content"`
+	Text    string `json:"text"`
+}
+
+// Alerts posts Alert events to alert_webhook_urls until the events channel is
+// closed. Call only if alert_webhook_urls is set.
+func Alerts(context *state.ServerContext, eventChannel <-chan events.Event) {
+	defer context.Stats.WaitGroup.Done()
+
+	hostname := config.GetValueString("hostname")
+	client := &http.Client{Timeout: kWebhookTimeout}
+	wg := sync.WaitGroup{}
+
+	var queues []chan []byte
+	for _, url := range config.GetValueList("alert_webhook_urls") {
+		queue := make(chan []byte, kWebhookQueueDepth)
+		queues = append(queues, queue)
+		wg.Add(1)
+		go deliver(context, &wg, client, url, nil, queue)
+	}
+
+	for event := range eventChannel {
+		if event.Type != events.Alert {
+			continue
+		}
+		text := fmt.Sprintf("%s: %s", hostname, event.Text)
+		body, err := json.Marshal(alertMessage{Content: text, Text: text})
+		if err != nil {
+			context.Logger.Println(err)
+			continue
+		}
+		for _, queue := range queues {
+			select {
+			case queue <- body:
+			default:
+				context.Logger.Println("Alert queue full, dropping", event.Text)
+			}
+		}
+	}
+
+	for _, queue := range queues {
+		close(queue)
+	}
+	wg.Wait()
+	context.Logger.Println("Stopped alert notifiers")
+}
@@ -0,0 +1,65 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package hooks
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"git.astrospark.com/bolorama/events"
+	"git.astrospark.com/bolorama/logfile"
+	"git.astrospark.com/bolorama/state"
+)
+
+// The chat log writes every chat message to chat_log_file, one per line:
+//
+//	2021-03-01T20:00:00Z 0a0000010001e240 Sylvester: hello
+//
+// The file is rotated as set by the other chat_log_ settings; see package
+// logfile.
+
+// ChatLog writes chat messages to chat_log_file until the events channel is
+// closed. Call only if chat_log_file is set.
+func ChatLog(context *state.ServerContext, eventChannel <-chan events.Event) {
+	defer context.Stats.WaitGroup.Done()
+
+	// keep draining so that publishers are not held up
+	defer func() {
+		for range eventChannel {
+		}
+	}()
+
+	logFile, err := logfile.Open("chat_log")
+	if err != nil {
+		context.Logger.Println("Failed to open chat log:", err)
+		return
+	}
+	defer logFile.Close()
+
+	for event := range eventChannel {
+		if event.Type != events.ChatMessage {
+			continue
+		}
+		line := fmt.Sprintf("%s %s %s: %s\n",
+			event.Timestamp.UTC().Format("2006-01-02T15:04:05Z"),
+			hex.EncodeToString(event.GameId[:]), event.Name, event.Text)
+		if _, err := logFile.Write([]byte(line)); err != nil {
+			context.Logger.Println("Chat log:", err)
+		}
+	}
+}
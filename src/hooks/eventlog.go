@@ -0,0 +1,66 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package hooks
+
+import (
+	"encoding/json"
+
+	"git.astrospark.com/bolorama/config"
+	"git.astrospark.com/bolorama/events"
+	"git.astrospark.com/bolorama/logfile"
+	"git.astrospark.com/bolorama/state"
+)
+
+// The event log writes every event to event_log_file as a line of JSON, in
+// the form sent to hook_command, for operators' own tools to read. Chat
+// messages are left out unless event_log_chat is set. The file is rotated as
+// set by the other event_log_ settings; see package logfile.
+
+// EventLog writes events to event_log_file until the events channel is
+// closed. Call only if event_log_file is set.
+func EventLog(context *state.ServerContext, eventChannel <-chan events.Event) {
+	defer context.Stats.WaitGroup.Done()
+
+	// keep draining so that publishers are not held up
+	defer func() {
+		for range eventChannel {
+		}
+	}()
+
+	logFile, err := logfile.Open("event_log")
+	if err != nil {
+		context.Logger.Println("Failed to open event log:", err)
+		return
+	}
+	defer logFile.Close()
+	chat := config.GetValueBool("event_log_chat")
+
+	for event := range eventChannel {
+		if event.Type == events.ChatMessage && !chat {
+			continue
+		}
+		line, err := json.Marshal(toHookEvent(event))
+		if err != nil {
+			context.Logger.Println(err)
+			continue
+		}
+		if _, err := logFile.Write(append(line, '\n')); err != nil {
+			context.Logger.Println("Event log:", err)
+		}
+	}
+}
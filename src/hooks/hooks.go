@@ -0,0 +1,129 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package hooks
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"strings"
+
+	"git.astrospark.com/bolorama/admin"
+	"git.astrospark.com/bolorama/config"
+	"git.astrospark.com/bolorama/events"
+	"git.astrospark.com/bolorama/privacy"
+	"git.astrospark.com/bolorama/state"
+)
+
+// Hooks let operators implement their own policies in a program of their
+// choice. The program given by hook_command is started with the server and
+// sent every event as a line of JSON on its standard input, for example:
+//
+//	{"type":"ChatMessage","time":1614628800,"ip":"198.51.100.7","port":50000,"proxy_port":40001,"game":"0a0000010001e240","player_id":2,"name":"Sylvester","text":"hello"}
+//
+// Each line it writes to its standard output is run as an admin console
+// command (see the admin package), e.g. "kick 40001 60", "tag 40001 muted" or
+// "broadcast Restarting at 20:00". Hooks are separate programs; no scripting
+// language is embedded in the server.
+
+type hookEvent struct {
+	Type      string `json:"type"`
+	Time      int64  `json:"time"` // unix seconds
+	Ip        string `json:"ip,omitempty"`
+	Port      int    `json:"port,omitempty"`
+	ProxyPort int    `json:"proxy_port,omitempty"`
+	Game      string `json:"game"`
+	PlayerId  int    `json:"player_id,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+	Text      string `json:"text,omitempty"`
+}
+
+// Run feeds events to hook_command and runs the commands it prints, until
+// the events channel is closed. Call only if hook_command is set.
+func Run(context *state.ServerContext, eventChannel <-chan events.Event) {
+	defer context.Stats.WaitGroup.Done()
+
+	// keep draining so that publishers are not held up
+	defer func() {
+		for range eventChannel {
+		}
+	}()
+
+	fields := strings.Fields(config.GetValueString("hook_command"))
+	cmd := exec.Command(fields[0], fields[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		context.Logger.Println("Failed to start hook command:", err)
+		return
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		context.Logger.Println("Failed to start hook command:", err)
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		context.Logger.Println("Failed to start hook command:", err)
+		return
+	}
+	context.Logger.Println("Started hook command", fields[0])
+	go runCommands(context, bufio.NewScanner(stdout))
+
+	encoder := json.NewEncoder(stdin)
+	for event := range eventChannel {
+		if err := encoder.Encode(toHookEvent(event)); err != nil {
+			context.Logger.Println("Hook command:", err)
+			break
+		}
+	}
+
+	stdin.Close()
+	cmd.Wait()
+	context.Logger.Println("Stopped hook command")
+}
+
+func runCommands(context *state.ServerContext, scanner *bufio.Scanner) {
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		context.Logger.Println("Hook command:", strings.Join(fields, " "))
+		if output := admin.Execute(context, "hook", fields); output != "" {
+			context.Logger.Print(output)
+		}
+	}
+}
+
+func toHookEvent(event events.Event) hookEvent {
+	return hookEvent{
+		Type:      event.Type.String(),
+		Time:      event.Timestamp.Unix(),
+		Ip:        privacy.IpString(event.PlayerAddr.IpAddr),
+		Port:      event.PlayerAddr.IpPort,
+		ProxyPort: event.PlayerAddr.ProxyPort,
+		Game:      hex.EncodeToString(event.GameId[:]),
+		PlayerId:  event.PlayerId,
+		Name:      event.Name,
+		Reason:    event.Reason,
+		Text:      event.Text,
+	}
+}
@@ -0,0 +1,55 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package hooks
+
+import (
+	"bufio"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"git.astrospark.com/bolorama/audit"
+	"git.astrospark.com/bolorama/state"
+)
+
+func TestBroadcastCommand(t *testing.T) {
+	context := state.InitReplayContext(50000, net.IPv4(192, 0, 2, 1))
+	// broadcast is audited
+	context.Audit = audit.NewLog(filepath.Join(t.TempDir(), "audit.log"), "", context.Logger)
+	context.State.WaitGroup.Add(1)
+	go state.Run(context)
+	defer state.Shutdown(context)
+
+	runCommands(context, bufio.NewScanner(strings.NewReader("broadcast Restarting at 20:00\n")))
+	var text string
+	state.Do(context, func(s *state.State) {
+		text = state.ServerBroadcastText(s)
+	})
+	if text != "Restarting at 20:00" {
+		t.Fatalf("broadcast is %q", text)
+	}
+
+	runCommands(context, bufio.NewScanner(strings.NewReader("broadcast clear\n")))
+	state.Do(context, func(s *state.State) {
+		text = state.ServerBroadcastText(s)
+	})
+	if text != "" {
+		t.Fatalf("broadcast is %q after clearing", text)
+	}
+}
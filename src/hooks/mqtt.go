@@ -0,0 +1,195 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package hooks
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"git.astrospark.com/bolorama/bolo"
+	"git.astrospark.com/bolorama/config"
+	"git.astrospark.com/bolorama/events"
+	"git.astrospark.com/bolorama/mqtt"
+	"git.astrospark.com/bolorama/state"
+)
+
+// Game and player counts are published to an MQTT broker for displays and
+// home automation. Under the mqtt_topic prefix:
+//
+//	status                   "online", or "offline" once the server is gone (retained)
+//	players                  players on the server (retained)
+//	games                    games in progress (retained)
+//	games/<game id>/players  players in the game, removed when it ends (retained)
+//	games/<game id>/map      the game's map name, same
+//	events/game_started      each game starting, in the JSON form sent to hook_command
+//	events/game_ended        each game ending, same
+//
+// When the connection fails it is made again with exponential backoff, and
+// the retained topics are brought up to date.
+
+const kMqttQueueDepth = 1024
+const kMqttInitialBackoff = time.Second
+const kMqttMaxBackoff = time.Minute
+
+type mqttMessage struct {
+	topic   string
+	payload []byte
+	retain  bool
+}
+
+// MqttPublisher publishes counts to mqtt_url until the events channel is
+// closed. Call only if mqtt_url is set.
+func MqttPublisher(context *state.ServerContext, eventChannel <-chan events.Event) {
+	defer context.Stats.WaitGroup.Done()
+
+	prefix := config.GetValueString("mqtt_topic")
+	queue := make(chan mqttMessage, kMqttQueueDepth)
+	done := make(chan struct{})
+	go publishMqtt(context, config.GetValueString("mqtt_url"), prefix, queue, done)
+
+	send := func(topic string, payload string, retain bool) {
+		select {
+		case queue <- mqttMessage{topic: prefix + "/" + topic, payload: []byte(payload), retain: retain}:
+		default:
+			context.Logger.Println("MQTT queue full, dropping", topic)
+		}
+	}
+	sendCounts := func(gameId bolo.GameId) {
+		var players, games, gamePlayers int
+		var mapName string
+		var ok bool
+		running := state.Do(context, func(s *state.State) {
+			players = len(s.Players)
+			games = len(s.Games)
+			var info bolo.GameInfo
+			if info, ok = s.Games[gameId]; ok {
+				gamePlayers = int(info.PlayerCount)
+				mapName = info.MapName
+			}
+		})
+		if !running {
+			return
+		}
+		send("players", strconv.Itoa(players), true)
+		send("games", strconv.Itoa(games), true)
+		if ok {
+			game := hex.EncodeToString(gameId[:])
+			send("games/"+game+"/players", strconv.Itoa(gamePlayers), true)
+			send("games/"+game+"/map", mapName, true)
+		}
+	}
+
+	sendCounts(bolo.GameId{})
+	for event := range eventChannel {
+		switch event.Type {
+		case events.PlayerJoined, events.PlayerLeft:
+			sendCounts(event.GameId)
+		case events.GameStarted, events.GameEnded:
+			payload, err := json.Marshal(toHookEvent(event))
+			if err != nil {
+				context.Logger.Println(err)
+				continue
+			}
+			if event.Type == events.GameStarted {
+				send("events/game_started", string(payload), false)
+			} else {
+				game := hex.EncodeToString(event.GameId[:])
+				send("games/"+game+"/players", "", true)
+				send("games/"+game+"/map", "", true)
+				send("events/game_ended", string(payload), false)
+			}
+			sendCounts(event.GameId)
+		}
+	}
+
+	close(queue)
+	<-done
+	context.Logger.Println("Stopped MQTT publisher")
+}
+
+func publishMqtt(context *state.ServerContext, url string, prefix string, queue chan mqttMessage, done chan struct{}) {
+	defer close(done)
+
+	var conn *mqtt.Conn
+	defer func() {
+		if conn != nil {
+			conn.Publish(prefix+"/status", []byte("offline"), true)
+			conn.Close()
+		}
+	}()
+	backoff := kMqttInitialBackoff
+	clientId := "bolorama-" + config.GetValueString("hostname")
+	will := &mqtt.Message{Topic: prefix + "/status", Payload: []byte("offline")}
+
+	// the latest value of each retained topic, to publish again after
+	// reconnecting
+	retained := make(map[string][]byte)
+
+	for message := range queue {
+		if message.retain {
+			retained[message.topic] = message.payload
+		}
+
+		for {
+			if conn == nil {
+				var err error
+				conn, err = mqtt.Connect(url, clientId, will)
+				if err == nil {
+					context.Logger.Println("Connected to MQTT broker")
+					backoff = kMqttInitialBackoff
+					err = conn.Publish(prefix+"/status", []byte("online"), true)
+					for topic, payload := range retained {
+						if err == nil && topic != message.topic {
+							err = conn.Publish(topic, payload, true)
+						}
+					}
+				}
+				if err != nil {
+					context.Logger.Println("MQTT:", err)
+					conn = nil
+				}
+			}
+			if conn != nil {
+				err := conn.Publish(message.topic, message.payload, message.retain)
+				if err == nil {
+					break
+				}
+				context.Logger.Println("MQTT:", err)
+				conn = nil
+			}
+
+			// when shutting down, drop what is left rather than wait
+			select {
+			case <-time.After(backoff):
+			case <-context.Stats.Ctx.Done():
+				return
+			}
+			if backoff *= 2; backoff > kMqttMaxBackoff {
+				backoff = kMqttMaxBackoff
+			}
+		}
+
+		// an empty retained payload removes the topic, which then need not
+		// be published again
+		if message.retain && len(message.payload) == 0 {
+			delete(retained, message.topic)
+		}
+	}
+}
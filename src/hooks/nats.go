@@ -0,0 +1,117 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package hooks
+
+import (
+	"encoding/json"
+	"time"
+
+	"git.astrospark.com/bolorama/config"
+	"git.astrospark.com/bolorama/events"
+	"git.astrospark.com/bolorama/nats"
+	"git.astrospark.com/bolorama/state"
+)
+
+// Every event is published to NATS, in the JSON form sent to hook_command,
+// on the subject nats_subject followed by a dot and the event type, e.g.
+// bolorama.events.PlayerJoined, so subscribers can pick the events they want
+// with a wildcard. When the connection fails it is made again with
+// exponential backoff; events that do not fit in the queue meanwhile are
+// dropped.
+
+const kNatsQueueDepth = 1024
+const kNatsInitialBackoff = time.Second
+const kNatsMaxBackoff = time.Minute
+
+type natsMessage struct {
+	subject string
+	payload []byte
+}
+
+// NatsPublisher publishes events to nats_url until the events channel is
+// closed. Call only if nats_url is set.
+func NatsPublisher(context *state.ServerContext, eventChannel <-chan events.Event) {
+	defer context.Stats.WaitGroup.Done()
+
+	subject := config.GetValueString("nats_subject")
+	queue := make(chan natsMessage, kNatsQueueDepth)
+	done := make(chan struct{})
+	go publishNats(context, config.GetValueString("nats_url"), queue, done)
+
+	for event := range eventChannel {
+		payload, err := json.Marshal(toHookEvent(event))
+		if err != nil {
+			context.Logger.Println(err)
+			continue
+		}
+		select {
+		case queue <- natsMessage{subject: subject + "." + event.Type.String(), payload: payload}:
+		default:
+			context.Logger.Println("NATS queue full, dropping", event.Type)
+		}
+	}
+
+	close(queue)
+	<-done
+	context.Logger.Println("Stopped NATS publisher")
+}
+
+func publishNats(context *state.ServerContext, url string, queue chan natsMessage, done chan struct{}) {
+	defer close(done)
+
+	var conn *nats.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	backoff := kNatsInitialBackoff
+
+	for message := range queue {
+		for {
+			if conn == nil {
+				var err error
+				conn, err = nats.Connect(url, "bolorama "+config.GetValueString("hostname"))
+				if err == nil {
+					context.Logger.Println("Connected to NATS")
+					backoff = kNatsInitialBackoff
+				} else {
+					context.Logger.Println("NATS:", err)
+				}
+			}
+			if conn != nil {
+				err := conn.Publish(message.subject, message.payload)
+				if err == nil {
+					break
+				}
+				context.Logger.Println("NATS:", err)
+				conn = nil
+			}
+
+			// when shutting down, drop what is left rather than wait
+			select {
+			case <-time.After(backoff):
+			case <-context.Stats.Ctx.Done():
+				return
+			}
+			if backoff *= 2; backoff > kNatsMaxBackoff {
+				backoff = kNatsMaxBackoff
+			}
+		}
+	}
+}
@@ -0,0 +1,139 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package hooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"git.astrospark.com/bolorama/config"
+	"git.astrospark.com/bolorama/events"
+	"git.astrospark.com/bolorama/state"
+)
+
+// Webhooks POST every event, in the JSON form sent to hook_command, to each
+// of webhook_urls. If webhook_secret is set the body is signed with it:
+//
+//	X-Bolorama-Signature: sha256=<hex HMAC-SHA256 of the body>
+//
+// Failed deliveries are retried with exponential backoff. Each URL has its own
+// queue, so a slow or dead endpoint does not hold up the others; when a queue
+// is full, new events for that URL are dropped.
+
+const kWebhookTimeout = 10 * time.Second
+const kWebhookAttempts = 5
+const kWebhookInitialBackoff = time.Second
+const kWebhookQueueDepth = 256
+
+const SignatureHeader = "X-Bolorama-Signature"
+
+// Webhooks delivers events to webhook_urls until the events channel is
+// closed. Call only if webhook_urls is set.
+func Webhooks(context *state.ServerContext, eventChannel <-chan events.Event) {
+	defer context.Stats.WaitGroup.Done()
+
+	secret := []byte(config.GetValueString("webhook_secret"))
+	client := &http.Client{Timeout: kWebhookTimeout}
+	wg := sync.WaitGroup{}
+
+	var queues []chan []byte
+	for _, url := range config.GetValueList("webhook_urls") {
+		queue := make(chan []byte, kWebhookQueueDepth)
+		queues = append(queues, queue)
+		wg.Add(1)
+		go deliver(context, &wg, client, url, secret, queue)
+	}
+
+	for event := range eventChannel {
+		body, err := json.Marshal(toHookEvent(event))
+		if err != nil {
+			context.Logger.Println(err)
+			continue
+		}
+		for _, queue := range queues {
+			select {
+			case queue <- body:
+			default:
+				context.Logger.Println("Webhook queue full, dropping", event.Type)
+			}
+		}
+	}
+
+	for _, queue := range queues {
+		close(queue)
+	}
+	wg.Wait()
+	context.Logger.Println("Stopped webhooks")
+}
+
+func deliver(context *state.ServerContext, wg *sync.WaitGroup, client *http.Client, url string, secret []byte, queue chan []byte) {
+	defer wg.Done()
+
+	for body := range queue {
+		backoff := kWebhookInitialBackoff
+		for attempt := 1; ; attempt++ {
+			err := post(client, url, secret, body)
+			if err == nil {
+				break
+			}
+			if attempt == kWebhookAttempts {
+				context.Logger.Printf("Webhook %s: giving up: %s\n", url, err)
+				break
+			}
+
+			// when shutting down, make one last attempt without waiting
+			select {
+			case <-time.After(backoff):
+			case <-context.Stats.Ctx.Done():
+				attempt = kWebhookAttempts - 1
+			}
+			backoff *= 2
+		}
+	}
+}
+
+func post(client *http.Client, url string, secret []byte, body []byte) error {
+	request, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if len(secret) > 0 {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(body)
+		request.Header.Set(SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+
+	if response.StatusCode/100 != 2 {
+		return fmt.Errorf("%s", response.Status)
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package logfile writes logs that rotate themselves. Each kind of log is
+// configured by settings sharing a prefix, e.g. for the event log:
+//
+//	event_log_file          the file to write
+//	event_log_max_bytes     rotate when it would grow past this size (0 for no limit)
+//	event_log_rotate_hours  rotate when it is this old (0 for no limit)
+//	event_log_keep          how many rotated files to keep
+//	event_log_compress      whether to gzip rotated files
+//
+// A rotated file is renamed with the suffix .1 (.1.gz if compressed), the
+// one before it to .2 and so on, and the oldest beyond the limit removed.
+package logfile
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"git.astrospark.com/bolorama/config"
+)
+
+// File is a log file that rotates itself. Write may be called from any
+// goroutine.
+type File struct {
+	filename    string
+	maxBytes    int64
+	rotateEvery time.Duration
+	keep        int
+	compress    bool
+	mutex       sync.Mutex
+	file        *os.File
+	size        int64
+	opened      time.Time
+	compressing sync.WaitGroup
+}
+
+// Open opens the log configured by the settings starting with prefix, for
+// appending.
+func Open(prefix string) (*File, error) {
+	logFile := &File{
+		filename:    config.GetValueString(prefix + "_file"),
+		maxBytes:    int64(config.GetValueInt(prefix + "_max_bytes")),
+		rotateEvery: time.Duration(config.GetValueInt(prefix+"_rotate_hours")) * time.Hour,
+		keep:        config.GetValueInt(prefix + "_keep"),
+		compress:    config.GetValueBool(prefix + "_compress"),
+	}
+	if err := logFile.open(); err != nil {
+		return nil, err
+	}
+	return logFile, nil
+}
+
+func (logFile *File) open() error {
+	file, err := os.OpenFile(logFile.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	logFile.file = file
+	logFile.size = info.Size()
+	logFile.opened = time.Now()
+	return nil
+}
+
+// Write appends p, rotating the file first if p would take it past its size
+// limit or it has reached its age limit.
+func (logFile *File) Write(p []byte) (int, error) {
+	logFile.mutex.Lock()
+	defer logFile.mutex.Unlock()
+
+	if logFile.file == nil {
+		// a failed rotation left no file open; try again
+		if err := logFile.open(); err != nil {
+			return 0, err
+		}
+	}
+	full := logFile.maxBytes > 0 && logFile.size > 0 && logFile.size+int64(len(p)) > logFile.maxBytes
+	old := logFile.rotateEvery > 0 && time.Since(logFile.opened) >= logFile.rotateEvery
+	if full || old {
+		if err := logFile.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := logFile.file.Write(p)
+	logFile.size += int64(n)
+	return n, err
+}
+
+func (logFile *File) rotated(i int) string {
+	if logFile.compress {
+		return fmt.Sprintf("%s.%d.gz", logFile.filename, i)
+	}
+	return fmt.Sprintf("%s.%d", logFile.filename, i)
+}
+
+// rotate shifts the older files up a number, dropping the oldest, and starts
+// a new file. The file just closed is compressed in the background.
+func (logFile *File) rotate() error {
+	logFile.file.Close()
+	logFile.file = nil
+
+	if logFile.keep <= 0 {
+		os.Remove(logFile.filename)
+		return logFile.open()
+	}
+
+	// the file rotated last time must be in place before it is shifted
+	logFile.compressing.Wait()
+	os.Remove(logFile.rotated(logFile.keep))
+	for i := logFile.keep - 1; i >= 1; i-- {
+		os.Rename(logFile.rotated(i), logFile.rotated(i+1))
+	}
+
+	if !logFile.compress {
+		if err := os.Rename(logFile.filename, logFile.rotated(1)); err != nil {
+			return err
+		}
+		return logFile.open()
+	}
+
+	uncompressed := logFile.filename + ".1"
+	if err := os.Rename(logFile.filename, uncompressed); err != nil {
+		return err
+	}
+	logFile.compressing.Add(1)
+	go func() {
+		defer logFile.compressing.Done()
+		if err := compress(uncompressed, logFile.rotated(1)); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to compress log:", err)
+		}
+	}()
+	return logFile.open()
+}
+
+// compress gzips src to dst and removes src.
+func compress(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	writer := gzip.NewWriter(out)
+	if _, err := io.Copy(writer, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// Close closes the file, after any compression in progress has finished.
+func (logFile *File) Close() error {
+	logFile.mutex.Lock()
+	defer logFile.mutex.Unlock()
+
+	logFile.compressing.Wait()
+	if logFile.file == nil {
+		return nil
+	}
+	err := logFile.file.Close()
+	logFile.file = nil
+	return err
+}
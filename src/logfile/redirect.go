@@ -0,0 +1,53 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package logfile
+
+import (
+	"io"
+	"log"
+	"os"
+)
+
+// Redirect sends everything written to standard output and standard error,
+// and by the log package, to logFile. The returned function undoes it once
+// all of it has been written.
+func Redirect(logFile *File) (func(), error) {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	stdout, stderr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = writer, writer
+	log.SetOutput(writer)
+
+	copied := make(chan struct{})
+	go func() {
+		defer close(copied)
+		io.Copy(logFile, reader)
+	}()
+
+	return func() {
+		os.Stdout, os.Stderr = stdout, stderr
+		log.SetOutput(stderr)
+		writer.Close()
+		<-copied
+		reader.Close()
+		logFile.Close()
+	}, nil
+}
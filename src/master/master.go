@@ -0,0 +1,114 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package master
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"git.astrospark.com/bolorama/config"
+	"git.astrospark.com/bolorama/state"
+)
+
+// A master server (meta-tracker) lists all public Bolorama servers. Each
+// server registers itself by posting a Registration as JSON to master_url
+// every master_register_seconds; the master should drop servers that have
+// not registered for a few intervals.
+
+const kPostTimeout = 10 * time.Second
+
+type Registration struct {
+	Hostname        string `json:"hostname"`
+	Address         string `json:"address"` // public proxy IP
+	TrackerPort     int    `json:"tracker_port"`
+	HttpPort        int    `json:"http_port"` // 0 if there is no web server
+	Games           int    `json:"games"`
+	Players         int    `json:"players"`
+	IntervalSeconds int    `json:"interval_seconds"`
+}
+
+// Register periodically registers the server with master_url. Does nothing
+// if master_url is not set.
+func Register(context *state.ServerContext) {
+	defer context.Network.WaitGroup.Done()
+
+	if !config.HasValue("master_url") {
+		return
+	}
+	url := config.GetValueString("master_url")
+	intervalSeconds := config.GetValueInt("master_register_seconds")
+
+	client := &http.Client{Timeout: kPostTimeout}
+	ticker := time.NewTicker(time.Duration(intervalSeconds) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		if err := post(context, client, url, registration(context, intervalSeconds)); err != nil {
+			context.Logger.Println("Master server registration:", err)
+		}
+
+		select {
+		case <-context.Network.Ctx.Done():
+			context.Logger.Println("Stopped master server registration")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func registration(context *state.ServerContext, intervalSeconds int) Registration {
+	r := Registration{
+		Hostname:        config.GetValueString("hostname"),
+		Address:         context.ProxyIp().String(),
+		TrackerPort:     config.GetValueInt("tracker_port"),
+		HttpPort:        config.GetValueInt("http_port"),
+		IntervalSeconds: intervalSeconds,
+	}
+	state.Do(context, func(s *state.State) {
+		r.Games = len(s.Games)
+		r.Players = len(s.Players)
+	})
+	return r
+}
+
+func post(context *state.ServerContext, client *http.Client, url string, r Registration) error {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequestWithContext(context.Network.Ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+
+	if response.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", url, response.Status)
+	}
+	return nil
+}
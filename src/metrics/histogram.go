@@ -0,0 +1,150 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package metrics has the counters and histograms the server keeps about
+// itself for operators.
+package metrics
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Bounds are the upper bounds of a Histogram's buckets, from the tens of
+// microseconds a packet normally spends in the proxy up to the tenths of a
+// second that players would notice. Longer times go in a last, unbounded
+// bucket.
+var Bounds = [...]time.Duration{
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	250 * time.Microsecond,
+	500 * time.Microsecond,
+	1 * time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+}
+
+// Histogram counts durations in the buckets given by Bounds. Observe may be
+// called from any goroutine and does not lock. A nil Histogram counts nothing.
+type Histogram struct {
+	sum     int64                   // nanoseconds, accessed atomically; kept first for alignment
+	buckets [len(Bounds) + 1]uint64 // same; the last one is unbounded
+	parent  *Histogram              // also counts everything counted here
+}
+
+func NewHistogram() *Histogram {
+	return &Histogram{}
+}
+
+// NewChild returns a histogram whose durations are counted in this one too.
+func (histogram *Histogram) NewChild() *Histogram {
+	return &Histogram{parent: histogram}
+}
+
+// Observe counts one duration.
+func (histogram *Histogram) Observe(duration time.Duration) {
+	if histogram == nil {
+		return
+	}
+	bucket := len(Bounds)
+	for i, bound := range Bounds {
+		if duration <= bound {
+			bucket = i
+			break
+		}
+	}
+	for ; histogram != nil; histogram = histogram.parent {
+		atomic.AddUint64(&histogram.buckets[bucket], 1)
+		atomic.AddInt64(&histogram.sum, int64(duration))
+	}
+}
+
+// HistogramSnapshot is the state of a Histogram at one time. Buckets are not
+// cumulative; Buckets[i] counts the durations in (Bounds[i-1], Bounds[i]].
+type HistogramSnapshot struct {
+	Count   uint64        `json:"count"`
+	Sum     time.Duration `json:"sum_ns"`
+	Buckets []uint64      `json:"buckets"`
+}
+
+// Snapshot returns the counts so far.
+func (histogram *Histogram) Snapshot() HistogramSnapshot {
+	if histogram == nil {
+		return HistogramSnapshot{}
+	}
+	snapshot := HistogramSnapshot{Buckets: make([]uint64, len(histogram.buckets))}
+	for i := range histogram.buckets {
+		snapshot.Buckets[i] = atomic.LoadUint64(&histogram.buckets[i])
+		snapshot.Count += snapshot.Buckets[i]
+	}
+	snapshot.Sum = time.Duration(atomic.LoadInt64(&histogram.sum))
+	return snapshot
+}
+
+// Sub returns the durations counted since previous, an earlier snapshot of
+// the same histogram.
+func (snapshot HistogramSnapshot) Sub(previous HistogramSnapshot) HistogramSnapshot {
+	recent := HistogramSnapshot{
+		Count:   snapshot.Count - previous.Count,
+		Sum:     snapshot.Sum - previous.Sum,
+		Buckets: make([]uint64, len(snapshot.Buckets)),
+	}
+	for i := range snapshot.Buckets {
+		recent.Buckets[i] = snapshot.Buckets[i]
+		if i < len(previous.Buckets) {
+			recent.Buckets[i] -= previous.Buckets[i]
+		}
+	}
+	return recent
+}
+
+// Quantile estimates the duration below which the fraction q of the counted
+// durations fall, as the upper bound of the bucket it is in. Durations in the
+// unbounded bucket are given as twice the last bound.
+func (snapshot HistogramSnapshot) Quantile(q float64) time.Duration {
+	if snapshot.Count == 0 {
+		return 0
+	}
+	rank := uint64(q * float64(snapshot.Count))
+	if rank >= snapshot.Count {
+		rank = snapshot.Count - 1
+	}
+	var seen uint64
+	for i, count := range snapshot.Buckets {
+		seen += count
+		if seen > rank {
+			if i < len(Bounds) {
+				return Bounds[i]
+			}
+			break
+		}
+	}
+	return 2 * Bounds[len(Bounds)-1]
+}
+
+// Mean returns the average of the counted durations.
+func (snapshot HistogramSnapshot) Mean() time.Duration {
+	if snapshot.Count == 0 {
+		return 0
+	}
+	return snapshot.Sum / time.Duration(snapshot.Count)
+}
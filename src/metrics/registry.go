@@ -0,0 +1,81 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package metrics
+
+import (
+	"sort"
+	"sync"
+)
+
+// Kind says how a sink should treat a metric's values.
+type Kind int
+
+const (
+	KindGauge     Kind = iota // a level, such as the number of players
+	KindCounter               // a running total, such as packets received
+	KindHistogram             // durations, read with Snapshot
+)
+
+// Metric is a value the server publishes about itself, read when a sink or
+// /debug/vars asks for it.
+type Metric struct {
+	Name      string
+	Kind      Kind
+	Value     func() int64             // gauges and counters
+	Histogram func() HistogramSnapshot // histograms
+}
+
+var registry = struct {
+	sync.Mutex
+	metrics map[string]Metric
+}{metrics: make(map[string]Metric)}
+
+// Gauge registers a metric whose value goes up and down.
+func Gauge(name string, value func() int64) {
+	register(Metric{Name: name, Kind: KindGauge, Value: value})
+}
+
+// Counter registers a metric whose value only goes up.
+func Counter(name string, value func() int64) {
+	register(Metric{Name: name, Kind: KindCounter, Value: value})
+}
+
+// Durations registers a histogram.
+func Durations(name string, histogram func() HistogramSnapshot) {
+	register(Metric{Name: name, Kind: KindHistogram, Histogram: histogram})
+}
+
+func register(metric Metric) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.metrics[metric.Name] = metric
+}
+
+// All returns the registered metrics, sorted by name.
+func All() []Metric {
+	registry.Lock()
+	defer registry.Unlock()
+	all := make([]Metric, 0, len(registry.metrics))
+	for _, metric := range registry.metrics {
+		all = append(all, metric)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Name < all[j].Name
+	})
+	return all
+}
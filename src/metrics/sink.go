@@ -0,0 +1,138 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// Sink is a metrics backend that registered metrics are pushed to. Values
+// given to Count are the change since the last report.
+type Sink interface {
+	Gauge(name string, value int64)
+	Count(name string, delta int64)
+	Flush() error
+}
+
+// Report pushes the registered metrics to sink every interval until ctx is
+// done. Counters are sent as the change since the previous report, and each
+// histogram as the number of durations counted since then with the median
+// and 99th percentile of those in microseconds, as name.count, name.p50_us
+// and name.p99_us. Failures to send are logged to logger.
+func Report(ctx context.Context, sink Sink, interval time.Duration, logger *log.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	counters := make(map[string]int64)
+	histograms := make(map[string]HistogramSnapshot)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, metric := range All() {
+			switch metric.Kind {
+			case KindGauge:
+				sink.Gauge(metric.Name, metric.Value())
+			case KindCounter:
+				value := metric.Value()
+				if previous, ok := counters[metric.Name]; ok && value >= previous {
+					sink.Count(metric.Name, value-previous)
+				}
+				counters[metric.Name] = value
+			case KindHistogram:
+				snapshot := metric.Histogram()
+				if previous, ok := histograms[metric.Name]; ok {
+					recent := snapshot.Sub(previous)
+					sink.Count(metric.Name+".count", int64(recent.Count))
+					if recent.Count > 0 {
+						sink.Gauge(metric.Name+".p50_us", recent.Quantile(0.5).Microseconds())
+						sink.Gauge(metric.Name+".p99_us", recent.Quantile(0.99).Microseconds())
+					}
+				}
+				histograms[metric.Name] = snapshot
+			}
+		}
+		if err := sink.Flush(); err != nil {
+			logger.Println("Metrics:", err)
+		}
+	}
+}
+
+// kStatsdPacketSize keeps StatsD datagrams within a typical MTU.
+const kStatsdPacketSize = 1432
+
+// StatsD is a Sink sending to a StatsD server, or a Datadog agent, over UDP.
+// Names are given the prefix and a dot.
+type StatsD struct {
+	connection net.Conn
+	prefix     string
+	packet     strings.Builder
+}
+
+// NewStatsD returns a sink sending to address (host:port).
+func NewStatsD(address string, prefix string) (*StatsD, error) {
+	connection, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+	return &StatsD{connection: connection, prefix: prefix}, nil
+}
+
+func (statsd *StatsD) Gauge(name string, value int64) {
+	statsd.add(fmt.Sprintf("%s%s:%d|g", statsd.prefix, name, value))
+}
+
+func (statsd *StatsD) Count(name string, delta int64) {
+	statsd.add(fmt.Sprintf("%s%s:%d|c", statsd.prefix, name, delta))
+}
+
+// add appends a line to the datagram being built, sending it first if the
+// line would not fit.
+func (statsd *StatsD) add(line string) {
+	if statsd.packet.Len() > 0 && statsd.packet.Len()+1+len(line) > kStatsdPacketSize {
+		statsd.Flush()
+	}
+	if statsd.packet.Len() > 0 {
+		statsd.packet.WriteByte('\n')
+	}
+	statsd.packet.WriteString(line)
+}
+
+func (statsd *StatsD) Flush() error {
+	if statsd.packet.Len() == 0 {
+		return nil
+	}
+	_, err := statsd.connection.Write([]byte(statsd.packet.String()))
+	statsd.packet.Reset()
+	return err
+}
+
+func (statsd *StatsD) Close() error {
+	return statsd.connection.Close()
+}
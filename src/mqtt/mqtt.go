@@ -0,0 +1,279 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package mqtt is a minimal MQTT 3.1.1 client for publishing at QoS 0: it
+// connects, with a will, keeps the connection alive and publishes. It does
+// not subscribe.
+package mqtt
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const kDialTimeout = 10 * time.Second
+const kKeepAlive = 60 * time.Second
+
+const (
+	packetConnect    = 1
+	packetConnack    = 2
+	packetPublish    = 3
+	packetPingreq    = 12
+	packetPingresp   = 13
+	packetDisconnect = 14
+)
+
+// Message is a retained message the broker sends on the client's behalf if
+// the connection is lost, such as "offline".
+type Message struct {
+	Topic   string
+	Payload []byte
+}
+
+// Conn is a connection to an MQTT broker. Publish may be called from any
+// goroutine. Once an error has been returned the connection is closed and a
+// new one must be made.
+type Conn struct {
+	conn  net.Conn
+	mutex sync.Mutex
+	err   error
+	done  chan struct{}
+}
+
+// Connect connects to the broker at rawUrl: mqtt://[user:password@]host[:port],
+// or mqtts:// for a TLS connection. will may be nil.
+func Connect(rawUrl string, clientId string, will *Message) (*Conn, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn net.Conn
+	switch u.Scheme {
+	case "mqtt":
+		address := u.Host
+		if u.Port() == "" {
+			address = net.JoinHostPort(u.Hostname(), "1883")
+		}
+		conn, err = net.DialTimeout("tcp", address, kDialTimeout)
+	case "mqtts":
+		address := u.Host
+		if u.Port() == "" {
+			address = net.JoinHostPort(u.Hostname(), "8883")
+		}
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: kDialTimeout}, "tcp", address, &tls.Config{ServerName: u.Hostname()})
+	default:
+		return nil, fmt.Errorf("not an mqtt:// or mqtts:// URL: %s", rawUrl)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// clean session, so the broker keeps nothing for us between connections
+	flags := byte(0x02)
+	var body []byte
+	body = appendString(body, "MQTT")
+	body = append(body, 4) // protocol level 3.1.1
+	flagsOffset := len(body)
+	body = append(body, 0)
+	body = appendUint16(body, uint16(kKeepAlive/time.Second))
+	body = appendString(body, clientId)
+	if will != nil {
+		flags |= 0x04 | 0x20 // will, retained, at QoS 0
+		body = appendString(body, will.Topic)
+		body = appendBytes(body, will.Payload)
+	}
+	if u.User != nil {
+		flags |= 0x80
+		body = appendString(body, u.User.Username())
+		if password, ok := u.User.Password(); ok {
+			flags |= 0x40
+			body = appendString(body, password)
+		}
+	}
+	body[flagsOffset] = flags
+
+	conn.SetDeadline(time.Now().Add(kDialTimeout))
+	if err := writePacket(conn, packetConnect<<4, body); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	packetType, payload, err := readPacket(reader)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if packetType != packetConnack || len(payload) < 2 {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected reply to connect: packet type %d", packetType)
+	}
+	if code := payload[1]; code != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("connection refused: %s", connackCodes[code])
+	}
+	conn.SetDeadline(time.Time{})
+
+	c := &Conn{conn: conn, done: make(chan struct{})}
+	go c.read(reader)
+	go c.ping()
+	return c, nil
+}
+
+var connackCodes = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "client identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+// read discards what the broker sends, which at QoS 0 is only ping
+// responses, until the connection fails.
+func (c *Conn) read(reader *bufio.Reader) {
+	for {
+		if _, _, err := readPacket(reader); err != nil {
+			c.fail(err)
+			return
+		}
+	}
+}
+
+// ping keeps the connection alive while nothing is being published.
+func (c *Conn) ping() {
+	ticker := time.NewTicker(kKeepAlive / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.write(packetPingreq<<4, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (c *Conn) fail(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.failLocked(err)
+}
+
+func (c *Conn) failLocked(err error) {
+	if c.err == nil {
+		c.err = err
+		close(c.done)
+	}
+	c.conn.Close()
+}
+
+func (c *Conn) write(header byte, body []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	if err := writePacket(c.conn, header, body); err != nil {
+		c.failLocked(err)
+		return err
+	}
+	return nil
+}
+
+// Publish sends payload to topic at QoS 0. A retained message is kept by the
+// broker and given to later subscribers; a retained empty payload removes it.
+func (c *Conn) Publish(topic string, payload []byte, retain bool) error {
+	header := byte(packetPublish << 4)
+	if retain {
+		header |= 0x01
+	}
+	return c.write(header, append(appendString(nil, topic), payload...))
+}
+
+// Close disconnects cleanly, so the broker does not send the will.
+func (c *Conn) Close() error {
+	c.write(packetDisconnect<<4, nil)
+	c.fail(fmt.Errorf("connection closed"))
+	return nil
+}
+
+func appendString(b []byte, s string) []byte {
+	return appendBytes(b, []byte(s))
+}
+
+func appendBytes(b []byte, data []byte) []byte {
+	b = appendUint16(b, uint16(len(data)))
+	return append(b, data...)
+}
+
+func appendUint16(b []byte, value uint16) []byte {
+	return append(b, byte(value>>8), byte(value))
+}
+
+func writePacket(w io.Writer, header byte, body []byte) error {
+	packet := []byte{header}
+	// remaining length, 7 bits at a time
+	length := len(body)
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if length == 0 {
+			break
+		}
+	}
+	_, err := w.Write(append(packet, body...))
+	return err
+}
+
+func readPacket(reader *bufio.Reader) (byte, []byte, error) {
+	header, err := reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		digit, err := reader.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(digit&0x7f) * multiplier
+		if digit&0x80 == 0 {
+			break
+		}
+		if i == 3 {
+			return 0, nil, fmt.Errorf("malformed remaining length")
+		}
+		multiplier *= 128
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return 0, nil, err
+	}
+	return header >> 4, payload, nil
+}
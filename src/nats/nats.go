@@ -0,0 +1,209 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package nats is a minimal client for publishing to a NATS server: it
+// connects, authenticates, answers the server's pings and publishes. It does
+// not subscribe.
+package nats
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const kDialTimeout = 10 * time.Second
+const kDefaultPort = "4222"
+
+// Conn is a connection to a NATS server. Publish may be called from any
+// goroutine. Once an error has been returned the connection is closed and a
+// new one must be made.
+type Conn struct {
+	conn   net.Conn
+	writer *bufio.Writer
+	mutex  sync.Mutex
+	err    error // set when the reader fails
+}
+
+type connectOptions struct {
+	Verbose   bool   `json:"verbose"`
+	Pedantic  bool   `json:"pedantic"`
+	Name      string `json:"name"`
+	Lang      string `json:"lang"`
+	Version   string `json:"version"`
+	User      string `json:"user,omitempty"`
+	Pass      string `json:"pass,omitempty"`
+	AuthToken string `json:"auth_token,omitempty"`
+}
+
+// Connect connects to the server at rawUrl: nats://[user:password@]host[:port],
+// nats://token@host[:port], or tls://... for a TLS connection. name
+// identifies the client to the server's monitoring.
+func Connect(rawUrl string, name string) (*Conn, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "nats" && u.Scheme != "tls" {
+		return nil, fmt.Errorf("not a nats:// or tls:// URL: %s", rawUrl)
+	}
+	address := u.Host
+	if u.Port() == "" {
+		address = net.JoinHostPort(u.Hostname(), kDefaultPort)
+	}
+
+	conn, err := net.DialTimeout("tcp", address, kDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+
+	// the server starts with INFO, after which a client wanting TLS
+	// upgrades the connection
+	conn.SetDeadline(time.Now().Add(kDialTimeout))
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected greeting: %s", strings.TrimSpace(line))
+	}
+	if u.Scheme == "tls" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+		reader = bufio.NewReader(conn)
+	}
+
+	options := connectOptions{Name: name, Lang: "go", Version: "1"}
+	if u.User != nil {
+		if password, ok := u.User.Password(); ok {
+			options.User = u.User.Username()
+			options.Pass = password
+		} else {
+			options.AuthToken = u.User.Username()
+		}
+	}
+	encoded, err := json.Marshal(options)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// PONG confirms the server took CONNECT; a refusal comes back as -ERR
+	writer := bufio.NewWriter(conn)
+	fmt.Fprintf(writer, "CONNECT %s\r\nPING\r\n", encoded)
+	if err := writer.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "PONG" {
+			break
+		}
+		if strings.HasPrefix(line, "-ERR") {
+			conn.Close()
+			return nil, fmt.Errorf("%s", line)
+		}
+	}
+	conn.SetDeadline(time.Time{})
+
+	c := &Conn{conn: conn, writer: writer}
+	go c.read(reader)
+	return c, nil
+}
+
+// read answers the server's pings until the connection fails.
+func (c *Conn) read(reader *bufio.Reader) {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PING":
+			c.mutex.Lock()
+			c.writer.WriteString("PONG\r\n")
+			err = c.writer.Flush()
+			c.mutex.Unlock()
+			if err != nil {
+				c.fail(err)
+				return
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			c.fail(fmt.Errorf("%s", line))
+			return
+		}
+	}
+}
+
+func (c *Conn) fail(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.conn.Close()
+}
+
+// Publish sends payload to subject.
+func (c *Conn) Publish(subject string, payload []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+
+	fmt.Fprintf(c.writer, "PUB %s %d\r\n", subject, len(payload))
+	c.writer.Write(payload)
+	c.writer.WriteString("\r\n")
+	if err := c.writer.Flush(); err != nil {
+		c.err = err
+		c.conn.Close()
+		return err
+	}
+	return nil
+}
+
+// Close closes the connection.
+func (c *Conn) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.err == nil {
+		c.err = fmt.Errorf("connection closed")
+	}
+	return c.conn.Close()
+}
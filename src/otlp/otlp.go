@@ -0,0 +1,337 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package otlp exports sampled traces of the packet path to an OpenTelemetry
+// collector, as OTLP/HTTP with JSON encoding. Each traced packet gets a trace
+// with a "packet" span from the proxy port receiving it to its being written
+// to the receiving player, and a child span for each step along the way.
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const kQueueLength = 4096
+const kBatchSize = 512
+const kFlushInterval = 5 * time.Second
+const kExportTimeout = 10 * time.Second
+
+const kServiceName = "bolorama"
+
+// Span is a finished step of a traced packet.
+type Span struct {
+	TraceId    [16]byte
+	SpanId     [8]byte
+	ParentId   [8]byte // zero for the root span
+	Name       string
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]interface{} // string, int, bool
+}
+
+// Exporter samples packets for tracing and posts the finished spans to a
+// collector in batches. Its methods may be called from any goroutine and
+// never block; spans are dropped if the collector falls behind. A nil
+// Exporter traces nothing.
+type Exporter struct {
+	packets     uint64 // accessed atomically; kept first for alignment
+	dropped     uint64 // same
+	url         string
+	sampleEvery uint64
+	queue       chan Span
+	client      *http.Client
+	logger      *log.Logger
+}
+
+// NewExporter returns nil if endpoint is empty. endpoint is the collector's
+// base URL, e.g. http://localhost:4318, and one in sampleEvery packets is
+// traced. Failed exports are logged to logger.
+func NewExporter(endpoint string, sampleEvery int, logger *log.Logger) *Exporter {
+	if endpoint == "" {
+		return nil
+	}
+	if sampleEvery < 1 {
+		sampleEvery = 1
+	}
+	url := endpoint
+	if !strings.HasSuffix(url, "/v1/traces") {
+		url = strings.TrimSuffix(url, "/") + "/v1/traces"
+	}
+	return &Exporter{
+		url:         url,
+		sampleEvery: uint64(sampleEvery),
+		queue:       make(chan Span, kQueueLength),
+		client:      &http.Client{Timeout: kExportTimeout},
+		logger:      logger,
+	}
+}
+
+// Sample returns a trace for a packet received at the given time, or nil if
+// the packet is not sampled.
+func (exporter *Exporter) Sample(received time.Time) *PacketTrace {
+	if exporter == nil || received.IsZero() {
+		return nil
+	}
+	if atomic.AddUint64(&exporter.packets, 1)%exporter.sampleEvery != 0 {
+		return nil
+	}
+
+	packetTrace := &PacketTrace{
+		exporter:   exporter,
+		start:      received,
+		last:       received,
+		attributes: make(map[string]interface{}),
+	}
+	rand.Read(packetTrace.traceId[:])
+	rand.Read(packetTrace.rootId[:])
+	return packetTrace
+}
+
+// Dropped returns how many spans were dropped on a full queue.
+func (exporter *Exporter) Dropped() uint64 {
+	if exporter == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&exporter.dropped)
+}
+
+func (exporter *Exporter) export(span Span) {
+	select {
+	case exporter.queue <- span:
+	default:
+		atomic.AddUint64(&exporter.dropped, 1)
+	}
+}
+
+// Run posts spans until ctx is done, then posts those still queued.
+func (exporter *Exporter) Run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(kFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]Span, 0, kBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := exporter.post(batch); err != nil {
+			exporter.logger.Println("OTLP export:", err)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			for {
+				select {
+				case span := <-exporter.queue:
+					batch = append(batch, span)
+					if len(batch) == kBatchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		case span := <-exporter.queue:
+			batch = append(batch, span)
+			if len(batch) == kBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func (exporter *Exporter) post(batch []Span) error {
+	body, err := json.Marshal(encode(batch))
+	if err != nil {
+		return err
+	}
+	response, err := exporter.client.Post(exporter.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", exporter.url, response.Status)
+	}
+	return nil
+}
+
+// PacketTrace collects the spans of one packet as it passes from goroutine to
+// goroutine; it must only be used by one at a time. Each Step ends where the
+// previous one did, so the steps cover the packet's whole time in the proxy.
+// A nil PacketTrace does nothing, so callers need not check whether the
+// packet was sampled.
+type PacketTrace struct {
+	exporter   *Exporter
+	traceId    [16]byte
+	rootId     [8]byte
+	start      time.Time
+	last       time.Time
+	attributes map[string]interface{}
+}
+
+// Step records a span named name from the end of the previous step until
+// now.
+func (packetTrace *PacketTrace) Step(name string) {
+	if packetTrace == nil {
+		return
+	}
+	now := time.Now()
+	span := Span{
+		TraceId:  packetTrace.traceId,
+		ParentId: packetTrace.rootId,
+		Name:     name,
+		Start:    packetTrace.last,
+		End:      now,
+	}
+	rand.Read(span.SpanId[:])
+	packetTrace.exporter.export(span)
+	packetTrace.last = now
+}
+
+// SetAttribute adds an attribute to the packet's root span.
+func (packetTrace *PacketTrace) SetAttribute(key string, value interface{}) {
+	if packetTrace == nil {
+		return
+	}
+	packetTrace.attributes[key] = value
+}
+
+// End records the root span, ending at the end of the last step.
+func (packetTrace *PacketTrace) End() {
+	if packetTrace == nil {
+		return
+	}
+	packetTrace.exporter.export(Span{
+		TraceId:    packetTrace.traceId,
+		SpanId:     packetTrace.rootId,
+		Name:       "packet",
+		Start:      packetTrace.start,
+		End:        packetTrace.last,
+		Attributes: packetTrace.attributes,
+	})
+}
+
+// The OTLP/HTTP JSON encoding of an ExportTraceServiceRequest. Ids are hex and
+// 64 bit integers are strings.
+
+type request struct {
+	ResourceSpans []resourceSpans `json:"resourceSpans"`
+}
+
+type resourceSpans struct {
+	Resource   resource     `json:"resource"`
+	ScopeSpans []scopeSpans `json:"scopeSpans"`
+}
+
+type resource struct {
+	Attributes []keyValue `json:"attributes"`
+}
+
+type scopeSpans struct {
+	Scope scope      `json:"scope"`
+	Spans []jsonSpan `json:"spans"`
+}
+
+type scope struct {
+	Name string `json:"name"`
+}
+
+type jsonSpan struct {
+	TraceId           string     `json:"traceId"`
+	SpanId            string     `json:"spanId"`
+	ParentSpanId      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []keyValue `json:"attributes,omitempty"`
+}
+
+type keyValue struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+type anyValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+const kSpanKindInternal = 1
+const kSpanKindServer = 2
+
+func encode(batch []Span) request {
+	spans := make([]jsonSpan, 0, len(batch))
+	for _, span := range batch {
+		encoded := jsonSpan{
+			TraceId:           hex.EncodeToString(span.TraceId[:]),
+			SpanId:            hex.EncodeToString(span.SpanId[:]),
+			Name:              span.Name,
+			Kind:              kSpanKindServer,
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+		}
+		if span.ParentId != [8]byte{} {
+			encoded.ParentSpanId = hex.EncodeToString(span.ParentId[:])
+			encoded.Kind = kSpanKindInternal
+		}
+		for key, value := range span.Attributes {
+			encoded.Attributes = append(encoded.Attributes, keyValue{Key: key, Value: toAnyValue(value)})
+		}
+		spans = append(spans, encoded)
+	}
+
+	serviceName := kServiceName
+	return request{ResourceSpans: []resourceSpans{{
+		Resource:   resource{Attributes: []keyValue{{Key: "service.name", Value: anyValue{StringValue: &serviceName}}}},
+		ScopeSpans: []scopeSpans{{Scope: scope{Name: kServiceName}, Spans: spans}},
+	}}}
+}
+
+func toAnyValue(value interface{}) anyValue {
+	switch v := value.(type) {
+	case int:
+		s := strconv.Itoa(v)
+		return anyValue{IntValue: &s}
+	case bool:
+		return anyValue{BoolValue: &v}
+	default:
+		s := fmt.Sprint(v)
+		return anyValue{StringValue: &s}
+	}
+}
@@ -0,0 +1,32 @@
+//go:build !linux
+// +build !linux
+
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package portmap
+
+import (
+	"errors"
+	"net"
+)
+
+// DefaultGateway is only implemented on Linux; set port_mapping_gateway
+// elsewhere.
+func DefaultGateway() (net.IP, error) {
+	return nil, errors.New("default gateway detection is not supported on this platform")
+}
@@ -0,0 +1,147 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package portmap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// A minimal RFC 6886 (NAT-PMP) client.
+
+const natPmpPort = 5351
+const natPmpVersion = 0
+
+const opExternalAddress = 0
+const opMapUdp = 1
+const opMapTcp = 2
+const opResponse = 128
+
+const initialRetryInterval = 250 * time.Millisecond
+const maxAttempts = 4
+
+type Protocol int
+
+const (
+	Udp Protocol = opMapUdp
+	Tcp Protocol = opMapTcp
+)
+
+func (protocol Protocol) String() string {
+	if protocol == Tcp {
+		return "TCP"
+	}
+	return "UDP"
+}
+
+var resultMessage = map[uint16]string{
+	1: "unsupported version",
+	2: "not authorized or refused",
+	3: "network failure",
+	4: "out of resources",
+	5: "unsupported opcode",
+}
+
+// Client talks NAT-PMP to a gateway. Requests are serialized.
+type Client struct {
+	gateway *net.UDPAddr
+	mutex   sync.Mutex
+}
+
+func NewClient(gateway net.IP) *Client {
+	return &Client{gateway: &net.UDPAddr{IP: gateway, Port: natPmpPort}}
+}
+
+// ExternalAddress asks the gateway for its public IPv4 address.
+func (client *Client) ExternalAddress() (net.IP, error) {
+	response, err := client.request([]byte{natPmpVersion, opExternalAddress}, opExternalAddress, 12)
+	if err != nil {
+		return nil, err
+	}
+	return net.IP(response[8:12]), nil
+}
+
+// Map asks the gateway to forward externalPort to internalPort on this host
+// for the given lifetime, and returns the external port actually assigned.
+// A zero lifetime deletes the mapping.
+func (client *Client) Map(protocol Protocol, internalPort int, externalPort int, lifetime time.Duration) (int, error) {
+	request := make([]byte, 12)
+	request[0] = natPmpVersion
+	request[1] = byte(protocol)
+	binary.BigEndian.PutUint16(request[4:6], uint16(internalPort))
+	binary.BigEndian.PutUint16(request[6:8], uint16(externalPort))
+	binary.BigEndian.PutUint32(request[8:12], uint32(lifetime/time.Second))
+
+	response, err := client.request(request, byte(protocol), 16)
+	if err != nil {
+		return 0, err
+	}
+	if int(binary.BigEndian.Uint16(response[8:10])) != internalPort {
+		return 0, errors.New("nat-pmp: response is for a different port")
+	}
+	return int(binary.BigEndian.Uint16(response[10:12])), nil
+}
+
+func (client *Client) request(request []byte, op byte, responseSize int) ([]byte, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	connection, err := net.DialUDP("udp4", nil, client.gateway)
+	if err != nil {
+		return nil, err
+	}
+	defer connection.Close()
+
+	buffer := make([]byte, 16)
+	timeout := initialRetryInterval
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		if _, err := connection.Write(request); err != nil {
+			return nil, err
+		}
+
+		connection.SetReadDeadline(time.Now().Add(timeout))
+		for {
+			n, err := connection.Read(buffer)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			if n < responseSize || buffer[0] != natPmpVersion || buffer[1] != opResponse+op {
+				continue
+			}
+			if result := binary.BigEndian.Uint16(buffer[2:4]); result != 0 {
+				message, ok := resultMessage[result]
+				if !ok {
+					message = fmt.Sprint("result code ", result)
+				}
+				return nil, errors.New("nat-pmp: " + message)
+			}
+			return buffer[:responseSize], nil
+		}
+		timeout *= 2
+	}
+
+	return nil, errors.New("nat-pmp: no response from gateway " + client.gateway.IP.String())
+}
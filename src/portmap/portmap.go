@@ -0,0 +1,139 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package portmap
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"git.astrospark.com/bolorama/config"
+	"git.astrospark.com/bolorama/events"
+	"git.astrospark.com/bolorama/state"
+)
+
+const kMappingLifetime = 2 * time.Hour
+const kRenewInterval = kMappingLifetime / 2
+
+type mapping struct {
+	protocol Protocol
+	port     int
+}
+
+// Mapper asks the router in front of us to forward the tracker port and each
+// player's proxy port, following players as they join and leave, and
+// removes the mappings on shutdown. Does nothing unless port_mapping is set.
+func Mapper(context *state.ServerContext, subscription <-chan events.Event) {
+	defer context.Network.WaitGroup.Done()
+
+	if !config.GetValueBool("port_mapping") {
+		for range subscription {
+		}
+		return
+	}
+
+	client, err := newConfiguredClient()
+	if err != nil {
+		context.Logger.Println("Port mapping disabled:", err)
+		for range subscription {
+		}
+		return
+	}
+
+	if externalIp, err := client.ExternalAddress(); err != nil {
+		context.Logger.Println("Port mapping: failed to get external address:", err)
+	} else {
+		context.Logger.Println("Port mapping: router external address is", externalIp)
+	}
+
+	trackerPort := config.GetValueInt("tracker_port")
+	mappings := make(map[mapping]struct{})
+	add := func(m mapping) {
+		if addMapping(context.Logger, client, m) {
+			mappings[m] = struct{}{}
+		}
+	}
+
+	add(mapping{Udp, trackerPort})
+	add(mapping{Tcp, trackerPort})
+
+	ticker := time.NewTicker(kRenewInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for m := range mappings {
+				addMapping(context.Logger, client, m)
+			}
+		case event, ok := <-subscription:
+			if !ok {
+				for m := range mappings {
+					deleteMapping(context.Logger, client, m)
+				}
+				return
+			}
+			switch event.Type {
+			case events.PlayerJoined:
+				add(mapping{Udp, event.PlayerAddr.ProxyPort})
+			case events.PlayerLeft:
+				m := mapping{Udp, event.PlayerAddr.ProxyPort}
+				if _, ok := mappings[m]; ok {
+					deleteMapping(context.Logger, client, m)
+					delete(mappings, m)
+				}
+			}
+		}
+	}
+}
+
+func newConfiguredClient() (*Client, error) {
+	if !config.HasValue("port_mapping_gateway") {
+		gateway, err := DefaultGateway()
+		if err != nil {
+			return nil, err
+		}
+		return NewClient(gateway), nil
+	}
+
+	gateway := net.ParseIP(config.GetValueString("port_mapping_gateway")).To4()
+	if gateway == nil {
+		return nil, fmt.Errorf("not an IPv4 address: %s", config.GetValueString("port_mapping_gateway"))
+	}
+	return NewClient(gateway), nil
+}
+
+func addMapping(logger *log.Logger, client *Client, m mapping) bool {
+	externalPort, err := client.Map(m.protocol, m.port, m.port, kMappingLifetime)
+	if err != nil {
+		logger.Printf("Port mapping: failed to map %s port %d: %s\n", m.protocol, m.port, err)
+		return false
+	}
+	if externalPort != m.port {
+		// players are told to use the same port number we listen on
+		logger.Printf("Port mapping: router assigned external %s port %d for %d, players will not reach it\n", m.protocol, externalPort, m.port)
+	}
+	return true
+}
+
+func deleteMapping(logger *log.Logger, client *Client, m mapping) {
+	if _, err := client.Map(m.protocol, m.port, 0, 0); err != nil {
+		logger.Printf("Port mapping: failed to remove %s port %d: %s\n", m.protocol, m.port, err)
+	}
+}
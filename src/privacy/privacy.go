@@ -0,0 +1,117 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package privacy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"git.astrospark.com/bolorama/config"
+)
+
+// privacy_mode decides how player addresses appear in logs, listings, hook
+// events and the statistics database. Hashes are keyed with a secret chosen at
+// startup, so an address can be followed through one run of the server but
+// cannot be recovered or matched against another run.
+//
+// The ban file and security_log keep real addresses, since they are needed to
+// refuse and firewall players.
+
+const ModeOff = "off"
+const ModeHash = "hash"
+const ModeTruncate = "truncate"
+
+const kSecretBytes = 32
+
+var loadOnce sync.Once
+var loadErr error
+var mode string
+var secret []byte
+
+// Load reads privacy_mode and chooses the secret, failing if privacy_mode is
+// not off, hash or truncate, in which case addresses are hashed. It is done
+// when an address is first shown, if not before; a server calls it at startup
+// so that the error stops it.
+func Load() error {
+	loadOnce.Do(func() {
+		mode = strings.ToLower(config.GetValueString("privacy_mode"))
+		if mode != ModeOff && mode != ModeHash && mode != ModeTruncate {
+			loadErr = fmt.Errorf("privacy_mode: not off, hash or truncate")
+			mode = ModeHash
+		}
+		secret = make([]byte, kSecretBytes)
+		if _, err := rand.Read(secret); err != nil && loadErr == nil {
+			loadErr = fmt.Errorf("failed to choose privacy secret: %s", err)
+		}
+	})
+	return loadErr
+}
+
+func load() {
+	Load()
+}
+
+// Enabled reports whether addresses are hashed or truncated.
+func Enabled() bool {
+	load()
+	return mode != ModeOff
+}
+
+// Ip returns ip as it may be shown or stored: the address, the address with
+// its last octet (or last 80 bits of IPv6) zeroed, or a hash of it.
+func Ip(ip net.IP) string {
+	load()
+	switch mode {
+	case ModeTruncate:
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4.Mask(net.CIDRMask(24, 32)).String()
+		}
+		return ip.Mask(net.CIDRMask(48, 128)).String()
+	case ModeHash:
+		return "ip-" + hex.EncodeToString(Hash(ip.To16())[:6])
+	}
+	return ip.String()
+}
+
+// IpString is Ip for an address in text form.
+func IpString(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+	return Ip(parsed)
+}
+
+// Addr returns ip and port as Ip shows them, e.g. "203.0.113.0:27500".
+func Addr(ip net.IP, port int) string {
+	return fmt.Sprintf("%s:%d", Ip(ip), port)
+}
+
+// Hash returns a hash of data keyed with the secret chosen at startup.
+func Hash(data []byte) []byte {
+	load()
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
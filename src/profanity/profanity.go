@@ -0,0 +1,163 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package profanity
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"git.astrospark.com/bolorama/config"
+)
+
+// The words to filter are read from profanity_wordlist, one per line, and
+// matched ignoring case against whole words. A word ending in * matches any
+// word starting with it. Lines starting with # are comments.
+//
+// Matched words are replaced with asterisks of the same length, so names and
+// messages can be masked in place in the packets.
+
+const ChatOff = "off"
+const ChatMask = "mask"
+const ChatBlank = "blank"
+
+var loadOnce sync.Once
+var loadErr error
+var words map[string]bool
+var prefixes []string
+var chatMode string
+
+// Load reads profanity_chat and the word list, failing if profanity_chat is
+// not off, mask or blank, in which case chat is masked, or if the word list
+// cannot be read, in which case nothing is filtered. It is done when a name or
+// message is first filtered, if not before; a server calls it at startup so
+// that the error stops it.
+func Load() error {
+	loadOnce.Do(func() {
+		chatMode = strings.ToLower(config.GetValueString("profanity_chat"))
+		if chatMode != ChatOff && chatMode != ChatMask && chatMode != ChatBlank {
+			loadErr = fmt.Errorf("profanity_chat: not off, mask or blank")
+			chatMode = ChatMask
+		}
+
+		words = make(map[string]bool)
+		filename := config.GetValueString("profanity_wordlist")
+		if filename == "" {
+			return
+		}
+		file, err := os.Open(filename)
+		if err != nil {
+			loadErr = fmt.Errorf("profanity_wordlist: %s", err)
+			return
+		}
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			word := strings.ToLower(strings.TrimSpace(scanner.Text()))
+			if word == "" || strings.HasPrefix(word, "#") {
+				continue
+			}
+			if strings.HasSuffix(word, "*") {
+				prefixes = append(prefixes, strings.TrimSuffix(word, "*"))
+			} else {
+				words[word] = true
+			}
+		}
+	})
+	return loadErr
+}
+
+func load() {
+	Load()
+}
+
+func isWordByte(b byte) bool {
+	return (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9') || b >= 0x80
+}
+
+func offensive(word []byte) bool {
+	lower := strings.ToLower(string(word))
+	if words[lower] {
+		return true
+	}
+	for _, prefix := range prefixes {
+		if prefix != "" && strings.HasPrefix(lower, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// maskBytes replaces the offensive words in text with asterisks, returning
+// whether there were any.
+func maskBytes(text []byte) bool {
+	masked := false
+	for start := 0; start < len(text); {
+		if !isWordByte(text[start]) {
+			start++
+			continue
+		}
+		end := start
+		for end < len(text) && isWordByte(text[end]) {
+			end++
+		}
+		if offensive(text[start:end]) {
+			for i := start; i < end; i++ {
+				text[i] = '*'
+			}
+			masked = true
+		}
+		start = end
+	}
+	return masked
+}
+
+// Mask returns text with the offensive words replaced with asterisks.
+func Mask(text string) string {
+	load()
+	buffer := []byte(text)
+	if !maskBytes(buffer) {
+		return text
+	}
+	return string(buffer)
+}
+
+// FilterChat filters a chat message in place as profanity_chat says: masking
+// the offensive words, or blanking the whole message if it has any. Returns
+// whether the message was changed.
+func FilterChat(message []byte) bool {
+	load()
+	switch chatMode {
+	case ChatMask:
+		return maskBytes(message)
+	case ChatBlank:
+		checked := make([]byte, len(message))
+		copy(checked, message)
+		if !maskBytes(checked) {
+			return false
+		}
+		for i := range message {
+			message[i] = '*'
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package protocol
+
+import (
+	"bytes"
+	"net"
+
+	"git.astrospark.com/bolorama/bolo"
+	"git.astrospark.com/bolorama/proxy"
+	"git.astrospark.com/bolorama/util"
+)
+
+// Bolo is the Handler for Mac Bolo.
+var Bolo Handler = boloHandler{}
+
+type boloHandler struct{}
+
+func (boloHandler) Name() string {
+	return "Bolo"
+}
+
+func (boloHandler) Validate(buffer []byte) (bool, string) {
+	return bolo.ValidatePacket(proxy.UdpPacket{Len: len(buffer), Buffer: buffer})
+}
+
+func (boloHandler) PacketType(buffer []byte) int {
+	return bolo.GetPacketType(buffer)
+}
+
+func (boloHandler) Version(buffer []byte) bolo.Version {
+	return bolo.GetVersion(buffer)
+}
+
+func (boloHandler) Compatible(a bolo.Version, b bolo.Version) bool {
+	return bolo.VersionsCompatible(a, b)
+}
+
+func (boloHandler) Sender(buffer []byte) (int, bool) {
+	return bolo.GetGameStateSender(buffer)
+}
+
+func (boloHandler) IsJoin(buffer []byte) bool {
+	return bolo.GetPacketType(buffer) == bolo.PacketType5
+}
+
+func (boloHandler) IsBulk(buffer []byte) bool {
+	return bolo.IsBulkPacket(buffer)
+}
+
+func (boloHandler) NatProbe(ip net.IP, port int) []byte {
+	return bolo.MarshalPacketType6(ip, port)
+}
+
+// a type 7 packet echoing the markers of our type 6 packet
+func (boloHandler) IsNatProbeReply(buffer []byte) bool {
+	return len(buffer) >= 22 &&
+		bolo.GetPacketType(buffer) == bolo.PacketType7 &&
+		bytes.Equal(buffer[10:12], []byte{0x01, 0x23}) &&
+		bytes.Equal(buffer[18:22], []byte{0x45, 0x67, 0x89, 0xab})
+}
+
+func (boloHandler) Rewrite(
+	buffer []byte,
+	proxyIps []net.IP,
+	proxyPort int,
+	sender util.PlayerAddr,
+	muted []int,
+	playerInfoEventChannel chan util.PlayerInfoEvent,
+	playerLeaveGameChannel chan util.PlayerAddr,
+) {
+	bolo.RewritePacket(buffer, proxyIps, proxyPort, sender, muted, playerInfoEventChannel, playerLeaveGameChannel)
+}
@@ -0,0 +1,96 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package protocol
+
+import (
+	"net"
+	"sync/atomic"
+
+	"git.astrospark.com/bolorama/bolo"
+	"git.astrospark.com/bolorama/util"
+)
+
+// Handler understands the packets of one game: how to recognize them, which
+// player sent them and how to rewrite the player addresses embedded in them
+// so that players only ever see each other at the proxy. The proxy core only
+// talks to games through a Handler, so another game that embeds addresses
+// in its packets can be supported by adding a Handler to handlers.
+type Handler interface {
+	// Name of the game, for logs.
+	Name() string
+	// Validate reports whether the packet is this game's, or why not.
+	Validate(buffer []byte) (bool, string)
+	// PacketType returns the game's own packet type, for debug output.
+	PacketType(buffer []byte) int
+	// Version returns the version of the client that sent the packet.
+	Version(buffer []byte) bolo.Version
+	// Compatible reports whether clients of versions a and b can play
+	// together.
+	Compatible(a bolo.Version, b bolo.Version) bool
+	// Sender returns the in-game id of the player who sent the packet, if
+	// the packet says.
+	Sender(buffer []byte) (int, bool)
+	// IsJoin reports whether the packet asks to join the receiver's game.
+	IsJoin(buffer []byte) bool
+	// IsBulk reports whether the packet is bulk data, such as a map
+	// download, that may wait behind game play packets.
+	IsBulk(buffer []byte) bool
+	// NatProbe returns a packet asking a player to send a packet to ip:port,
+	// which opens their NAT to packets from there.
+	NatProbe(ip net.IP, port int) []byte
+	// IsNatProbeReply reports whether the packet answers a NatProbe.
+	IsNatProbeReply(buffer []byte) bool
+	// Rewrite replaces the addresses of players embedded in the packet with
+	// the proxy's, and reports player ids, names and departures it sees. Chat
+	// messages from the players with ids in muted are blanked.
+	Rewrite(
+		buffer []byte,
+		proxyIps []net.IP,
+		proxyPort int,
+		sender util.PlayerAddr,
+		muted []int,
+		playerInfoEventChannel chan util.PlayerInfoEvent,
+		playerLeaveGameChannel chan util.PlayerAddr,
+	)
+}
+
+var handlers = []Handler{Bolo}
+
+var undetected uint64
+
+// Undetected returns how many packets Detect found no handler for.
+func Undetected() uint64 {
+	return atomic.LoadUint64(&undetected)
+}
+
+// Detect returns the handler for a packet. If no handler accepts it, the
+// reason the first handler gave is returned instead.
+func Detect(buffer []byte) (Handler, string) {
+	var reason string
+	for i, handler := range handlers {
+		valid, why := handler.Validate(buffer)
+		if valid {
+			return handler, ""
+		}
+		if i == 0 {
+			reason = why
+		}
+	}
+	atomic.AddUint64(&undetected, 1)
+	return nil, reason
+}
@@ -0,0 +1,63 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package proxy
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	"git.astrospark.com/bolorama/ratelog"
+)
+
+// RxChannel is unbuffered, so a proxy port handing it a packet waits for as
+// long as the consumer takes over the packet before. Waits of
+// kRxStallThreshold or more are counted as stalls, and those of
+// kSlowConsumerWarning or more logged, so backpressure shows up as numbers
+// rather than as unexplained lag. Transmit queues never block; they shed
+// their oldest packet instead, and those drops are counted across all routes.
+
+const kRxStallThreshold = 10 * time.Millisecond
+const kSlowConsumerWarning = 250 * time.Millisecond
+
+var rxStalls uint64
+var rxStallNanoseconds uint64
+var txDrops uint64
+
+func countRxStall(logger *log.Logger, proxyPort int, waited time.Duration) {
+	if waited < kRxStallThreshold {
+		return
+	}
+	atomic.AddUint64(&rxStalls, 1)
+	atomic.AddUint64(&rxStallNanoseconds, uint64(waited))
+	if waited >= kSlowConsumerWarning {
+		ratelog.Printf(logger, "Proxy port %d waited over %s for the RxChannel consumer\n", proxyPort, kSlowConsumerWarning)
+	}
+}
+
+// RxStalls returns how many packets waited at least kRxStallThreshold to be
+// handed to RxChannel, and how long they waited in all.
+func RxStalls() (uint64, time.Duration) {
+	return atomic.LoadUint64(&rxStalls), time.Duration(atomic.LoadUint64(&rxStallNanoseconds))
+}
+
+// TxDrops returns how many packets the transmit queues of all routes have
+// shed because they were full.
+func TxDrops() uint64 {
+	return atomic.LoadUint64(&txDrops)
+}
@@ -0,0 +1,192 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package proxy
+
+import (
+	"net"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// mmsghdr mirrors struct mmsghdr from <sys/socket.h> on 64-bit Linux.
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	len uint32
+	_   [4]byte
+}
+
+// BatchConn reads or writes several datagrams per system call using
+// recvmmsg(2) and sendmmsg(2). A BatchConn holds scratch space for one
+// goroutine; readers and writers sharing a socket each need their own. Sockets
+// other than real ones are read and written one datagram at a time.
+type BatchConn struct {
+	conn    PacketConn
+	rawConn syscall.RawConn
+	hdrs    []mmsghdr
+	iovecs  []syscall.Iovec
+	names   []syscall.RawSockaddrInet4
+}
+
+func NewBatchConn(conn PacketConn, size int) (*BatchConn, error) {
+	udpConn, ok := conn.(*net.UDPConn)
+	if !ok {
+		return &BatchConn{conn: conn}, nil
+	}
+
+	rawConn, err := udpConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	return &BatchConn{
+		conn:    conn,
+		rawConn: rawConn,
+		hdrs:    make([]mmsghdr, size),
+		iovecs:  make([]syscall.Iovec, size),
+		names:   make([]syscall.RawSockaddrInet4, size),
+	}, nil
+}
+
+// ReadBatch blocks until at least one datagram is available, then reads as
+// many as are queued, up to len(packets). Each packet must already hold a
+// pooled buffer; SrcAddr, Len and Buffer are filled in for the packets read.
+func (bc *BatchConn) ReadBatch(packets []UdpPacket) (int, error) {
+	if bc.rawConn == nil {
+		return readOne(bc.conn, packets)
+	}
+
+	count := len(packets)
+	if count > len(bc.hdrs) {
+		count = len(bc.hdrs)
+	}
+
+	for i := 0; i < count; i++ {
+		buffer := packets[i].Pooled.Bytes()
+		bc.iovecs[i].Base = &buffer[0]
+		bc.iovecs[i].SetLen(len(buffer))
+		bc.hdrs[i] = mmsghdr{}
+		bc.hdrs[i].hdr.Name = (*byte)(unsafe.Pointer(&bc.names[i]))
+		bc.hdrs[i].hdr.Namelen = syscall.SizeofSockaddrInet4
+		bc.hdrs[i].hdr.Iov = &bc.iovecs[i]
+		bc.hdrs[i].hdr.Iovlen = 1
+	}
+
+	var n int
+	var errno syscall.Errno
+	err := bc.rawConn.Read(func(fd uintptr) bool {
+		r, _, e := syscall.Syscall6(sysRecvmmsg, fd, uintptr(unsafe.Pointer(&bc.hdrs[0])), uintptr(count), 0, 0, 0)
+		if e == syscall.EAGAIN {
+			return false
+		}
+		n, errno = int(r), e
+		return true
+	})
+	runtime.KeepAlive(packets)
+	if err != nil {
+		return 0, err
+	}
+	if errno != 0 {
+		return 0, &net.OpError{Op: "recvmmsg", Net: "udp4", Source: bc.conn.LocalAddr(), Err: errno}
+	}
+
+	for i := 0; i < n; i++ {
+		length := int(bc.hdrs[i].len)
+		packets[i].SrcAddr = sockaddrToUDPAddr(&bc.names[i])
+		packets[i].Len = length
+		packets[i].Buffer = packets[i].Pooled.Bytes()[:length]
+	}
+
+	return n, nil
+}
+
+// WriteBatch sends packets to their DstAddr, looping until all are sent or
+// an error occurs. It returns how many were sent; on error the packet at that
+// index is the one that failed.
+func (bc *BatchConn) WriteBatch(packets []UdpPacket) (int, error) {
+	if bc.rawConn == nil {
+		return writeEach(bc.conn, packets)
+	}
+
+	sent := 0
+
+	for sent < len(packets) {
+		count := len(packets) - sent
+		if count > len(bc.hdrs) {
+			count = len(bc.hdrs)
+		}
+
+		for i := 0; i < count; i++ {
+			packet := &packets[sent+i]
+			udpAddrToSockaddr(&packet.DstAddr, &bc.names[i])
+			if len(packet.Buffer) > 0 {
+				bc.iovecs[i].Base = &packet.Buffer[0]
+			} else {
+				bc.iovecs[i].Base = nil
+			}
+			bc.iovecs[i].SetLen(len(packet.Buffer))
+			bc.hdrs[i] = mmsghdr{}
+			bc.hdrs[i].hdr.Name = (*byte)(unsafe.Pointer(&bc.names[i]))
+			bc.hdrs[i].hdr.Namelen = syscall.SizeofSockaddrInet4
+			bc.hdrs[i].hdr.Iov = &bc.iovecs[i]
+			bc.hdrs[i].hdr.Iovlen = 1
+		}
+
+		var n int
+		var errno syscall.Errno
+		err := bc.rawConn.Write(func(fd uintptr) bool {
+			r, _, e := syscall.Syscall6(sysSendmmsg, fd, uintptr(unsafe.Pointer(&bc.hdrs[0])), uintptr(count), 0, 0, 0)
+			if e == syscall.EAGAIN {
+				return false
+			}
+			n, errno = int(r), e
+			return true
+		})
+		runtime.KeepAlive(packets)
+		if err != nil {
+			return sent, err
+		}
+		if errno != 0 {
+			return sent, &net.OpError{Op: "sendmmsg", Net: "udp4", Source: bc.conn.LocalAddr(), Addr: &packets[sent].DstAddr, Err: errno}
+		}
+
+		sent = sent + n
+	}
+
+	return sent, nil
+}
+
+func sockaddrToUDPAddr(sa *syscall.RawSockaddrInet4) net.UDPAddr {
+	port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+	return net.UDPAddr{
+		IP:   net.IPv4(sa.Addr[0], sa.Addr[1], sa.Addr[2], sa.Addr[3]),
+		Port: int(port[0])<<8 | int(port[1]),
+	}
+}
+
+func udpAddrToSockaddr(addr *net.UDPAddr, sa *syscall.RawSockaddrInet4) {
+	*sa = syscall.RawSockaddrInet4{Family: syscall.AF_INET}
+	copy(sa.Addr[:], addr.IP.To4())
+	port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+	port[0] = byte(addr.Port >> 8)
+	port[1] = byte(addr.Port)
+}
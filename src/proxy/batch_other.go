@@ -0,0 +1,39 @@
+//go:build !linux || (!amd64 && !arm64)
+// +build !linux !amd64,!arm64
+
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package proxy
+
+// BatchConn falls back to one datagram per system call on platforms without
+// recvmmsg(2) and sendmmsg(2) support here.
+type BatchConn struct {
+	conn PacketConn
+}
+
+func NewBatchConn(conn PacketConn, size int) (*BatchConn, error) {
+	return &BatchConn{conn: conn}, nil
+}
+
+func (bc *BatchConn) ReadBatch(packets []UdpPacket) (int, error) {
+	return readOne(bc.conn, packets)
+}
+
+func (bc *BatchConn) WriteBatch(packets []UdpPacket) (int, error) {
+	return writeEach(bc.conn, packets)
+}
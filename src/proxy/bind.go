@@ -0,0 +1,105 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package proxy
+
+import (
+	"log"
+	"net"
+
+	"git.astrospark.com/bolorama/config"
+	"git.astrospark.com/bolorama/systemd"
+	"git.astrospark.com/bolorama/util"
+)
+
+// ListenUdp opens a UDP socket on port for each of the configured
+// bind_addresses, or a single socket on all interfaces if none are set. If
+// systemd passed sockets bound to port (socket activation), those are used
+// instead. After UseLoopback, the sockets are opened on the loopback network.
+// Sockets that cannot be tuned are used anyway, and the problem logged to
+// logger.
+func ListenUdp(port int, logger *log.Logger) ([]PacketConn, error) {
+	if loopback == nil {
+		if taken := systemd.TakeUdp(port, logger); len(taken) > 0 {
+			connections := make([]PacketConn, len(taken))
+			for i, connection := range taken {
+				if err := TuneSocket(connection); err != nil {
+					logger.Println(err)
+				}
+				connections[i] = connection
+			}
+			return connections, nil
+		}
+	}
+
+	bindAddresses, err := config.GetBindAddresses()
+	if err != nil {
+		return nil, err
+	}
+	if len(bindAddresses) == 0 {
+		bindAddresses = []net.IP{nil}
+	}
+
+	var connections []PacketConn
+	for _, ip := range bindAddresses {
+		connection, err := listenUdp(&net.UDPAddr{IP: ip, Port: port})
+		if err != nil {
+			for _, c := range connections {
+				c.Close()
+			}
+			return nil, err
+		}
+
+		if err := TuneSocket(connection); err != nil {
+			logger.Println(err)
+		}
+		connections = append(connections, connection)
+	}
+
+	return connections, nil
+}
+
+func listenUdp(addr *net.UDPAddr) (PacketConn, error) {
+	if loopback != nil {
+		return loopback.Listen(addr)
+	}
+	return net.ListenUDP("udp4", addr)
+}
+
+// SelectConnection picks the socket to send to ip from: the one bound to our
+// address on ip's network if there is one, otherwise the first.
+func SelectConnection(connections []PacketConn, ip net.IP) PacketConn {
+	return connections[selectConnectionIndex(connections, ip)]
+}
+
+func selectConnectionIndex(connections []PacketConn, ip net.IP) int {
+	if len(connections) < 2 {
+		return 0
+	}
+
+	localIp := util.GetLocalIpFor(ip)
+	if localIp == nil {
+		return 0
+	}
+
+	for i, connection := range connections {
+		if connection.LocalAddr().(*net.UDPAddr).IP.Equal(localIp) {
+			return i
+		}
+	}
+	return 0
+}
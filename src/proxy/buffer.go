@@ -0,0 +1,120 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package proxy
+
+import (
+	"log"
+	"sync"
+)
+
+// PacketBuffer is a receive buffer borrowed from a pool. The listener that
+// reads a datagram owns it until it hands the packet on; whoever finally
+// transmits or discards the packet must call Release exactly once.
+type PacketBuffer struct {
+	bytes []byte
+}
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		// one byte spare, so that a datagram filling the buffer is known
+		// to have been cut short (see readable)
+		return &PacketBuffer{bytes: make([]byte, BufferSize()+1)}
+	},
+}
+
+func AcquireBuffer() *PacketBuffer {
+	return bufferPool.Get().(*PacketBuffer)
+}
+
+func (buffer *PacketBuffer) Bytes() []byte {
+	return buffer.bytes
+}
+
+func (buffer *PacketBuffer) Release() {
+	bufferPool.Put(buffer)
+}
+
+// Release returns the packet's buffer to the pool. Packets built outside a
+// listener (e.g. marshalled probes) have no pooled buffer and are left for
+// the garbage collector. The packet must not be used afterwards.
+func (packet UdpPacket) Release() {
+	if packet.Pooled != nil {
+		packet.Pooled.Release()
+	}
+}
+
+// BatchReader reads datagrams from a socket in batches into pooled buffers.
+type BatchReader struct {
+	conn     *BatchConn
+	slots    []UdpPacket
+	received []UdpPacket
+	logger   *log.Logger
+}
+
+func NewBatchReader(conn PacketConn, size int, logger *log.Logger) (*BatchReader, error) {
+	if size < 1 {
+		size = 1
+	}
+
+	batchConn, err := NewBatchConn(conn, size)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BatchReader{
+		conn:     batchConn,
+		slots:    make([]UdpPacket, size),
+		received: make([]UdpPacket, 0, size),
+		logger:   logger,
+	}, nil
+}
+
+// Read blocks until at least one datagram arrives. The caller owns the
+// returned packets and must release them; the slice itself is reused by the
+// next call.
+func (reader *BatchReader) Read() ([]UdpPacket, error) {
+	for i := range reader.slots {
+		if reader.slots[i].Pooled == nil {
+			reader.slots[i].Pooled = AcquireBuffer()
+		}
+	}
+
+	n, err := reader.conn.ReadBatch(reader.slots)
+	if err != nil {
+		return nil, err
+	}
+
+	reader.received = reader.received[:0]
+	for i := 0; i < n; i++ {
+		if readable(reader.conn.conn, reader.slots[i], reader.logger) {
+			reader.received = append(reader.received, reader.slots[i])
+			reader.slots[i] = UdpPacket{}
+		}
+	}
+
+	return reader.received, nil
+}
+
+// Close returns the reader's unused buffers to the pool. It does not close
+// the socket.
+func (reader *BatchReader) Close() {
+	for i := range reader.slots {
+		reader.slots[i].Release()
+		reader.slots[i] = UdpPacket{}
+	}
+}
@@ -0,0 +1,210 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// PacketConn is a UDP socket. The proxy and tracker use real sockets
+// (*net.UDPConn) unless UseLoopback has been called, in which case they use
+// sockets on an in-memory network, so that routing can be exercised without
+// the operating system.
+type PacketConn interface {
+	ReadFromUDP(b []byte) (int, *net.UDPAddr, error)
+	WriteToUDP(b []byte, addr *net.UDPAddr) (int, error)
+	LocalAddr() net.Addr
+	Close() error
+}
+
+var loopback *Loopback
+
+// UseLoopback makes ListenUdp open sockets on network instead of real ones.
+// Call it before the server starts listening.
+func UseLoopback(network *Loopback) {
+	loopback = network
+}
+
+// loopbackQueueLength is how many datagrams a loopback socket holds unread
+// before further ones are dropped, as a full kernel buffer would.
+const loopbackQueueLength = 256
+
+var errLoopbackClosed = errors.New("use of closed network connection")
+
+// Loopback is an in-memory network of UDP sockets. Datagrams sent to an
+// address no socket is bound to are dropped, as they would be on a real
+// network; nothing is ever reordered.
+type Loopback struct {
+	mutex         sync.Mutex
+	conns         map[string]*LoopbackConn
+	ephemeralPort int
+}
+
+func NewLoopback() *Loopback {
+	return &Loopback{
+		conns:         make(map[string]*LoopbackConn),
+		ephemeralPort: 49152,
+	}
+}
+
+// Listen binds a socket to addr. An IP of nil binds to all addresses, and a
+// port of 0 to a free port.
+func (network *Loopback) Listen(addr *net.UDPAddr) (*LoopbackConn, error) {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+
+	local := net.UDPAddr{IP: net.IPv4zero, Port: addr.Port}
+	if addr.IP != nil {
+		local.IP = addr.IP.To4()
+	}
+	if local.Port == 0 {
+		for network.conns[loopbackKey(local.IP, network.ephemeralPort)] != nil {
+			network.ephemeralPort++
+		}
+		local.Port = network.ephemeralPort
+		network.ephemeralPort++
+	}
+
+	key := loopbackKey(local.IP, local.Port)
+	if network.conns[key] != nil {
+		return nil, &net.OpError{Op: "listen", Net: "udp4", Addr: &local, Err: errors.New("address already in use")}
+	}
+
+	conn := &LoopbackConn{
+		network: network,
+		addr:    local,
+		queue:   make(chan loopbackDatagram, loopbackQueueLength),
+		closed:  make(chan struct{}),
+	}
+	network.conns[key] = conn
+	return conn, nil
+}
+
+func loopbackKey(ip net.IP, port int) string {
+	return fmt.Sprintf("%s:%d", ip, port)
+}
+
+// deliver queues a copy of b for the socket bound to dst, if there is one.
+func (network *Loopback) deliver(b []byte, src net.UDPAddr, dst *net.UDPAddr) {
+	network.mutex.Lock()
+	conn := network.conns[loopbackKey(dst.IP.To4(), dst.Port)]
+	if conn == nil {
+		conn = network.conns[loopbackKey(net.IPv4zero, dst.Port)]
+	}
+	network.mutex.Unlock()
+	if conn == nil {
+		return
+	}
+
+	datagram := loopbackDatagram{data: append([]byte(nil), b...), from: src}
+	select {
+	case conn.queue <- datagram:
+	default:
+	}
+}
+
+type loopbackDatagram struct {
+	data []byte
+	from net.UDPAddr
+}
+
+// LoopbackConn is a socket on a Loopback network.
+type LoopbackConn struct {
+	network   *Loopback
+	addr      net.UDPAddr
+	queue     chan loopbackDatagram
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// ReadFromUDP blocks until a datagram arrives or the socket is closed.
+func (conn *LoopbackConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	select {
+	case datagram := <-conn.queue:
+		from := datagram.from
+		return copy(b, datagram.data), &from, nil
+	case <-conn.closed:
+		return 0, nil, &net.OpError{Op: "read", Net: "udp4", Source: &conn.addr, Err: errLoopbackClosed}
+	}
+}
+
+// WriteToUDP sends a copy of b to addr. A socket bound to all addresses sends
+// from 127.0.0.1.
+func (conn *LoopbackConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	select {
+	case <-conn.closed:
+		return 0, &net.OpError{Op: "write", Net: "udp4", Source: &conn.addr, Addr: addr, Err: errLoopbackClosed}
+	default:
+	}
+
+	src := conn.addr
+	if src.IP.Equal(net.IPv4zero) {
+		src.IP = net.IPv4(127, 0, 0, 1).To4()
+	}
+	conn.network.deliver(b, src, addr)
+	return len(b), nil
+}
+
+func (conn *LoopbackConn) LocalAddr() net.Addr {
+	addr := conn.addr
+	return &addr
+}
+
+// Close unbinds the socket and wakes any reader.
+func (conn *LoopbackConn) Close() error {
+	conn.closeOnce.Do(func() {
+		conn.network.mutex.Lock()
+		delete(conn.network.conns, loopbackKey(conn.addr.IP, conn.addr.Port))
+		conn.network.mutex.Unlock()
+		close(conn.closed)
+	})
+	return nil
+}
+
+// readOne reads a single datagram into packets[0], for sockets that cannot
+// read in batches.
+func readOne(conn PacketConn, packets []UdpPacket) (int, error) {
+	if len(packets) == 0 {
+		return 0, nil
+	}
+
+	n, addr, err := conn.ReadFromUDP(packets[0].Pooled.Bytes())
+	if err != nil {
+		return 0, err
+	}
+
+	packets[0].SrcAddr = *addr
+	packets[0].Len = n
+	packets[0].Buffer = packets[0].Pooled.Bytes()[:n]
+	return 1, nil
+}
+
+// writeEach sends packets one at a time, for sockets that cannot write in
+// batches.
+func writeEach(conn PacketConn, packets []UdpPacket) (int, error) {
+	for i := range packets {
+		_, err := conn.WriteToUDP(packets[i].Buffer, &packets[i].DstAddr)
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(packets), nil
+}
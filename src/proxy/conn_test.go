@@ -0,0 +1,103 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package proxy
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"git.astrospark.com/bolorama/clock"
+)
+
+func TestRouteOverLoopback(t *testing.T) {
+	network := NewLoopback()
+	UseLoopback(network)
+	defer UseLoopback(nil)
+
+	player, err := network.Listen(&net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 50000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer player.Close()
+	playerAddr := *player.LocalAddr().(*net.UDPAddr)
+
+	rx := make(chan UdpPacket, 1)
+	ports := NewPorts(firstPlayerPort, log.New(io.Discard, "", 0))
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	defer cancel()
+	route, err := ports.AddPlayer(ctx, &wg, playerAddr, RouteOptions{RxChannel: rx, TxQueueDepth: 4, Clock: clock.Real})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyAddr := net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: route.ProxyPort}
+
+	// what the player sends to their proxy port is handed to the router
+	player.WriteToUDP([]byte("from player"), &proxyAddr)
+	select {
+	case packet := <-rx:
+		if string(packet.Buffer) != "from player" || packet.DstPort != route.ProxyPort || !packet.SrcAddr.IP.Equal(playerAddr.IP) || packet.SrcAddr.Port != playerAddr.Port {
+			t.Errorf("received %q from %s to port %d", packet.Buffer, &packet.SrcAddr, packet.DstPort)
+		}
+		packet.Release()
+	case <-time.After(time.Second):
+		t.Fatal("nothing received from the player")
+	}
+
+	// and what is queued for them arrives from it
+	route.TxQueue.Send(UdpPacket{DstAddr: playerAddr, Buffer: []byte("to player")})
+	buffer := make([]byte, 64)
+	received := make(chan string, 1)
+	var from *net.UDPAddr
+	go func() {
+		var n int
+		n, from, _ = player.ReadFromUDP(buffer)
+		received <- string(buffer[:n])
+	}()
+	select {
+	case text := <-received:
+		if text != "to player" || from == nil || from.Port != route.ProxyPort {
+			t.Errorf("player received %q from %v", text, from)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("nothing sent to the player")
+	}
+}
+
+func TestLoopbackBindsOnce(t *testing.T) {
+	network := NewLoopback()
+	conn, err := network.Listen(&net.UDPAddr{Port: firstPlayerPort})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := network.Listen(&net.UDPAddr{Port: firstPlayerPort}); err == nil {
+		t.Error("bound a port twice")
+	}
+	conn.Close()
+	conn, err = network.Listen(&net.UDPAddr{Port: firstPlayerPort})
+	if err != nil {
+		t.Fatalf("closed port cannot be bound again: %s", err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,118 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package proxy
+
+import (
+	"hash/fnv"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Some NATs and retrying network gear deliver the same datagram twice, and
+// Bolo copes badly with the copies. A route with duplicate filtering on drops
+// a packet from the player if the same bytes came from the same address
+// within its window. Bolo resends unacknowledged packets itself, but far
+// less often than a window of a few milliseconds, so its resends get through.
+
+var duplicates uint64
+
+// dedupEntry is a packet seen, in the order they arrived.
+type dedupEntry struct {
+	hash uint64
+	at   int64 // unix nanoseconds
+}
+
+// dedupCache remembers the packets a route received within the window. The
+// route's listeners, one per bind address, share it.
+type dedupCache struct {
+	mutex sync.Mutex
+	seen  map[uint64]int64 // hash to when it first arrived
+	order []dedupEntry
+}
+
+func newDedupCache() *dedupCache {
+	return &dedupCache{seen: make(map[uint64]int64)}
+}
+
+// duplicate records the packet, reporting whether it was seen within window.
+func (cache *dedupCache) duplicate(hash uint64, now int64, window int64) bool {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	expired := 0
+	for _, entry := range cache.order {
+		if now-entry.at < window {
+			break
+		}
+		if cache.seen[entry.hash] == entry.at {
+			delete(cache.seen, entry.hash)
+		}
+		expired++
+	}
+	cache.order = cache.order[expired:]
+
+	if _, ok := cache.seen[hash]; ok {
+		return true
+	}
+	cache.seen[hash] = now
+	cache.order = append(cache.order, dedupEntry{hash, now})
+	return false
+}
+
+func packetHash(addr net.UDPAddr, payload []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(addr.IP.To16())
+	h.Write([]byte{byte(addr.Port >> 8), byte(addr.Port)})
+	h.Write(payload)
+	return h.Sum64()
+}
+
+// SetDedupWindow turns duplicate filtering on for the route with the given
+// window, or off with a window of 0.
+func (playerRoute *Route) SetDedupWindow(window time.Duration) {
+	atomic.StoreInt64(&playerRoute.dedupWindow, int64(window))
+}
+
+// Duplicates returns how many packets from the player the route dropped as
+// duplicates.
+func (playerRoute *Route) Duplicates() int64 {
+	return atomic.LoadInt64(&playerRoute.duplicates)
+}
+
+// isDuplicate reports whether packet repeats one received within the route's
+// window, counting it if so.
+func (playerRoute *Route) isDuplicate(packet UdpPacket, received time.Time) bool {
+	window := atomic.LoadInt64(&playerRoute.dedupWindow)
+	if window <= 0 {
+		return false
+	}
+	hash := packetHash(packet.SrcAddr, packet.Buffer[:packet.Len])
+	if !playerRoute.dedup.duplicate(hash, received.UnixNano(), window) {
+		return false
+	}
+	atomic.AddInt64(&playerRoute.duplicates, 1)
+	atomic.AddUint64(&duplicates, 1)
+	return true
+}
+
+// Duplicates returns how many packets all routes dropped as duplicates.
+func Duplicates() uint64 {
+	return atomic.LoadUint64(&duplicates)
+}
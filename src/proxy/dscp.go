@@ -0,0 +1,71 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package proxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Routers and ISPs that honour DiffServ queue packets by the DSCP in their IP
+// header, so marking the proxy's packets e.g. EF (expedited forwarding) or
+// CS4 (real-time interactive) gets them past bulk traffic on a congested
+// link. Many networks ignore or clear the mark; it costs nothing where they
+// do.
+
+var dscpNames = map[string]int{
+	"cs0": 0, "cs1": 8, "cs2": 16, "cs3": 24, "cs4": 32, "cs5": 40, "cs6": 48, "cs7": 56,
+	"af11": 10, "af12": 12, "af13": 14,
+	"af21": 18, "af22": 20, "af23": 22,
+	"af31": 26, "af32": 28, "af33": 30,
+	"af41": 34, "af42": 36, "af43": 38,
+	"ef": 46,
+	"le": 1,
+}
+
+// dscp is the code point set on the sockets, or -1 to leave them alone.
+var dscp = -1
+
+// ParseDscp reads a DSCP given by name (e.g. EF, CS4, AF41) or as a number
+// from 0 to 63. An empty value means no marking, and returns -1.
+func ParseDscp(value string) (int, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return -1, nil
+	}
+	if code, ok := dscpNames[strings.ToLower(value)]; ok {
+		return code, nil
+	}
+	code, err := strconv.Atoi(value)
+	if err != nil || code < 0 || code > 63 {
+		return 0, fmt.Errorf("not a DSCP name such as EF, CS4 or AF41, or a number from 0 to 63: %s", value)
+	}
+	return code, nil
+}
+
+// SetDscp marks the packets of sockets opened from now on with the DSCP in
+// value (see ParseDscp). Call it once, before the server opens its ports.
+func SetDscp(value string) error {
+	code, err := ParseDscp(value)
+	if err != nil {
+		return err
+	}
+	dscp = code
+	return nil
+}
@@ -0,0 +1,104 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package proxy
+
+import (
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"git.astrospark.com/bolorama/config"
+	"git.astrospark.com/bolorama/ratelog"
+)
+
+// Datagrams are read into buffers of udp_buffer_bytes. One larger than that
+// would be cut short by the read, and forwarding the rest would hand Bolo a
+// corrupt packet, so it is dropped and counted instead.
+//
+// Bolo's larger packets (map data) may exceed what a path carries in one
+// piece. IPv4 is only guaranteed to reassemble 576 byte datagrams, and IPv6
+// only carries 1280 byte ones unfragmented, which leaves 1232 bytes for the
+// UDP payload; players reaching the server through an IPv6 translator or a
+// tunnel are subject to that limit. Packets over it are counted, and on
+// Linux the proxy sockets send without the don't fragment bit (see
+// udp_allow_fragmentation), so routers split large packets rather than drop
+// them when the ICMP messages of path MTU discovery are filtered.
+
+// MinBufferSize is the least udp_buffer_bytes, the datagram IPv4 is
+// guaranteed to reassemble less its headers.
+const MinBufferSize = 576 - 20 - 8
+
+// MaxBufferSize is the most udp_buffer_bytes, the largest UDP payload over
+// IPv4.
+const MaxBufferSize = 65535 - 20 - 8
+
+// kUnfragmentedPayload is the largest UDP payload the IPv6 minimum MTU
+// carries in one piece.
+const kUnfragmentedPayload = 1280 - 40 - 8
+
+var bufferSize int
+var bufferSizeOnce sync.Once
+
+var truncated uint64
+var large uint64
+
+// BufferSize returns the largest datagram read in full, udp_buffer_bytes
+// kept within MinBufferSize and MaxBufferSize.
+func BufferSize() int {
+	bufferSizeOnce.Do(func() {
+		bufferSize = config.GetValueInt("udp_buffer_bytes")
+		if bufferSize < MinBufferSize {
+			bufferSize = MinBufferSize
+		}
+		if bufferSize > MaxBufferSize {
+			bufferSize = MaxBufferSize
+		}
+	})
+	return bufferSize
+}
+
+// readable reports whether a packet read from conn arrived whole, counting
+// it if it is large or was cut short.
+func readable(conn PacketConn, packet UdpPacket, logger *log.Logger) bool {
+	if packet.Len > BufferSize() {
+		atomic.AddUint64(&truncated, 1)
+		port := 0
+		if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+			port = addr.Port
+		}
+		ratelog.Printf(logger, "Dropped a packet to port %d longer than udp_buffer_bytes (%d)\n", port, BufferSize())
+		return false
+	}
+	if packet.Len > kUnfragmentedPayload {
+		atomic.AddUint64(&large, 1)
+	}
+	return true
+}
+
+// Truncated returns how many datagrams were dropped as longer than
+// udp_buffer_bytes.
+func Truncated() uint64 {
+	return atomic.LoadUint64(&truncated)
+}
+
+// Large returns how many datagrams were received with more than 1232 bytes of
+// payload, which paths limited to the IPv6 minimum MTU must fragment.
+func Large() uint64 {
+	return atomic.LoadUint64(&large)
+}
@@ -0,0 +1,116 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Pinned ports give a player address the same proxy port every time it joins,
+// for dedicated hosts whose port is opened in a firewall or bookmarked. They
+// are set in pinned_ports as address=port, where the address is an IP, or an
+// IP and UDP port to tell apart clients behind one NAT. A pinned port is held
+// while its player is away so nobody else is given it; a second client from
+// the same address while it is in use is given a port as usual.
+
+// ParsePinnedPorts reads pinned_ports entries into a map from address to
+// proxy port.
+func ParsePinnedPorts(entries []string) (map[string]int, error) {
+	pins := make(map[string]int)
+	owners := make(map[int]string)
+	for _, entry := range entries {
+		s := strings.SplitN(entry, "=", 2)
+		if len(s) < 2 {
+			return nil, fmt.Errorf("not address=port: %s", entry)
+		}
+		address := strings.TrimSpace(s[0])
+		port, err := strconv.Atoi(strings.TrimSpace(s[1]))
+		if err != nil || port < firstPlayerPort || port >= firstPlayerPort+MaxPlayerPorts {
+			return nil, fmt.Errorf("%s: not a proxy port (%d to %d)", entry, firstPlayerPort, firstPlayerPort+MaxPlayerPorts-1)
+		}
+
+		key, ok := pinnedKey(address)
+		if !ok {
+			return nil, fmt.Errorf("%s: not an IPv4 address, or address and port", entry)
+		}
+
+		if owner, ok := owners[port]; ok {
+			return nil, fmt.Errorf("%s: port %d already pinned to %s", entry, port, owner)
+		}
+		if _, ok := pins[key]; ok {
+			return nil, fmt.Errorf("%s: %s already has a pinned port", entry, address)
+		}
+		owners[port] = address
+		pins[key] = port
+	}
+	return pins, nil
+}
+
+// pinnedKey returns the key of pinned for an IP, or an IP and port.
+func pinnedKey(address string) (string, bool) {
+	if ip := net.ParseIP(address).To4(); ip != nil {
+		return ip.String(), true
+	}
+	host, portText, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", false
+	}
+	ip := net.ParseIP(host).To4()
+	port, err := strconv.Atoi(portText)
+	if ip == nil || err != nil || port <= 0 || port > 65535 {
+		return "", false
+	}
+	return (&net.UDPAddr{IP: ip, Port: port}).String(), true
+}
+
+// PinPorts holds the ports in pinned_ports for their addresses. Call it once,
+// before the server takes players and before FillSocketPool.
+func (ports *Ports) PinPorts(entries []string) error {
+	pins, err := ParsePinnedPorts(entries)
+	if err != nil {
+		return err
+	}
+	for key, port := range pins {
+		if !ports.allocator.reserve(port) {
+			return fmt.Errorf("port %d is already held", port)
+		}
+		ports.pinned[key] = port
+		ports.pinnedPorts[port] = true
+	}
+	return nil
+}
+
+// pinnedPort returns the free pinned port of addr, if it has one.
+func (ports *Ports) pinnedPort(addr net.UDPAddr) (int, bool) {
+	port, ok := ports.pinned[addr.String()]
+	if !ok {
+		port, ok = ports.pinned[addr.IP.String()]
+	}
+	if !ok || ports.pinnedInUse[port] {
+		return 0, false
+	}
+	return port, true
+}
+
+// pinnedIdle returns how many pinned ports have no player.
+func (ports *Ports) pinnedIdle() int {
+	return len(ports.pinnedPorts) - len(ports.pinnedInUse)
+}
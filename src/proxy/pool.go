@@ -0,0 +1,129 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package proxy
+
+import (
+	"fmt"
+	"time"
+)
+
+// The socket pool binds socket_pool_size proxy ports at startup, so that a
+// joining player is given sockets that are already open instead of waiting on
+// a bind, which can fail when the server is short of file descriptors. A
+// pooled port's sockets are not closed when its player leaves: its listeners
+// are stopped with a read deadline, whatever is still queued for the last
+// player is discarded, and the port goes to the back of the pool. Players
+// joining while the pool is empty have ports bound for them as before.
+
+// kPoolDrainTime is how long a returned port is read for packets still on
+// their way to its last player.
+const kPoolDrainTime = 10 * time.Millisecond
+
+type warmPort struct {
+	port        int
+	connections []PacketConn
+}
+
+// deadlineConn is a socket whose reads can be interrupted without closing it.
+type deadlineConn interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// FillSocketPool binds size proxy ports for the pool. Call it once, before
+// the server takes players. Binding stops at the first port that fails, and
+// the pool keeps the ports bound so far.
+func (ports *Ports) FillSocketPool(size int) error {
+	if size <= 0 || ports.stubTransmit != nil {
+		return nil
+	}
+	ports.socketPool = make(chan warmPort, size)
+
+	for i := 0; i < size; i++ {
+		port, err := ports.allocator.allocate()
+		if err != nil {
+			return err
+		}
+		connections, err := ListenUdp(port, ports.logger)
+		if err != nil {
+			ports.allocator.release(port)
+			return err
+		}
+		for _, connection := range connections {
+			if _, ok := connection.(deadlineConn); !ok {
+				for _, connection := range connections {
+					connection.Close()
+				}
+				ports.allocator.release(port)
+				return fmt.Errorf("sockets on this network cannot be pooled")
+			}
+		}
+		ports.poolPorts[port] = true
+		ports.socketPool <- warmPort{port: port, connections: connections}
+	}
+	return nil
+}
+
+// SocketPoolIdle returns how many pooled ports are waiting for a player.
+func (ports *Ports) SocketPoolIdle() int {
+	return len(ports.socketPool)
+}
+
+// Close closes the sockets of the idle pooled ports, for a server that fails
+// to start after filling the pool.
+func (ports *Ports) Close() {
+	for {
+		warm, ok := ports.leaseWarmPort()
+		if !ok {
+			return
+		}
+		for _, connection := range warm.connections {
+			connection.Close()
+		}
+		ports.allocator.release(warm.port)
+	}
+}
+
+// leaseWarmPort takes the pooled port idle the longest, if there is one.
+func (ports *Ports) leaseWarmPort() (warmPort, bool) {
+	select {
+	case warm := <-ports.socketPool:
+		return warm, true
+	default:
+		return warmPort{}, false
+	}
+}
+
+// returnWarmPort puts a leased port back in the pool once its route's
+// listeners have stopped. The route must be torn down already.
+func (ports *Ports) returnWarmPort(playerRoute *Route) {
+	playerRoute.listeners.Wait()
+
+	buffer := make([]byte, 1)
+	for _, connection := range playerRoute.Connections {
+		deadline := connection.(deadlineConn)
+		deadline.SetReadDeadline(time.Now().Add(kPoolDrainTime))
+		for {
+			if _, _, err := connection.ReadFromUDP(buffer); err != nil {
+				break
+			}
+		}
+		deadline.SetReadDeadline(time.Time{})
+	}
+
+	ports.socketPool <- warmPort{port: playerRoute.ProxyPort, connections: playerRoute.Connections}
+}
@@ -0,0 +1,115 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package proxy
+
+import "errors"
+
+// ErrNoPlayerPorts is returned by AddPlayer when every proxy port is held.
+var ErrNoPlayerPorts = errors.New("every proxy port is in use")
+
+// portAllocator hands out the ports of a range in constant time. Free ports
+// wait in a ring in the order they were released, so a port just given up is
+// the last to be handed out again, and stray packets still on their way to
+// its last player are unlikely to reach the next one. A bitmap of held ports
+// catches ports released twice or never handed out. Must be used from one
+// goroutine at a time, the state goroutine for the proxy ports.
+type portAllocator struct {
+	first int
+	held  []bool
+	free  []int // ring of free ports
+	head  int   // index into free of the next port to hand out
+	count int   // free ports in the ring
+}
+
+func newPortAllocator(first int, size int) *portAllocator {
+	allocator := &portAllocator{
+		first: first,
+		held:  make([]bool, size),
+		free:  make([]int, size),
+		count: size,
+	}
+	for i := range allocator.free {
+		allocator.free[i] = first + i
+	}
+	return allocator
+}
+
+// allocate hands out the free port released longest ago, or fails if every
+// port in the range is held.
+func (allocator *portAllocator) allocate() (int, error) {
+	if allocator.count == 0 {
+		return 0, ErrNoPlayerPorts
+	}
+	port := allocator.free[allocator.head]
+	allocator.head = (allocator.head + 1) % len(allocator.free)
+	allocator.count--
+	allocator.held[port-allocator.first] = true
+	return port, nil
+}
+
+// release frees a held port, returning false if it was not held.
+func (allocator *portAllocator) release(port int) bool {
+	index := port - allocator.first
+	if index < 0 || index >= len(allocator.held) || !allocator.held[index] {
+		return false
+	}
+	allocator.held[index] = false
+	allocator.free[(allocator.head+allocator.count)%len(allocator.free)] = port
+	allocator.count++
+	return true
+}
+
+// reserve holds a particular port, returning false if it is already held or
+// out of the range. Unlike allocate and release it takes time in proportion
+// to the free ports, as the port is taken out of the middle of the ring.
+func (allocator *portAllocator) reserve(port int) bool {
+	index := port - allocator.first
+	if index < 0 || index >= len(allocator.held) || allocator.held[index] {
+		return false
+	}
+	size := len(allocator.free)
+	for i := 0; i < allocator.count; i++ {
+		if allocator.free[(allocator.head+i)%size] != port {
+			continue
+		}
+		// close the gap, keeping the order of the ports after it
+		for j := i; j < allocator.count-1; j++ {
+			allocator.free[(allocator.head+j)%size] = allocator.free[(allocator.head+j+1)%size]
+		}
+		allocator.count--
+		allocator.held[index] = true
+		return true
+	}
+	return false
+}
+
+// inUse returns how many ports are held.
+func (allocator *portAllocator) inUse() int {
+	return len(allocator.held) - allocator.count
+}
+
+// ports returns the held ports in order.
+func (allocator *portAllocator) ports() []int {
+	ports := make([]int, 0, allocator.inUse())
+	for i, held := range allocator.held {
+		if held {
+			ports = append(ports, allocator.first+i)
+		}
+	}
+	return ports
+}
@@ -0,0 +1,129 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package proxy
+
+import (
+	"reflect"
+	"testing"
+)
+
+func allocateAll(t *testing.T, allocator *portAllocator, n int) []int {
+	var ports []int
+	for i := 0; i < n; i++ {
+		port, err := allocator.allocate()
+		if err != nil {
+			t.Fatalf("allocation %d: %s", i, err)
+		}
+		ports = append(ports, port)
+	}
+	return ports
+}
+
+func TestPortAllocatorOrder(t *testing.T) {
+	allocator := newPortAllocator(40001, 4)
+	ports := allocateAll(t, allocator, 4)
+	if want := []int{40001, 40002, 40003, 40004}; !reflect.DeepEqual(ports, want) {
+		t.Errorf("allocated %v, want %v", ports, want)
+	}
+	if allocator.inUse() != 4 {
+		t.Errorf("%d in use, want 4", allocator.inUse())
+	}
+}
+
+func TestPortAllocatorReleaseAndReuse(t *testing.T) {
+	allocator := newPortAllocator(40001, 4)
+	allocateAll(t, allocator, 3)
+
+	allocator.release(40002)
+	allocator.release(40001)
+	if want := []int{40003}; !reflect.DeepEqual(allocator.ports(), want) {
+		t.Errorf("held %v, want %v", allocator.ports(), want)
+	}
+
+	// the port never handed out comes first, then the released ones in the
+	// order they were released
+	ports := allocateAll(t, allocator, 3)
+	if want := []int{40004, 40002, 40001}; !reflect.DeepEqual(ports, want) {
+		t.Errorf("allocated %v, want %v", ports, want)
+	}
+}
+
+func TestPortAllocatorReserve(t *testing.T) {
+	allocator := newPortAllocator(40001, 4)
+	if !allocator.reserve(40003) {
+		t.Fatal("could not reserve a free port")
+	}
+	if allocator.reserve(40003) {
+		t.Error("reserved a held port")
+	}
+	if allocator.reserve(40000) || allocator.reserve(40005) {
+		t.Error("reserved a port out of the range")
+	}
+
+	// a reserved port is skipped, the others keep their order
+	ports := allocateAll(t, allocator, 3)
+	if want := []int{40001, 40002, 40004}; !reflect.DeepEqual(ports, want) {
+		t.Errorf("allocated %v, want %v", ports, want)
+	}
+
+	if !allocator.release(40003) {
+		t.Fatal("could not release a reserved port")
+	}
+	if port, err := allocator.allocate(); err != nil || port != 40003 {
+		t.Errorf("allocated %d, %v after releasing the reserved port", port, err)
+	}
+}
+
+func TestPortAllocatorExhaustion(t *testing.T) {
+	allocator := newPortAllocator(40001, 2)
+	allocateAll(t, allocator, 2)
+	if _, err := allocator.allocate(); err != ErrNoPlayerPorts {
+		t.Fatalf("allocating from a full range: %v, want ErrNoPlayerPorts", err)
+	}
+	allocator.release(40002)
+	if port, err := allocator.allocate(); err != nil || port != 40002 {
+		t.Errorf("allocated %d, %v after a release", port, err)
+	}
+}
+
+func TestPortAllocatorDoubleRelease(t *testing.T) {
+	allocator := newPortAllocator(40001, 4)
+	allocateAll(t, allocator, 2)
+
+	if !allocator.release(40001) {
+		t.Fatal("could not release a held port")
+	}
+	if allocator.release(40001) {
+		t.Error("released a port twice")
+	}
+	if allocator.release(40004) {
+		t.Error("released a port never handed out")
+	}
+	if allocator.release(50000) {
+		t.Error("released a port out of the range")
+	}
+
+	// the ring holds each free port once
+	ports := allocateAll(t, allocator, 3)
+	if want := []int{40003, 40004, 40001}; !reflect.DeepEqual(ports, want) {
+		t.Errorf("allocated %v, want %v", ports, want)
+	}
+	if _, err := allocator.allocate(); err != ErrNoPlayerPorts {
+		t.Errorf("allocating from a full range: %v, want ErrNoPlayerPorts", err)
+	}
+}
@@ -18,202 +18,527 @@
 package proxy
 
 import (
-	"fmt"
+	"context"
 	"log"
 	"net"
 	"strings"
 	"sync"
-
-	"git.astrospark.com/bolorama/util"
+	"sync/atomic"
+	"time"
+
+	"git.astrospark.com/bolorama/clock"
+	"git.astrospark.com/bolorama/config"
+	"git.astrospark.com/bolorama/metrics"
+	"git.astrospark.com/bolorama/otlp"
+	"git.astrospark.com/bolorama/privacy"
 )
 
 const firstPlayerPort = 40001
 
+// MaxPlayerPorts is how many proxy ports can be open at once.
+const MaxPlayerPorts = 1000
+
 // Route associates a proxy port with a player's real IP address + port
 type Route struct {
-	PlayerIPAddr      net.UDPAddr
-	ProxyPort         int
-	Connection        *net.UDPConn
-	RxChannel         chan UdpPacket
-	TxChannel         chan UdpPacket
-	DisconnectChannel chan struct{}
+	lastActivity int64 // unix nanoseconds, accessed atomically; kept first for alignment
+	lastReceived int64 // same, but only counting packets from the player
+	rxPackets    int64 // from the player, accessed atomically
+	txPackets    int64 // to the player, same
+	rxBlocked    int64 // unix nanoseconds since handing a packet to RxChannel began, or 0; accessed atomically
+	txBlocked    int64 // same, for writing to the player's socket
+	dedupWindow  int64 // nanoseconds, 0 unless duplicate filtering is on; accessed atomically
+	duplicates   int64 // packets from the player dropped as duplicates, accessed atomically
+	writeErrors  [writeErrorClasses]int64
+	ProxyPort    int
+	Connections  []PacketConn // one per bind address
+	RxChannel    chan UdpPacket
+	TxQueue      *TxQueue
+	Ctx          context.Context
+	cancel       context.CancelFunc // tears the route down after a panic
+	mutex        sync.Mutex
+	playerAddr   net.UDPAddr
+	txIndex      int            // index into Connections used to reach playerAddr
+	pooled       bool           // the sockets go back to the socket pool
+	listeners    sync.WaitGroup // the listeners, done once they leave the sockets alone
+	dedup        *dedupCache
+	clock        clock.Clock
+	ports        *Ports
+	// called after the route is torn down, see RouteOptions
+	onPanic       func(playerRoute *Route)
+	onUnreachable func(playerRoute *Route)
+	// when writes to the player started failing as unreachable, or zero;
+	// only the transmitter uses it
+	unreachableSince time.Time
 }
 
 // UdpPacket represents a packet being sent from srcAddr to dstAddr
 type UdpPacket struct {
-	SrcAddr net.UDPAddr
-	DstAddr net.UDPAddr
-	DstPort int
-	Len     int
-	Buffer  []byte
+	SrcAddr  net.UDPAddr
+	DstAddr  net.UDPAddr
+	DstPort  int
+	Len      int
+	Buffer   []byte
+	Pooled   *PacketBuffer
+	Received time.Time          // when a proxy port read it; zero for packets made by the proxy
+	Trace    *otlp.PacketTrace  // nil unless the packet is sampled for tracing
+	Latency  *metrics.Histogram // counts the time from Received to being sent, if set
 }
 
-var assignedPlayerPorts []int
+// Ports are a tracker's proxy ports: the range its players are given ports
+// from, with the pinned ports and the socket pool, and the logger of the
+// routes on them. Trackers in one process each have a range of their own. Apart from SocketPoolIdle, their methods must be called from the
+// state goroutine.
+type Ports struct {
+	allocator *portAllocator
+	logger    *log.Logger
+
+	// the idle pooled ports, nil without a pool; every port the pool owns,
+	// idle or leased, which does not change once the pool is filled; and the
+	// routes of the pooled ports in use (see pool.go)
+	socketPool chan warmPort
+	poolPorts  map[int]bool
+	leased     map[int]*Route
+
+	// "ip" and "ip:port" mapped to their pinned proxy port; every pinned
+	// port; and which have a player (see pinned.go)
+	pinned      map[string]int
+	pinnedPorts map[int]bool
+	pinnedInUse map[int]bool
+
+	stubTransmit func(proxyPort int, packet UdpPacket) // see UseStubRoutes
+}
 
-// 0 <= index <= len(a)
-func insert(a []int, index int, value int) []int {
-	if len(a) == index { // nil or empty slice or after last element
-		return append(a, value)
+// NewPorts returns the MaxPlayerPorts proxy ports from first, none of them
+// pinned or pooled yet, logging what happens on them to logger. A server's
+// main tracker has the ports from FirstPlayerPort.
+func NewPorts(first int, logger *log.Logger) *Ports {
+	return &Ports{
+		allocator:   newPortAllocator(first, MaxPlayerPorts),
+		logger:      logger,
+		poolPorts:   make(map[int]bool),
+		leased:      make(map[int]*Route),
+		pinned:      make(map[string]int),
+		pinnedPorts: make(map[int]bool),
+		pinnedInUse: make(map[int]bool),
 	}
-	a = append(a[:index+1], a[index:]...) // index < len(a)
-	a[index] = value
-	return a
 }
 
-func getNextAvailablePort(firstPort int, assignedPorts *[]int) int {
-	nextPort := firstPort
-	portCount := len(*assignedPorts)
+// RouteOptions are how AddPlayer sets up a route.
+type RouteOptions struct {
+	RxChannel    chan UdpPacket // receives the packets from the player
+	TxQueueDepth int
+	Clock        clock.Clock // times idle periods and keepalives
+	// OnPanic, if set, is called with the route after one of its goroutines
+	// panicked and it was torn down, on that goroutine, so that its player
+	// can be removed.
+	OnPanic func(playerRoute *Route)
+	// OnUnreachable, if set, is called on the route's transmitter with the
+	// route, torn down because its player could not be reached.
+	OnUnreachable func(playerRoute *Route)
+}
 
-	if portCount == 0 {
-		*assignedPorts = append(*assignedPorts, nextPort)
-		return nextPort
-	}
+// PlayerPortsInUse returns how many proxy ports are held for players; idle
+// ports in the socket pool and pinned ports whose player is away are not
+// counted.
+func (ports *Ports) PlayerPortsInUse() int {
+	return ports.allocator.inUse() - len(ports.poolPorts) + len(ports.leased) - ports.pinnedIdle()
+}
 
-	// use a first hole in port list, if one exists
-	for i, port := range *assignedPorts {
-		if port == nextPort {
-			nextPort = port + 1
-		} else {
-			*assignedPorts = insert(*assignedPorts, i, nextPort)
-			break
+// PlayerPorts returns the proxy ports held for players in order.
+func (ports *Ports) PlayerPorts() []int {
+	var held []int
+	for _, port := range ports.allocator.ports() {
+		if ports.poolPorts[port] && ports.leased[port] == nil {
+			continue
 		}
+		if ports.pinnedPorts[port] && !ports.pinnedInUse[port] {
+			continue
+		}
+		held = append(held, port)
 	}
+	return held
+}
 
-	lastPort := (*assignedPorts)[len(*assignedPorts)-1]
-	if nextPort > lastPort {
-		*assignedPorts = append(*assignedPorts, nextPort)
+// DeletePort frees a proxy port for another player once its route is torn
+// down. Freeing a port that is not held does nothing.
+func (ports *Ports) DeletePort(port int) {
+	if playerRoute, ok := ports.leased[port]; ok {
+		delete(ports.leased, port)
+		playerRoute.cancel()
+		go ports.returnWarmPort(playerRoute)
+		return
+	}
+	if ports.pinnedPorts[port] {
+		delete(ports.pinnedInUse, port)
+		return
+	}
+	if !ports.allocator.release(port) {
+		ports.logger.Printf("Proxy port %d freed but not held\n", port)
 	}
-
-	return nextPort
 }
 
-func DeletePort(port int) {
-	idx := -1
-	for i, value := range assignedPlayerPorts {
-		if value == port {
-			idx = i
-			break
+// AddPlayer opens a proxy port for the player, failing with ErrNoPlayerPorts
+// if all are held, or with the error binding the port's sockets. The route is
+// torn down when ctx is done.
+func (ports *Ports) AddPlayer(
+	ctx context.Context,
+	wg *sync.WaitGroup,
+	playerAddr net.UDPAddr,
+	options RouteOptions,
+) (*Route, error) {
+	if port, ok := ports.pinnedPort(playerAddr); ok {
+		playerRoute := ports.newPlayerRoute(ctx, playerAddr, port, options)
+		if err := ports.createProxy(wg, playerRoute); err != nil {
+			playerRoute.cancel()
+			return nil, err
 		}
+		ports.pinnedInUse[port] = true
+		return playerRoute, nil
 	}
 
-	if idx >= 0 {
-		copy(assignedPlayerPorts[idx:], assignedPlayerPorts[idx+1:])
-		assignedPlayerPorts = assignedPlayerPorts[:len(assignedPlayerPorts)-1]
+	if warm, ok := ports.leaseWarmPort(); ok {
+		playerRoute := ports.newPlayerRoute(ctx, playerAddr, warm.port, options)
+		playerRoute.pooled = true
+		ports.leased[warm.port] = playerRoute
+		logCreatingProxy(playerRoute)
+		startPlayerProxy(wg, playerRoute, warm.connections)
+		return playerRoute, nil
 	}
-}
 
-func AddPlayer(
-	wg *sync.WaitGroup,
-	playerAddr net.UDPAddr,
-	rxChannel chan UdpPacket,
-	disconnectChannel chan struct{},
-	shutdownChannel chan struct{},
-) (int, chan UdpPacket, *net.UDPConn) {
-	if len(assignedPlayerPorts) > 1000 {
-		// TODO this allows someone to deny service
-		panic("maximum players exceeded (1000)")
+	nextPlayerPort, err := ports.allocator.allocate()
+	if err != nil {
+		return nil, err
+	}
+	playerRoute := ports.newPlayerRoute(ctx, playerAddr, nextPlayerPort, options)
+	if err := ports.createProxy(wg, playerRoute); err != nil {
+		playerRoute.cancel()
+		ports.allocator.release(nextPlayerPort)
+		return nil, err
 	}
-	nextPlayerPort := getNextAvailablePort(firstPlayerPort, &assignedPlayerPorts)
-	playerRoute := newPlayerRoute(playerAddr, nextPlayerPort, rxChannel, disconnectChannel)
-	createPlayerProxy(wg, playerRoute, shutdownChannel)
-	return playerRoute.ProxyPort, playerRoute.TxChannel, playerRoute.Connection
+	return playerRoute, nil
 }
 
-func newPlayerRoute(addr net.UDPAddr, port int, rxChannel chan UdpPacket, disconnectChannel chan struct{}) Route {
-	txChannel := make(chan UdpPacket)
+// createProxy starts the route on sockets of its own, or on a stub.
+func (ports *Ports) createProxy(wg *sync.WaitGroup, playerRoute *Route) error {
+	if ports.stubTransmit != nil {
+		createStubProxy(wg, playerRoute)
+		return nil
+	}
+	return createPlayerProxy(wg, playerRoute)
+}
 
-	return Route{
-		addr,
-		port,
-		nil,
-		rxChannel,
-		txChannel,
-		disconnectChannel,
+func (ports *Ports) newPlayerRoute(ctx context.Context, addr net.UDPAddr, port int, options RouteOptions) *Route {
+	ctx, cancel := context.WithCancel(ctx)
+	return &Route{
+		ProxyPort:     port,
+		RxChannel:     options.RxChannel,
+		TxQueue:       newTxQueue(options.TxQueueDepth),
+		Ctx:           ctx,
+		cancel:        cancel,
+		playerAddr:    addr,
+		dedup:         newDedupCache(),
+		clock:         options.Clock,
+		ports:         ports,
+		onPanic:       options.OnPanic,
+		onUnreachable: options.OnUnreachable,
 	}
 }
 
-func createPlayerProxy(wg *sync.WaitGroup, playerRoute Route, shutdownChannel chan struct{}) {
-	fmt.Println()
-	log.Printf("Creating proxy: %d => %s:%d\n", playerRoute.ProxyPort,
-		playerRoute.PlayerIPAddr.IP.String(), playerRoute.PlayerIPAddr.Port)
+func logCreatingProxy(playerRoute *Route) {
+	playerRoute.ports.logger.Printf("Creating proxy: %d => %s\n", playerRoute.ProxyPort,
+		privacy.Addr(playerRoute.playerAddr.IP, playerRoute.playerAddr.Port))
+}
 
-	listenAddr, err := net.ResolveUDPAddr("udp4", fmt.Sprint(":", playerRoute.ProxyPort))
-	if err != nil {
-		fmt.Println(err)
-		return
-	}
+func createPlayerProxy(wg *sync.WaitGroup, playerRoute *Route) error {
+	logCreatingProxy(playerRoute)
 
-	connection, err := net.ListenUDP("udp4", listenAddr)
+	connections, err := ListenUdp(playerRoute.ProxyPort, playerRoute.ports.logger)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return err
 	}
+	startPlayerProxy(wg, playerRoute, connections)
+	return nil
+}
 
-	playerRoute.Connection = connection
-
-	wg.Add(2)
-	go udpListener(wg, shutdownChannel, playerRoute)
-	go udpTransmitter(wg, shutdownChannel, playerRoute)
+// startPlayerProxy starts the route's goroutines on its open sockets.
+func startPlayerProxy(wg *sync.WaitGroup, playerRoute *Route, connections []PacketConn) {
+	playerRoute.Connections = connections
+	playerRoute.txIndex = selectConnectionIndex(connections, playerRoute.playerAddr.IP)
+	playerRoute.touch()
+	playerRoute.touchReceived()
+
+	wg.Add(len(connections) + 1)
+	playerRoute.listeners.Add(len(connections))
+	if playerRoute.pooled {
+		// and the goroutines interrupting them
+		playerRoute.listeners.Add(len(connections))
+	}
+	for _, connection := range connections {
+		go udpListener(wg, playerRoute, connection)
+	}
+	go udpTransmitter(wg, playerRoute)
 }
 
-func udpListener(wg *sync.WaitGroup, shutdownChannel chan struct{}, playerRoute Route) {
+func udpListener(wg *sync.WaitGroup, playerRoute *Route, connection PacketConn) {
 	defer wg.Done()
-	buffer := make([]byte, util.MaxUdpPacketSize)
-
-	go func() {
-		for {
+	defer playerRoute.listeners.Done()
+	defer playerRoute.recoverPanic("listener")
+
+	if playerRoute.pooled {
+		// pooled sockets are kept open, and only their reads are interrupted
+		stopped := make(chan struct{})
+		defer close(stopped)
+		go func() {
+			defer playerRoute.listeners.Done()
 			select {
-			case _, ok := <-playerRoute.DisconnectChannel:
-				if !ok {
-					playerRoute.Connection.Close()
-					return
-				}
-			case _, ok := <-shutdownChannel:
-				if !ok {
-					playerRoute.Connection.Close()
-					return
-				}
+			case <-playerRoute.Ctx.Done():
+				connection.(deadlineConn).SetReadDeadline(time.Now())
+			case <-stopped:
 			}
-		}
-	}()
+		}()
+	} else {
+		go func() {
+			<-playerRoute.Ctx.Done()
+			connection.Close()
+		}()
+	}
+
+	logger := playerRoute.ports.logger
+	reader, err := NewBatchReader(connection, config.GetValueInt("udp_batch_size"), logger)
+	if err != nil {
+		logger.Println(err)
+		return
+	}
+	defer reader.Close()
 
 	for {
-		n, addr, err := playerRoute.Connection.ReadFromUDP(buffer)
+		packets, err := reader.Read()
 		if err != nil {
-			if !strings.HasSuffix(err.Error(), "use of closed network connection") {
-				fmt.Println(err)
+			if !strings.HasSuffix(err.Error(), "use of closed network connection") && !(playerRoute.pooled && playerRoute.Ctx.Err() != nil) {
+				logger.Println(err)
 			}
-			fmt.Println("Stopped listening on UDP port", playerRoute.ProxyPort)
+			logger.Println("Stopped listening on UDP port", playerRoute.ProxyPort)
 			break
 		}
 
-		data := make([]byte, n)
-		copy(data, buffer)
-		playerRoute.RxChannel <- UdpPacket{*addr, net.UDPAddr{}, playerRoute.ProxyPort, n, data}
+		playerRoute.touch()
+		playerRoute.touchReceived()
+		atomic.AddInt64(&playerRoute.rxPackets, int64(len(packets)))
+		received := time.Now()
+
+		for _, packet := range packets {
+			if playerRoute.isDuplicate(packet, received) {
+				packet.Release()
+				continue
+			}
+			packet.DstPort = playerRoute.ProxyPort
+			packet.Received = received
+			handoff := time.Now()
+			atomic.StoreInt64(&playerRoute.rxBlocked, handoff.UnixNano())
+			select {
+			case playerRoute.RxChannel <- packet:
+			case <-playerRoute.Ctx.Done():
+				packet.Release()
+			}
+			atomic.StoreInt64(&playerRoute.rxBlocked, 0)
+			countRxStall(logger, playerRoute.ProxyPort, time.Since(handoff))
+		}
 	}
 }
 
-func udpTransmitter(wg *sync.WaitGroup, shutdownChannel chan struct{}, playerRoute Route) {
+func udpTransmitter(wg *sync.WaitGroup, playerRoute *Route) {
 	defer wg.Done()
+	defer playerRoute.recoverPanic("transmitter")
+	logger := playerRoute.ports.logger
 	defer func() {
-		fmt.Println("Stopped transmitting on UDP port", playerRoute.ProxyPort)
+		logger.Println("Stopped transmitting on UDP port", playerRoute.ProxyPort)
+		if drops := playerRoute.TxQueue.Drops(); drops > 0 {
+			logger.Printf("  dropped %d packets on full transmit queue\n", drops)
+		}
 	}()
 
+	batchSize := config.GetValueInt("udp_batch_size")
+	if batchSize < 1 {
+		batchSize = 1
+	}
+
+	batchConns := make([]*BatchConn, len(playerRoute.Connections))
+	for i, connection := range playerRoute.Connections {
+		batchConn, err := NewBatchConn(connection, batchSize)
+		if err != nil {
+			logger.Println(err)
+			return
+		}
+		batchConns[i] = batchConn
+	}
+
+	batch := make([]UdpPacket, 0, batchSize)
+
+	bucket := newTokenBucket(config.GetValueInt("player_rate_limit_kbps"), config.GetValueInt("player_rate_limit_burst_bytes"))
+
+	// a nil channel never fires, so keepalives are off unless configured
+	var keepaliveChannel <-chan time.Time
+	keepaliveInterval := time.Duration(config.GetValueInt("keepalive_seconds")) * time.Second
+	if keepaliveInterval > 0 {
+		ticker := playerRoute.clock.NewTicker(keepaliveInterval / 2)
+		defer ticker.Stop()
+		keepaliveChannel = ticker.C()
+	}
+
 	for {
-		select {
-		case _, ok := <-playerRoute.DisconnectChannel:
-			if !ok {
+		if playerRoute.Ctx.Err() != nil {
+			return
+		}
+
+		// check for waiting packets first so that bulk ones only go out
+		// when there is nothing else
+		data, ok := playerRoute.TxQueue.tryReceive()
+		if !ok {
+			select {
+			case <-playerRoute.Ctx.Done():
 				return
+			case <-keepaliveChannel:
+				if playerRoute.idle() >= keepaliveInterval {
+					sendKeepalive(playerRoute)
+					if playerRoute.tearDownUnreachable() {
+						return
+					}
+				}
+				continue
+			case data = <-playerRoute.TxQueue.channel:
+			case data = <-playerRoute.TxQueue.bulk:
 			}
-		case _, ok := <-shutdownChannel:
+		}
+
+		batch = append(batch[:0], data)
+		for len(batch) < batchSize {
+			data, ok := playerRoute.TxQueue.tryReceive()
 			if !ok {
+				break
+			}
+			batch = append(batch, data)
+		}
+
+		// while waiting for the bucket the queue fills up, and sheds
+		// its oldest packets if the player keeps sending too much
+		size := 0
+		for _, packet := range batch {
+			size += len(packet.Buffer)
+		}
+		if wait := bucket.take(size); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-playerRoute.Ctx.Done():
+				timer.Stop()
+				for _, packet := range batch {
+					packet.Release()
+				}
 				return
 			}
-		case data := <-playerRoute.TxChannel:
-			_, err := playerRoute.Connection.WriteToUDP(data.Buffer, &data.DstAddr)
-			if err != nil {
-				fmt.Println(err)
+		}
+
+		for _, packet := range batch {
+			packet.Trace.Step("queue")
+		}
+		atomic.StoreInt64(&playerRoute.txBlocked, time.Now().UnixNano())
+		playerRoute.writeAll(batchConns[playerRoute.connectionIndex()], batch)
+		atomic.StoreInt64(&playerRoute.txBlocked, 0)
+		playerRoute.touch()
+		atomic.AddInt64(&playerRoute.txPackets, int64(len(batch)))
+		sent := time.Now()
+		for _, packet := range batch {
+			if !packet.Received.IsZero() {
+				packet.Latency.Observe(sent.Sub(packet.Received))
 			}
+			packet.Trace.Step("transmit")
+			packet.Trace.End()
+			packet.Release()
 		}
+		if playerRoute.tearDownUnreachable() {
+			return
+		}
+	}
+}
+
+// sendKeepalive sends an empty datagram to the player so their NAT keeps the
+// mapping for this proxy port open through quiet periods. Bolo discards it as
+// too short to be a packet.
+func sendKeepalive(playerRoute *Route) {
+	playerAddr := playerRoute.PlayerAddr()
+	connection := playerRoute.Connections[playerRoute.connectionIndex()]
+	_, err := connection.WriteToUDP([]byte{}, &playerAddr)
+	if err != nil {
+		playerRoute.writeFailed(classifyWriteError(err), err)
+	} else {
+		playerRoute.unreachableSince = time.Time{}
+	}
+	playerRoute.touch()
+}
+
+// PlayerAddr returns the player's current public address.
+func (playerRoute *Route) PlayerAddr() net.UDPAddr {
+	playerRoute.mutex.Lock()
+	defer playerRoute.mutex.Unlock()
+	return playerRoute.playerAddr
+}
+
+// SetPlayerAddr points the route at a new public address for the same player,
+// e.g. after their NAT rebinds.
+func (playerRoute *Route) SetPlayerAddr(addr net.UDPAddr) {
+	txIndex := selectConnectionIndex(playerRoute.Connections, addr.IP)
+
+	playerRoute.mutex.Lock()
+	defer playerRoute.mutex.Unlock()
+	playerRoute.playerAddr = addr
+	playerRoute.txIndex = txIndex
+}
+
+func (playerRoute *Route) connectionIndex() int {
+	playerRoute.mutex.Lock()
+	defer playerRoute.mutex.Unlock()
+	return playerRoute.txIndex
+}
+
+func (playerRoute *Route) touch() {
+	atomic.StoreInt64(&playerRoute.lastActivity, playerRoute.clock.Now().UnixNano())
+}
+
+func (playerRoute *Route) idle() time.Duration {
+	return clock.Since(playerRoute.clock, time.Unix(0, atomic.LoadInt64(&playerRoute.lastActivity)))
+}
+
+func (playerRoute *Route) touchReceived() {
+	atomic.StoreInt64(&playerRoute.lastReceived, playerRoute.clock.Now().UnixNano())
+}
+
+// ReceivedIdle is how long since the proxy port last received a packet.
+func (playerRoute *Route) ReceivedIdle() time.Duration {
+	return clock.Since(playerRoute.clock, time.Unix(0, atomic.LoadInt64(&playerRoute.lastReceived)))
+}
+
+// Packets returns how many packets the proxy port has received from the
+// player and sent to them.
+func (playerRoute *Route) Packets() (int64, int64) {
+	return atomic.LoadInt64(&playerRoute.rxPackets), atomic.LoadInt64(&playerRoute.txPackets)
+}
+
+// RxBlocked is how long the proxy port has been waiting to hand a packet from
+// the player to RxChannel, or 0 if it is not waiting.
+func (playerRoute *Route) RxBlocked() time.Duration {
+	return blockedFor(&playerRoute.rxBlocked)
+}
+
+// TxBlocked is how long the proxy port has been writing packets to the
+// player's socket, or 0 if it is not writing.
+func (playerRoute *Route) TxBlocked() time.Duration {
+	return blockedFor(&playerRoute.txBlocked)
+}
+
+func blockedFor(since *int64) time.Duration {
+	nanoseconds := atomic.LoadInt64(since)
+	if nanoseconds == 0 {
+		return 0
 	}
+	return time.Since(time.Unix(0, nanoseconds))
 }
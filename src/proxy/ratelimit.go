@@ -0,0 +1,64 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package proxy
+
+import "time"
+
+// tokenBucket shapes a route's outgoing traffic to a steady rate while
+// allowing short bursts. It is only used by the route's transmitter, so it
+// needs no locking.
+type tokenBucket struct {
+	rate   float64 // bytes per second
+	burst  float64 // bytes
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns nil, meaning no limit, if kbps is not positive.
+func newTokenBucket(kbps int, burstBytes int) *tokenBucket {
+	if kbps <= 0 {
+		return nil
+	}
+	rate := float64(kbps) * 1000 / 8
+	burst := float64(burstBytes)
+	if burst < float64(BufferSize()) {
+		// a burst smaller than one packet would never fill up enough
+		burst = float64(BufferSize())
+	}
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// take spends n bytes and returns how long to wait before sending them.
+func (bucket *tokenBucket) take(n int) time.Duration {
+	if bucket == nil {
+		return 0
+	}
+
+	now := time.Now()
+	bucket.tokens += now.Sub(bucket.last).Seconds() * bucket.rate
+	if bucket.tokens > bucket.burst {
+		bucket.tokens = bucket.burst
+	}
+	bucket.last = now
+
+	bucket.tokens -= float64(n)
+	if bucket.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-bucket.tokens / bucket.rate * float64(time.Second))
+}
@@ -0,0 +1,51 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package proxy
+
+import (
+	"runtime/debug"
+	"sync/atomic"
+
+	"git.astrospark.com/bolorama/privacy"
+)
+
+var panics uint64
+
+// Panics returns how many panics have been recovered in route goroutines.
+func Panics() uint64 {
+	return atomic.LoadUint64(&panics)
+}
+
+// recoverPanic recovers a panic in one of the route's goroutines, logging it
+// and tearing down the route instead of the whole server. It must be deferred.
+func (playerRoute *Route) recoverPanic(goroutine string) {
+	err := recover()
+	if err == nil {
+		return
+	}
+
+	playerAddr := playerRoute.PlayerAddr()
+	playerRoute.ports.logger.Printf("Recovered panic in the %s of proxy port %d (%s): %v\n%s", goroutine, playerRoute.ProxyPort,
+		privacy.Addr(playerAddr.IP, playerAddr.Port), err, debug.Stack())
+	atomic.AddUint64(&panics, 1)
+
+	playerRoute.cancel()
+	if playerRoute.onPanic != nil {
+		playerRoute.onPanic(playerRoute)
+	}
+}
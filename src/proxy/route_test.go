@@ -0,0 +1,56 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package proxy
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"git.astrospark.com/bolorama/clock"
+)
+
+func TestRouteIdleFollowsClock(t *testing.T) {
+	mock := clock.NewMock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	ports := NewPorts(firstPlayerPort, log.New(io.Discard, "", 0))
+	route := ports.newPlayerRoute(context.Background(), net.UDPAddr{}, firstPlayerPort, RouteOptions{TxQueueDepth: 1, Clock: mock})
+	defer route.cancel()
+	route.touch()
+	route.touchReceived()
+
+	mock.Advance(time.Minute)
+	if idle := route.idle(); idle != time.Minute {
+		t.Errorf("idle is %v a minute after activity", idle)
+	}
+	if idle := route.ReceivedIdle(); idle != time.Minute {
+		t.Errorf("received idle is %v a minute after receiving", idle)
+	}
+
+	// sending is activity, but only receiving resets ReceivedIdle
+	route.touch()
+	mock.Advance(time.Second)
+	if idle := route.idle(); idle != time.Second {
+		t.Errorf("idle is %v a second after activity", idle)
+	}
+	if idle := route.ReceivedIdle(); idle != time.Minute+time.Second {
+		t.Errorf("received idle is %v, reset by activity other than receiving", idle)
+	}
+}
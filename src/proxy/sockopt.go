@@ -0,0 +1,81 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+
+	"git.astrospark.com/bolorama/config"
+)
+
+// TuneSocket applies the configured kernel buffer sizes to a UDP socket,
+// udp_allow_fragmentation and the DSCP set by SetDscp. A configured size of 0
+// leaves the operating system default in place. Loopback sockets are left as
+// they are.
+func TuneSocket(packetConn PacketConn) error {
+	conn, ok := packetConn.(*net.UDPConn)
+	if !ok {
+		return nil
+	}
+
+	receiveBufferBytes := config.GetValueInt("socket_receive_buffer_bytes")
+	sendBufferBytes := config.GetValueInt("socket_send_buffer_bytes")
+
+	if receiveBufferBytes > 0 {
+		if err := conn.SetReadBuffer(receiveBufferBytes); err != nil {
+			return err
+		}
+	}
+
+	if sendBufferBytes > 0 {
+		if err := conn.SetWriteBuffer(sendBufferBytes); err != nil {
+			return err
+		}
+	}
+
+	if config.GetValueBool("udp_allow_fragmentation") {
+		if err := allowFragmentation(conn); err != nil {
+			return err
+		}
+	}
+
+	if dscp >= 0 {
+		// the DSCP is the top six bits of the TOS byte
+		if err := setTos(conn, dscp<<2); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SprintSocketBuffers describes the buffer sizes the kernel actually granted,
+// which may differ from those requested (Linux doubles the value and caps it
+// at net.core.rmem_max / wmem_max).
+func SprintSocketBuffers(packetConn PacketConn) string {
+	conn, ok := packetConn.(*net.UDPConn)
+	if !ok {
+		return "in memory"
+	}
+	receiveBufferBytes, sendBufferBytes, err := socketBufferSizes(conn)
+	if err != nil {
+		return fmt.Sprint("unknown (", err, ")")
+	}
+	return fmt.Sprintf("receive %d bytes, send %d bytes", receiveBufferBytes, sendBufferBytes)
+}
@@ -0,0 +1,86 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package proxy
+
+import (
+	"sync"
+)
+
+// UseStubRoutes makes AddPlayer create routes without sockets, for replaying
+// recordings. Packets queued on a stub route are handed to transmit, along
+// with the proxy port they would have been sent from, instead of being sent.
+func (ports *Ports) UseStubRoutes(transmit func(proxyPort int, packet UdpPacket)) {
+	ports.stubTransmit = transmit
+}
+
+// Stubbed reports whether stub routes are in use.
+func (ports *Ports) Stubbed() bool {
+	return ports.stubTransmit != nil
+}
+
+// TransmitStub hands packet to the stub transmit function, if stub routes are
+// in use, and reports whether it did.
+func (ports *Ports) TransmitStub(proxyPort int, packet UdpPacket) bool {
+	if ports.stubTransmit == nil {
+		return false
+	}
+	ports.stubTransmit(proxyPort, packet)
+	return true
+}
+
+// ReservePort keeps AddPlayer from assigning port, so that a replay can give
+// players the same proxy ports they had when the game was recorded. Ports
+// after it are still assigned in order on a fresh server.
+func (ports *Ports) ReservePort(port int) {
+	ports.allocator.reserve(port)
+}
+
+// FirstPlayerPort is the lowest port AddPlayer assigns on a server's main
+// tracker.
+func FirstPlayerPort() int {
+	return firstPlayerPort
+}
+
+// First is the lowest of the ports.
+func (ports *Ports) First() int {
+	return ports.allocator.first
+}
+
+func createStubProxy(wg *sync.WaitGroup, playerRoute *Route) {
+	playerRoute.touch()
+	playerRoute.touchReceived()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer playerRoute.recoverPanic("stub transmitter")
+		for {
+			packet, ok := playerRoute.TxQueue.tryReceive()
+			if !ok {
+				select {
+				case <-playerRoute.Ctx.Done():
+					return
+				case packet = <-playerRoute.TxQueue.channel:
+				case packet = <-playerRoute.TxQueue.bulk:
+				}
+			}
+			playerRoute.ports.stubTransmit(playerRoute.ProxyPort, packet)
+			packet.Release()
+		}
+	}()
+}
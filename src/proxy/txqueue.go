@@ -0,0 +1,99 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package proxy
+
+import (
+	"sync/atomic"
+)
+
+// TxQueue is a bounded queue of packets waiting to be written to a route's
+// socket. Send never blocks: when the queue is full the oldest packet is
+// dropped, since a stale game packet is worth less than a fresh one, and the
+// drop is counted so a congested route shows up in the server state.
+//
+// Bulk packets (map downloads) have a queue of their own, which is only
+// drained when no other packets are waiting, so a big transfer does not add
+// lag to the game.
+type TxQueue struct {
+	drops   uint64 // accessed atomically; kept first for alignment
+	channel chan UdpPacket
+	bulk    chan UdpPacket
+}
+
+func newTxQueue(depth int) *TxQueue {
+	return &TxQueue{
+		channel: make(chan UdpPacket, depth),
+		bulk:    make(chan UdpPacket, depth),
+	}
+}
+
+func (queue *TxQueue) Send(packet UdpPacket) {
+	queue.send(queue.channel, packet)
+}
+
+func (queue *TxQueue) SendBulk(packet UdpPacket) {
+	queue.send(queue.bulk, packet)
+}
+
+func (queue *TxQueue) send(channel chan UdpPacket, packet UdpPacket) {
+	for {
+		select {
+		case channel <- packet:
+			return
+		default:
+		}
+
+		select {
+		case oldest := <-channel:
+			oldest.Release()
+			atomic.AddUint64(&queue.drops, 1)
+			atomic.AddUint64(&txDrops, 1)
+		default:
+		}
+	}
+}
+
+// tryReceive returns the next packet if there is one waiting, taking bulk
+// packets only when there is nothing else.
+func (queue *TxQueue) tryReceive() (UdpPacket, bool) {
+	select {
+	case packet := <-queue.channel:
+		return packet, true
+	default:
+	}
+
+	select {
+	case packet := <-queue.bulk:
+		return packet, true
+	default:
+	}
+
+	return UdpPacket{}, false
+}
+
+func (queue *TxQueue) Drops() uint64 {
+	return atomic.LoadUint64(&queue.drops)
+}
+
+func (queue *TxQueue) Len() int {
+	return len(queue.channel) + len(queue.bulk)
+}
+
+func (queue *TxQueue) Cap() int {
+	return cap(queue.channel) + cap(queue.bulk)
+}
@@ -0,0 +1,149 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package proxy
+
+import (
+	"errors"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"git.astrospark.com/bolorama/clock"
+	"git.astrospark.com/bolorama/privacy"
+	"git.astrospark.com/bolorama/ratelog"
+)
+
+// Errors writing to a player are sorted into classes. A full kernel queue is
+// transient, so the packet is tried again after a short pause. Otherwise the
+// packet is skipped and the error counted for the route; a route that has
+// only had unreachable errors for kUnreachableTeardown is torn down, and its
+// player removed, rather than left to time out.
+const (
+	writeErrorBuffers     = iota // ENOBUFS, ENOMEM or EAGAIN: the send queue is full
+	writeErrorUnreachable        // no route to the player, or refused
+	writeErrorPermission         // EPERM or EACCES, usually a firewall rule
+	writeErrorOther
+	writeErrorClasses
+)
+
+var writeErrorNames = [writeErrorClasses]string{"nobufs", "unreachable", "permission", "other"}
+
+// kWriteRetries is how many times a packet is tried again after a transient
+// error, waiting kWriteRetryBackoff and then twice as long each time.
+const kWriteRetries = 3
+const kWriteRetryBackoff = 500 * time.Microsecond
+
+const kUnreachableTeardown = 10 * time.Second
+
+var txErrors [writeErrorClasses]uint64
+
+func classifyWriteError(err error) int {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return writeErrorOther
+	}
+	switch errno {
+	case syscall.ENOBUFS, syscall.ENOMEM, syscall.EAGAIN:
+		return writeErrorBuffers
+	case syscall.EHOSTUNREACH, syscall.ENETUNREACH, syscall.EHOSTDOWN, syscall.ENETDOWN, syscall.ECONNREFUSED:
+		return writeErrorUnreachable
+	case syscall.EPERM, syscall.EACCES:
+		return writeErrorPermission
+	}
+	return writeErrorOther
+}
+
+// writeAll sends every packet in the batch, retrying those that fail for want
+// of buffers and skipping over any that fail otherwise.
+func (playerRoute *Route) writeAll(batchConn *BatchConn, batch []UdpPacket) {
+	retries := 0
+	for len(batch) > 0 {
+		sent, err := batchConn.WriteBatch(batch)
+		if sent > 0 {
+			playerRoute.unreachableSince = time.Time{}
+			retries = 0
+		}
+		if err == nil {
+			return
+		}
+		batch = batch[sent:]
+
+		class := classifyWriteError(err)
+		if class == writeErrorBuffers && retries < kWriteRetries {
+			time.Sleep(kWriteRetryBackoff << retries)
+			retries++
+			continue
+		}
+		playerRoute.writeFailed(class, err)
+		batch = batch[1:]
+		retries = 0
+	}
+}
+
+// writeFailed counts and logs an error writing to the player, in the route's
+// writeErrors, which are accessed atomically.
+func (playerRoute *Route) writeFailed(class int, err error) {
+	atomic.AddInt64(&playerRoute.writeErrors[class], 1)
+	atomic.AddUint64(&txErrors[class], 1)
+	ratelog.Printf(playerRoute.ports.logger, "Proxy port %d: %s error: %v\n", playerRoute.ProxyPort, writeErrorNames[class], err)
+	if class == writeErrorUnreachable && playerRoute.unreachableSince.IsZero() {
+		playerRoute.unreachableSince = playerRoute.clock.Now()
+	}
+}
+
+// tearDownUnreachable tears the route down if its player has been unreachable
+// for kUnreachableTeardown, returning whether it did. Only the transmitter
+// may call it.
+func (playerRoute *Route) tearDownUnreachable() bool {
+	if playerRoute.unreachableSince.IsZero() || clock.Since(playerRoute.clock, playerRoute.unreachableSince) < kUnreachableTeardown {
+		return false
+	}
+	playerAddr := playerRoute.PlayerAddr()
+	playerRoute.ports.logger.Printf("Proxy port %d: %s unreachable for %s, dropping the route\n", playerRoute.ProxyPort,
+		privacy.Addr(playerAddr.IP, playerAddr.Port), kUnreachableTeardown)
+	playerRoute.cancel()
+	if playerRoute.onUnreachable != nil {
+		playerRoute.onUnreachable(playerRoute)
+	}
+	return true
+}
+
+// WriteErrors returns how many errors of each class writing to the player
+// the route has had, leaving out classes it has had none of.
+func (playerRoute *Route) WriteErrors() map[string]int64 {
+	var errors map[string]int64
+	for class, name := range writeErrorNames {
+		if count := atomic.LoadInt64(&playerRoute.writeErrors[class]); count > 0 {
+			if errors == nil {
+				errors = make(map[string]int64)
+			}
+			errors[name] = count
+		}
+	}
+	return errors
+}
+
+// TxErrors returns how many errors of each class writing to players all
+// routes have had.
+func TxErrors() map[string]uint64 {
+	errors := make(map[string]uint64)
+	for class, name := range writeErrorNames {
+		errors[name] = atomic.LoadUint64(&txErrors[class])
+	}
+	return errors
+}
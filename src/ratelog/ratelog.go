@@ -0,0 +1,94 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package ratelog prints log lines that may repeat once per packet, such as a
+// failure to send to a player who has gone away, without flooding the log.
+// The first time a line is printed it goes out as usual; the same line again
+// within log_repeat_seconds is only counted, and when that time is up
+//
+//	message repeated 1523 times in 30s: write udp ...: connection refused
+//
+// is printed in its place.
+package ratelog
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.astrospark.com/bolorama/config"
+)
+
+var (
+	mutex      sync.Mutex
+	repeats    = make(map[string]int)
+	suppressed uint64
+)
+
+// Println logs its operands to logger like logger.Println, collapsing
+// repeats.
+func Println(logger *log.Logger, a ...interface{}) {
+	printLine(logger, fmt.Sprintln(a...))
+}
+
+// Printf logs to logger like logger.Printf, collapsing repeats.
+func Printf(logger *log.Logger, format string, a ...interface{}) {
+	printLine(logger, fmt.Sprintf(format, a...))
+}
+
+func printLine(logger *log.Logger, line string) {
+	window := time.Duration(config.GetValueInt("log_repeat_seconds")) * time.Second
+	if window <= 0 {
+		logger.Print(line)
+		return
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if count, ok := repeats[line]; ok {
+		repeats[line] = count + 1
+		atomic.AddUint64(&suppressed, 1)
+		return
+	}
+	repeats[line] = 0
+	logger.Print(line)
+	time.AfterFunc(window, func() {
+		flush(logger, line, window)
+	})
+}
+
+// flush ends the window of line, reporting how often it was repeated.
+func flush(logger *log.Logger, line string, window time.Duration) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	count := repeats[line]
+	delete(repeats, line)
+	if count > 0 {
+		logger.Printf("message repeated %d times in %s: %s\n", count, window,
+			strings.TrimSuffix(line, "\n"))
+	}
+}
+
+// Suppressed returns how many lines have been collapsed into repeat counts.
+func Suppressed() uint64 {
+	return atomic.LoadUint64(&suppressed)
+}
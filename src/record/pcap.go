@@ -0,0 +1,300 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package record
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+// pcap files hold the packets with synthesized IPv4 and UDP headers (link
+// type raw IP), so they open in Wireshark and the Bolo dissector in
+// wireshark/bolo.lua picks them up.
+
+const pcapMagic = 0xa1b2c3d4 // microsecond timestamps
+const pcapSnapLength = 65535
+const pcapLinkTypeRaw = 101
+const pcapRecordHeaderSize = 16
+const ipv4HeaderSize = 20
+const udpHeaderSize = 8
+
+type pcapFile struct {
+	file     *os.File
+	writer   *bufio.Writer
+	bytes    int64
+	maxBytes int64 // 0 for no limit
+	full     bool
+}
+
+func createPcapFile(filename string, maxBytes int64) (*pcapFile, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:4], pcapMagic)
+	binary.LittleEndian.PutUint16(header[4:6], 2)
+	binary.LittleEndian.PutUint16(header[6:8], 4)
+	binary.LittleEndian.PutUint32(header[16:20], pcapSnapLength)
+	binary.LittleEndian.PutUint32(header[20:24], pcapLinkTypeRaw)
+
+	writer := bufio.NewWriter(file)
+	if _, err := writer.Write(header); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &pcapFile{file: file, writer: writer, bytes: int64(len(header)), maxBytes: maxBytes}, nil
+}
+
+func (pcap *pcapFile) write(packet Packet, proxyIp net.IP) error {
+	if pcap.full {
+		return nil
+	}
+
+	length := ipv4HeaderSize + udpHeaderSize + len(packet.Buffer)
+	if pcap.maxBytes > 0 && pcap.bytes+int64(pcapRecordHeaderSize+length) > pcap.maxBytes {
+		pcap.full = true
+		return fmt.Errorf("%s reached pcap_max_bytes, not capturing any more", pcap.file.Name())
+	}
+
+	proxyAddr := net.UDPAddr{IP: proxyIp, Port: packet.ProxyPort}
+	src, dst := packet.PlayerAddr, proxyAddr
+	if packet.Direction == Outbound {
+		src, dst = proxyAddr, packet.PlayerAddr
+	}
+
+	record := make([]byte, pcapRecordHeaderSize+ipv4HeaderSize+udpHeaderSize, pcapRecordHeaderSize+length)
+	micros := packet.Time.UnixNano() / 1000
+	binary.LittleEndian.PutUint32(record[0:4], uint32(micros/1000000))
+	binary.LittleEndian.PutUint32(record[4:8], uint32(micros%1000000))
+	binary.LittleEndian.PutUint32(record[8:12], uint32(length))
+	binary.LittleEndian.PutUint32(record[12:16], uint32(length))
+
+	ip := record[pcapRecordHeaderSize : pcapRecordHeaderSize+ipv4HeaderSize]
+	ip[0] = 0x45 // version 4, 5 word header
+	binary.BigEndian.PutUint16(ip[2:4], uint16(length))
+	ip[8] = 64 // ttl
+	ip[9] = 17 // udp
+	copy(ip[12:16], src.IP.To4())
+	copy(ip[16:20], dst.IP.To4())
+	binary.BigEndian.PutUint16(ip[10:12], ipv4Checksum(ip))
+
+	// udp checksum left as zero, which means none for IPv4
+	udp := record[pcapRecordHeaderSize+ipv4HeaderSize:]
+	binary.BigEndian.PutUint16(udp[0:2], uint16(src.Port))
+	binary.BigEndian.PutUint16(udp[2:4], uint16(dst.Port))
+	binary.BigEndian.PutUint16(udp[4:6], uint16(udpHeaderSize+len(packet.Buffer)))
+
+	record = append(record, packet.Buffer...)
+	_, err := pcap.writer.Write(record)
+	pcap.bytes += int64(len(record))
+	return err
+}
+
+func (pcap *pcapFile) close() error {
+	err := pcap.writer.Flush()
+	pcap.file.Close()
+	return err
+}
+
+func ipv4Checksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i : i+2]))
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+const pcapMagicNanoseconds = 0xa1b23c4d
+const pcapLinkTypeNull = 0
+const pcapLinkTypeEthernet = 1
+const pcapLinkTypeLinuxCooked = 113
+const pcapLinkTypeIPv4 = 228
+const pcapLinkTypeIPv6 = 229
+
+// PcapPacket is a UDP datagram read from a pcap file.
+type PcapPacket struct {
+	Time    time.Time
+	SrcAddr net.UDPAddr
+	DstAddr net.UDPAddr
+	Buffer  []byte
+}
+
+// PcapReader reads the UDP datagrams in a pcap file, such as one written with
+// pcap_directory or captured with tcpdump. Link types raw IP, Ethernet, BSD
+// loopback and Linux cooked capture are understood, over IPv4 or IPv6. Other
+// packets, and fragments past the first, are skipped.
+type PcapReader struct {
+	reader      *bufio.Reader
+	byteOrder   binary.ByteOrder
+	nanoseconds bool
+	linkType    uint32
+}
+
+func NewPcapReader(r io.Reader) (*PcapReader, error) {
+	reader := &PcapReader{reader: bufio.NewReader(r)}
+
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(reader.reader, header); err != nil {
+		return nil, err
+	}
+	switch {
+	case binary.LittleEndian.Uint32(header[0:4]) == pcapMagic:
+		reader.byteOrder = binary.LittleEndian
+	case binary.BigEndian.Uint32(header[0:4]) == pcapMagic:
+		reader.byteOrder = binary.BigEndian
+	case binary.LittleEndian.Uint32(header[0:4]) == pcapMagicNanoseconds:
+		reader.byteOrder = binary.LittleEndian
+		reader.nanoseconds = true
+	case binary.BigEndian.Uint32(header[0:4]) == pcapMagicNanoseconds:
+		reader.byteOrder = binary.BigEndian
+		reader.nanoseconds = true
+	default:
+		return nil, errors.New("not a pcap file (pcapng is not supported)")
+	}
+
+	reader.linkType = reader.byteOrder.Uint32(header[20:24]) & 0x0fffffff
+	switch reader.linkType {
+	case pcapLinkTypeNull, pcapLinkTypeEthernet, pcapLinkTypeRaw, pcapLinkTypeLinuxCooked, pcapLinkTypeIPv4, pcapLinkTypeIPv6:
+	default:
+		return nil, fmt.Errorf("unsupported pcap link type %d", reader.linkType)
+	}
+	return reader, nil
+}
+
+// Next returns the next UDP datagram, or io.EOF after the last one.
+func (reader *PcapReader) Next() (PcapPacket, error) {
+	for {
+		var header [pcapRecordHeaderSize]byte
+		if _, err := io.ReadFull(reader.reader, header[:]); err != nil {
+			return PcapPacket{}, err
+		}
+
+		length := reader.byteOrder.Uint32(header[8:12])
+		if length > pcapSnapLength*4 {
+			return PcapPacket{}, errors.New("corrupt pcap file: packet too long")
+		}
+		frame := make([]byte, length)
+		if _, err := io.ReadFull(reader.reader, frame); err != nil {
+			return PcapPacket{}, io.ErrUnexpectedEOF
+		}
+
+		seconds := int64(reader.byteOrder.Uint32(header[0:4]))
+		fraction := int64(reader.byteOrder.Uint32(header[4:8]))
+		if !reader.nanoseconds {
+			fraction = fraction * 1000
+		}
+
+		packet, ok := reader.parseFrame(frame)
+		if !ok {
+			continue
+		}
+		packet.Time = time.Unix(seconds, fraction)
+		return packet, nil
+	}
+}
+
+// parseFrame finds the UDP datagram in a captured frame.
+func (reader *PcapReader) parseFrame(frame []byte) (PcapPacket, bool) {
+	switch reader.linkType {
+	case pcapLinkTypeNull:
+		if len(frame) < 4 {
+			return PcapPacket{}, false
+		}
+		frame = frame[4:]
+	case pcapLinkTypeEthernet:
+		if len(frame) < 14 {
+			return PcapPacket{}, false
+		}
+		etherType := binary.BigEndian.Uint16(frame[12:14])
+		frame = frame[14:]
+		// skip VLAN tags
+		for (etherType == 0x8100 || etherType == 0x88a8) && len(frame) >= 4 {
+			etherType = binary.BigEndian.Uint16(frame[2:4])
+			frame = frame[4:]
+		}
+	case pcapLinkTypeLinuxCooked:
+		if len(frame) < 16 {
+			return PcapPacket{}, false
+		}
+		frame = frame[16:]
+	}
+	return parseIpUdp(frame)
+}
+
+// parseIpUdp returns the UDP datagram in an IPv4 or IPv6 packet.
+func parseIpUdp(ip []byte) (PcapPacket, bool) {
+	var packet PcapPacket
+	var udp []byte
+
+	if len(ip) < 1 {
+		return packet, false
+	}
+	switch ip[0] >> 4 {
+	case 4:
+		if len(ip) < ipv4HeaderSize {
+			return packet, false
+		}
+		headerLength := int(ip[0]&0x0f) * 4
+		fragmentOffset := binary.BigEndian.Uint16(ip[6:8]) & 0x1fff
+		if ip[9] != 17 || fragmentOffset != 0 || headerLength < ipv4HeaderSize || len(ip) < headerLength {
+			return packet, false
+		}
+		if totalLength := int(binary.BigEndian.Uint16(ip[2:4])); totalLength >= headerLength && totalLength < len(ip) {
+			// drop Ethernet padding
+			ip = ip[:totalLength]
+		}
+		packet.SrcAddr.IP = net.IP(append([]byte(nil), ip[12:16]...))
+		packet.DstAddr.IP = net.IP(append([]byte(nil), ip[16:20]...))
+		udp = ip[headerLength:]
+	case 6:
+		const ipv6HeaderSize = 40
+		// extension headers are not followed
+		if len(ip) < ipv6HeaderSize || ip[6] != 17 {
+			return packet, false
+		}
+		packet.SrcAddr.IP = net.IP(append([]byte(nil), ip[8:24]...))
+		packet.DstAddr.IP = net.IP(append([]byte(nil), ip[24:40]...))
+		udp = ip[ipv6HeaderSize:]
+	default:
+		return packet, false
+	}
+
+	if len(udp) < udpHeaderSize {
+		return packet, false
+	}
+	packet.SrcAddr.Port = int(binary.BigEndian.Uint16(udp[0:2]))
+	packet.DstAddr.Port = int(binary.BigEndian.Uint16(udp[2:4]))
+	payload := udp[udpHeaderSize:]
+	if udpLength := int(binary.BigEndian.Uint16(udp[4:6])); udpLength >= udpHeaderSize && udpLength-udpHeaderSize < len(payload) {
+		payload = payload[:udpLength-udpHeaderSize]
+	}
+	packet.Buffer = payload
+	return packet, true
+}
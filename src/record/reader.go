@@ -0,0 +1,97 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package record
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"git.astrospark.com/bolorama/bolo"
+)
+
+// Reader reads back a recording written by Recorder.
+type Reader struct {
+	GameId   bolo.GameId
+	Start    time.Time
+	reader   *bufio.Reader
+	previous time.Time
+}
+
+func NewReader(r io.Reader) (*Reader, error) {
+	reader := &Reader{reader: bufio.NewReader(r)}
+
+	header := make([]byte, 21)
+	if _, err := io.ReadFull(reader.reader, header); err != nil {
+		return nil, err
+	}
+	if string(header[0:4]) != fileMagic {
+		return nil, errors.New("not a bolorama recording")
+	}
+	if header[4] != fileVersion {
+		return nil, errors.New("unsupported recording version")
+	}
+
+	copy(reader.GameId[:], header[5:13])
+	reader.Start = time.Unix(0, int64(binary.BigEndian.Uint64(header[13:21])))
+	reader.previous = reader.Start
+	return reader, nil
+}
+
+// Next returns the next packet, or io.EOF after the last one.
+func (reader *Reader) Next() (Packet, error) {
+	delta, err := binary.ReadUvarint(reader.reader)
+	if err != nil {
+		return Packet{}, err
+	}
+
+	var fixed [9]byte
+	if _, err := io.ReadFull(reader.reader, fixed[:]); err != nil {
+		return Packet{}, io.ErrUnexpectedEOF
+	}
+
+	length, err := binary.ReadUvarint(reader.reader)
+	if err != nil {
+		return Packet{}, io.ErrUnexpectedEOF
+	}
+	if length > 65535 {
+		return Packet{}, errors.New("corrupt recording: packet too long")
+	}
+
+	buffer := make([]byte, length)
+	if _, err := io.ReadFull(reader.reader, buffer); err != nil {
+		return Packet{}, io.ErrUnexpectedEOF
+	}
+
+	reader.previous = reader.previous.Add(time.Duration(delta) * time.Microsecond)
+
+	return Packet{
+		Time:      reader.previous,
+		GameId:    reader.GameId,
+		Direction: Direction(fixed[0]),
+		ProxyPort: int(binary.BigEndian.Uint16(fixed[1:3])),
+		PlayerAddr: net.UDPAddr{
+			IP:   net.IP(append([]byte(nil), fixed[3:7]...)),
+			Port: int(binary.BigEndian.Uint16(fixed[7:9])),
+		},
+		Buffer: buffer,
+	}, nil
+}
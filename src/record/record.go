@@ -0,0 +1,308 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package record
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.astrospark.com/bolorama/bolo"
+	"git.astrospark.com/bolorama/events"
+)
+
+// A recording holds every packet of one game as it passed through the proxy.
+// All integers are big endian.
+//
+//	file header:   "BREC" | format version (1) | game id (8) | start time (8, unix nanoseconds)
+//	packet record: time since previous record (uvarint, microseconds) |
+//	               direction (1) | proxy port (2) | player ip (4) | player port (2) |
+//	               length (uvarint) | packet bytes
+//
+// For Inbound packets the player address is the sender and the proxy port the
+// one it was sent to; for Outbound packets the player address is the receiver
+// and the proxy port the one it was sent from. Joined records have no packet
+// bytes and give the proxy port assigned to a player address, so that a
+// replay can recreate the routes.
+
+const fileMagic = "BREC"
+const fileVersion = 1
+const FileExtension = ".brec"
+
+const kQueueLength = 1024
+
+type Direction byte
+
+const (
+	Inbound  Direction = 0
+	Outbound Direction = 1
+	Joined   Direction = 2
+)
+
+type Packet struct {
+	Time       time.Time
+	GameId     bolo.GameId
+	Direction  Direction
+	ProxyPort  int
+	PlayerAddr net.UDPAddr
+	Buffer     []byte
+}
+
+// Recorder writes a recording per game to a directory, and/or a pcap file
+// per game to another. Record may be called from any goroutine and never
+// blocks; packets are dropped if the writer falls behind. A nil Recorder
+// records nothing.
+type Recorder struct {
+	dropped       uint64 // accessed atomically; kept first for alignment
+	directory     string
+	pcapDirectory string
+	pcapMaxBytes  int64
+	proxyIp       func() net.IP
+	queue         chan Packet
+	files         map[bolo.GameId]*recording
+	logger        *log.Logger
+}
+
+type recording struct {
+	file     *os.File // nil if only writing pcap
+	writer   *bufio.Writer
+	previous time.Time
+	pcap     *pcapFile // nil if not writing pcap
+}
+
+// NewRecorder returns nil if both directories are empty. proxyIp gives the
+// proxy's address for the synthesized IP headers in pcap files. Failures to
+// write are logged to logger.
+func NewRecorder(directory string, pcapDirectory string, pcapMaxBytes int64, proxyIp func() net.IP, logger *log.Logger) *Recorder {
+	if directory == "" && pcapDirectory == "" {
+		return nil
+	}
+	return &Recorder{
+		directory:     directory,
+		pcapDirectory: pcapDirectory,
+		pcapMaxBytes:  pcapMaxBytes,
+		proxyIp:       proxyIp,
+		queue:         make(chan Packet, kQueueLength),
+		files:         make(map[bolo.GameId]*recording),
+		logger:        logger,
+	}
+}
+
+// Record queues a copy of buffer for writing.
+func (recorder *Recorder) Record(gameId bolo.GameId, direction Direction, proxyPort int, playerAddr net.UDPAddr, buffer []byte) {
+	if recorder == nil {
+		return
+	}
+
+	packet := Packet{
+		Time:       time.Now(),
+		GameId:     gameId,
+		Direction:  direction,
+		ProxyPort:  proxyPort,
+		PlayerAddr: playerAddr,
+		Buffer:     append([]byte(nil), buffer...),
+	}
+
+	select {
+	case recorder.queue <- packet:
+	default:
+		atomic.AddUint64(&recorder.dropped, 1)
+	}
+}
+
+// Run writes queued packets until subscription is closed, closing each
+// game's file when the game ends.
+func (recorder *Recorder) Run(wg *sync.WaitGroup, subscription <-chan events.Event) {
+	defer wg.Done()
+	defer func() {
+		recorder.logger.Println("Stopped recorder")
+	}()
+
+	for _, directory := range []string{recorder.directory, recorder.pcapDirectory} {
+		if directory == "" {
+			continue
+		}
+		if err := os.MkdirAll(directory, 0755); err != nil {
+			recorder.logger.Println(err)
+		}
+	}
+
+	for {
+		select {
+		case packet := <-recorder.queue:
+			recorder.write(packet)
+		case event, ok := <-subscription:
+			if !ok {
+				recorder.flush()
+				return
+			}
+			switch event.Type {
+			case events.GameEnded:
+				recorder.close(event.GameId)
+			case events.PlayerJoined, events.PlayerMigrated:
+				recorder.write(Packet{
+					Time:       event.Timestamp,
+					GameId:     event.GameId,
+					Direction:  Joined,
+					ProxyPort:  event.PlayerAddr.ProxyPort,
+					PlayerAddr: net.UDPAddr{IP: net.ParseIP(event.PlayerAddr.IpAddr), Port: event.PlayerAddr.IpPort},
+				})
+			}
+		}
+	}
+}
+
+func (recorder *Recorder) flush() {
+	for {
+		select {
+		case packet := <-recorder.queue:
+			recorder.write(packet)
+		default:
+			for gameId := range recorder.files {
+				recorder.close(gameId)
+			}
+			if dropped := atomic.LoadUint64(&recorder.dropped); dropped > 0 {
+				recorder.logger.Printf("  recorder dropped %d packets\n", dropped)
+			}
+			return
+		}
+	}
+}
+
+func (recorder *Recorder) write(packet Packet) {
+	r, ok := recorder.files[packet.GameId]
+	if !ok {
+		var err error
+		r, err = recorder.open(packet.GameId, packet.Time)
+		if err != nil {
+			recorder.logger.Println(err)
+			return
+		}
+		recorder.files[packet.GameId] = r
+	}
+
+	if r.file != nil {
+		if err := writePacket(r.writer, packet, r.previous); err != nil {
+			recorder.logger.Println(err)
+		}
+		r.previous = packet.Time
+	}
+
+	if r.pcap != nil && packet.Direction != Joined {
+		if err := r.pcap.write(packet, recorder.proxyIp()); err != nil {
+			recorder.logger.Println(err)
+		}
+	}
+}
+
+func (recorder *Recorder) open(gameId bolo.GameId, start time.Time) (*recording, error) {
+	r := &recording{previous: start}
+	basename := fmt.Sprintf("%s-%s", hex.EncodeToString(gameId[:]), start.UTC().Format("20060102T150405Z"))
+
+	if recorder.directory != "" {
+		file, err := os.Create(filepath.Join(recorder.directory, basename+FileExtension))
+		if err != nil {
+			return nil, err
+		}
+		recorder.logger.Println("Recording game to", file.Name())
+
+		writer := bufio.NewWriter(file)
+		header := make([]byte, 0, 21)
+		header = append(header, fileMagic...)
+		header = append(header, fileVersion)
+		header = append(header, gameId[:]...)
+		header = appendUint64(header, uint64(start.UnixNano()))
+		if _, err := writer.Write(header); err != nil {
+			file.Close()
+			return nil, err
+		}
+		r.file = file
+		r.writer = writer
+	}
+
+	if recorder.pcapDirectory != "" {
+		pcap, err := createPcapFile(filepath.Join(recorder.pcapDirectory, basename+".pcap"), recorder.pcapMaxBytes)
+		if err != nil {
+			if r.file != nil {
+				r.file.Close()
+			}
+			return nil, err
+		}
+		recorder.logger.Println("Capturing game to", pcap.file.Name())
+		r.pcap = pcap
+	}
+
+	return r, nil
+}
+
+func (recorder *Recorder) close(gameId bolo.GameId) {
+	r, ok := recorder.files[gameId]
+	if !ok {
+		return
+	}
+	if r.file != nil {
+		if err := r.writer.Flush(); err != nil {
+			recorder.logger.Println(err)
+		}
+		r.file.Close()
+	}
+	if r.pcap != nil {
+		if err := r.pcap.close(); err != nil {
+			recorder.logger.Println(err)
+		}
+	}
+	delete(recorder.files, gameId)
+}
+
+func writePacket(writer *bufio.Writer, packet Packet, previous time.Time) error {
+	var scratch [binary.MaxVarintLen64]byte
+
+	delta := packet.Time.Sub(previous).Microseconds()
+	if delta < 0 {
+		delta = 0
+	}
+	n := binary.PutUvarint(scratch[:], uint64(delta))
+	writer.Write(scratch[:n])
+
+	var fixed [9]byte
+	fixed[0] = byte(packet.Direction)
+	binary.BigEndian.PutUint16(fixed[1:3], uint16(packet.ProxyPort))
+	copy(fixed[3:7], packet.PlayerAddr.IP.To4())
+	binary.BigEndian.PutUint16(fixed[7:9], uint16(packet.PlayerAddr.Port))
+	writer.Write(fixed[:])
+
+	n = binary.PutUvarint(scratch[:], uint64(len(packet.Buffer)))
+	writer.Write(scratch[:n])
+
+	_, err := writer.Write(packet.Buffer)
+	return err
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var bytes [8]byte
+	binary.BigEndian.PutUint64(bytes[:], v)
+	return append(b, bytes[:]...)
+}
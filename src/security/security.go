@@ -0,0 +1,137 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package security
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.astrospark.com/bolorama/config"
+)
+
+// Security events are appended to security_log, one per line, in a format
+// that stays the same between releases so fail2ban or CrowdSec can match it:
+//
+//	2021-03-01T20:00:00Z bolorama security: <event> src=<ip> port=<port> detail="<text>"
+//
+// port is 0 when not known. detail has no double quotes or newlines.
+
+// Events
+const Malformed = "malformed" // a packet that is not Bolo or WinBolo
+const Flood = "flood"         // a source blacklisted for flooding
+const Refused = "refused"     // a player turned away, e.g. kicked or banned
+const Kicked = "kicked"       // a player kicked by the operator or a host
+
+var mutex sync.Mutex
+var file *os.File
+var opened bool
+
+// Log appends an event to security_log. Does nothing unless it is set.
+// Failing to open the file is returned once, the first time.
+func Log(event string, ip net.IP, port int, detail string) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if !opened {
+		opened = true
+		if err := openLog(); err != nil {
+			return err
+		}
+	}
+	if file == nil {
+		return nil
+	}
+
+	quoted := strconv.Quote(detail)
+	line := fmt.Sprintf("%s bolorama security: %s src=%s port=%d detail=%s\n",
+		time.Now().UTC().Format(time.RFC3339), event, ip.String(), port, quoted)
+	if _, err := file.WriteString(line); err != nil {
+		return fmt.Errorf("failed to write security log: %s", err)
+	}
+	return nil
+}
+
+func openLog() error {
+	filename := config.GetValueString("security_log")
+	if filename == "" {
+		return nil
+	}
+	var err error
+	file, err = os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		file = nil
+		return fmt.Errorf("failed to open security log: %s", err)
+	}
+	return nil
+}
+
+// Purge removes the events of ip from security_log. Returns how many were
+// removed.
+func Purge(ip net.IP) (int, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	filename := config.GetValueString("security_log")
+	if filename == "" {
+		return 0, nil
+	}
+	buffer, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	var kept strings.Builder
+	match := " src=" + ip.String() + " "
+	for _, line := range strings.SplitAfter(string(buffer), "\n") {
+		if strings.Contains(line, match) {
+			removed++
+			continue
+		}
+		kept.WriteString(line)
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+
+	if err := ioutil.WriteFile(filename+".tmp", []byte(kept.String()), 0644); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(filename+".tmp", filename); err != nil {
+		return 0, err
+	}
+	// the open file is the one just replaced
+	if file != nil {
+		file.Close()
+		file = nil
+	}
+	opened = true
+	if err := openLog(); err != nil {
+		return removed, err
+	}
+	return removed, nil
+}
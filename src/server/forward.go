@@ -0,0 +1,154 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"hash/fnv"
+	"runtime"
+
+	"git.astrospark.com/bolorama/bolo"
+	"git.astrospark.com/bolorama/protocol"
+	"git.astrospark.com/bolorama/proxy"
+	"git.astrospark.com/bolorama/state"
+)
+
+// Packets are rewritten and queued for sending by a fixed set of forward
+// workers rather than a goroutine each. All packets of a game go to the same
+// worker, so they reach the transmit queues in the order they arrived, while
+// the games are spread over the workers. A worker's queue is bounded: when it
+// is full the RxChannel consumer waits, and handles player info and players
+// leaving meanwhile, since the worker may be waiting for it to do so.
+
+// kForwardQueueDepth is how many packets wait for each worker.
+const kForwardQueueDepth = 256
+
+type forwardJob struct {
+	handler   protocol.Handler
+	packet    proxy.UdpPacket
+	srcPlayer state.Player
+	dstPlayer state.Player
+	muted     []int
+}
+
+// StartWorkers starts count forward workers, or one per CPU if count is 0.
+// They stop when the network is shut down. Without workers each packet is
+// forwarded on a goroutine of its own. Call it before the router is used.
+func (router *Router) StartWorkers(count int) {
+	if count <= 0 {
+		count = runtime.NumCPU()
+	}
+	router.queues = make([]chan forwardJob, count)
+	for i := range router.queues {
+		router.queues[i] = make(chan forwardJob, kForwardQueueDepth)
+		router.workers.Add(1)
+		go router.forwardWorker(router.queues[i])
+	}
+}
+
+// WaitWorkers waits for the forward workers to stop once the network is shut
+// down, handling the player events they send meanwhile, as Run does.
+func (router *Router) WaitWorkers() {
+	done := make(chan struct{})
+	go func() {
+		router.workers.Wait()
+		close(done)
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		case playerInfo := <-router.playerInfo:
+			router.HandlePlayerInfo(playerInfo)
+		case playerAddr := <-router.playerLeave:
+			router.HandlePlayerLeave(playerAddr)
+		}
+	}
+}
+
+func (router *Router) forwardWorker(queue chan forwardJob) {
+	defer router.workers.Done()
+
+	for {
+		select {
+		case <-router.context.Network.Ctx.Done():
+			for {
+				select {
+				case job := <-queue:
+					job.packet.Release()
+				default:
+					return
+				}
+			}
+		case job := <-queue:
+			router.forwardPacket(job.handler, job.packet, job.srcPlayer, job.dstPlayer, job.muted)
+		}
+	}
+}
+
+// Queued returns how many packets wait for the forward workers.
+func (router *Router) Queued() int {
+	queued := 0
+	for _, queue := range router.queues {
+		queued += len(queue)
+	}
+	return queued
+}
+
+// forwardWorkerFor returns the index of the worker for a game's packets.
+func (router *Router) forwardWorkerFor(gameId bolo.GameId) int {
+	hash := fnv.New32a()
+	hash.Write(gameId[:])
+	return int(hash.Sum32() % uint32(len(router.queues)))
+}
+
+// startForward hands packet to the worker for its game, or forwards it on a
+// goroutine of its own if there are no workers (a replay), or before
+// returning if the router forwards inline. It must not be called from the
+// state goroutine, since it may wait for the router's player events.
+func (router *Router) startForward(
+	handler protocol.Handler,
+	packet proxy.UdpPacket,
+	srcPlayer state.Player,
+	dstPlayer state.Player,
+	muted []int,
+) {
+	if router.inline {
+		router.forwardPacket(handler, packet, srcPlayer, dstPlayer, muted)
+		return
+	}
+	if router.queues == nil {
+		go router.forwardPacket(handler, packet, srcPlayer, dstPlayer, muted)
+		return
+	}
+
+	queue := router.queues[router.forwardWorkerFor(srcPlayer.GameId)]
+	job := forwardJob{handler: handler, packet: packet, srcPlayer: srcPlayer, dstPlayer: dstPlayer, muted: muted}
+	for {
+		select {
+		case queue <- job:
+			return
+		case playerInfo := <-router.playerInfo:
+			router.HandlePlayerInfo(playerInfo)
+		case playerAddr := <-router.playerLeave:
+			router.HandlePlayerLeave(playerAddr)
+		case <-router.context.Network.Ctx.Done():
+			packet.Release()
+			return
+		}
+	}
+}
@@ -0,0 +1,194 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"runtime"
+	"time"
+
+	"git.astrospark.com/bolorama/config"
+	"git.astrospark.com/bolorama/metrics"
+	"git.astrospark.com/bolorama/protocol"
+	"git.astrospark.com/bolorama/proxy"
+	"git.astrospark.com/bolorama/ratelog"
+	"git.astrospark.com/bolorama/state"
+	"git.astrospark.com/bolorama/tracker"
+)
+
+// registerMetrics registers the metrics published on /debug/vars (see
+// pprof_port) and pushed to statsd_address.
+func registerMetrics(context *state.ServerContext, router *Router) {
+	metrics.Gauge("goroutines", func() int64 {
+		return int64(runtime.NumGoroutine())
+	})
+	metrics.Gauge("players", func() int64 {
+		var players int
+		state.Do(context, func(s *state.State) {
+			players = len(s.Players)
+		})
+		return int64(players)
+	})
+	metrics.Gauge("games", func() int64 {
+		var games int
+		state.Do(context, func(s *state.State) {
+			games = len(s.Games)
+		})
+		return int64(games)
+	})
+	metrics.Gauge("proxy_ports", func() int64 {
+		var ports int
+		state.Do(context, func(s *state.State) {
+			ports = context.Ports.PlayerPortsInUse()
+		})
+		return int64(ports)
+	})
+	metrics.Gauge("proxy_socket_pool", func() int64 {
+		return int64(context.Ports.SocketPoolIdle())
+	})
+	metrics.Gauge("proxy_ports_percent", func() int64 {
+		var ports int
+		state.Do(context, func(s *state.State) {
+			ports = context.Ports.PlayerPortsInUse()
+		})
+		return int64(ports * 100 / proxy.MaxPlayerPorts)
+	})
+	metrics.Counter("proxy_unknown_packets", func() int64 {
+		return int64(protocol.Undetected())
+	})
+	metrics.Counter("panics", func() int64 {
+		return int64(state.Panics())
+	})
+	metrics.Counter("log_repeats_suppressed", func() int64 {
+		return int64(ratelog.Suppressed())
+	})
+	metrics.Counter("tracker_flood.received", func() int64 {
+		return int64(tracker.FloodMetrics().Received)
+	})
+	metrics.Counter("tracker_flood.malformed", func() int64 {
+		return int64(tracker.FloodMetrics().Malformed)
+	})
+	metrics.Counter("tracker_flood.dropped", func() int64 {
+		return int64(tracker.FloodMetrics().Dropped)
+	})
+	metrics.Counter("tracker_flood.blacklistings", func() int64 {
+		return int64(tracker.FloodMetrics().Blacklistings)
+	})
+	metrics.Gauge("tracker_flood.blacklisted", func() int64 {
+		return int64(tracker.FloodMetrics().Blacklisted)
+	})
+	metrics.Counter("rx_stalls", func() int64 {
+		stalls, _ := proxy.RxStalls()
+		return int64(stalls)
+	})
+	metrics.Counter("rx_stall_ms", func() int64 {
+		_, waited := proxy.RxStalls()
+		return waited.Milliseconds()
+	})
+	metrics.Counter("state_stalls", func() int64 {
+		return int64(state.StateStalls())
+	})
+	metrics.Gauge("tx_queued", func() int64 {
+		queued, _ := txQueueDepths(context)
+		return int64(queued)
+	})
+	metrics.Gauge("tx_queue_fullest_percent", func() int64 {
+		_, fullest := txQueueDepths(context)
+		return int64(fullest)
+	})
+	metrics.Counter("rx_truncated", func() int64 {
+		return int64(proxy.Truncated())
+	})
+	metrics.Counter("rx_large", func() int64 {
+		return int64(proxy.Large())
+	})
+	metrics.Counter("rx_duplicates", func() int64 {
+		return int64(proxy.Duplicates())
+	})
+	metrics.Counter("tx_drops", func() int64 {
+		return int64(proxy.TxDrops())
+	})
+	for class := range proxy.TxErrors() {
+		class := class
+		metrics.Counter("tx_errors_"+class, func() int64 {
+			return int64(proxy.TxErrors()[class])
+		})
+	}
+	metrics.Gauge("forward_queued", func() int64 {
+		return int64(router.Queued())
+	})
+	metrics.Gauge("event_backlog", func() int64 {
+		backlog := 0
+		for _, queued := range context.Events.Backlogs() {
+			backlog += queued
+		}
+		return int64(backlog)
+	})
+	metrics.Counter("event_drops", func() int64 {
+		dropped := 0
+		for _, count := range context.Events.Dropped() {
+			dropped += count
+		}
+		return int64(dropped)
+	})
+	metrics.Durations("latency", context.Latency.Snapshot)
+}
+
+// txQueueDepths returns how many packets wait in all transmit queues, and how
+// full the fullest is, in percent.
+func txQueueDepths(context *state.ServerContext) (int, int) {
+	queued := 0
+	fullest := 0
+	state.Do(context, func(s *state.State) {
+		for _, player := range s.Players {
+			if player.Route == nil || player.Route.TxQueue.Cap() == 0 {
+				continue
+			}
+			length := player.Route.TxQueue.Len()
+			queued += length
+			if percent := length * 100 / player.Route.TxQueue.Cap(); percent > fullest {
+				fullest = percent
+			}
+		}
+	})
+	return queued, fullest
+}
+
+// reportMetrics pushes the metrics to statsd_address, if it is set, until
+// shutdown.
+func reportMetrics(context *state.ServerContext) {
+	defer context.Network.WaitGroup.Done()
+
+	address := config.GetValueString("statsd_address")
+	if address == "" {
+		return
+	}
+
+	sink, err := metrics.NewStatsD(address, config.GetValueString("statsd_prefix"))
+	if err != nil {
+		context.Logger.Println(err)
+		return
+	}
+	defer sink.Close()
+
+	interval := time.Duration(config.GetValueInt("statsd_interval_seconds")) * time.Second
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	context.Logger.Println("Sending metrics to StatsD at", address)
+	metrics.Report(context.Network.Ctx, sink, interval, context.Logger)
+}
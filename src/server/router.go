@@ -0,0 +1,391 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"encoding/hex"
+	"net"
+	"sync"
+
+	"git.astrospark.com/bolorama/bolo"
+	"git.astrospark.com/bolorama/clock"
+	"git.astrospark.com/bolorama/metrics"
+	"git.astrospark.com/bolorama/privacy"
+	"git.astrospark.com/bolorama/protocol"
+	"git.astrospark.com/bolorama/proxy"
+	"git.astrospark.com/bolorama/ratelog"
+	"git.astrospark.com/bolorama/record"
+	"git.astrospark.com/bolorama/state"
+	"git.astrospark.com/bolorama/util"
+)
+
+// Router moves the packets players send to proxy ports on to the other
+// players in their game. The server's main loop drives it, and so do replays
+// and simulations, with routes stubbed out (see proxy.Ports.UseStubRoutes).
+// It logs to its context's Logger.
+type Router struct {
+	context     *state.ServerContext
+	pings       chan<- state.Player // new players, for the tracker to ping
+	playerInfo  chan util.PlayerInfoEvent
+	playerLeave chan util.PlayerAddr
+	queues      []chan forwardJob // the forward workers' queues, nil without workers
+	workers     sync.WaitGroup
+	inline      bool
+}
+
+// NewRouter returns a router for the server in context. New players are sent
+// on pings, which the tracker reads (see tracker.Tracker). Player info and
+// departures found in forwarded packets wait in channels of eventDepth until
+// the router's owner handles them (see Run and DrainPlayerEvents).
+func NewRouter(context *state.ServerContext, pings chan<- state.Player, eventDepth int) *Router {
+	return &Router{
+		context:     context,
+		pings:       pings,
+		playerInfo:  make(chan util.PlayerInfoEvent, eventDepth),
+		playerLeave: make(chan util.PlayerAddr, eventDepth),
+	}
+}
+
+// SetInline makes Route forward packets before returning, so that a
+// simulation runs in order.
+func (router *Router) SetInline() {
+	router.inline = true
+}
+
+// Run routes the packets from packets until it is closed or done is, and
+// handles the player events meanwhile. A nil done never is.
+func (router *Router) Run(packets <-chan proxy.UdpPacket, done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case playerInfo := <-router.playerInfo:
+			router.HandlePlayerInfo(playerInfo)
+		case playerAddr := <-router.playerLeave:
+			router.HandlePlayerLeave(playerAddr)
+		case packet, ok := <-packets:
+			if !ok {
+				return
+			}
+			state.RxBusy(router.context, packet.DstPort)
+			router.Route(packet)
+			state.RxIdle(router.context)
+		}
+	}
+}
+
+// DrainPlayerEvents handles the player events waiting, as Run does.
+func (router *Router) DrainPlayerEvents() {
+	for {
+		select {
+		case playerInfo := <-router.playerInfo:
+			router.HandlePlayerInfo(playerInfo)
+		case playerAddr := <-router.playerLeave:
+			router.HandlePlayerLeave(playerAddr)
+		default:
+			return
+		}
+	}
+}
+
+// HandlePlayerInfo applies a player's id, name or chat message found in a
+// forwarded packet.
+func (router *Router) HandlePlayerInfo(playerInfo util.PlayerInfoEvent) {
+	state.Do(router.context, func(s *state.State) {
+		if playerInfo.SetId {
+			state.PlayerSetId(s, playerInfo.PlayerAddr, playerInfo.PlayerId)
+		} else if playerInfo.SetName {
+			state.PlayerSetName(s, playerInfo.PlayerAddr, playerInfo.PlayerId, playerInfo.Name)
+		} else if playerInfo.Chat {
+			state.PlayerChat(s, playerInfo.PlayerAddr, playerInfo.PlayerId, playerInfo.Message)
+		}
+	})
+}
+
+// HandlePlayerLeave removes a player found to have left their game.
+func (router *Router) HandlePlayerLeave(playerAddr util.PlayerAddr) {
+	router.context.Logger.Printf("Player left their game: %d (%s:%d)\n", playerAddr.ProxyPort, privacy.IpString(playerAddr.IpAddr), playerAddr.IpPort)
+	state.Do(router.context, func(s *state.State) {
+		state.PlayerDelete(s, playerAddr)
+		state.PrintServerState(s)
+	})
+}
+
+// Route handles a packet a player sent to a proxy port: it finds or adds the
+// sending player, does NAT traversal, and forwards the packet to the player
+// the proxy port belongs to. The router owns the packet from then on.
+func (router *Router) Route(packet proxy.UdpPacket) {
+	context := router.context
+	defer state.RecoverPlayer(context, "handling a packet", packet.SrcAddr)
+
+	packetTrace := context.Spans.Sample(packet.Received)
+	packetTrace.Step("receive")
+	packetTrace.SetAttribute("proxy_port", packet.DstPort)
+
+	handler, _ := protocol.Detect(packet.Buffer[:packet.Len])
+	if handler == nil {
+		// skip packets of unknown games
+		packetTrace.Step("parse")
+		packetTrace.End()
+		packet.Release()
+		return
+	}
+
+	version := handler.Version(packet.Buffer)
+	join := handler.IsJoin(packet.Buffer)
+	natProbeReply := handler.IsNatProbeReply(packet.Buffer[:packet.Len])
+	packetTrace.SetAttribute("packet_type", handler.PacketType(packet.Buffer))
+	packetTrace.Step("parse")
+
+	var srcPlayer, dstPlayer state.Player
+	found := false
+	newPlayer := false
+	forward := false
+	saved := false
+	var muted []int
+	var latency *metrics.Histogram
+	// a packet held for NAT traversal, released by the probe reply
+	var released *proxy.UdpPacket
+
+	state.Do(context, func(s *state.State) {
+		var err error
+
+		// get destination player ip by proxy port
+		dstPlayer, err = state.PlayerGetByPort(s, packet.DstPort)
+		if err != nil {
+			// normally won't happen, but there could be a pending packet incoming from a player that was subsequently deleted
+			ratelog.Println(context.Logger, err)
+			return
+		}
+
+		if !handler.Compatible(version, dstPlayer.Version) {
+			if context.Debug {
+				context.Logger.Printf("dropping packet from %s: version %s cannot play with %s\n",
+					privacy.Addr(packet.SrcAddr.IP, packet.SrcAddr.Port), version, dstPlayer.Version)
+			}
+			return
+		}
+		found = true
+
+		srcPlayer, err = state.PlayerGetByAddr(s, packet.SrcAddr)
+		if err == nil && !srcPlayer.DisconnectedAt.IsZero() {
+			state.PlayerResume(s, srcPlayer.ProxyPort)
+		}
+		if err != nil {
+			srcPlayer, err = state.PlayerReconnect(s, packet.SrcAddr, &dstPlayer.GameId)
+		}
+		if err != nil {
+			migrated := false
+			if playerId, ok := handler.Sender(packet.Buffer); ok {
+				srcPlayer, migrated = state.PlayerMigrate(s, dstPlayer.GameId, playerId, packet.SrcAddr)
+			}
+			if !migrated {
+				if err := state.PlayerLimitError(s, packet.SrcAddr.IP, dstPlayer.GameId); err != nil {
+					state.PlayerRefuse(s, packet.SrcAddr, dstPlayer.GameId, err)
+					found = false
+					return
+				}
+				srcPlayer, err = state.PlayerNew(s, packet.SrcAddr, dstPlayer.GameId, dstPlayer.ProxyPort, version)
+				if err != nil {
+					state.PlayerRefuse(s, packet.SrcAddr, dstPlayer.GameId, err)
+					found = false
+					return
+				}
+				newPlayer = true
+			}
+			state.PrintServerState(s)
+		}
+
+		if join {
+			if srcPlayer.GameId != dstPlayer.GameId {
+				state.PlayerJoinGame(s, srcPlayer.ProxyPort, dstPlayer.GameId)
+			}
+		}
+
+		if context.Debug {
+			if packetType := handler.PacketType(packet.Buffer); packetType == bolo.PacketType5 || packetType == bolo.PacketType6 || packetType == bolo.PacketType7 {
+				srcTimestamp := srcPlayer.Peers[dstPlayer.ProxyPort]
+				dstTimestamp := dstPlayer.Peers[srcPlayer.ProxyPort]
+				timestamp := util.MaxTime(srcTimestamp, dstTimestamp)
+
+				natStatus := "?"
+				if clock.Since(context.Clock, timestamp).Seconds() < 20 {
+					natStatus = "*"
+				}
+
+				context.Logger.Printf("%s PacketType=%d %d (%s) -> %d (%s)\n", natStatus, packetType,
+					srcPlayer.ProxyPort, privacy.Addr(srcPlayer.IpAddr, srcPlayer.IpPort),
+					dstPlayer.ProxyPort, privacy.Addr(dstPlayer.IpAddr, dstPlayer.IpPort),
+				)
+				context.Logger.Printf("    Timestamp=%s\n", timestamp)
+			}
+		}
+
+		if natProbeReply {
+			savedPacket, ok := srcPlayer.PeerPackets[dstPlayer.ProxyPort]
+			if !ok {
+				context.Logger.Printf("received nat probe reply (%d -> %d, %s -> %s)\n", srcPlayer.ProxyPort, dstPlayer.ProxyPort, privacy.Addr(srcPlayer.IpAddr, srcPlayer.IpPort), privacy.Addr(dstPlayer.IpAddr, dstPlayer.IpPort))
+				context.Logger.Println("  error: no saved packet")
+				return
+			}
+			if context.Debug {
+				context.Logger.Printf("received nat probe reply (%d -> %d, %s -> %s)\n", srcPlayer.ProxyPort, dstPlayer.ProxyPort, privacy.Addr(srcPlayer.IpAddr, srcPlayer.IpPort), privacy.Addr(dstPlayer.IpAddr, dstPlayer.IpPort))
+				context.Logger.Printf("  packet length = %d\n", len(savedPacket.Buffer))
+				context.Logger.Printf("  forwarding PacketType=%d (%d -> %d, %s -> %s)\n", handler.PacketType(savedPacket.Buffer), dstPlayer.ProxyPort, srcPlayer.ProxyPort, privacy.Addr(dstPlayer.IpAddr, dstPlayer.IpPort), privacy.Addr(srcPlayer.IpAddr, srcPlayer.IpPort))
+			}
+			delete(srcPlayer.PeerPackets, dstPlayer.ProxyPort)
+			srcPlayer.Peers[dstPlayer.ProxyPort] = context.Clock.Now()
+			released = &savedPacket
+			muted = state.GameMutedPlayerIds(s, dstPlayer.GameId)
+			return
+		}
+
+		if srcPlayer.NatPort != context.ProxyPort {
+			natProbe(context, s, handler, srcPlayer, context.ProxyPort)
+		}
+
+		// if the player is talking to themselves (happens when they are the last player in the game), no nat traversal is needed
+		if srcPlayer.ProxyPort != dstPlayer.ProxyPort {
+			srcTimestamp := srcPlayer.Peers[dstPlayer.ProxyPort]
+			dstTimestamp := dstPlayer.Peers[srcPlayer.ProxyPort]
+			timestamp := util.MaxTime(srcTimestamp, dstTimestamp)
+			if clock.Since(context.Clock, timestamp).Seconds() > 20 {
+				if previous, ok := dstPlayer.PeerPackets[srcPlayer.ProxyPort]; ok {
+					previous.Release()
+				}
+				dstPlayer.PeerPackets[srcPlayer.ProxyPort] = packet
+				saved = true
+				natProbe(context, s, handler, dstPlayer, srcPlayer.ProxyPort)
+				return
+			}
+
+			srcPlayer.Peers[dstPlayer.ProxyPort] = context.Clock.Now()
+
+			// the player is still answered (see the pong below), but
+			// nothing they send reaches the others
+			if state.PlayerShadowBanned(s, srcPlayer.IpAddr) {
+				return
+			}
+		}
+
+		forward = true
+		muted = state.GameMutedPlayerIds(s, dstPlayer.GameId)
+		latency = state.GameLatency(s, dstPlayer.GameId)
+	})
+
+	packetTrace.Step("route")
+	if found {
+		packetTrace.SetAttribute("game_id", hex.EncodeToString(srcPlayer.GameId[:]))
+		capture(context, srcPlayer.GameId, record.Inbound, packet.DstPort, packet.SrcAddr, packet.Buffer)
+	}
+	if forward {
+		packet.Trace = packetTrace
+		packet.Latency = latency
+	} else {
+		packetTrace.End()
+	}
+
+	if !forward && !saved {
+		packet.Release()
+	}
+
+	if !found {
+		return
+	}
+
+	if newPlayer {
+		router.pings <- srcPlayer
+	}
+
+	context.PlayerPongChannel <- util.PlayerAddr{IpAddr: srcPlayer.IpAddr.String(), IpPort: srcPlayer.IpPort, ProxyPort: srcPlayer.ProxyPort}
+
+	// startForward may wait for a worker, so not from the state goroutine
+	if released != nil {
+		router.startForward(handler, *released, dstPlayer, srcPlayer, muted)
+	}
+	if forward {
+		router.startForward(handler, packet, srcPlayer, dstPlayer, muted)
+	}
+}
+
+func natProbe(context *state.ServerContext, s *state.State, handler protocol.Handler, dstPlayer state.Player, targetProxyPort int) {
+	trackerPort := context.ProxyPort
+	buffer := handler.NatProbe(state.AdvertisedIp(context, dstPlayer), targetProxyPort)
+	dstAddr := &net.UDPAddr{IP: dstPlayer.IpAddr, Port: dstPlayer.IpPort}
+
+	if context.Debug {
+		context.Logger.Printf("sending nat probe to %s (target port: %d)\n", privacy.Addr(dstPlayer.IpAddr, dstPlayer.IpPort), targetProxyPort)
+	}
+
+	if dstPlayer.NatPort == trackerPort {
+		if context.Debug {
+			context.Logger.Printf("  (nat probe source port: %d)\n", trackerPort)
+		}
+		context.SendFromTrackerPort(buffer, dstAddr)
+		capture(context, dstPlayer.GameId, record.Outbound, trackerPort, *dstAddr, buffer)
+	} else {
+		natPlayer, err := state.PlayerGetByPort(s, dstPlayer.NatPort)
+		if err != nil {
+			ratelog.Println(context.Logger, err)
+			return
+		}
+		if context.Debug {
+			context.Logger.Printf("  (nat probe source port: %d)\n", natPlayer.ProxyPort)
+		}
+		capture(context, dstPlayer.GameId, record.Outbound, natPlayer.ProxyPort, *dstAddr, buffer)
+		natPlayer.Route.TxQueue.Send(proxy.UdpPacket{DstAddr: *dstAddr, Buffer: buffer})
+	}
+}
+
+func (router *Router) forwardPacket(
+	handler protocol.Handler,
+	packet proxy.UdpPacket,
+	srcPlayer state.Player,
+	dstPlayer state.Player,
+	muted []int,
+) {
+	context := router.context
+	defer state.RecoverPlayer(context, "forwarding a packet", packet.SrcAddr)
+
+	packet.Trace.Step("dispatch")
+	srcPlayerAddr := util.PlayerAddr{IpAddr: srcPlayer.IpAddr.String(), IpPort: srcPlayer.IpPort, ProxyPort: srcPlayer.ProxyPort}
+	handler.Rewrite(
+		packet.Buffer,
+		[]net.IP{state.AdvertisedIp(context, dstPlayer), state.AdvertisedIp(context, srcPlayer), context.ProxyIp()},
+		srcPlayer.ProxyPort,
+		srcPlayerAddr,
+		muted,
+		router.playerInfo,
+		router.playerLeave,
+	)
+	packet.Trace.Step("rewrite")
+
+	packet.DstAddr = net.UDPAddr{IP: dstPlayer.IpAddr, Port: dstPlayer.IpPort}
+	capture(context, dstPlayer.GameId, record.Outbound, srcPlayer.ProxyPort, packet.DstAddr, packet.Buffer)
+	if handler.IsBulk(packet.Buffer) {
+		srcPlayer.Route.TxQueue.SendBulk(packet)
+	} else {
+		srcPlayer.Route.TxQueue.Send(packet)
+	}
+}
+
+// capture hands a packet to the recorder and the tracer.
+func capture(context *state.ServerContext, gameId bolo.GameId, direction record.Direction, proxyPort int, playerAddr net.UDPAddr, buffer []byte) {
+	context.Recorder.Record(gameId, direction, proxyPort, playerAddr, buffer)
+	context.Tracer.Packet(gameId, direction, proxyPort, playerAddr, buffer)
+}
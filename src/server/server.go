@@ -0,0 +1,420 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package server runs a Bolorama server: the tracker, the proxy ports and the
+// services around them, as the bolorama command does. Other programs can
+// embed one:
+//
+//	config.UseFile("bolorama.conf")
+//	srv, err := server.New(nil)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	go srv.Run()
+//	...
+//	srv.Shutdown()
+//	srv.Wait()
+//
+// The server is configured through the config package and its metrics are
+// registered in a process-wide registry, both shared by every server in the
+// process. The proxy ports, the handling of dropped routes and the logger
+// belong to the Server. The state of a running server's main tracker is
+// reached through Context (see state.Do); the trackers set in trackers keep
+// state of their own.
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"git.astrospark.com/bolorama/accounts"
+	"git.astrospark.com/bolorama/admin"
+	"git.astrospark.com/bolorama/alert"
+	"git.astrospark.com/bolorama/audit"
+	"git.astrospark.com/bolorama/config"
+	"git.astrospark.com/bolorama/data"
+	"git.astrospark.com/bolorama/federation"
+	"git.astrospark.com/bolorama/hooks"
+	"git.astrospark.com/bolorama/master"
+	"git.astrospark.com/bolorama/portmap"
+	"git.astrospark.com/bolorama/privacy"
+	"git.astrospark.com/bolorama/profanity"
+	"git.astrospark.com/bolorama/proxy"
+	"git.astrospark.com/bolorama/state"
+	"git.astrospark.com/bolorama/stats"
+	"git.astrospark.com/bolorama/systemd"
+	"git.astrospark.com/bolorama/tournament"
+	"git.astrospark.com/bolorama/tracker"
+	"git.astrospark.com/bolorama/web"
+)
+
+const kStateResponseTimeout = 5 * time.Second
+
+// Server is a Bolorama server set up by New.
+type Server struct {
+	// Context is the server's state and shared channels.
+	Context *state.ServerContext
+
+	router       *Router
+	pings        chan state.Player
+	ports        *proxy.Ports
+	logger       *log.Logger
+	listeners    *tracker.Listeners
+	web          *web.Listeners
+	admin        *net.TCPListener // nil unless admin_port is set
+	db           *sql.DB          // nil unless enable_statistics is set
+	alertRules   []alert.Rule
+	peers        []federation.Peer
+	trackers     []*trackerInstance // set in trackers
+	shutdown     chan struct{}      // closed to begin shutdown
+	shutdownOnce sync.Once
+	stopped      chan struct{} // closed once Run returns
+}
+
+// New sets up a server from the config: it loads and checks every setting,
+// including the trackers' files, before binding anything, then registers the
+// metrics, binds the ports of the main tracker and the trackers set in
+// trackers, and the web, profiler and admin ports, holds the pinned ports,
+// binds the socket pool, opens the statistics database and starts the
+// forward workers. It fails if a setting cannot be used, one of those ports
+// cannot be bound or the database cannot be opened, closing what it had
+// bound. The server logs to logger, or the standard logger if it is nil.
+func New(logger *log.Logger) (*Server, error) {
+	if logger == nil {
+		logger = log.Default()
+	}
+	if err := config.Load(); err != nil {
+		return nil, err
+	}
+	if ignored := config.IgnoredFilename(); ignored != "" {
+		logger.Printf("Ignoring %s: %s is used\n", ignored, config.TypedFilename)
+	}
+	if err := config.CheckRequired(); err != nil {
+		return nil, err
+	}
+	if err := privacy.Load(); err != nil {
+		return nil, err
+	}
+	if err := profanity.Load(); err != nil {
+		return nil, err
+	}
+	alertRules, err := alert.ParseRules(config.GetValueList("alert_rules"))
+	if err != nil {
+		return nil, fmt.Errorf("alert_rules: %s", err)
+	}
+	peers, err := federation.ParsePeers()
+	if err != nil {
+		return nil, err
+	}
+	if config.GetValueBool("accounts") && !config.GetValueBool("enable_statistics") {
+		return nil, fmt.Errorf("accounts: needs enable_statistics")
+	}
+	trackers, err := config.GetTrackers()
+	if err != nil {
+		return nil, fmt.Errorf("trackers: %s", err)
+	}
+	if _, err := proxy.ParsePinnedPorts(config.GetValueList("pinned_ports")); err != nil {
+		return nil, fmt.Errorf("pinned_ports: %s", err)
+	}
+	if _, err := proxy.ParseDscp(config.GetValueString("dscp")); err != nil {
+		return nil, fmt.Errorf("dscp: %s", err)
+	}
+
+	server := &Server{
+		pings:      make(chan state.Player),
+		ports:      proxy.NewPorts(proxy.FirstPlayerPort(), logger),
+		logger:     logger,
+		alertRules: alertRules,
+		peers:      peers,
+		shutdown:   make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}
+	if err := server.bind(trackers); err != nil {
+		server.close()
+		return nil, err
+	}
+
+	server.router.StartWorkers(config.GetValueInt("forward_workers"))
+	for _, instance := range server.trackers {
+		instance.router.StartWorkers(config.GetValueInt("forward_workers"))
+	}
+	return server, nil
+}
+
+// bind binds the server's ports and opens its database, keeping each in the
+// server as it goes so that close can undo it.
+func (server *Server) bind(trackers []config.Tracker) error {
+	logger := server.logger
+	context, err := state.InitContext(config.GetValueInt("tracker_port"), server.ports, logger)
+	if err != nil {
+		return err
+	}
+	server.Context = context
+	if server.listeners, err = tracker.Listen(context); err != nil {
+		return err
+	}
+	if server.web, err = web.Listen(); err != nil {
+		return err
+	}
+	if server.admin, err = admin.Listen(); err != nil {
+		return err
+	}
+	server.router = NewRouter(context, server.pings, 0)
+
+	logger.Println("Hostname:", config.GetValueString("hostname"))
+	logger.Println("IP Address:", context.ProxyIp())
+
+	registerMetrics(context, server.router)
+
+	if err := server.newTrackers(trackers); err != nil {
+		return err
+	}
+
+	if err := server.ports.PinPorts(config.GetValueList("pinned_ports")); err != nil {
+		return fmt.Errorf("pinned_ports: %s", err)
+	}
+	if err := proxy.SetDscp(config.GetValueString("dscp")); err != nil {
+		return fmt.Errorf("dscp: %s", err)
+	}
+	// a pool that could not be filled is smaller, not fatal
+	if err := server.ports.FillSocketPool(config.GetValueInt("socket_pool_size")); err != nil {
+		logger.Println("Socket pool:", err)
+	}
+	if idle := server.ports.SocketPoolIdle(); idle > 0 {
+		logger.Printf("Socket pool: %d proxy ports bound\n", idle)
+	}
+	if config.GetValueBool("enable_statistics") {
+		if server.db, err = data.Init(); err != nil {
+			return err
+		}
+	}
+	auditLog := audit.NewLog(config.GetValueString("audit_file"), config.GetValueString("audit_secret"), logger)
+	if auditLog != nil && !config.HasValue("audit_secret") {
+		logger.Println("Audit log: audit_secret is not set, so the chain is not keyed")
+	}
+	context.Db = server.db
+	context.Audit = auditLog
+	for _, instance := range server.trackers {
+		instance.router.context.Db = server.db
+		instance.router.context.Audit = auditLog
+		context.Trackers = append(context.Trackers, instance.router.context)
+	}
+	return nil
+}
+
+// close closes what bind got, once Run returns or for a server that fails to
+// start.
+func (server *Server) close() {
+	for _, instance := range server.trackers {
+		instance.close()
+	}
+	if server.db != nil {
+		server.db.Close()
+	}
+	if server.admin != nil {
+		server.admin.Close()
+	}
+	if server.web != nil {
+		server.web.Close()
+	}
+	if server.listeners != nil {
+		server.listeners.Close()
+	}
+	if server.Context != nil {
+		closeUdp(server.Context)
+	}
+	server.ports.Close()
+}
+
+// closeUdp closes a tracker's UDP port.
+func closeUdp(context *state.ServerContext) {
+	for _, connection := range context.UdpConnections {
+		connection.Close()
+	}
+}
+
+// Shutdown begins shutting the server down. It may be called more than once,
+// and from any goroutine; Run returns once the server has stopped.
+func (server *Server) Shutdown() {
+	server.shutdownOnce.Do(func() { close(server.shutdown) })
+}
+
+// Wait blocks until Run has returned.
+func (server *Server) Wait() {
+	<-server.stopped
+}
+
+// Run starts the server's goroutines and handles packets until the server is
+// shut down, by Shutdown or a scheduled restart.
+func (server *Server) Run() {
+	defer close(server.stopped)
+	context := server.Context
+	mainShutdownChannel := make(chan struct{})
+	db := server.db
+
+	if config.GetValueBool("accounts") {
+		context.Stats.WaitGroup.Add(1)
+		go accounts.Run(context, context.Events.Subscribe(context.Stats.Ctx, "accounts"))
+	}
+
+	context.Stats.WaitGroup.Add(1)
+	go stats.Logger(context, db, context.Events.Subscribe(context.Stats.Ctx, "statistics"))
+
+	if context.Recorder != nil {
+		context.Stats.WaitGroup.Add(1)
+		go context.Recorder.Run(context.Stats.WaitGroup, context.Events.Subscribe(context.Stats.Ctx, "recorder"))
+	}
+
+	if context.Spans != nil {
+		context.Stats.WaitGroup.Add(1)
+		go context.Spans.Run(context.Stats.Ctx, context.Stats.WaitGroup)
+	}
+
+	context.Stats.WaitGroup.Add(1)
+	go tournament.Run(context, context.Events.Subscribe(context.Stats.Ctx, "tournament"))
+
+	if config.HasValue("hook_command") {
+		context.Stats.WaitGroup.Add(1)
+		go hooks.Run(context, context.Events.Subscribe(context.Stats.Ctx, "hook_command"))
+	}
+
+	if config.HasValue("webhook_urls") {
+		context.Stats.WaitGroup.Add(1)
+		go hooks.Webhooks(context, context.Events.Subscribe(context.Stats.Ctx, "webhooks"))
+	}
+
+	if config.HasValue("alert_webhook_urls") {
+		context.Stats.WaitGroup.Add(1)
+		go hooks.Alerts(context, context.Events.Subscribe(context.Stats.Ctx, "alerts"))
+	}
+
+	if config.HasValue("event_log_file") {
+		context.Stats.WaitGroup.Add(1)
+		go hooks.EventLog(context, context.Events.Subscribe(context.Stats.Ctx, "event_log"))
+	}
+
+	if config.HasValue("chat_log_file") {
+		context.Stats.WaitGroup.Add(1)
+		go hooks.ChatLog(context, context.Events.Subscribe(context.Stats.Ctx, "chat_log"))
+	}
+
+	if config.HasValue("nats_url") {
+		context.Stats.WaitGroup.Add(1)
+		go hooks.NatsPublisher(context, context.Events.Subscribe(context.Stats.Ctx, "nats"))
+	}
+
+	if config.HasValue("mqtt_url") {
+		context.Stats.WaitGroup.Add(1)
+		go hooks.MqttPublisher(context, context.Events.Subscribe(context.Stats.Ctx, "mqtt"))
+	}
+
+	context.State.WaitGroup.Add(1)
+	go state.Run(context)
+
+	context.Network.WaitGroup.Add(1)
+	go tracker.Tracker(context, server.pings, server.listeners)
+
+	context.Network.WaitGroup.Add(1)
+	go state.PublicIpMonitor(context)
+
+	context.Network.WaitGroup.Add(1)
+	go state.ConsistencyChecker(context)
+
+	context.Network.WaitGroup.Add(1)
+	go state.Watchdog(context)
+
+	context.Network.WaitGroup.Add(1)
+	go state.SelfProbe(context)
+
+	context.Network.WaitGroup.Add(1)
+	go alert.Run(context, server.alertRules)
+
+	context.Network.WaitGroup.Add(1)
+	go portmap.Mapper(context, context.Events.Subscribe(context.Network.Ctx, "port_mapping"))
+
+	context.Network.WaitGroup.Add(1)
+	go web.Server(context, server.web)
+
+	context.Network.WaitGroup.Add(1)
+	go web.Profiler(context, server.web)
+
+	context.Network.WaitGroup.Add(1)
+	go reportMetrics(context)
+
+	context.Network.WaitGroup.Add(1)
+	go admin.Console(context, server.admin)
+
+	if config.GetValueBool("federation") {
+		server.logger.Println("Federation public key:", federation.PublicKey(server.logger))
+	}
+	context.Network.WaitGroup.Add(1)
+	go federation.Peers(context, server.peers)
+
+	context.Network.WaitGroup.Add(1)
+	go master.Register(context)
+
+	context.Network.WaitGroup.Add(1)
+	go state.RestartScheduler(context, server.Shutdown)
+
+	context.Network.WaitGroup.Add(1)
+	go systemd.Watchdog(context.Network.Ctx, context.Network.WaitGroup, server.logger, func() bool {
+		return stateResponds(context)
+	})
+	if err := systemd.Notify("READY=1"); err != nil {
+		server.logger.Println(err)
+	}
+
+	for _, instance := range server.trackers {
+		go instance.run(server.shutdown)
+	}
+
+	go func() {
+		<-server.shutdown
+		server.logger.Println("Shutting down")
+		if err := systemd.Notify("STOPPING=1"); err != nil {
+			server.logger.Println(err)
+		}
+		state.Shutdown(context)
+		close(mainShutdownChannel)
+	}()
+
+	server.router.Run(context.RxChannel, mainShutdownChannel)
+	server.router.WaitWorkers()
+	for _, instance := range server.trackers {
+		<-instance.done
+	}
+	server.close()
+}
+
+// stateResponds reports whether the state goroutine takes a request within
+// kStateResponseTimeout.
+func stateResponds(context *state.ServerContext) bool {
+	done := make(chan struct{}, 1)
+	go state.Do(context, func(s *state.State) {
+		done <- struct{}{}
+	})
+	select {
+	case <-done:
+		return true
+	case <-time.After(kStateResponseTimeout):
+		return false
+	}
+}
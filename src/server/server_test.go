@@ -0,0 +1,124 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"testing"
+
+	"git.astrospark.com/bolorama/config"
+)
+
+// the tracker ports of the main tracker and the two in trackers
+var trackerPorts [3]int
+
+func TestMain(m *testing.M) {
+	for i := range trackerPorts {
+		port, err := freePort()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		trackerPorts[i] = port
+	}
+	config.Set("hostname", "test")
+	config.Set("proxy_ip", "127.0.0.1")
+	config.Set("bind_addresses", "127.0.0.1")
+	config.Set("tracker_port", fmt.Sprint(trackerPorts[0]))
+	config.Set("tracker_debug_port", "0")
+	config.Set("trackers", fmt.Sprintf("newbie:%d,tour:%d", trackerPorts[1], trackerPorts[2]))
+	config.Set("audit_file", "")
+	config.Set("ban_file", "")
+	os.Exit(m.Run())
+}
+
+// freePort returns a port free for both UDP and TCP when it was checked.
+func freePort() (int, error) {
+	udp, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return 0, err
+	}
+	defer udp.Close()
+	port := udp.LocalAddr().(*net.UDPAddr).Port
+	tcp, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	if err != nil {
+		return 0, err
+	}
+	tcp.Close()
+	return port, nil
+}
+
+func TestNewClosesPortsOnFailure(t *testing.T) {
+	// the last tracker's TCP port is taken, so New fails once everything
+	// before it is bound
+	busy, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: trackerPorts[2]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(nil); err == nil {
+		busy.Close()
+		t.Fatal("New succeeded with a tracker port in use")
+	}
+	busy.Close()
+
+	server, err := New(nil)
+	if err != nil {
+		t.Fatalf("New after a failed New: %s", err)
+	}
+	server.close()
+}
+
+func TestTrackersHaveTheirOwnPorts(t *testing.T) {
+	server, err := New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.close()
+
+	firsts := map[int]bool{server.ports.First(): true}
+	for _, instance := range server.trackers {
+		if instance.ports == server.ports || firsts[instance.ports.First()] {
+			t.Errorf("tracker %s shares proxy ports from %d", instance.name, instance.ports.First())
+		}
+		firsts[instance.ports.First()] = true
+	}
+	for _, name := range []string{"", "newbie", "tour"} {
+		if _, ok := server.Context.Tracker(name); !ok {
+			t.Errorf("no tracker %q", name)
+		}
+	}
+}
+
+func TestRunClosesPortsWhenItReturns(t *testing.T) {
+	server, err := New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Run()
+	server.Shutdown()
+	server.Wait()
+
+	// the ports are free again
+	server, err = New(nil)
+	if err != nil {
+		t.Fatalf("New after Run returned: %s", err)
+	}
+	server.close()
+}
@@ -0,0 +1,147 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"fmt"
+
+	"git.astrospark.com/bolorama/config"
+	"git.astrospark.com/bolorama/metrics"
+	"git.astrospark.com/bolorama/proxy"
+	"git.astrospark.com/bolorama/state"
+	"git.astrospark.com/bolorama/stats"
+	"git.astrospark.com/bolorama/tournament"
+	"git.astrospark.com/bolorama/tracker"
+)
+
+// trackerInstance is one of the trackers set in trackers, run beside the
+// main tracker with its own port, proxy ports, state and packet routing. The
+// admin console and web server reach it by name (see ServerContext.Tracker), and its
+// statistics go to the shared database under its name; the hooks and
+// federation serve the main tracker only.
+type trackerInstance struct {
+	name      string
+	router    *Router
+	pings     chan state.Player
+	ports     *proxy.Ports
+	listeners *tracker.Listeners
+	done      chan struct{} // closed once its router returns
+}
+
+// newTrackers binds the UDP and TCP ports of the trackers set in trackers.
+// The nth is given the MaxPlayerPorts proxy ports that follow those of the
+// one before, so the main tracker's start at FirstPlayerPort and the first
+// in trackers' MaxPlayerPorts later.
+func (server *Server) newTrackers(trackers []config.Tracker) error {
+	for i, t := range trackers {
+		ports := proxy.NewPorts(proxy.FirstPlayerPort()+(i+1)*proxy.MaxPlayerPorts, server.logger)
+		context, err := state.InitContext(t.Port, ports, server.logger)
+		if err != nil {
+			return fmt.Errorf("tracker %s: %s", t.Name, err)
+		}
+		context.Config = t.Scope
+		context.Name = t.Name
+		instance := &trackerInstance{
+			name:  t.Name,
+			pings: make(chan state.Player),
+			ports: ports,
+			done:  make(chan struct{}),
+		}
+		instance.router = NewRouter(context, instance.pings, 0)
+		server.trackers = append(server.trackers, instance)
+
+		if instance.listeners, err = tracker.Listen(context); err != nil {
+			return fmt.Errorf("tracker %s: %s", t.Name, err)
+		}
+		registerTrackerMetrics(t.Name, context)
+		server.logger.Printf("Tracker %s: port %d, proxy ports %d to %d\n", t.Name, t.Port, ports.First(), ports.First()+proxy.MaxPlayerPorts-1)
+	}
+	return nil
+}
+
+// close closes the tracker's ports, once it has stopped or for a server that
+// fails to start.
+func (instance *trackerInstance) close() {
+	if instance.listeners != nil {
+		instance.listeners.Close()
+	}
+	closeUdp(instance.router.context)
+	instance.ports.Close()
+}
+
+// run starts the tracker's goroutines and handles its packets until stop is
+// closed.
+func (instance *trackerInstance) run(stop chan struct{}) {
+	defer close(instance.done)
+	context := instance.router.context
+
+	if context.Recorder != nil {
+		context.Stats.WaitGroup.Add(1)
+		go context.Recorder.Run(context.Stats.WaitGroup, context.Events.Subscribe(context.Stats.Ctx, "recorder"))
+	}
+
+	if context.Spans != nil {
+		context.Stats.WaitGroup.Add(1)
+		go context.Spans.Run(context.Stats.Ctx, context.Stats.WaitGroup)
+	}
+
+	context.Stats.WaitGroup.Add(1)
+	go stats.Logger(context, context.Db, context.Events.Subscribe(context.Stats.Ctx, "statistics"))
+
+	context.Stats.WaitGroup.Add(1)
+	go tournament.Run(context, context.Events.Subscribe(context.Stats.Ctx, "tournament"))
+
+	context.State.WaitGroup.Add(1)
+	go state.Run(context)
+
+	context.Network.WaitGroup.Add(1)
+	go tracker.Tracker(context, instance.pings, instance.listeners)
+
+	context.Network.WaitGroup.Add(1)
+	go state.PublicIpMonitor(context)
+
+	routerShutdownChannel := make(chan struct{})
+	go func() {
+		<-stop
+		context.Logger.Println("Shutting down tracker", instance.name)
+		state.Shutdown(context)
+		close(routerShutdownChannel)
+	}()
+
+	instance.router.Run(context.RxChannel, routerShutdownChannel)
+	instance.router.WaitWorkers()
+}
+
+// registerTrackerMetrics registers the players and games of a tracker set
+// in trackers, as trackers.<name>.players and trackers.<name>.games.
+func registerTrackerMetrics(name string, context *state.ServerContext) {
+	metrics.Gauge("trackers."+name+".players", func() int64 {
+		var players int
+		state.Do(context, func(s *state.State) {
+			players = len(s.Players)
+		})
+		return int64(players)
+	})
+	metrics.Gauge("trackers."+name+".games", func() int64 {
+		var games int
+		state.Do(context, func(s *state.State) {
+			games = len(s.Games)
+		})
+		return int64(games)
+	})
+}
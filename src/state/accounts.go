@@ -0,0 +1,56 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package state
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"git.astrospark.com/bolorama/bolo"
+	"git.astrospark.com/bolorama/events"
+	"git.astrospark.com/bolorama/util"
+)
+
+// HashToken returns the form in which account tokens are stored and passed
+// around, so the token itself is only ever seen by its holder.
+func HashToken(token string) string {
+	hash := sha256.Sum256([]byte(strings.TrimSpace(token)))
+	return hex.EncodeToString(hash[:])
+}
+
+// loginCommand handles a bolo.LoginCommand chat message, which logs the
+// sender in to the account for their name, by publishing a PlayerLogin event
+// with the hash of the token, returning false if text is not one.
+func loginCommand(s *State, player Player, text string) bool {
+	fields := strings.Fields(text)
+	if len(fields) == 0 || fields[0] != bolo.LoginCommand {
+		return false
+	}
+	if len(fields) == 2 {
+		s.context.Events.Publish(events.Event{
+			Type:       events.PlayerLogin,
+			PlayerAddr: util.PlayerAddr{IpAddr: player.IpAddr.String(), IpPort: player.IpPort, ProxyPort: player.ProxyPort},
+			GameId:     player.GameId,
+			PlayerId:   player.PlayerId,
+			Name:       player.Name,
+			Text:       HashToken(fields[1]),
+		})
+	}
+	return true
+}
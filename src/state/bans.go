@@ -0,0 +1,127 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package state
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"git.astrospark.com/bolorama/config"
+)
+
+// Kicks are saved to ban_file, one "<ip> <until, RFC 3339>" line each, so
+// they outlast a restart.
+
+// loadBans reads the kicks that have not expired from ban_file.
+func loadBans(s *State) {
+	filename := config.GetValueString("ban_file")
+	if filename == "" {
+		return
+	}
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		s.context.Logger.Println("Failed to read bans:", err)
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		until, err := time.Parse(time.RFC3339, fields[1])
+		if ip == nil || err != nil {
+			s.context.Logger.Println("Malformed ban:", scanner.Text())
+			continue
+		}
+		if time.Now().Before(until) {
+			s.kicked[ip.String()] = until
+		}
+	}
+}
+
+// CheckBans returns a problem for each line of ban_file that loadBans could
+// not read.
+func CheckBans() ([]string, error) {
+	filename := config.GetValueString("ban_file")
+	if filename == "" {
+		return nil, nil
+	}
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var problems []string
+	scanner := bufio.NewScanner(file)
+	for number := 1; scanner.Scan(); number++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 || net.ParseIP(fields[0]) == nil {
+			problems = append(problems, fmt.Sprintf("%s:%d: not <ip> <until>: %s", filename, number, scanner.Text()))
+			continue
+		}
+		if _, err := time.Parse(time.RFC3339, fields[1]); err != nil {
+			problems = append(problems, fmt.Sprintf("%s:%d: not an RFC 3339 time: %s", filename, number, fields[1]))
+		}
+	}
+	return problems, scanner.Err()
+}
+
+// saveBans writes the kicks that have not expired to ban_file.
+func saveBans(s *State) {
+	filename := config.GetValueString("ban_file")
+	if filename == "" {
+		return
+	}
+
+	var lines []string
+	for ip, until := range s.kicked {
+		if time.Now().Before(until) {
+			lines = append(lines, fmt.Sprintf("%s %s\n", ip, until.Format(time.RFC3339)))
+		}
+	}
+	sort.Strings(lines)
+
+	// write and rename, so a crash cannot leave a truncated file
+	if err := ioutil.WriteFile(filename+".tmp", []byte(strings.Join(lines, "")), 0644); err != nil {
+		s.context.Logger.Println("Failed to save bans:", err)
+		return
+	}
+	if err := os.Rename(filename+".tmp", filename); err != nil {
+		s.context.Logger.Println("Failed to save bans:", err)
+	}
+}
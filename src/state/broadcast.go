@@ -0,0 +1,39 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package state
+
+import "git.astrospark.com/bolorama/events"
+
+// ServerBroadcast shows text to players at the top of the tracker listing,
+// and announces it with a ServerBroadcast event for hooks to relay, until it
+// is cleared with "". Bolo has no way for the proxy to send messages into a
+// game.
+func ServerBroadcast(s *State, text string) {
+	s.broadcast = text
+	if text == "" {
+		s.context.Logger.Println("Broadcast cleared")
+		return
+	}
+	s.context.Logger.Println("Broadcast:", text)
+	s.context.Events.Publish(events.Event{Type: events.ServerBroadcast, Text: text})
+}
+
+// ServerBroadcastText returns the message set with ServerBroadcast, or "".
+func ServerBroadcastText(s *State) string {
+	return s.broadcast
+}
@@ -0,0 +1,116 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package state
+
+import (
+	"fmt"
+	"time"
+
+	"git.astrospark.com/bolorama/config"
+	"git.astrospark.com/bolorama/privacy"
+	"git.astrospark.com/bolorama/util"
+)
+
+// The consistency checker cross-checks the players against the proxy ports
+// every consistency_check_seconds. Orphans are logged, and removed if
+// consistency_repair is set: ports held with no player, which are never
+// reused, and players whose route is dead (its sockets could not be opened, or
+// it was torn down), who can no longer be reached.
+
+// ConsistencyChecker runs the checks until the network is shut down.
+func ConsistencyChecker(context *ServerContext) {
+	defer context.Network.WaitGroup.Done()
+
+	interval := config.GetValueInt("consistency_check_seconds")
+	if interval <= 0 {
+		return
+	}
+	repair := config.GetValueBool("consistency_repair")
+
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-context.Network.Ctx.Done():
+			return
+		case <-ticker.C:
+			Do(context, func(s *State) {
+				for _, problem := range CheckConsistency(s, repair) {
+					context.Logger.Println("Inconsistent state:", problem)
+				}
+			})
+		}
+	}
+}
+
+// CheckConsistency returns the problems found, repairing them if repair is
+// set.
+func CheckConsistency(s *State, repair bool) []string {
+	var problems []string
+	report := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	players := make(map[int]Player)
+	var dead []Player
+	for _, player := range s.Players {
+		if other, ok := players[player.ProxyPort]; ok {
+			report("proxy port %d belongs to both %s and %s", player.ProxyPort,
+				privacy.Addr(other.IpAddr, other.IpPort), privacy.Addr(player.IpAddr, player.IpPort))
+		}
+		players[player.ProxyPort] = player
+
+		route := player.Route
+		switch {
+		case route == nil:
+			report("player %d (%s) has no route", player.ProxyPort, player.Name)
+			dead = append(dead, player)
+		case route.Ctx.Err() != nil:
+			report("player %d (%s) has a route that was torn down", player.ProxyPort, player.Name)
+			dead = append(dead, player)
+		case len(route.Connections) == 0 && !s.context.Ports.Stubbed():
+			report("player %d (%s) has no open sockets", player.ProxyPort, player.Name)
+			dead = append(dead, player)
+		}
+	}
+
+	assigned := make(map[int]bool)
+	for _, port := range s.context.Ports.PlayerPorts() {
+		assigned[port] = true
+		if _, ok := players[port]; !ok {
+			report("proxy port %d is held with no player", port)
+			if repair {
+				s.context.Ports.DeletePort(port)
+			}
+		}
+	}
+	for port, player := range players {
+		if !assigned[port] {
+			report("player %d (%s) has a proxy port that is not held", port, player.Name)
+		}
+	}
+
+	if repair {
+		for _, player := range dead {
+			s.context.Logger.Printf("Removing player %d (%s) with a dead route\n", player.ProxyPort, player.Name)
+			playerDelete(s, util.PlayerAddr{IpAddr: player.IpAddr.String(), IpPort: player.IpPort, ProxyPort: player.ProxyPort}, "orphaned")
+		}
+	}
+	return problems
+}
@@ -0,0 +1,80 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package state
+
+import (
+	"fmt"
+	"time"
+
+	"git.astrospark.com/bolorama/bolo"
+)
+
+// Duplicate filtering drops packets a player's proxy port receives twice
+// within dedup_window_ms (see the proxy package). Games start with it on if
+// dedup_by_default is set, and their host or the admin console can turn it
+// on or off for the rest of the game.
+
+func dedupWindow(s *State) time.Duration {
+	return time.Duration(s.context.Config.GetValueInt("dedup_window_ms")) * time.Millisecond
+}
+
+// GameDedup reports whether duplicate filtering is on for the game.
+func GameDedup(s *State, gameId bolo.GameId) bool {
+	if on, ok := s.dedup[gameId]; ok {
+		return on
+	}
+	return s.context.Config.GetValueBool("dedup_by_default")
+}
+
+// GameSetDedup turns duplicate filtering on or off for the game of the player
+// on proxyPort.
+func GameSetDedup(s *State, proxyPort int, on bool) error {
+	if dedupWindow(s) <= 0 {
+		return fmt.Errorf("duplicate filtering needs dedup_window_ms")
+	}
+	player, err := PlayerGetByPort(s, proxyPort)
+	if err != nil {
+		return err
+	}
+	if _, ok := s.Games[player.GameId]; !ok {
+		return fmt.Errorf("player with proxy port %d is not in a game", proxyPort)
+	}
+	setDedup(s, player.GameId, on)
+	return nil
+}
+
+func setDedup(s *State, gameId bolo.GameId, on bool) {
+	s.dedup[gameId] = on
+	for _, player := range s.Players {
+		if player.GameId == gameId {
+			applyDedup(s, player)
+		}
+	}
+}
+
+// applyDedup sets the player's route filtering as their game has it.
+func applyDedup(s *State, player Player) {
+	if player.Route == nil {
+		return
+	}
+	window := dedupWindow(s)
+	if !GameDedup(s, player.GameId) {
+		window = 0
+	}
+	player.Route.SetDedupWindow(window)
+}
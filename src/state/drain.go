@@ -0,0 +1,70 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package state
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"git.astrospark.com/bolorama/bolo"
+)
+
+// While the server drains, for maintenance, new games and players are
+// refused but the games in progress play on until they end.
+
+var errDraining = errors.New("server is draining for maintenance")
+
+// ServerDrain starts or stops draining.
+func ServerDrain(s *State, drain bool) {
+	if drain == !s.drainingSince.IsZero() {
+		return
+	}
+	if drain {
+		s.drainingSince = time.Now()
+		s.context.Logger.Println("Draining:", DrainProgress(s))
+	} else {
+		s.drainingSince = time.Time{}
+		s.context.Logger.Println("Stopped draining")
+	}
+}
+
+// ServerDraining reports whether the server is draining.
+func ServerDraining(s *State) bool {
+	return !s.drainingSince.IsZero()
+}
+
+// DrainProgress describes how far draining has got.
+func DrainProgress(s *State) string {
+	if s.drainingSince.IsZero() {
+		return "not draining"
+	}
+	since := time.Since(s.drainingSince).Round(time.Second)
+	if len(s.Games) == 0 && len(s.Players) == 0 {
+		return fmt.Sprintf("drained after %s", since)
+	}
+	return fmt.Sprintf("%d games and %d players left after %s", len(s.Games), len(s.Players), since)
+}
+
+// drainGameEnded logs when the last game of a drain ends.
+func drainGameEnded(s *State, gameId bolo.GameId) {
+	if s.drainingSince.IsZero() {
+		return
+	}
+	s.context.Logger.Printf("Draining: game %x ended, %s\n", gameId, DrainProgress(s))
+}
@@ -0,0 +1,205 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package state
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"time"
+
+	"git.astrospark.com/bolorama/config"
+	"git.astrospark.com/bolorama/events"
+	"git.astrospark.com/bolorama/privacy"
+)
+
+// A dump is everything the state goroutine knows, with the depths of the
+// channels around it, written to a JSON file for debugging routing after the
+// fact. Addresses are shown as privacy_mode has them logged.
+
+type stateDump struct {
+	Time        time.Time               `json:"time"`
+	Goroutines  int                     `json:"goroutines"`
+	Panics      uint64                  `json:"panics"`
+	ProxyIp     string                  `json:"proxy_ip"`
+	PlayerPorts []int                   `json:"player_ports"`
+	Channels    map[string]channelDepth `json:"channels"`
+	Players     []playerDump            `json:"players"`
+	Games       []gameDump              `json:"games"`
+	RemoteGames map[string]int          `json:"remote_games"` // by peer
+	Kicked      map[string]time.Time    `json:"kicked"`
+	Scheduled   []ScheduledGame         `json:"scheduled"`
+	Drain       string                  `json:"drain"`
+	RestartAt   time.Time               `json:"restart_at"`
+	Broadcast   string                  `json:"broadcast"`
+	TimedOut    int                     `json:"timed_out"`
+}
+
+type channelDepth struct {
+	Len int `json:"len"`
+	Cap int `json:"cap"`
+}
+
+type playerDump struct {
+	ProxyPort      int               `json:"proxy_port"`
+	Address        string            `json:"address"`
+	NatPort        int               `json:"nat_port"`
+	GameId         string            `json:"game_id"`
+	PlayerId       int               `json:"player_id"`
+	Name           string            `json:"name"`
+	ClaimedName    string            `json:"claimed_name"`
+	Version        string            `json:"version"`
+	AdvertiseIp    string            `json:"advertise_ip,omitempty"`
+	Peers          map[int]time.Time `json:"peers"`        // last contact with each peer's proxy port
+	PeerPackets    []int             `json:"peer_packets"` // peers with a packet held for NAT traversal
+	DisconnectedAt time.Time         `json:"disconnected_at"`
+	RttMs          int64             `json:"rtt_ms"`
+	Tags           []string          `json:"tags"`
+	Route          *routeDump        `json:"route"`
+}
+
+type routeDump struct {
+	RouteAddress   string           `json:"address"` // where the route sends
+	RxPackets      int64            `json:"rx_packets"`
+	TxPackets      int64            `json:"tx_packets"`
+	ReceivedIdleMs int64            `json:"received_idle_ms"`
+	TxQueue        channelDepth     `json:"tx_queue"`
+	TxQueueDrops   uint64           `json:"tx_queue_drops"`
+	Duplicates     int64            `json:"duplicates"`
+	WriteErrors    map[string]int64 `json:"write_errors,omitempty"`
+	Closed         bool             `json:"closed"`
+}
+
+type gameDump struct {
+	GameId   string `json:"game_id"`
+	MapName  string `json:"map_name"`
+	Players  int    `json:"players"`
+	Title    string `json:"title,omitempty"`
+	Unlisted bool   `json:"unlisted"`
+	Locked   bool   `json:"locked"`
+	Dedup    bool   `json:"dedup"`
+}
+
+// Dump writes the state to a timestamped file in dump_directory and returns
+// its name.
+func Dump(context *ServerContext) (string, error) {
+	var dump stateDump
+	Do(context, func(s *State) {
+		dump = collectDump(s)
+	})
+	dump.Goroutines = runtime.NumGoroutine()
+	dump.Panics = Panics()
+	dump.Channels["rx"] = channelDepth{len(context.RxChannel), cap(context.RxChannel)}
+	dump.Channels["player_pong"] = channelDepth{len(context.PlayerPongChannel), cap(context.PlayerPongChannel)}
+	dump.Channels["state_requests"] = channelDepth{len(context.requestChannel), cap(context.requestChannel)}
+	for name, backlog := range context.Events.Backlogs() {
+		dump.Channels["events."+name] = channelDepth{backlog, events.MaxBacklog}
+	}
+
+	encoded, err := json.MarshalIndent(dump, "", "\t")
+	if err != nil {
+		return "", err
+	}
+	filename := filepath.Join(config.GetValueString("dump_directory"),
+		fmt.Sprintf("bolorama-state-%s.json", dump.Time.Format("20060102T150405.000")))
+	return filename, ioutil.WriteFile(filename, encoded, 0600)
+}
+
+func collectDump(s *State) stateDump {
+	dump := stateDump{
+		Time:        time.Now(),
+		ProxyIp:     s.context.ProxyIp().String(),
+		PlayerPorts: s.context.Ports.PlayerPorts(),
+		Channels:    make(map[string]channelDepth),
+		Players:     []playerDump{},
+		Games:       []gameDump{},
+		RemoteGames: make(map[string]int),
+		Kicked:      make(map[string]time.Time),
+		Scheduled:   append([]ScheduledGame{}, s.scheduled...),
+		Drain:       DrainProgress(s),
+		RestartAt:   s.restartAt,
+		Broadcast:   s.broadcast,
+		TimedOut:    s.TimedOut,
+	}
+
+	for _, player := range s.Players {
+		p := playerDump{
+			ProxyPort:      player.ProxyPort,
+			Address:        privacy.Addr(player.IpAddr, player.IpPort),
+			NatPort:        player.NatPort,
+			GameId:         hex.EncodeToString(player.GameId[:]),
+			PlayerId:       player.PlayerId,
+			Name:           player.Name,
+			ClaimedName:    player.claimedName,
+			Version:        player.Version.String(),
+			Peers:          player.Peers,
+			PeerPackets:    []int{},
+			DisconnectedAt: player.DisconnectedAt,
+			RttMs:          player.Rtt.Milliseconds(),
+			Tags:           player.Tags,
+		}
+		if player.AdvertiseIp != nil {
+			p.AdvertiseIp = player.AdvertiseIp.String()
+		}
+		for port := range player.PeerPackets {
+			p.PeerPackets = append(p.PeerPackets, port)
+		}
+		sort.Ints(p.PeerPackets)
+		if route := player.Route; route != nil {
+			routeAddr := route.PlayerAddr()
+			rx, tx := route.Packets()
+			p.Route = &routeDump{
+				RouteAddress:   privacy.Addr(routeAddr.IP, routeAddr.Port),
+				RxPackets:      rx,
+				TxPackets:      tx,
+				ReceivedIdleMs: route.ReceivedIdle().Milliseconds(),
+				TxQueue:        channelDepth{route.TxQueue.Len(), route.TxQueue.Cap()},
+				TxQueueDrops:   route.TxQueue.Drops(),
+				Duplicates:     route.Duplicates(),
+				WriteErrors:    route.WriteErrors(),
+				Closed:         route.Ctx.Err() != nil,
+			}
+		}
+		dump.Players = append(dump.Players, p)
+	}
+
+	for gameId, info := range s.Games {
+		dump.Games = append(dump.Games, gameDump{
+			GameId:   hex.EncodeToString(gameId[:]),
+			MapName:  info.MapName,
+			Players:  int(info.PlayerCount),
+			Title:    s.titles[gameId],
+			Unlisted: s.unlisted[gameId],
+			Locked:   s.locked[gameId],
+			Dedup:    GameDedup(s, gameId),
+		})
+	}
+	sort.Slice(dump.Games, func(i, j int) bool { return dump.Games[i].GameId < dump.Games[j].GameId })
+
+	for peer, games := range s.RemoteGames {
+		dump.RemoteGames[peer] = len(games)
+	}
+	for ip, until := range s.kicked {
+		dump.Kicked[privacy.IpString(ip)] = until
+	}
+	return dump
+}
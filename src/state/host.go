@@ -0,0 +1,146 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package state
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"git.astrospark.com/bolorama/bolo"
+	"git.astrospark.com/bolorama/privacy"
+)
+
+// The host of a game, the player who created it, can manage it with chat
+// commands starting with / or !, e.g. "/title Capture the flag" or "!kick
+// Alice". Other players' commands are ignored. Kicks and locks only apply to
+// the host's game and last until it ends.
+const kTitleCommand = "title"
+const kUnlistCommand = "unlist"
+const kListCommand = "list"
+const kKickCommand = "kick"
+const kLockCommand = "lock"
+const kUnlockCommand = "unlock"
+const kDedupCommand = "dedup"
+const kNoDedupCommand = "nodedup"
+
+// hostCommand handles a host chat command, returning false if text is not
+// one.
+func hostCommand(s *State, player Player, text string) bool {
+	if !strings.HasPrefix(text, "/") && !strings.HasPrefix(text, "!") {
+		return false
+	}
+	fields := strings.SplitN(text[1:], " ", 2)
+	argument := ""
+	if len(fields) > 1 {
+		argument = strings.TrimSpace(fields[1])
+	}
+	switch fields[0] {
+	case kTitleCommand, kUnlistCommand, kListCommand, kKickCommand, kLockCommand, kUnlockCommand, kDedupCommand, kNoDedupCommand:
+	default:
+		return false
+	}
+	if port, ok := GameHostPort(s, player.GameId); !ok || port != player.ProxyPort {
+		return true
+	}
+
+	switch fields[0] {
+	case kTitleCommand:
+		setTitle(s, player.GameId, argument)
+	case kUnlistCommand:
+		setUnlisted(s, player.GameId, true)
+	case kListCommand:
+		setUnlisted(s, player.GameId, false)
+	case kKickCommand:
+		hostKick(s, player, argument)
+	case kLockCommand:
+		s.locked[player.GameId] = true
+		s.context.Logger.Printf("Host %s locked game %s\n", player.Name, hex.EncodeToString(player.GameId[:]))
+		s.context.Audit.Record("host "+player.Name, "lock", hex.EncodeToString(player.GameId[:]), "", "")
+	case kUnlockCommand:
+		delete(s.locked, player.GameId)
+		s.context.Logger.Printf("Host %s unlocked game %s\n", player.Name, hex.EncodeToString(player.GameId[:]))
+		s.context.Audit.Record("host "+player.Name, "unlock", hex.EncodeToString(player.GameId[:]), "", "")
+	case kDedupCommand, kNoDedupCommand:
+		if dedupWindow(s) <= 0 {
+			break
+		}
+		setDedup(s, player.GameId, fields[0] == kDedupCommand)
+		s.context.Logger.Printf("Host %s turned duplicate filtering %s for game %s\n", player.Name, onOff(fields[0] == kDedupCommand), hex.EncodeToString(player.GameId[:]))
+	}
+	return true
+}
+
+// hostKick disconnects the player named name from the host's game and refuses
+// their address in it.
+func hostKick(s *State, host Player, name string) {
+	for _, player := range s.Players {
+		if player.GameId != host.GameId || player.ProxyPort == host.ProxyPort || !strings.EqualFold(player.Name, name) {
+			continue
+		}
+		bans := s.gameBans[host.GameId]
+		if bans == nil {
+			bans = make(map[string]bool)
+			s.gameBans[host.GameId] = bans
+		}
+		bans[player.IpAddr.String()] = true
+		s.context.Logger.Printf("Host %s kicked %s from game %s\n", host.Name, player.Name, hex.EncodeToString(host.GameId[:]))
+		s.context.Audit.Record("host "+host.Name, "kick", fmt.Sprintf("%s %s from game %s", player.Name, privacy.Addr(player.IpAddr, player.IpPort), hex.EncodeToString(host.GameId[:])), "", "")
+		PlayerKick(s, player.ProxyPort, 0)
+		return
+	}
+}
+
+// gameAccessError gives the reason the host does not let a new player from ip
+// join the game, or nil if they may.
+func gameAccessError(s *State, ip string, gameId bolo.GameId) error {
+	if s.gameBans[gameId][ip] {
+		return fmt.Errorf("kicked from the game by its host")
+	}
+	if s.locked[gameId] {
+		return fmt.Errorf("game is locked by its host")
+	}
+	return nil
+}
+
+// GameSetHost records the player on proxyPort as the host of a game they
+// created. Ports are reused, so the host is not worked out from them later.
+func GameSetHost(s *State, gameId bolo.GameId, proxyPort int) {
+	s.hosts[gameId] = proxyPort
+}
+
+// GameHostPort returns the proxy port of the game's host, if they are still
+// in it.
+func GameHostPort(s *State, gameId bolo.GameId) (int, bool) {
+	port, ok := s.hosts[gameId]
+	if !ok {
+		return 0, false
+	}
+	host, err := PlayerGetByPort(s, port)
+	if err != nil || host.GameId != gameId {
+		return 0, false
+	}
+	return port, true
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
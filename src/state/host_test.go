@@ -0,0 +1,113 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package state
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+
+	"git.astrospark.com/bolorama/audit"
+	"git.astrospark.com/bolorama/bolo"
+	"git.astrospark.com/bolorama/proxy"
+)
+
+// newTestState returns a state with stub routes and an audit log in a
+// temporary directory, used from the test's own goroutine in place of the
+// state goroutine.
+func newTestState(t *testing.T) *State {
+	context := InitReplayContext(50000, net.IPv4(192, 0, 2, 1))
+	context.Ports.UseStubRoutes(func(int, proxy.UdpPacket) {})
+	context.Audit = audit.NewLog(filepath.Join(t.TempDir(), "audit.log"), "secret", context.Logger)
+	t.Cleanup(func() {
+		Shutdown(context)
+	})
+	return context.state
+}
+
+func newTestPlayer(t *testing.T, s *State, ip string, gameId bolo.GameId) Player {
+	player, err := PlayerNew(s, net.UDPAddr{IP: net.ParseIP(ip).To4(), Port: 50000}, gameId, 50000, bolo.Version{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return player
+}
+
+func TestHostIsTheCreatorNotTheLowestPort(t *testing.T) {
+	s := newTestState(t)
+	gameId := bolo.GameId{1, 2, 3, 4, 5, 6, 7, 8}
+	s.Games[gameId] = bolo.GameInfo{GameId: gameId}
+
+	// the joiner holds the lower port, as they can with reserved, pinned or
+	// reused ports
+	joiner := newTestPlayer(t, s, "198.51.100.2", gameId)
+	host := newTestPlayer(t, s, "198.51.100.1", gameId)
+	GameSetHost(s, gameId, host.ProxyPort)
+	if joiner.ProxyPort > host.ProxyPort {
+		t.Fatalf("joiner has port %d, above the host's %d", joiner.ProxyPort, host.ProxyPort)
+	}
+
+	if !hostCommand(s, joiner, "/title Joiner's game") {
+		t.Fatal("/title was not taken as a host command")
+	}
+	if title := GameTitle(s, gameId); title != "" {
+		t.Errorf("joiner set the title to %q", title)
+	}
+	hostCommand(s, joiner, "!lock")
+	if s.locked[gameId] {
+		t.Error("joiner locked the game")
+	}
+
+	hostCommand(s, host, "/title Host's game")
+	if title := GameTitle(s, gameId); title != "Host's game" {
+		t.Errorf("title is %q after the host set it", title)
+	}
+	hostCommand(s, host, "!lock")
+	if !s.locked[gameId] {
+		t.Error("host could not lock the game")
+	}
+
+	entries, err := s.context.Audit.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Actor != "host "+host.Name || entries[0].Action != "lock" {
+		t.Errorf("audit log has %+v, want only the host's lock", entries)
+	}
+}
+
+func TestHostLeaving(t *testing.T) {
+	s := newTestState(t)
+	gameId := bolo.GameId{1, 2, 3, 4, 5, 6, 7, 8}
+	s.Games[gameId] = bolo.GameInfo{GameId: gameId}
+	host := newTestPlayer(t, s, "198.51.100.1", gameId)
+	joiner := newTestPlayer(t, s, "198.51.100.2", gameId)
+	GameSetHost(s, gameId, host.ProxyPort)
+
+	if port, ok := GameHostPort(s, gameId); !ok || port != host.ProxyPort {
+		t.Fatalf("host port is %d, %v", port, ok)
+	}
+	PlayerJoinGame(s, host.ProxyPort, bolo.GameId{9})
+	if _, ok := GameHostPort(s, gameId); ok {
+		t.Error("host still counted after leaving the game")
+	}
+	hostCommand(s, joiner, "/unlist")
+	if GameUnlisted(s, gameId) {
+		t.Error("joiner unlisted the game after the host left")
+	}
+}
@@ -0,0 +1,62 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package state
+
+import (
+	"testing"
+	"time"
+
+	"git.astrospark.com/bolorama/bolo"
+	"git.astrospark.com/bolorama/clock"
+)
+
+func TestGameExpireIdle(t *testing.T) {
+	s := newTestState(t)
+	mock := clock.NewMock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	s.context.Clock = mock
+
+	const timeout = 5 * time.Minute
+	gameId := bolo.GameId{1, 2, 3, 4, 5, 6, 7, 8}
+	s.Games[gameId] = bolo.GameInfo{GameId: gameId, LastSeen: mock.Now()}
+	newTestPlayer(t, s, "198.51.100.1", gameId)
+
+	mock.Advance(timeout - time.Second)
+	if n := GameExpireIdle(s, timeout); n != 0 {
+		t.Fatalf("expired %d games before the timeout", n)
+	}
+
+	// game info from the host keeps the game going
+	gameInfo := s.Games[gameId]
+	gameInfo.LastSeen = mock.Now()
+	s.Games[gameId] = gameInfo
+	mock.Advance(2 * time.Second)
+	if n := GameExpireIdle(s, timeout); n != 0 {
+		t.Fatalf("expired %d games the host announced a second ago", n)
+	}
+
+	mock.Advance(timeout)
+	if n := GameExpireIdle(s, timeout); n != 1 {
+		t.Fatalf("expired %d games, want 1", n)
+	}
+	if _, ok := s.Games[gameId]; ok {
+		t.Error("expired game is still listed")
+	}
+	if len(s.Players) != 0 {
+		t.Errorf("%d players left in the expired game", len(s.Players))
+	}
+}
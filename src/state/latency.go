@@ -0,0 +1,44 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package state
+
+import (
+	"git.astrospark.com/bolorama/bolo"
+	"git.astrospark.com/bolorama/metrics"
+)
+
+// GameLatency returns the histogram of the time packets forwarded in the game
+// spend in the proxy, from a proxy port reading them to another writing them
+// to the receiving player. The times are counted in context.Latency too.
+func GameLatency(s *State, gameId bolo.GameId) *metrics.Histogram {
+	histogram, ok := s.latency[gameId]
+	if !ok {
+		histogram = s.context.Latency.NewChild()
+		s.latency[gameId] = histogram
+	}
+	return histogram
+}
+
+// GameLatencies returns a snapshot of each game's latency histogram.
+func GameLatencies(s *State) map[bolo.GameId]metrics.HistogramSnapshot {
+	snapshots := make(map[bolo.GameId]metrics.HistogramSnapshot, len(s.latency))
+	for gameId, histogram := range s.latency {
+		snapshots[gameId] = histogram.Snapshot()
+	}
+	return snapshots
+}
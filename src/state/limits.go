@@ -0,0 +1,193 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package state
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"git.astrospark.com/bolorama/bolo"
+	"git.astrospark.com/bolorama/config"
+	"git.astrospark.com/bolorama/events"
+	"git.astrospark.com/bolorama/geoip"
+	"git.astrospark.com/bolorama/privacy"
+	"git.astrospark.com/bolorama/proxy"
+	"git.astrospark.com/bolorama/security"
+	"git.astrospark.com/bolorama/util"
+)
+
+const kRefuseLogInterval = time.Minute
+
+// PlayerLimitError gives the reason a new player from ip may not join the
+// game, or nil if they may.
+func PlayerLimitError(s *State, ip net.IP, gameId bolo.GameId) error {
+	if ServerDraining(s) {
+		return errDraining
+	}
+
+	if until, ok := s.kicked[ip.String()]; ok {
+		if time.Now().Before(until) {
+			return fmt.Errorf("kicked until %s", until.Format(time.Kitchen))
+		}
+		delete(s.kicked, ip.String())
+	}
+
+	if err := gameAccessError(s, ip.String(), gameId); err != nil {
+		return err
+	}
+
+	if err := countryPolicyError(ip, s.context.Logger); err != nil {
+		return err
+	}
+
+	if err := GameLimitError(s, gameId); err != nil {
+		return err
+	}
+
+	if s.context.Ports.PlayerPortsInUse() >= proxy.MaxPlayerPorts {
+		return proxy.ErrNoPlayerPorts
+	}
+
+	maxPerGame := s.context.Config.GetValueInt("max_players_per_game")
+	if maxPerGame > 0 && gameCountPlayers(s, gameId) >= maxPerGame {
+		return fmt.Errorf("game is full (max_players_per_game)")
+	}
+	if maxScheduled := scheduleMaxPlayers(s, gameId); maxScheduled > 0 && gameCountPlayers(s, gameId) >= maxScheduled {
+		return fmt.Errorf("game is full (scheduled for %d players)", maxScheduled)
+	}
+
+	maxPerIp := s.context.Config.GetValueInt("max_players_per_ip")
+	maxPerSubnet := s.context.Config.GetValueInt("max_players_per_subnet")
+	if maxPerIp <= 0 && maxPerSubnet <= 0 {
+		return nil
+	}
+
+	subnet := net.IPNet{IP: ip.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}
+	sameIp := 0
+	sameSubnet := 0
+	// suspended players still hold a proxy port, so they count too
+	for _, player := range s.Players {
+		if player.IpAddr.Equal(ip) {
+			sameIp++
+		}
+		if subnet.Contains(player.IpAddr) {
+			sameSubnet++
+		}
+	}
+
+	if maxPerIp > 0 && sameIp >= maxPerIp {
+		return fmt.Errorf("%d players from this address (max_players_per_ip)", sameIp)
+	}
+	if maxPerSubnet > 0 && sameSubnet >= maxPerSubnet {
+		return fmt.Errorf("%d players from %s (max_players_per_subnet)", sameSubnet, subnet.String())
+	}
+	return nil
+}
+
+// countryPolicyError applies geoip_allow_countries and geoip_deny_countries.
+// Addresses the database does not place in a country, such as LAN addresses,
+// are let in.
+func countryPolicyError(ip net.IP, logger *log.Logger) error {
+	allow := config.GetValueList("geoip_allow_countries")
+	deny := config.GetValueList("geoip_deny_countries")
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil
+	}
+
+	country := geoip.Lookup(ip, logger).Country
+	if country == "" {
+		return nil
+	}
+	for _, code := range deny {
+		if strings.EqualFold(code, country) {
+			return fmt.Errorf("country %s is denied (geoip_deny_countries)", country)
+		}
+	}
+	if len(allow) == 0 {
+		return nil
+	}
+	for _, code := range allow {
+		if strings.EqualFold(code, country) {
+			return nil
+		}
+	}
+	return fmt.Errorf("country %s is not allowed (geoip_allow_countries)", country)
+}
+
+// GameLimitError gives the reason the game may not be started, or nil if it
+// may or is already running.
+func GameLimitError(s *State, gameId bolo.GameId) error {
+	if _, ok := s.Games[gameId]; ok {
+		return nil
+	}
+	if ServerDraining(s) {
+		return errDraining
+	}
+
+	maxGames := s.context.Config.GetValueInt("max_games")
+	if maxGames <= 0 {
+		return nil
+	}
+
+	// WinBolo games and pure tracker hosts are only listed, not proxied
+	count := 0
+	for _, game := range s.Games {
+		if game.DirectAddr() == nil {
+			count++
+		}
+	}
+	if count >= maxGames {
+		return fmt.Errorf("%d games running (max_games)", count)
+	}
+	if reserved := scheduleReserved(s); count+reserved >= maxGames {
+		return fmt.Errorf("%d games running and %d reserved for scheduled games (max_games)", count, reserved)
+	}
+	return nil
+}
+
+// PlayerRefuse logs that a player was turned away and publishes a
+// PlayerRefused event, at most once a minute per address since a refused
+// client keeps trying. The client gets no reply, as Bolo has no way to say
+// why; to them it looks like the game cannot be reached.
+func PlayerRefuse(s *State, addr net.UDPAddr, gameId bolo.GameId, reason error) {
+	now := time.Now()
+	for key, refusedAt := range s.refused {
+		if now.Sub(refusedAt) >= kRefuseLogInterval {
+			delete(s.refused, key)
+		}
+	}
+	key := addr.String()
+	if _, ok := s.refused[key]; ok {
+		return
+	}
+	s.refused[key] = now
+
+	s.context.Logger.Printf("Refusing player %s: %s\n", privacy.Addr(addr.IP, addr.Port), reason)
+	if err := security.Log(security.Refused, addr.IP, addr.Port, reason.Error()); err != nil {
+		s.context.Logger.Println(err)
+	}
+	s.context.Events.Publish(events.Event{
+		Type:       events.PlayerRefused,
+		PlayerAddr: util.PlayerAddr{IpAddr: addr.IP.String(), IpPort: addr.Port},
+		GameId:     gameId,
+		Reason:     reason.Error(),
+	})
+}
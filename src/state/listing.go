@@ -0,0 +1,93 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package state
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"git.astrospark.com/bolorama/bolo"
+)
+
+const kMaxTitleLength = 60
+
+// GameTitle returns the title the host gave the game, or "" if none.
+func GameTitle(s *State, gameId bolo.GameId) string {
+	return s.titles[gameId]
+}
+
+// GameSetTitle gives the game of the player on proxyPort a title, shown in
+// the tracker and web listings. An empty title removes it.
+func GameSetTitle(s *State, proxyPort int, title string) error {
+	player, err := PlayerGetByPort(s, proxyPort)
+	if err != nil {
+		return err
+	}
+	if _, ok := s.Games[player.GameId]; !ok {
+		return fmt.Errorf("player with proxy port %d is not in a game", proxyPort)
+	}
+	setTitle(s, player.GameId, title)
+	return nil
+}
+
+// GameUnlisted reports whether the host asked for the game not to be listed.
+func GameUnlisted(s *State, gameId bolo.GameId) bool {
+	return s.unlisted[gameId]
+}
+
+// GameSetUnlisted hides the game of the player on proxyPort from the tracker
+// and web listings, or lists it again. Players who know the host's address
+// can still join through the proxy.
+func GameSetUnlisted(s *State, proxyPort int, unlisted bool) error {
+	player, err := PlayerGetByPort(s, proxyPort)
+	if err != nil {
+		return err
+	}
+	if _, ok := s.Games[player.GameId]; !ok {
+		return fmt.Errorf("player with proxy port %d is not in a game", proxyPort)
+	}
+	setUnlisted(s, player.GameId, unlisted)
+	return nil
+}
+
+func setUnlisted(s *State, gameId bolo.GameId, unlisted bool) {
+	if unlisted {
+		s.unlisted[gameId] = true
+	} else {
+		delete(s.unlisted, gameId)
+	}
+}
+
+func setTitle(s *State, gameId bolo.GameId, title string) {
+	title = strings.TrimSpace(strings.Map(func(r rune) rune {
+		if !unicode.IsPrint(r) {
+			return -1
+		}
+		return r
+	}, title))
+	if len(title) > kMaxTitleLength {
+		title = strings.TrimSpace(title[:kMaxTitleLength])
+	}
+
+	if title == "" {
+		delete(s.titles, gameId)
+		return
+	}
+	s.titles[gameId] = title
+}
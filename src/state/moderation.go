@@ -0,0 +1,297 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package state
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"git.astrospark.com/bolorama/bolo"
+	"git.astrospark.com/bolorama/events"
+	"git.astrospark.com/bolorama/privacy"
+	"git.astrospark.com/bolorama/security"
+	"git.astrospark.com/bolorama/util"
+)
+
+// Bolo sends a message to each recipient separately, so the same message
+// passes through the proxy several times in quick succession.
+const kChatRepeatWindow = 5 * time.Second
+
+// LeaveReasonKicked is the Reason of PlayerLeft events for kicked players.
+const LeaveReasonKicked = "kicked"
+
+// PlayerChat publishes a ChatMessage event for a message sent by the player
+// with playerId in the game of the player at addr.
+func PlayerChat(s *State, addr util.PlayerAddr, playerId int, text string) {
+	sender, err := PlayerGetByPort(s, addr.ProxyPort)
+	if err != nil {
+		return
+	}
+
+	for i, player := range s.Players {
+		if player.GameId != sender.GameId || player.PlayerId != playerId {
+			continue
+		}
+		if player.lastChat == text && time.Since(player.lastChatAt) < kChatRepeatWindow {
+			return
+		}
+		s.Players[i].lastChat = text
+		s.Players[i].lastChatAt = time.Now()
+		if hostCommand(s, player, text) || loginCommand(s, player, text) {
+			return
+		}
+		s.context.Events.Publish(events.Event{
+			Type:       events.ChatMessage,
+			PlayerAddr: util.PlayerAddr{IpAddr: player.IpAddr.String(), IpPort: player.IpPort, ProxyPort: player.ProxyPort},
+			GameId:     player.GameId,
+			PlayerId:   playerId,
+			Name:       player.Name,
+			Text:       text,
+		})
+		return
+	}
+}
+
+// uniqueName returns the name for the player at index i, who claims name:
+// name itself, or with a number appended if another player in the game is
+// already using it. Publishes a NameCollision event when it has to append.
+func uniqueName(s *State, i int, name string) string {
+	target := s.Players[i]
+	taken := func(candidate string) bool {
+		for j, player := range s.Players {
+			if j != i && player.GameId == target.GameId && strings.EqualFold(player.Name, candidate) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if !taken(name) {
+		return name
+	}
+	unique := name
+	for n := 2; taken(unique); n++ {
+		unique = fmt.Sprintf("%s (%d)", name, n)
+	}
+
+	s.context.Logger.Printf("Player %s (%d) claimed name %s, already in use in the game; now %s\n",
+		privacy.Addr(target.IpAddr, target.IpPort), target.ProxyPort, name, unique)
+	s.context.Events.Publish(events.Event{
+		Type:       events.NameCollision,
+		PlayerAddr: util.PlayerAddr{IpAddr: target.IpAddr.String(), IpPort: target.IpPort, ProxyPort: target.ProxyPort},
+		GameId:     target.GameId,
+		PlayerId:   target.PlayerId,
+		Name:       unique,
+		Text:       name,
+	})
+	return unique
+}
+
+// PlayerKick disconnects the player on proxyPort and refuses new players from
+// their IP address for duration. The ban is saved to ban_file.
+func PlayerKick(s *State, proxyPort int, duration time.Duration) error {
+	player, err := PlayerGetByPort(s, proxyPort)
+	if err != nil {
+		return err
+	}
+
+	if duration > 0 {
+		s.kicked[player.IpAddr.String()] = time.Now().Add(duration)
+		saveBans(s)
+	}
+	s.context.Logger.Printf("Kicked player %s (%d)\n", privacy.Addr(player.IpAddr, player.IpPort), player.ProxyPort)
+	detail := "kicked"
+	if duration > 0 {
+		detail = fmt.Sprintf("banned for %s", duration)
+	}
+	if err := security.Log(security.Kicked, player.IpAddr, player.IpPort, detail); err != nil {
+		s.context.Logger.Println(err)
+	}
+	playerDelete(s, util.PlayerAddr{IpAddr: player.IpAddr.String(), IpPort: player.IpPort, ProxyPort: player.ProxyPort}, LeaveReasonKicked)
+	return nil
+}
+
+// PlayerBan refuses ip for duration, as PlayerKick does, and disconnects the
+// players from it.
+func PlayerBan(s *State, ip net.IP, duration time.Duration) {
+	s.kicked[ip.String()] = time.Now().Add(duration)
+	saveBans(s)
+	if err := security.Log(security.Kicked, ip, 0, fmt.Sprintf("banned for %s", duration)); err != nil {
+		s.context.Logger.Println(err)
+	}
+
+	var ports []int
+	for _, player := range s.Players {
+		if player.IpAddr.Equal(ip) {
+			ports = append(ports, player.ProxyPort)
+		}
+	}
+	for _, port := range ports {
+		PlayerKick(s, port, 0)
+	}
+}
+
+// PlayerKicked returns the addresses refused by PlayerKick and until when.
+// Expired bans are dropped.
+func PlayerKicked(s *State) map[string]time.Time {
+	kicked := make(map[string]time.Time)
+	for ip, until := range s.kicked {
+		if time.Now().Before(until) {
+			kicked[ip] = until
+		} else {
+			delete(s.kicked, ip)
+		}
+	}
+	return kicked
+}
+
+// PlayerUnkick lets players from ip join again.
+func PlayerUnkick(s *State, ip net.IP) bool {
+	_, ok := s.kicked[ip.String()]
+	delete(s.kicked, ip.String())
+	if ok {
+		saveBans(s)
+	}
+	return ok
+}
+
+// PlayerShadowBan keeps the packets of players from the address of the player
+// on proxyPort from reaching anyone, without telling them: they are still
+// answered and sent the game, so the ban is not obvious to the player and
+// they have no reason to come back under another address.
+func PlayerShadowBan(s *State, proxyPort int) error {
+	player, err := PlayerGetByPort(s, proxyPort)
+	if err != nil {
+		return err
+	}
+
+	s.shadowBanned[player.IpAddr.String()] = true
+	s.context.Logger.Printf("Shadow banned player %s (%d)\n", privacy.Addr(player.IpAddr, player.IpPort), player.ProxyPort)
+	return nil
+}
+
+// PlayerShadowBanned reports whether players from ip are shadow banned.
+func PlayerShadowBanned(s *State, ip net.IP) bool {
+	return s.shadowBanned[ip.String()]
+}
+
+// PlayerShadowBans returns the shadow banned addresses.
+func PlayerShadowBans(s *State) []string {
+	var ips []string
+	for ip := range s.shadowBanned {
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+// PlayerUnshadowBan lifts the shadow ban on ip.
+func PlayerUnshadowBan(s *State, ip net.IP) bool {
+	_, ok := s.shadowBanned[ip.String()]
+	delete(s.shadowBanned, ip.String())
+	return ok
+}
+
+// PlayerMute blanks the chat messages of players from the address of the
+// player on proxyPort. Their game play is not affected.
+func PlayerMute(s *State, proxyPort int) error {
+	player, err := PlayerGetByPort(s, proxyPort)
+	if err != nil {
+		return err
+	}
+
+	s.muted[player.IpAddr.String()] = true
+	s.context.Logger.Printf("Muted player %s (%d)\n", privacy.Addr(player.IpAddr, player.IpPort), player.ProxyPort)
+	return nil
+}
+
+// PlayerMutes returns the muted addresses.
+func PlayerMutes(s *State) []string {
+	var ips []string
+	for ip := range s.muted {
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+// PlayerUnmute lets players from ip chat again.
+func PlayerUnmute(s *State, ip net.IP) bool {
+	_, ok := s.muted[ip.String()]
+	delete(s.muted, ip.String())
+	return ok
+}
+
+// GameMutedPlayerIds returns the Bolo player ids of the muted players in the
+// game.
+func GameMutedPlayerIds(s *State, gameId bolo.GameId) []int {
+	if len(s.muted) == 0 {
+		return nil
+	}
+	var ids []int
+	for _, player := range s.Players {
+		if player.GameId == gameId && player.PlayerId >= 0 && s.muted[player.IpAddr.String()] {
+			ids = append(ids, player.PlayerId)
+		}
+	}
+	return ids
+}
+
+// PlayerTag adds or removes a tag on the player on proxyPort. Tags mark
+// players for the operator and hooks; they do not change how the player is
+// handled.
+func PlayerTag(s *State, proxyPort int, tag string, add bool) error {
+	for i, player := range s.Players {
+		if player.ProxyPort != proxyPort {
+			continue
+		}
+		var tags []string
+		for _, t := range player.Tags {
+			if t != tag {
+				tags = append(tags, t)
+			}
+		}
+		if add {
+			tags = append(tags, tag)
+		}
+		s.Players[i].Tags = tags
+		return nil
+	}
+	return fmt.Errorf("player with proxy port %d not found", proxyPort)
+}
+
+// PlayerPurge forgets the address: its kick, shadow ban, mute and game bans.
+// Returns false if there was nothing to forget.
+func PlayerPurge(s *State, ip net.IP) bool {
+	key := ip.String()
+	found := PlayerUnkick(s, ip)
+	found = PlayerUnshadowBan(s, ip) || found
+	found = PlayerUnmute(s, ip) || found
+	for _, bans := range s.gameBans {
+		if bans[key] {
+			delete(bans, key)
+			found = true
+		}
+	}
+	for addr := range s.refused {
+		if host, _, err := net.SplitHostPort(addr); err == nil && host == key {
+			delete(s.refused, addr)
+		}
+	}
+	return found
+}
@@ -0,0 +1,87 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package state
+
+import (
+	"time"
+
+	"git.astrospark.com/bolorama/clock"
+	"git.astrospark.com/bolorama/privacy"
+	"git.astrospark.com/bolorama/util"
+)
+
+// PlayerPingSent notes when the tracker last pinged the player for game info,
+// so the reply can be timed.
+func PlayerPingSent(s *State, proxyPort int) {
+	for i, player := range s.Players {
+		if player.ProxyPort == proxyPort {
+			s.Players[i].pingSentAt = s.context.Clock.Now()
+			return
+		}
+	}
+}
+
+// PlayerPingReply is called when the player sends something to the tracker
+// port. If a ping is outstanding, the time since it was sent updates the
+// player's smoothed round trip time, as TCP does.
+func PlayerPingReply(s *State, proxyPort int) {
+	for i, player := range s.Players {
+		if player.ProxyPort != proxyPort {
+			continue
+		}
+		if player.pingSentAt.IsZero() {
+			return
+		}
+		sample := clock.Since(s.context.Clock, player.pingSentAt)
+		if player.Rtt == 0 {
+			s.Players[i].Rtt = sample
+		} else {
+			s.Players[i].Rtt = (7*player.Rtt + sample) / 8
+		}
+		s.Players[i].pingSentAt = time.Time{}
+		return
+	}
+}
+
+// PlayerRtts returns the round trip times of the given players that have
+// been measured.
+func PlayerRtts(s *State, addrs []util.PlayerAddr) map[util.PlayerAddr]time.Duration {
+	rtts := make(map[util.PlayerAddr]time.Duration)
+	for _, addr := range addrs {
+		for _, player := range s.Players {
+			if player.ProxyPort == addr.ProxyPort && player.Rtt > 0 {
+				rtts[addr] = player.Rtt
+				break
+			}
+		}
+	}
+	return rtts
+}
+
+// PlayerTimedOut handles a player who stopped answering pings: they are held
+// for reconnect_grace_seconds if set, otherwise deleted. Timeouts are counted
+// separately from players leaving normally.
+func PlayerTimedOut(s *State, addr util.PlayerAddr, reconnectGrace time.Duration) {
+	s.context.Logger.Printf("Player timed out %s:%d\n", privacy.IpString(addr.IpAddr), addr.IpPort)
+	s.TimedOut++
+	if reconnectGrace > 0 {
+		PlayerSuspend(s, addr)
+	} else {
+		playerDelete(s, addr, LeaveReasonTimeout)
+	}
+}
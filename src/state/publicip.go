@@ -0,0 +1,64 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package state
+
+import (
+	"time"
+
+	"git.astrospark.com/bolorama/config"
+)
+
+// PublicIpMonitor periodically re-discovers the public IP address with STUN.
+// When it changes, the new address is used for NAT probes and every player's
+// peer timestamps are cleared so that probes carrying it go out with the next
+// packets. Does nothing unless stun_server is set and proxy_ip is not.
+func PublicIpMonitor(context *ServerContext) {
+	defer context.Network.WaitGroup.Done()
+
+	interval := config.GetValueInt("public_ip_refresh_seconds")
+	if !config.HasValue("stun_server") || config.HasValue("proxy_ip") || interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-context.Network.Ctx.Done():
+			return
+		case <-ticker.C:
+			ip, err := config.DiscoverPublicIp()
+			if err != nil {
+				context.Logger.Println("Public IP discovery failed:", err)
+				continue
+			}
+			if ip.Equal(context.ProxyIp()) {
+				continue
+			}
+
+			context.Logger.Printf("Public IP address changed from %s to %s\n", context.ProxyIp(), ip)
+			context.SetProxyIp(ip)
+			Do(context, func(s *State) {
+				for i := range s.Players {
+					s.Players[i].Peers = make(map[int]time.Time)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,82 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package state
+
+import (
+	"net"
+	"runtime/debug"
+	"sync/atomic"
+
+	"git.astrospark.com/bolorama/privacy"
+	"git.astrospark.com/bolorama/proxy"
+	"git.astrospark.com/bolorama/util"
+)
+
+// LeaveReasonCrashed is the Reason of PlayerLeft events for players removed
+// after a panic while handling their packets.
+const LeaveReasonCrashed = "crashed"
+
+var panics uint64
+
+// Panics returns how many panics have been recovered, in route goroutines or
+// while handling packets, instead of crashing the server.
+func Panics() uint64 {
+	return atomic.LoadUint64(&panics) + proxy.Panics()
+}
+
+// RecoverPlayer recovers a panic while doing what for the player at
+// playerAddr, logging it and removing only that player. It must be deferred.
+func RecoverPlayer(context *ServerContext, what string, playerAddr net.UDPAddr) {
+	err := recover()
+	if err == nil {
+		return
+	}
+
+	context.Logger.Printf("Recovered panic %s for %s: %v\n%s", what, privacy.Addr(playerAddr.IP, playerAddr.Port), err, debug.Stack())
+	atomic.AddUint64(&panics, 1)
+
+	Do(context, func(s *State) {
+		player, err := PlayerGetByAddr(s, playerAddr)
+		if err != nil {
+			return
+		}
+		context.Logger.Printf("Removing player %d (%s) after a panic\n", player.ProxyPort, player.Name)
+		playerDelete(s, util.PlayerAddr{IpAddr: player.IpAddr.String(), IpPort: player.IpPort, ProxyPort: player.ProxyPort}, LeaveReasonCrashed)
+	})
+}
+
+// Recover recovers a panic while doing what, logging it. It must be deferred.
+func Recover(context *ServerContext, what string) {
+	if err := recover(); err != nil {
+		context.Logger.Printf("Recovered panic %s: %v\n%s", what, err, debug.Stack())
+		atomic.AddUint64(&panics, 1)
+	}
+}
+
+// removeDropped removes the player whose route was torn down, after a panic
+// or because their address could not be reached.
+func removeDropped(context *ServerContext, route *proxy.Route, why string, reason string) {
+	Do(context, func(s *State) {
+		player, err := PlayerGetByPort(s, route.ProxyPort)
+		if err != nil {
+			return
+		}
+		context.Logger.Printf("Removing player %d (%s) %s\n", player.ProxyPort, player.Name, why)
+		playerDelete(s, util.PlayerAddr{IpAddr: player.IpAddr.String(), IpPort: player.IpPort, ProxyPort: player.ProxyPort}, reason)
+	})
+}
@@ -0,0 +1,153 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package state
+
+import (
+	"fmt"
+	"time"
+
+	"git.astrospark.com/bolorama/events"
+)
+
+// A scheduled restart is announced with ServerRestart events at each of
+// kRestartWarnings before it. At the restart time the server drains, and it
+// shuts down once the last game has ended.
+
+var kRestartWarnings = []time.Duration{30 * time.Minute, 10 * time.Minute, 5 * time.Minute, time.Minute}
+
+const kRestartCheckInterval = time.Second
+
+// ServerScheduleRestart schedules a restart at at, replacing any scheduled
+// before, and announces it.
+func ServerScheduleRestart(s *State, at time.Time) {
+	s.restartAt = at
+	s.restartWarned = 0
+	remaining := time.Until(at)
+	for s.restartWarned < len(kRestartWarnings) && remaining <= kRestartWarnings[s.restartWarned] {
+		s.restartWarned++
+	}
+	// once due, restartTick announces the drain
+	if remaining > 0 {
+		restartAnnounce(s, remaining)
+	}
+}
+
+// ServerCancelRestart cancels the scheduled restart, and the drain it started.
+// Returns false if there was none.
+func ServerCancelRestart(s *State) bool {
+	if s.restartAt.IsZero() {
+		return false
+	}
+	if s.restartDraining {
+		ServerDrain(s, false)
+	}
+	s.restartAt = time.Time{}
+	s.restartDraining = false
+	s.context.Logger.Println("Restart cancelled")
+	return true
+}
+
+// ServerRestartTime returns when the server restarts, or the zero time.
+func ServerRestartTime(s *State) time.Time {
+	return s.restartAt
+}
+
+// RestartNotice describes the scheduled restart or drain for players, or
+// is empty if there is neither.
+func RestartNotice(s *State) string {
+	if !s.restartAt.IsZero() && time.Now().Before(s.restartAt) {
+		return fmt.Sprintf("This server restarts in %s, at %s.",
+			formatCountdown(time.Until(s.restartAt)), s.restartAt.UTC().Format("15:04 MST"))
+	}
+	if ServerDraining(s) {
+		return "This server is about to restart and is not taking new games or players."
+	}
+	return ""
+}
+
+// RestartScheduler carries out scheduled restarts, calling shutdown once the
+// server has drained.
+func RestartScheduler(context *ServerContext, shutdown func()) {
+	defer context.Network.WaitGroup.Done()
+
+	ticker := time.NewTicker(kRestartCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-context.Network.Ctx.Done():
+			return
+		case <-ticker.C:
+			drained := false
+			Do(context, func(s *State) {
+				drained = restartTick(s)
+			})
+			if drained {
+				context.Logger.Println("Restarting: the last game has ended")
+				shutdown()
+				return
+			}
+		}
+	}
+}
+
+// restartTick gives the warnings that are due and starts draining at the
+// restart time. Returns true once the drain is complete.
+func restartTick(s *State) bool {
+	if s.restartAt.IsZero() {
+		return false
+	}
+
+	remaining := time.Until(s.restartAt)
+	if remaining > 0 {
+		warn := false
+		for s.restartWarned < len(kRestartWarnings) && remaining <= kRestartWarnings[s.restartWarned] {
+			s.restartWarned++
+			warn = true
+		}
+		if warn {
+			restartAnnounce(s, remaining)
+		}
+		return false
+	}
+
+	if !s.restartDraining {
+		s.restartDraining = true
+		ServerDrain(s, true)
+		restartAnnounce(s, 0)
+	}
+	return len(s.Games) == 0 && len(s.Players) == 0
+}
+
+func restartAnnounce(s *State, remaining time.Duration) {
+	text := "Server is restarting once the games in progress end; no new games or players"
+	if remaining > 0 {
+		text = fmt.Sprintf("Server restarts in %s, at %s", formatCountdown(remaining), s.restartAt.UTC().Format("15:04 MST"))
+	}
+	s.context.Logger.Println(text)
+	s.context.Events.Publish(events.Event{Type: events.ServerRestart, Text: text})
+}
+
+// formatCountdown rounds d up to whole minutes, e.g. "10 minutes".
+func formatCountdown(d time.Duration) string {
+	minutes := int((d + time.Minute - time.Second) / time.Minute)
+	if minutes == 1 {
+		return "1 minute"
+	}
+	return fmt.Sprintf("%d minutes", minutes)
+}
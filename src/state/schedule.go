@@ -0,0 +1,156 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package state
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"git.astrospark.com/bolorama/bolo"
+	"git.astrospark.com/bolorama/events"
+)
+
+// A scheduled game reserves a slot under max_games from its start time
+// until a game on its map starts and claims it, or until kReservationWindow
+// has passed.
+const kReservationWindow = 30 * time.Minute
+
+// at most this many upcoming games, so public scheduling cannot fill memory
+const kMaxScheduled = 50
+
+type ScheduledGame struct {
+	Id          int       `json:"id"`
+	Start       time.Time `json:"start"`
+	MapName     string    `json:"map_name"`
+	MaxPlayers  int       `json:"max_players"` // 0 for no limit
+	ScheduledBy string    `json:"scheduled_by"`
+	// GameId is set once a game on the map has started at the scheduled
+	// time
+	GameId *bolo.GameId `json:"-"`
+}
+
+// Announcement describes the game for players.
+func (game ScheduledGame) Announcement() string {
+	players := "any number of players"
+	if game.MaxPlayers > 0 {
+		players = fmt.Sprintf("up to %d players", game.MaxPlayers)
+	}
+	return fmt.Sprintf("%s at %s, %s", game.MapName, game.Start.Format(time.RFC1123), players)
+}
+
+// ScheduleAdd schedules a game and announces it with a GameScheduled event.
+func ScheduleAdd(s *State, game ScheduledGame) (ScheduledGame, error) {
+	scheduleExpire(s)
+	if len(s.scheduled) >= kMaxScheduled {
+		return game, fmt.Errorf("too many games scheduled")
+	}
+	if game.Start.Before(time.Now()) {
+		return game, fmt.Errorf("start time has passed")
+	}
+
+	s.scheduleId++
+	game.Id = s.scheduleId
+	game.GameId = nil
+	s.scheduled = append(s.scheduled, game)
+	sort.SliceStable(s.scheduled, func(i, j int) bool {
+		return s.scheduled[i].Start.Before(s.scheduled[j].Start)
+	})
+
+	s.context.Logger.Println("Scheduled game", game.Id, game.Announcement())
+	s.context.Events.Publish(events.Event{Type: events.GameScheduled, Name: game.MapName, Text: game.Announcement()})
+	return game, nil
+}
+
+// ScheduleRemove cancels a scheduled game.
+func ScheduleRemove(s *State, id int) bool {
+	for i, game := range s.scheduled {
+		if game.Id == id {
+			s.scheduled = append(s.scheduled[:i], s.scheduled[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// ScheduleList returns the scheduled games that have not started or are
+// still holding their reservation, soonest first.
+func ScheduleList(s *State) []ScheduledGame {
+	scheduleExpire(s)
+	return append([]ScheduledGame(nil), s.scheduled...)
+}
+
+// ScheduleClaim gives a new game the reservation of a scheduled game on the
+// same map whose start time has come. Call before checking limits, so the
+// game is not refused for lack of the slot reserved for it.
+func ScheduleClaim(s *State, gameInfo bolo.GameInfo) {
+	if _, ok := s.Games[gameInfo.GameId]; ok {
+		return
+	}
+	scheduleExpire(s)
+	for i, game := range s.scheduled {
+		if game.GameId == nil && !time.Now().Before(game.Start) && strings.EqualFold(game.MapName, gameInfo.MapName) {
+			gameId := gameInfo.GameId
+			s.scheduled[i].GameId = &gameId
+			s.context.Logger.Println("Game", game.Id, "started as scheduled")
+			return
+		}
+	}
+}
+
+// scheduleReserved returns how many games are reserved and not yet claimed.
+func scheduleReserved(s *State) int {
+	scheduleExpire(s)
+	count := 0
+	for _, game := range s.scheduled {
+		if game.GameId == nil && !time.Now().Before(game.Start) {
+			count++
+		}
+	}
+	return count
+}
+
+// scheduleMaxPlayers returns the player limit of the scheduled game the game
+// claimed, or 0.
+func scheduleMaxPlayers(s *State, gameId bolo.GameId) int {
+	for _, game := range s.scheduled {
+		if game.GameId != nil && *game.GameId == gameId {
+			return game.MaxPlayers
+		}
+	}
+	return 0
+}
+
+// scheduleExpire drops scheduled games whose reservation window has passed,
+// and claimed ones whose game has ended.
+func scheduleExpire(s *State) {
+	var scheduled []ScheduledGame
+	for _, game := range s.scheduled {
+		if game.GameId == nil && time.Since(game.Start) > kReservationWindow {
+			continue
+		}
+		if game.GameId != nil {
+			if _, ok := s.Games[*game.GameId]; !ok {
+				continue
+			}
+		}
+		scheduled = append(scheduled, game)
+	}
+	s.scheduled = scheduled
+}
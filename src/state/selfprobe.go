@@ -0,0 +1,282 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package state
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"git.astrospark.com/bolorama/bolo"
+	"git.astrospark.com/bolorama/config"
+	"git.astrospark.com/bolorama/events"
+	"git.astrospark.com/bolorama/proxy"
+	"git.astrospark.com/bolorama/util"
+)
+
+// The self-probe plays a player from outside every self_probe_minutes, to
+// catch a server that is up but broken. It asks the tracker port for the game
+// listing, hosts a game of its own by sending game info to the tracker port,
+// and sends a packet to the proxy port it is given, which the proxy echoes
+// back as it does for a host alone in its game. Its game is kept out of the
+// listings and ended as soon as the probe is done. A failure raises an Alert
+// event naming the stage that failed, and success afterwards resolves it.
+
+// AlertSelfProbe is the Name of Alert events raised by the self-probe.
+const AlertSelfProbe = "self-probe"
+
+// Alert Reasons
+const AlertFiring = "firing"
+const AlertResolved = "resolved"
+
+// LeaveReasonProbe is the Reason of PlayerLeft events for the self-probe's
+// player, removed when the probe is done.
+const LeaveReasonProbe = "probe"
+
+const kSelfProbeMapName = "bolorama self-probe"
+
+// selfProbeMarker starts the body of the packet echoed through the proxy port.
+var selfProbeMarker = []byte("PROBE")
+
+// SelfProbe runs the self-probe until the network is shut down. Does nothing
+// unless self_probe_minutes is set, or in pure tracker mode, in which games
+// are not proxied.
+func SelfProbe(context *ServerContext) {
+	defer context.Network.WaitGroup.Done()
+
+	interval := time.Duration(config.GetValueInt("self_probe_minutes")) * time.Minute
+	if interval <= 0 || config.GetValueBool("pure_tracker") {
+		return
+	}
+	timeout := time.Duration(config.GetValueInt("self_probe_timeout_seconds")) * time.Second
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// the stage that failed the last probe, "" if it passed
+	failing := ""
+
+	for {
+		select {
+		case <-context.Network.Ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		stage, err := selfProbe(context, timeout)
+		if err != nil {
+			if context.Network.Ctx.Err() != nil {
+				// shutting down underneath the probe
+				return
+			}
+			context.Logger.Printf("Self-probe failed at %s: %s\n", stage, err)
+			if stage != failing {
+				context.Events.Publish(events.Event{
+					Type:   events.Alert,
+					Name:   AlertSelfProbe,
+					Reason: AlertFiring,
+					Text:   fmt.Sprintf("self-probe failed at %s: %s", stage, err),
+				})
+			}
+			failing = stage
+			continue
+		}
+
+		if context.Debug {
+			context.Logger.Println("Self-probe passed")
+		}
+		if failing != "" {
+			context.Logger.Println("Self-probe passed again")
+			context.Events.Publish(events.Event{
+				Type:   events.Alert,
+				Name:   AlertSelfProbe,
+				Reason: AlertResolved,
+				Text:   "self-probe passed again",
+			})
+			failing = ""
+		}
+	}
+}
+
+// selfProbeAddress returns the address the self-probe sends to:
+// self_probe_address, or the proxy's public address.
+func selfProbeAddress(context *ServerContext) net.IP {
+	if config.HasValue("self_probe_address") {
+		return net.ParseIP(config.GetValueString("self_probe_address")).To4()
+	}
+	return context.ProxyIp()
+}
+
+// selfProbe runs the stages of the probe in turn, returning the one that
+// failed and why.
+func selfProbe(context *ServerContext, timeout time.Duration) (string, error) {
+	ip := selfProbeAddress(context)
+	trackerAddr := &net.UDPAddr{IP: ip, Port: context.ProxyPort}
+
+	// in pure proxy mode the external tracker has the listing
+	if !config.HasValue("external_tracker") {
+		if err := selfProbeListing(trackerAddr, timeout); err != nil {
+			return "listing", err
+		}
+	}
+
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return "route", err
+	}
+	defer conn.Close()
+
+	var gameId bolo.GameId
+	if _, err := rand.Read(gameId[:]); err != nil {
+		return "route", err
+	}
+	Do(context, func(s *State) {
+		setUnlisted(s, gameId, true)
+	})
+	defer selfProbeEnd(context, gameId)
+
+	proxyPort, err := selfProbeRoute(context, conn, trackerAddr, gameId, timeout)
+	if err != nil {
+		return "route", err
+	}
+
+	if err := selfProbeEcho(conn, &net.UDPAddr{IP: ip, Port: proxyPort}, timeout); err != nil {
+		return "echo", err
+	}
+	return "", nil
+}
+
+// selfProbeListing reads the game listing from the tracker port.
+func selfProbeListing(trackerAddr *net.UDPAddr, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp4", trackerAddr.String(), timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	listing, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return err
+	}
+	if len(listing) == 0 {
+		return fmt.Errorf("empty listing from %s", trackerAddr)
+	}
+	return nil
+}
+
+// selfProbeRoute announces the probe's game to the tracker port, and returns
+// the proxy port the probe is given as its host.
+func selfProbeRoute(context *ServerContext, conn *net.UDPConn, trackerAddr *net.UDPAddr, gameId bolo.GameId, timeout time.Duration) (int, error) {
+	if _, err := conn.WriteToUDP(selfProbeGameInfo(gameId), trackerAddr); err != nil {
+		return 0, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		proxyPort := 0
+		Do(context, func(s *State) {
+			for _, player := range s.Players {
+				if player.GameId == gameId {
+					proxyPort = player.ProxyPort
+					return
+				}
+			}
+		})
+		if proxyPort != 0 {
+			return proxyPort, nil
+		}
+
+		select {
+		case <-context.Network.Ctx.Done():
+			return 0, context.Network.Ctx.Err()
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	return 0, fmt.Errorf("no proxy port for the game announced to %s within %s", trackerAddr, timeout)
+}
+
+// selfProbeEcho sends a packet to the probe's own proxy port and waits for the
+// proxy to send it back.
+func selfProbeEcho(conn *net.UDPConn, proxyAddr *net.UDPAddr, timeout time.Duration) error {
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	packet := append(bolo.MarshalPacketTypeD()[:bolo.PacketHeaderSize], selfProbeMarker...)
+	packet[bolo.PacketTypeOffset] = bolo.PacketTypeGameStateAck
+	packet = append(packet, nonce...)
+
+	if _, err := conn.WriteToUDP(packet, proxyAddr); err != nil {
+		return err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buffer := make([]byte, proxy.BufferSize())
+	for {
+		n, addr, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return fmt.Errorf("no echo from proxy port %d within %s", proxyAddr.Port, timeout)
+			}
+			return err
+		}
+		// game info requests from the tracker port may arrive too
+		if addr.Port == proxyAddr.Port && bytes.Equal(buffer[:n], packet) {
+			return nil
+		}
+	}
+}
+
+// selfProbeEnd removes the probe's player and game.
+func selfProbeEnd(context *ServerContext, gameId bolo.GameId) {
+	Do(context, func(s *State) {
+		var players []util.PlayerAddr
+		for _, player := range s.Players {
+			if player.GameId == gameId {
+				players = append(players, util.PlayerAddr{IpAddr: player.IpAddr.String(), IpPort: player.IpPort, ProxyPort: player.ProxyPort})
+			}
+		}
+		for _, playerAddr := range players {
+			playerDelete(s, playerAddr, LeaveReasonProbe)
+		}
+		if _, ok := s.Games[gameId]; ok {
+			GameDelete(s, gameId)
+		}
+		delete(s.unlisted, gameId)
+	})
+}
+
+// selfProbeGameInfo returns the game info packet the probe hosts its game
+// with.
+func selfProbeGameInfo(gameId bolo.GameId) []byte {
+	packet := append(bolo.MarshalPacketTypeD()[:bolo.PacketHeaderSize], make([]byte, 63)...)
+	packet[bolo.PacketTypeOffset] = bolo.PacketTypeGameInfo
+	pos := bolo.PacketHeaderSize
+	packet[pos] = byte(copy(packet[pos+1:pos+36], kSelfProbeMapName))
+	pos += 36
+	copy(packet[pos:pos+8], gameId[:])
+	pos += 8
+	packet[pos] = 1                                   // game type
+	binary.LittleEndian.PutUint16(packet[pos+12:], 1) // player count
+	return packet
+}
@@ -18,113 +18,404 @@
 package state
 
 import (
+	"context"
+	"database/sql"
 	"encoding/hex"
 	"fmt"
+	"log"
 	"net"
+	"runtime/debug"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"git.astrospark.com/bolorama/audit"
 	"git.astrospark.com/bolorama/bolo"
+	"git.astrospark.com/bolorama/clock"
 	"git.astrospark.com/bolorama/config"
+	"git.astrospark.com/bolorama/events"
+	"git.astrospark.com/bolorama/geoip"
+	"git.astrospark.com/bolorama/metrics"
+	"git.astrospark.com/bolorama/otlp"
+	"git.astrospark.com/bolorama/privacy"
+	"git.astrospark.com/bolorama/profanity"
 	"git.astrospark.com/bolorama/proxy"
+	"git.astrospark.com/bolorama/record"
+	"git.astrospark.com/bolorama/trace"
 	"git.astrospark.com/bolorama/util"
 )
 
+const migrationQuietDuration = 2 * time.Second
+
 type ServerContext struct {
-	Players               []Player
-	Games                 map[bolo.GameId]bolo.GameInfo
-	ProxyIpAddr           net.IP
-	ProxyPort             int
-	UdpConnection         *net.UDPConn
-	RxChannel             chan proxy.UdpPacket
-	PlayerPongChannel     chan util.PlayerAddr
-	LogGameEndChannel     chan bolo.GameId
-	LogPlayerJoinChannel  chan util.PlayerAddr
-	LogPlayerLeaveChannel chan util.PlayerAddr
-	ShutdownChannel       chan struct{}
-	WaitGroup             *sync.WaitGroup
-	Mutex                 *sync.RWMutex
-	Debug                 bool
+	rxBusySince       int64 // unix nanoseconds, accessed atomically; kept first for alignment
+	rxBusyPort        int64 // proxy port of the packet being handled, same
+	ProxyPort         int
+	UdpConnections    []proxy.PacketConn // tracker port, one per bind address
+	RxChannel         chan proxy.UdpPacket
+	PlayerPongChannel chan util.PlayerAddr
+	Events            *events.Bus
+	Recorder          *record.Recorder // nil unless record_directory or pcap_directory is set
+	Audit             *audit.Log       // nil unless audit_file is set; shared by the trackers
+	Tracer            *trace.Tracer
+	Spans             *otlp.Exporter     // nil unless otlp_endpoint is set
+	Latency           *metrics.Histogram // of all games; see GameLatency
+	Clock             clock.Clock        // the wall clock, except in a simulation
+	Config            *config.Scope      // the tracker's own settings; nil for the main tracker
+	Name              string             // the tracker's name in trackers; "" for the main tracker
+	Trackers          []*ServerContext   // on the main tracker, the trackers set in trackers
+	Ports             *proxy.Ports       // the proxy ports players are given
+	Logger            *log.Logger        // receives the server's diagnostics
+	Db                *sql.DB            // nil unless enable_statistics is set
+	Network           *Subsystem
+	State             *Subsystem
+	Stats             *Subsystem
+	Debug             bool
+	requestChannel    chan *stateRequest
+	state             *State
+	proxyIp           atomic.Value
+}
+
+// Subsystem groups goroutines that are stopped together during shutdown.
+// Goroutines belonging to a subsystem add themselves to its WaitGroup and
+// return when its Ctx is done.
+type Subsystem struct {
+	Name      string
+	Ctx       context.Context
+	Cancel    context.CancelFunc
+	WaitGroup *sync.WaitGroup
+}
+
+// State holds the players and games. It is owned by the state goroutine (see
+// Run) and must only be accessed from within a function passed to Do.
+type State struct {
+	Players []Player
+	Games   map[bolo.GameId]bolo.GameInfo
+	// RemoteGames are the games listed by federation peers, by peer
+	RemoteGames map[string][]RemoteGame
+	context     *ServerContext
+	refused     map[string]time.Time // see PlayerRefuse
+	kicked      map[string]time.Time // see PlayerKick
+	// addresses whose packets are dropped (see PlayerShadowBan)
+	shadowBanned map[string]bool
+	muted        map[string]bool                    // see PlayerMute
+	titles       map[bolo.GameId]string             // see GameSetTitle
+	latency      map[bolo.GameId]*metrics.Histogram // see GameLatency
+	unlisted     map[bolo.GameId]bool               // see GameSetUnlisted
+	// addresses kicked from a game, and games locked, by their host (see
+	// hostCommand)
+	gameBans   map[bolo.GameId]map[string]bool
+	locked     map[bolo.GameId]bool
+	hosts      map[bolo.GameId]int  // see GameSetHost
+	dedup      map[bolo.GameId]bool // see GameSetDedup
+	scheduled  []ScheduledGame
+	scheduleId int
+	// zero unless draining (see ServerDrain)
+	drainingSince time.Time
+	// zero unless a restart is scheduled (see ServerScheduleRestart)
+	restartAt       time.Time
+	restartWarned   int  // how many of kRestartWarnings were given
+	restartDraining bool // the restart time has passed and draining began
+	// shown to players until cleared (see ServerBroadcast)
+	broadcast string
+	// nil unless a tournament was created (see TournamentReplace)
+	tournament *Tournament
+	// TimedOut counts players who stopped answering pings since startup
+	TimedOut int
 }
 
 type Player struct {
-	IpAddr            net.IP
-	IpPort            int
-	ProxyPort         int
-	Connection        *net.UDPConn
-	TxChannel         chan proxy.UdpPacket
-	DisconnectChannel chan struct{}
-	GameId            bolo.GameId
-	PlayerId          int
-	Name              string
-	Peers             map[int]time.Time
-	PeerPackets       map[int]proxy.UdpPacket
-	NatPort           int
-}
-
-func InitContext(port int) *ServerContext {
-	debug := config.GetValueBool("debug")
-	return &ServerContext{
-		Games:                 make(map[bolo.GameId]bolo.GameInfo),
-		ProxyIpAddr:           config.GetProxyIp(),
-		ProxyPort:             port,
-		UdpConnection:         connectUdp(port),
-		PlayerPongChannel:     make(chan util.PlayerAddr),
-		RxChannel:             make(chan proxy.UdpPacket),
-		LogGameEndChannel:     make(chan bolo.GameId),
-		LogPlayerJoinChannel:  make(chan util.PlayerAddr),
-		LogPlayerLeaveChannel: make(chan util.PlayerAddr),
-		ShutdownChannel:       make(chan struct{}),
-		WaitGroup:             &sync.WaitGroup{},
-		Mutex:                 &sync.RWMutex{},
-		Debug:                 debug,
-	}
-}
-
-func connectUdp(port int) *net.UDPConn {
-	listenAddr, err := net.ResolveUDPAddr("udp4", fmt.Sprint(":", port))
+	IpAddr      net.IP
+	IpPort      int
+	ProxyPort   int
+	Route       *proxy.Route
+	Ctx         context.Context
+	Disconnect  context.CancelFunc
+	GameId      bolo.GameId
+	PlayerId    int
+	Name        string
+	Peers       map[int]time.Time
+	PeerPackets map[int]proxy.UdpPacket
+	NatPort     int
+	Version     bolo.Version
+	// AdvertiseIp is the proxy address given to this player when it differs
+	// from the public one: from a matching advertise_rules entry, or our
+	// address on their network if they are on the same subnet as the server.
+	// nil otherwise.
+	AdvertiseIp net.IP
+	// DisconnectedAt is set when the player times out but is being held for
+	// reconnect_grace_seconds; zero while connected.
+	DisconnectedAt time.Time
+	Location       geoip.Location
+	// Rtt is the smoothed round trip time of game info pings, zero until
+	// measured.
+	Rtt        time.Duration
+	pingSentAt time.Time
+	// Tags are set by the operator or hooks (see PlayerTag)
+	Tags       []string
+	lastChat   string
+	lastChatAt time.Time
+	// claimedName is the name the player sent; Name may have a number
+	// appended to tell them apart from another player (see uniqueName)
+	claimedName string
+}
+
+// RemoteGame is a game running on another Bolorama server, learned from its
+// signed listing (see the federation package). Players connect to Host:Port.
+type RemoteGame struct {
+	Info    bolo.GameInfo
+	Host    string
+	Port    int
+	Players []string
+	Title   string
+	Expires time.Time
+}
+
+type stateRequest struct {
+	fn    func(*State)
+	done  chan struct{}
+	panic interface{} // recovered from fn, to be raised again in Do's caller
+}
+
+// InitContext returns the context of a server whose tracker listens on port,
+// failing if the port cannot be bound. Its players are given ports from
+// ports, and it logs to logger.
+func InitContext(port int, ports *proxy.Ports, logger *log.Logger) (*ServerContext, error) {
+	proxyIp, err := config.GetProxyIp(logger)
 	if err != nil {
-		fmt.Println(err)
-		return nil
+		return nil, err
 	}
+	connections, err := connectUdp(port, logger)
+	if err != nil {
+		return nil, err
+	}
+	serverContext := newServerContext(port, ports, logger)
+	serverContext.UdpConnections = connections
+	serverContext.Recorder = record.NewRecorder(
+		config.GetValueString("record_directory"),
+		config.GetValueString("pcap_directory"),
+		int64(config.GetValueInt("pcap_max_bytes")),
+		serverContext.ProxyIp,
+		logger,
+	)
+	serverContext.Spans = otlp.NewExporter(config.GetValueString("otlp_endpoint"), config.GetValueInt("otlp_sample_packets"), logger)
+	serverContext.SetProxyIp(proxyIp)
+	loadBans(serverContext.state)
+	return serverContext, nil
+}
 
-	connection, err := net.ListenUDP("udp4", listenAddr)
+// InitReplayContext returns a context with no sockets, for feeding recorded
+// packets through the packet handling, with proxy ports of its own. Use
+// together with its Ports' UseStubRoutes.
+func InitReplayContext(port int, proxyIp net.IP) *ServerContext {
+	serverContext := newServerContext(port, proxy.NewPorts(proxy.FirstPlayerPort(), log.Default()), log.Default())
+	serverContext.SetProxyIp(proxyIp)
+	return serverContext
+}
+
+func newServerContext(port int, ports *proxy.Ports, logger *log.Logger) *ServerContext {
+	serverContext := &ServerContext{
+		ProxyPort:         port,
+		PlayerPongChannel: make(chan util.PlayerAddr),
+		RxChannel:         make(chan proxy.UdpPacket),
+		Events:            events.NewBus(logger),
+		Tracer:            trace.NewTracer(logger),
+		Latency:           metrics.NewHistogram(),
+		Clock:             clock.Real,
+		Ports:             ports,
+		Logger:            logger,
+		Network:           newSubsystem("network"),
+		State:             newSubsystem("state"),
+		Stats:             newSubsystem("statistics"),
+		Debug:             config.GetValueBool("debug"),
+		requestChannel:    make(chan *stateRequest),
+	}
+	serverContext.state = &State{
+		Games:        make(map[bolo.GameId]bolo.GameInfo),
+		RemoteGames:  make(map[string][]RemoteGame),
+		context:      serverContext,
+		refused:      make(map[string]time.Time),
+		kicked:       make(map[string]time.Time),
+		shadowBanned: make(map[string]bool),
+		muted:        make(map[string]bool),
+		titles:       make(map[bolo.GameId]string),
+		latency:      make(map[bolo.GameId]*metrics.Histogram),
+		unlisted:     make(map[bolo.GameId]bool),
+		gameBans:     make(map[bolo.GameId]map[string]bool),
+		locked:       make(map[bolo.GameId]bool),
+		hosts:        make(map[bolo.GameId]int),
+		dedup:        make(map[bolo.GameId]bool),
+	}
+	return serverContext
+}
+
+// ProxyIp returns the address advertised to players. It may change while the
+// server is running (see PublicIpMonitor).
+func (context *ServerContext) ProxyIp() net.IP {
+	return context.proxyIp.Load().(net.IP)
+}
+
+func (context *ServerContext) SetProxyIp(ip net.IP) {
+	context.proxyIp.Store(ip)
+}
+
+// Tracker returns the tracker set in trackers as name, or the main tracker
+// for "". Call it on the main tracker's context.
+func (context *ServerContext) Tracker(name string) (*ServerContext, bool) {
+	if name == "" {
+		return context, true
+	}
+	for _, tracker := range context.Trackers {
+		if tracker.Name == name {
+			return tracker, true
+		}
+	}
+	return nil, false
+}
+
+func newSubsystem(name string) *Subsystem {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Subsystem{
+		Name:      name,
+		Ctx:       ctx,
+		Cancel:    cancel,
+		WaitGroup: &sync.WaitGroup{},
+	}
+}
+
+// Shutdown stops the subsystems in dependency order: the network first so no
+// new packets arrive, then the state goroutine, then statistics so the final
+// events are recorded. Each subsystem gets shutdown_timeout_seconds to
+// stop before we give up on it and move on.
+func Shutdown(context *ServerContext) {
+	timeout := time.Duration(config.GetValueInt("shutdown_timeout_seconds")) * time.Second
+
+	for _, subsystem := range []*Subsystem{context.Network, context.State, context.Stats} {
+		subsystem.Cancel()
+
+		done := make(chan struct{})
+		go func(wg *sync.WaitGroup) {
+			wg.Wait()
+			close(done)
+		}(subsystem.WaitGroup)
+
+		select {
+		case <-done:
+		case <-time.After(timeout):
+			context.Logger.Printf("Timed out waiting for %s to stop\n", subsystem.Name)
+		}
+	}
+}
+
+// connectUdp binds the tracker port.
+func connectUdp(port int, logger *log.Logger) ([]proxy.PacketConn, error) {
+	connections, err := proxy.ListenUdp(port, logger)
 	if err != nil {
-		fmt.Println(err)
+		return nil, fmt.Errorf("tracker port %d: %s", port, err)
+	}
+
+	logger.Println("Socket buffers:", proxy.SprintSocketBuffers(connections[0]))
+
+	return connections, nil
+}
+
+// UdpConnectionFor returns the tracker port socket to use for sending to ip.
+func (context *ServerContext) UdpConnectionFor(ip net.IP) proxy.PacketConn {
+	return proxy.SelectConnection(context.UdpConnections, ip)
+}
+
+// SendFromTrackerPort sends buffer to dstAddr from the tracker port.
+func (context *ServerContext) SendFromTrackerPort(buffer []byte, dstAddr *net.UDPAddr) error {
+	if context.Ports.TransmitStub(context.ProxyPort, proxy.UdpPacket{DstAddr: *dstAddr, Buffer: buffer}) {
 		return nil
 	}
+	_, err := context.UdpConnectionFor(dstAddr.IP).WriteToUDP(buffer, dstAddr)
+	return err
+}
+
+// Run is the state goroutine. It services requests from Do one at a time, so
+// the functions in this package never need to lock.
+func Run(context *ServerContext) {
+	defer context.State.WaitGroup.Done()
+	defer func() {
+		context.Logger.Println("Stopped state")
+	}()
+
+	s := context.state
+
+	for {
+		select {
+		case <-context.State.Ctx.Done():
+			return
+		case request := <-context.requestChannel:
+			runRequest(s, request)
+		}
+	}
+}
 
-	return connection
+// runRequest runs fn, recovering a panic so that the state goroutine, and the
+// state, survive it. The panic is raised again in Do's caller, where there is
+// more context to recover it with.
+func runRequest(s *State, request *stateRequest) {
+	defer close(request.done)
+	defer func() {
+		if err := recover(); err != nil {
+			s.context.Logger.Printf("Recovered panic on the state goroutine: %v\n%s", err, debug.Stack())
+			request.panic = err
+		}
+	}()
+	request.fn(s)
 }
 
-func SprintServerState(context *ServerContext, newline string, lock bool) string {
-	if lock {
-		context.Mutex.RLock()
-		defer context.Mutex.RUnlock()
+// Do runs fn on the state goroutine and waits for it to return. fn must not
+// block on channels serviced by goroutines that may themselves be waiting on
+// Do. Returns false without running fn if the server is shutting down. If fn
+// panics, so does Do.
+func Do(context *ServerContext, fn func(*State)) bool {
+	request := &stateRequest{fn: fn, done: make(chan struct{})}
+
+	start := time.Now()
+	select {
+	case context.requestChannel <- request:
+	case <-context.State.Ctx.Done():
+		return false
 	}
+	countStateStall(time.Since(start))
 
+	<-request.done
+	if request.panic != nil {
+		panic(request.panic)
+	}
+	return true
+}
+
+func SprintServerState(s *State, newline string) string {
 	var sb strings.Builder
-	sb.WriteString(fmt.Sprintf("   Player                   Proxy Port    Game Id%s", newline))
-	for _, player := range context.Players {
-		ipAddr := fmt.Sprintf("%s:%d", player.IpAddr.String(), player.IpPort)
-		sb.WriteString(fmt.Sprintf("   %-21s    %-10d    %s%s", ipAddr, player.ProxyPort, hex.EncodeToString(player.GameId[:]), newline))
+	sb.WriteString(fmt.Sprintf("   Player                   Proxy Port    Game Id             Version    RTT       Tx Drops    Tags%s", newline))
+	for _, player := range s.Players {
+		ipAddr := privacy.Addr(player.IpAddr, player.IpPort)
+		rtt := "-"
+		if player.Rtt > 0 {
+			rtt = fmt.Sprintf("%dms", player.Rtt.Milliseconds())
+		}
+		sb.WriteString(fmt.Sprintf("   %-21s    %-10d    %s    %-7s    %-6s    %-8d    %s%s", ipAddr, player.ProxyPort, hex.EncodeToString(player.GameId[:]), player.Version, rtt, player.Route.TxQueue.Drops(), strings.Join(player.Tags, ","), newline))
 	}
 	return sb.String()
 }
 
-func PrintServerState(context *ServerContext, lock bool) {
-	fmt.Print(SprintServerState(context, "\n", lock))
+func PrintServerState(s *State) {
+	s.context.Logger.Print(SprintServerState(s, "\n"))
 }
 
-func gameCountPlayers(context *ServerContext, targetGameId bolo.GameId, lock bool) int {
-	if lock {
-		context.Mutex.RLock()
-		defer context.Mutex.RUnlock()
-	}
+// Logger returns the logger of the server that s belongs to.
+func Logger(s *State) *log.Logger {
+	return s.context.Logger
+}
 
+func gameCountPlayers(s *State, targetGameId bolo.GameId) int {
 	count := 0
-	for _, player := range context.Players {
+	for _, player := range s.Players {
 		if player.GameId == targetGameId {
 			count = count + 1
 		}
@@ -132,39 +423,71 @@ func gameCountPlayers(context *ServerContext, targetGameId bolo.GameId, lock boo
 	return count
 }
 
-func GameUpdatePlayerCount(context *ServerContext, gameId bolo.GameId, lock bool) {
-	if lock {
-		context.Mutex.Lock()
-		defer context.Mutex.Unlock()
-	}
-
-	playerCount := gameCountPlayers(context, gameId, false)
+func GameUpdatePlayerCount(s *State, gameId bolo.GameId) {
+	playerCount := gameCountPlayers(s, gameId)
 	if playerCount == 0 {
-		GameDelete(context, gameId, false)
+		GameDelete(s, gameId)
 	} else {
-		gameInfo := context.Games[gameId]
+		gameInfo := s.Games[gameId]
 		gameInfo.PlayerCount = uint16(playerCount)
-		context.Games[gameId] = gameInfo
+		s.Games[gameId] = gameInfo
 	}
 }
 
-func GameDelete(context *ServerContext, gameId bolo.GameId, lock bool) {
-	if lock {
-		context.Mutex.Lock()
-		defer context.Mutex.Unlock()
+// GameExpireIdle ends proxied games in which no player has sent anything to
+// their proxy port, and the host no game info, for timeout. Their players
+// are deleted, closing the routes.
+func GameExpireIdle(s *State, timeout time.Duration) int {
+	var expired []bolo.GameId
+	for gameId, gameInfo := range s.Games {
+		if gameInfo.DirectAddr() != nil || clock.Since(s.context.Clock, gameInfo.LastSeen) < timeout {
+			continue
+		}
+		idle := true
+		for _, player := range s.Players {
+			if player.GameId == gameId && player.Route.ReceivedIdle() < timeout {
+				idle = false
+				break
+			}
+		}
+		if idle {
+			expired = append(expired, gameId)
+		}
 	}
 
-	delete(context.Games, gameId)
-	context.LogGameEndChannel <- gameId
+	for _, gameId := range expired {
+		s.context.Logger.Println("Game idle, ending:", hex.EncodeToString(gameId[:]))
+		var players []util.PlayerAddr
+		for _, player := range s.Players {
+			if player.GameId == gameId {
+				players = append(players, util.PlayerAddr{IpAddr: player.IpAddr.String(), IpPort: player.IpPort, ProxyPort: player.ProxyPort})
+			}
+		}
+		for _, playerAddr := range players {
+			PlayerDelete(s, playerAddr)
+		}
+		if _, ok := s.Games[gameId]; ok {
+			GameDelete(s, gameId)
+		}
+	}
+	return len(expired)
 }
 
-func PlayerGetByAddr(context *ServerContext, addr net.UDPAddr, lock bool) (Player, error) {
-	if lock {
-		context.Mutex.RLock()
-		defer context.Mutex.RUnlock()
-	}
+func GameDelete(s *State, gameId bolo.GameId) {
+	delete(s.Games, gameId)
+	delete(s.titles, gameId)
+	delete(s.latency, gameId)
+	delete(s.unlisted, gameId)
+	delete(s.gameBans, gameId)
+	delete(s.locked, gameId)
+	delete(s.hosts, gameId)
+	delete(s.dedup, gameId)
+	s.context.Events.Publish(events.Event{Type: events.GameEnded, GameId: gameId})
+	drainGameEnded(s, gameId)
+}
 
-	for _, player := range context.Players {
+func PlayerGetByAddr(s *State, addr net.UDPAddr) (Player, error) {
+	for _, player := range s.Players {
 		if net.IP.Equal(addr.IP, player.IpAddr) && addr.Port == player.IpPort {
 			return player, nil
 		}
@@ -174,13 +497,8 @@ func PlayerGetByAddr(context *ServerContext, addr net.UDPAddr, lock bool) (Playe
 		addr.IP.String(), addr.Port)
 }
 
-func PlayerGetByPort(context *ServerContext, port int, lock bool) (Player, error) {
-	if lock {
-		context.Mutex.RLock()
-		defer context.Mutex.RUnlock()
-	}
-
-	for _, player := range context.Players {
+func PlayerGetByPort(s *State, port int) (Player, error) {
+	for _, player := range s.Players {
 		if port == player.ProxyPort {
 			return player, nil
 		}
@@ -190,69 +508,228 @@ func PlayerGetByPort(context *ServerContext, port int, lock bool) (Player, error
 }
 
 func PlayerNew(
-	context *ServerContext,
+	s *State,
 	playerAddr net.UDPAddr,
 	gameId bolo.GameId,
 	natPort int,
-	lock bool,
-) Player {
-	if lock {
-		context.Mutex.Lock()
-		defer context.Mutex.Unlock()
-	}
-
-	disconnectChannel := make(chan struct{})
-
-	proxyPort, txChannel, connection := proxy.AddPlayer(
-		context.WaitGroup,
+	version bolo.Version,
+) (Player, error) {
+	ctx, disconnect := context.WithCancel(s.context.Network.Ctx)
+
+	serverContext := s.context
+	route, err := serverContext.Ports.AddPlayer(
+		ctx,
+		serverContext.Network.WaitGroup,
 		playerAddr,
-		context.RxChannel,
-		disconnectChannel,
-		context.ShutdownChannel,
+		proxy.RouteOptions{
+			RxChannel:    serverContext.RxChannel,
+			TxQueueDepth: config.GetValueInt("tx_queue_depth"),
+			Clock:        serverContext.Clock,
+			OnPanic: func(route *proxy.Route) {
+				removeDropped(serverContext, route, "after a panic", LeaveReasonCrashed)
+			},
+			OnUnreachable: func(route *proxy.Route) {
+				removeDropped(serverContext, route, "as unreachable", LeaveReasonUnreachable)
+			},
+		},
 	)
+	if err != nil {
+		disconnect()
+		return Player{}, err
+	}
 
 	player := Player{
-		IpAddr:            playerAddr.IP,
-		IpPort:            playerAddr.Port,
-		ProxyPort:         proxyPort,
-		Connection:        connection,
-		TxChannel:         txChannel,
-		DisconnectChannel: disconnectChannel,
-		GameId:            gameId,
-		PlayerId:          -1,
-		Name:              "<unknown>",
-		Peers:             make(map[int]time.Time),
-		PeerPackets:       make(map[int]proxy.UdpPacket),
-		NatPort:           natPort,
+		IpAddr:      playerAddr.IP,
+		IpPort:      playerAddr.Port,
+		ProxyPort:   route.ProxyPort,
+		Route:       route,
+		Ctx:         ctx,
+		Disconnect:  disconnect,
+		GameId:      gameId,
+		PlayerId:    -1,
+		Name:        "<unknown>",
+		Peers:       make(map[int]time.Time),
+		PeerPackets: make(map[int]proxy.UdpPacket),
+		NatPort:     natPort,
+		Version:     version,
+		AdvertiseIp: advertiseIpFor(playerAddr.IP),
+		Location:    geoip.Lookup(playerAddr.IP, s.context.Logger),
+	}
+
+	applyDedup(s, player)
+	s.Players = append(s.Players, player)
+	s.context.Events.Publish(events.Event{
+		Type:       events.PlayerJoined,
+		PlayerAddr: util.PlayerAddr{IpAddr: playerAddr.IP.String(), IpPort: playerAddr.Port, ProxyPort: route.ProxyPort},
+		GameId:     gameId,
+	})
+
+	return player, nil
+}
+
+// PlayerMigrate looks for a player in the game who has the given Bolo player
+// id but is now sending from a different address, which happens when their
+// NAT rebinds or their connection moves. If found, the player and their route
+// are updated to the new address. The old address must have been quiet for a
+// moment first, so a live player's id can't simply be claimed by someone else.
+func PlayerMigrate(s *State, gameId bolo.GameId, playerId int, addr net.UDPAddr) (Player, bool) {
+	for i, player := range s.Players {
+		if player.GameId != gameId || player.PlayerId != playerId || playerId < 0 {
+			continue
+		}
+		if net.IP.Equal(addr.IP, player.IpAddr) && addr.Port == player.IpPort {
+			continue
+		}
+		if clock.Since(s.context.Clock, playerLastSeen(player)) < migrationQuietDuration {
+			continue
+		}
+
+		s.context.Logger.Printf("Player migrated %s -> %s (proxy port %d)\n",
+			privacy.Addr(player.IpAddr, player.IpPort), privacy.Addr(addr.IP, addr.Port), player.ProxyPort)
+		playerSetAddr(s, i, addr)
+
+		return s.Players[i], true
+	}
+
+	return Player{}, false
+}
+
+// PlayerReconnect hands a disconnected player's route back to a client that
+// comes back from the same IP address within the grace period. If gameId is
+// not nil, only players from that game are considered.
+func PlayerReconnect(s *State, addr net.UDPAddr, gameId *bolo.GameId) (Player, error) {
+	for i, player := range s.Players {
+		if player.DisconnectedAt.IsZero() || !net.IP.Equal(addr.IP, player.IpAddr) {
+			continue
+		}
+		if gameId != nil && player.GameId != *gameId {
+			continue
+		}
+
+		s.context.Logger.Printf("Player reconnected %s -> %s (proxy port %d)\n",
+			privacy.Addr(player.IpAddr, player.IpPort), privacy.Addr(addr.IP, addr.Port), player.ProxyPort)
+		if addr.Port != player.IpPort {
+			playerSetAddr(s, i, addr)
+		}
+		s.Players[i].DisconnectedAt = time.Time{}
+
+		return s.Players[i], nil
+	}
+
+	return Player{}, fmt.Errorf("no disconnected player with address %s", addr.IP.String())
+}
+
+func advertiseIpFor(ip net.IP) net.IP {
+	// checked when the config was loaded
+	rules, _ := config.GetAdvertiseRules()
+	for _, rule := range rules {
+		if rule.Subnet.Contains(ip) {
+			return rule.Ip
+		}
+	}
+	if !config.GetValueBool("advertise_lan_address") {
+		return nil
+	}
+	return util.GetLocalIpFor(ip)
+}
+
+// AdvertisedIp returns the proxy address that player should be told to use.
+func AdvertisedIp(context *ServerContext, player Player) net.IP {
+	if player.AdvertiseIp != nil {
+		return player.AdvertiseIp
+	}
+	return context.ProxyIp()
+}
+
+// playerSetAddr moves the player at idx, and their route, to a new address.
+func playerSetAddr(s *State, idx int, addr net.UDPAddr) {
+	player := s.Players[idx]
+	previousAddr := util.PlayerAddr{IpAddr: player.IpAddr.String(), IpPort: player.IpPort, ProxyPort: player.ProxyPort}
+
+	s.Players[idx].IpAddr = addr.IP
+	s.Players[idx].IpPort = addr.Port
+	s.Players[idx].AdvertiseIp = advertiseIpFor(addr.IP)
+	s.Players[idx].Location = geoip.Lookup(addr.IP, s.context.Logger)
+	s.Players[idx].Route.SetPlayerAddr(addr)
+
+	s.context.Events.Publish(events.Event{
+		Type:         events.PlayerMigrated,
+		PlayerAddr:   util.PlayerAddr{IpAddr: addr.IP.String(), IpPort: addr.Port, ProxyPort: player.ProxyPort},
+		PreviousAddr: previousAddr,
+		GameId:       player.GameId,
+		PlayerId:     player.PlayerId,
+	})
+}
+
+// PlayerSuspend marks a timed out player as disconnected, keeping their proxy
+// port and peer state so a quick reconnect gets the same route back.
+func PlayerSuspend(s *State, addr util.PlayerAddr) {
+	for i, player := range s.Players {
+		if (addr.IpAddr == player.IpAddr.String()) && (addr.IpPort == player.IpPort) && (addr.ProxyPort == player.ProxyPort) {
+			if player.DisconnectedAt.IsZero() {
+				s.Players[i].DisconnectedAt = s.context.Clock.Now()
+			}
+			return
+		}
+	}
+}
+
+// PlayerResume clears the disconnected mark when a suspended player is heard
+// from again at their old address.
+func PlayerResume(s *State, proxyPort int) {
+	for i, player := range s.Players {
+		if player.ProxyPort == proxyPort {
+			s.Players[i].DisconnectedAt = time.Time{}
+			return
+		}
 	}
+}
 
-	context.Players = append(context.Players, player)
-	context.LogPlayerJoinChannel <- util.PlayerAddr{IpAddr: playerAddr.IP.String(), IpPort: playerAddr.Port, ProxyPort: proxyPort}
+// PlayerExpireSuspended deletes players who have been disconnected for longer
+// than the grace period, and returns how many were deleted.
+func PlayerExpireSuspended(s *State, grace time.Duration) int {
+	var expired []util.PlayerAddr
+	for _, player := range s.Players {
+		if !player.DisconnectedAt.IsZero() && clock.Since(s.context.Clock, player.DisconnectedAt) > grace {
+			expired = append(expired, util.PlayerAddr{IpAddr: player.IpAddr.String(), IpPort: player.IpPort, ProxyPort: player.ProxyPort})
+		}
+	}
 
-	return player
+	for _, addr := range expired {
+		s.context.Logger.Printf("Player reconnect grace expired %s:%d\n", privacy.IpString(addr.IpAddr), addr.IpPort)
+		playerDelete(s, addr, LeaveReasonTimeout)
+	}
+
+	return len(expired)
 }
 
-func PlayerJoinGame(context *ServerContext, playerPort int, newGameId bolo.GameId, lock bool) {
-	if lock {
-		context.Mutex.Lock()
-		defer context.Mutex.Unlock()
+// playerLastSeen is the last time the player's packets were forwarded to any
+// peer.
+func playerLastSeen(player Player) time.Time {
+	var lastSeen time.Time
+	for _, timestamp := range player.Peers {
+		lastSeen = util.MaxTime(lastSeen, timestamp)
 	}
+	return lastSeen
+}
 
+func PlayerJoinGame(s *State, playerPort int, newGameId bolo.GameId) {
 	var oldGameId bolo.GameId = bolo.GameId{}
 	var oldGameIdOk bool = false
-	for i, player := range context.Players {
+	for i, player := range s.Players {
 		if player.ProxyPort == playerPort {
 			oldGameId = player.GameId
 			oldGameIdOk = true
-			context.Players[i].GameId = newGameId
-			context.Players[i].PlayerId = -1
+			s.Players[i].GameId = newGameId
+			s.Players[i].PlayerId = -1
+			applyDedup(s, s.Players[i])
 		}
 	}
 
-	GameUpdatePlayerCount(context, newGameId, false)
+	GameUpdatePlayerCount(s, newGameId)
 
 	if oldGameIdOk && oldGameId != newGameId {
-		GameUpdatePlayerCount(context, oldGameId, false)
+		GameUpdatePlayerCount(s, oldGameId)
 	}
 }
 
@@ -261,14 +738,21 @@ func playerRemoveElement(players []Player, idx int) []Player {
 	return players[:len(players)-1]
 }
 
-func PlayerDelete(context *ServerContext, playerAddr util.PlayerAddr, lock bool) {
-	if lock {
-		context.Mutex.Lock()
-		defer context.Mutex.Unlock()
-	}
+// LeaveReasonTimeout is the Reason of PlayerLeft events for players who
+// stopped answering pings.
+const LeaveReasonTimeout = "timeout"
+
+// LeaveReasonUnreachable is the Reason of PlayerLeft events for players whose
+// address could not be written to for a while.
+const LeaveReasonUnreachable = "unreachable"
 
+func PlayerDelete(s *State, playerAddr util.PlayerAddr) {
+	playerDelete(s, playerAddr, "")
+}
+
+func playerDelete(s *State, playerAddr util.PlayerAddr, reason string) {
 	player_idx := -1
-	for i, player := range context.Players {
+	for i, player := range s.Players {
 		if net.IP.Equal(player.IpAddr, net.ParseIP(playerAddr.IpAddr)) && player.IpPort == playerAddr.IpPort && player.ProxyPort == playerAddr.ProxyPort {
 			player_idx = i
 			break
@@ -279,23 +763,18 @@ func PlayerDelete(context *ServerContext, playerAddr util.PlayerAddr, lock bool)
 		return
 	}
 
-	gameId := context.Players[player_idx].GameId
+	gameId := s.Players[player_idx].GameId
 
-	close(context.Players[player_idx].DisconnectChannel)
-	proxy.DeletePort(context.Players[player_idx].ProxyPort)
-	context.Players = playerRemoveElement(context.Players, player_idx)
-	context.LogPlayerLeaveChannel <- playerAddr
-	GameUpdatePlayerCount(context, gameId, false)
+	s.Players[player_idx].Disconnect()
+	s.context.Ports.DeletePort(s.Players[player_idx].ProxyPort)
+	s.Players = playerRemoveElement(s.Players, player_idx)
+	s.context.Events.Publish(events.Event{Type: events.PlayerLeft, PlayerAddr: playerAddr, GameId: gameId, Reason: reason})
+	GameUpdatePlayerCount(s, gameId)
 }
 
-func PlayerSetNatPort(context *ServerContext, addr util.PlayerAddr, natPort int, lock bool) {
-	if lock {
-		context.Mutex.Lock()
-		defer context.Mutex.Unlock()
-	}
-
+func PlayerSetNatPort(s *State, addr util.PlayerAddr, natPort int) {
 	playerIdx := -1
-	for i, player := range context.Players {
+	for i, player := range s.Players {
 		if (addr.IpAddr == player.IpAddr.String()) && (addr.IpPort == player.IpPort) && (addr.ProxyPort == player.ProxyPort) {
 			playerIdx = i
 			break
@@ -303,18 +782,13 @@ func PlayerSetNatPort(context *ServerContext, addr util.PlayerAddr, natPort int,
 	}
 
 	if playerIdx >= 0 {
-		context.Players[playerIdx].NatPort = natPort
+		s.Players[playerIdx].NatPort = natPort
 	}
 }
 
-func PlayerSetId(context *ServerContext, addr util.PlayerAddr, playerId int, lock bool) {
-	if lock {
-		context.Mutex.Lock()
-		defer context.Mutex.Unlock()
-	}
-
+func PlayerSetId(s *State, addr util.PlayerAddr, playerId int) {
 	playerIdx := -1
-	for i, player := range context.Players {
+	for i, player := range s.Players {
 		if (addr.IpAddr == player.IpAddr.String()) && (addr.IpPort == player.IpPort) && (addr.ProxyPort == player.ProxyPort) {
 			playerIdx = i
 			break
@@ -322,17 +796,14 @@ func PlayerSetId(context *ServerContext, addr util.PlayerAddr, playerId int, loc
 	}
 
 	if playerIdx >= 0 {
-		context.Players[playerIdx].PlayerId = playerId
+		s.Players[playerIdx].PlayerId = playerId
 	}
 }
 
-func PlayerSetName(context *ServerContext, addr util.PlayerAddr, playerId int, playerName string) {
-	context.Mutex.Lock()
-	defer context.Mutex.Unlock()
-
+func PlayerSetName(s *State, addr util.PlayerAddr, playerId int, playerName string) {
 	gameId := [8]byte{}
 	gameIdFound := false
-	for _, player := range context.Players {
+	for _, player := range s.Players {
 		if (addr.IpAddr == player.IpAddr.String()) && (addr.IpPort == player.IpPort) && (addr.ProxyPort == player.ProxyPort) {
 			gameId = player.GameId
 			gameIdFound = true
@@ -344,13 +815,23 @@ func PlayerSetName(context *ServerContext, addr util.PlayerAddr, playerId int, p
 		return
 	}
 
-	for i, player := range context.Players {
+	for i, player := range s.Players {
 		if (player.GameId == gameId) && (player.PlayerId == playerId) {
 			if strings.HasSuffix(playerName, "Unknown Machine Name") {
 				nameSlice := strings.Split(playerName, "@")
 				playerName = strings.Join(nameSlice[0:len(nameSlice)-1], "")
 			}
-			context.Players[i].Name = playerName
+			if s.Players[i].claimedName != playerName {
+				s.Players[i].claimedName = playerName
+				s.Players[i].Name = uniqueName(s, i, profanity.Mask(playerName))
+				s.context.Events.Publish(events.Event{
+					Type:       events.NameChanged,
+					PlayerAddr: util.PlayerAddr{IpAddr: player.IpAddr.String(), IpPort: player.IpPort, ProxyPort: player.ProxyPort},
+					GameId:     gameId,
+					PlayerId:   playerId,
+					Name:       s.Players[i].Name,
+				})
+			}
 			break
 		}
 	}
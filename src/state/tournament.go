@@ -0,0 +1,62 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package state
+
+import "fmt"
+
+// Tournament is the single elimination bracket run from the admin console
+// (see the tournament package). Each tracker has its own, kept with the
+// players and games it refers to.
+type Tournament struct {
+	Name     string   `json:"name"`
+	Entrants []string `json:"entrants"`
+	Started  bool     `json:"started"`
+	Matches  []Match  `json:"matches"` // round by round, in bracket order
+}
+
+type Match struct {
+	Id      int       `json:"id"` // 1-based
+	Round   int       `json:"round"`
+	Players [2]string `json:"players"` // "" until decided by an earlier match
+	Winner  string    `json:"winner"`
+	GameId  string    `json:"game_id"` // hex, once the match's game is seen
+}
+
+// MatchName is how a match is labelled, e.g. "Spring Cup, round 1 match 3".
+func (t *Tournament) MatchName(match Match) string {
+	return fmt.Sprintf("%s, round %d match %d", t.Name, match.Round, match.Id)
+}
+
+// Champion returns the winner of the final, or "".
+func (t *Tournament) Champion() string {
+	if len(t.Matches) == 0 {
+		return ""
+	}
+	return t.Matches[len(t.Matches)-1].Winner
+}
+
+// TournamentCurrent returns the tournament, or nil if there is none. It may
+// only be changed inside Do.
+func TournamentCurrent(s *State) *Tournament {
+	return s.tournament
+}
+
+// TournamentReplace replaces the tournament, or removes it if t is nil.
+func TournamentReplace(s *State, t *Tournament) {
+	s.tournament = t
+}
@@ -0,0 +1,202 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package state
+
+import (
+	"log"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"git.astrospark.com/bolorama/config"
+	"git.astrospark.com/bolorama/util"
+)
+
+// LeaveReasonStuck is the Reason of PlayerLeft events for players whose route
+// the watchdog dropped.
+const LeaveReasonStuck = "stuck"
+
+// The watchdog looks for goroutines blocked for longer than watchdog_seconds:
+// the RxChannel consumer handling one packet, a proxy port waiting to hand a
+// packet to RxChannel (which is unbuffered, so it waits for as long as the
+// consumer does), and a proxy port writing to the player's socket. It logs the
+// stacks of all goroutines the first time it finds each stall, and recovers
+// by dropping the offending route: the one whose packet the consumer is stuck
+// on, or failing that every route stuck itself. Dropping a route closes its
+// sockets and releases any goroutine waiting on it.
+
+// RxBusy records that the RxChannel consumer started handling a packet for the
+// proxy port.
+func RxBusy(context *ServerContext, port int) {
+	atomic.StoreInt64(&context.rxBusyPort, int64(port))
+	atomic.StoreInt64(&context.rxBusySince, time.Now().UnixNano())
+}
+
+// RxIdle records that the RxChannel consumer finished handling the packet.
+func RxIdle(context *ServerContext) {
+	atomic.StoreInt64(&context.rxBusySince, 0)
+}
+
+// rxBusy returns how long the RxChannel consumer has been handling the current
+// packet, and its proxy port, or 0 if it is waiting for one.
+func rxBusy(context *ServerContext) (time.Duration, int) {
+	since := atomic.LoadInt64(&context.rxBusySince)
+	if since == 0 {
+		return 0, 0
+	}
+	return time.Since(time.Unix(0, since)), int(atomic.LoadInt64(&context.rxBusyPort))
+}
+
+// kStateStallThreshold is how long Do may wait for the state goroutine to take
+// a request before the wait is counted as a stall.
+const kStateStallThreshold = 10 * time.Millisecond
+
+var stateStalls uint64
+
+func countStateStall(waited time.Duration) {
+	if waited >= kStateStallThreshold {
+		atomic.AddUint64(&stateStalls, 1)
+	}
+}
+
+// StateStalls returns how many times Do waited at least kStateStallThreshold
+// for the state goroutine to take a request.
+func StateStalls() uint64 {
+	return atomic.LoadUint64(&stateStalls)
+}
+
+// Watchdog runs the checks until the network is shut down.
+func Watchdog(context *ServerContext) {
+	defer context.Network.WaitGroup.Done()
+
+	threshold := time.Duration(config.GetValueInt("watchdog_seconds")) * time.Second
+	if threshold <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(threshold / 2)
+	defer ticker.Stop()
+
+	// a check waiting on the state goroutine, so a stuck one does not pile
+	// up more of them
+	var pending chan struct{}
+	stalled := false
+
+	for {
+		select {
+		case <-context.Network.Ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if pending != nil {
+			select {
+			case <-pending:
+				pending = nil
+			default:
+				if !stalled {
+					context.Logger.Printf("Watchdog: state goroutine has not responded for over %s\n", threshold/2)
+					logStacks(context.Logger)
+					stalled = true
+				}
+				continue
+			}
+		}
+
+		busy, busyPort := rxBusy(context)
+		consumerStuck := busy >= threshold
+		if consumerStuck && !stalled {
+			context.Logger.Printf("Watchdog: RxChannel consumer stuck for %s on a packet for proxy port %d\n", busy.Round(time.Millisecond), busyPort)
+		}
+
+		done := make(chan struct{})
+		pending = done
+		stuckRoutes := make(chan int, 1)
+		go func() {
+			defer close(done)
+			Do(context, func(s *State) {
+				stuckRoutes <- dropStuckRoutes(s, threshold, consumerStuck, busyPort, stalled)
+			})
+		}()
+
+		select {
+		case count := <-stuckRoutes:
+			<-done
+			pending = nil
+			if count > 0 && !stalled {
+				logStacks(context.Logger)
+			}
+			stalled = consumerStuck || count > 0
+		case <-time.After(threshold / 2):
+			// checked again on the next tick
+		}
+	}
+}
+
+// dropStuckRoutes drops the route the consumer is stuck on, if it is, and
+// otherwise any route blocked for at least threshold, returning how many
+// routes were stuck.
+func dropStuckRoutes(s *State, threshold time.Duration, consumerStuck bool, busyPort int, stalled bool) int {
+	var stuck []Player
+	for _, player := range s.Players {
+		route := player.Route
+		if route == nil {
+			continue
+		}
+
+		switch {
+		case consumerStuck:
+			if player.ProxyPort == busyPort {
+				stuck = append(stuck, player)
+			}
+		case route.TxBlocked() >= threshold:
+			if !stalled {
+				s.context.Logger.Printf("Watchdog: proxy port %d stuck for %s writing to the player\n", player.ProxyPort, route.TxBlocked().Round(time.Millisecond))
+			}
+			stuck = append(stuck, player)
+		case route.RxBlocked() >= threshold:
+			if !stalled {
+				s.context.Logger.Printf("Watchdog: proxy port %d stuck for %s handing a packet to RxChannel\n", player.ProxyPort, route.RxBlocked().Round(time.Millisecond))
+			}
+			stuck = append(stuck, player)
+		}
+	}
+
+	for _, player := range stuck {
+		s.context.Logger.Printf("Dropping the stuck route of player %d (%s)\n", player.ProxyPort, player.Name)
+		playerDelete(s, util.PlayerAddr{IpAddr: player.IpAddr.String(), IpPort: player.IpPort, ProxyPort: player.ProxyPort}, LeaveReasonStuck)
+	}
+	if consumerStuck && len(stuck) == 0 {
+		return 1 // the consumer is stuck on a port with no player
+	}
+	return len(stuck)
+}
+
+// logStacks logs the stacks of all goroutines.
+func logStacks(logger *log.Logger) {
+	buffer := make([]byte, 64*1024)
+	for {
+		n := runtime.Stack(buffer, true)
+		if n < len(buffer) {
+			buffer = buffer[:n]
+			break
+		}
+		buffer = make([]byte, 2*len(buffer))
+	}
+	logger.Printf("Goroutine stacks:\n%s\n", buffer)
+}
@@ -0,0 +1,107 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package stats
+
+import (
+	"database/sql"
+	"log"
+	"time"
+
+	"git.astrospark.com/bolorama/bolo"
+	"git.astrospark.com/bolorama/data"
+	"git.astrospark.com/bolorama/events"
+	"git.astrospark.com/bolorama/util"
+)
+
+// playerTracker follows player sessions through the events and adds each
+// to the player's totals when it ends. Sessions of players who never sent a
+// name are not counted.
+type playerTracker struct {
+	logger   *log.Logger
+	sessions map[util.PlayerAddr]*playerSession
+	// games whose first player, the host, has not joined yet
+	unhosted map[bolo.GameId]bool
+}
+
+type playerSession struct {
+	name     string
+	joinedAt time.Time
+	hosted   bool
+}
+
+func newPlayerTracker(logger *log.Logger) *playerTracker {
+	return &playerTracker{
+		logger:   logger,
+		sessions: make(map[util.PlayerAddr]*playerSession),
+		unhosted: make(map[bolo.GameId]bool),
+	}
+}
+
+func (tracker *playerTracker) handle(db *sql.DB, event events.Event) {
+	switch event.Type {
+	case events.GameStarted:
+		tracker.unhosted[event.GameId] = true
+	case events.GameEnded:
+		delete(tracker.unhosted, event.GameId)
+	case events.PlayerJoined:
+		tracker.sessions[event.PlayerAddr] = &playerSession{
+			joinedAt: event.Timestamp,
+			hosted:   tracker.unhosted[event.GameId],
+		}
+		delete(tracker.unhosted, event.GameId)
+	case events.NameChanged:
+		if session, ok := tracker.sessions[event.PlayerAddr]; ok {
+			session.name = event.Name
+		}
+	case events.PlayerMigrated:
+		if session, ok := tracker.sessions[event.PreviousAddr]; ok {
+			delete(tracker.sessions, event.PreviousAddr)
+			tracker.sessions[event.PlayerAddr] = session
+		}
+	case events.PlayerLeft:
+		tracker.end(db, event.PlayerAddr, event.Timestamp)
+	}
+}
+
+func (tracker *playerTracker) end(db *sql.DB, addr util.PlayerAddr, at time.Time) {
+	session, ok := tracker.sessions[addr]
+	if !ok {
+		return
+	}
+	delete(tracker.sessions, addr)
+	if session.name != "" {
+		err := data.AddPlayerSession(db, session.name, int(at.Sub(session.joinedAt).Seconds()), session.hosted)
+		if err != nil {
+			tracker.logger.Println("Statistics:", err)
+		}
+	}
+}
+
+// endAll ends the sessions still open at shutdown.
+func (tracker *playerTracker) endAll(db *sql.DB) {
+	now := time.Now()
+	for addr := range tracker.sessions {
+		tracker.end(db, addr, now)
+	}
+}
+
+// PurgePlayer erases the totals, rating and account of the players using
+// name. Returns false if there was nothing.
+func PurgePlayer(db *sql.DB, name string) (bool, error) {
+	return data.DeletePlayer(db, name)
+}
@@ -0,0 +1,67 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package stats
+
+import (
+	"database/sql"
+	"math"
+
+	"git.astrospark.com/bolorama/data"
+)
+
+// Players are rated with the Elo system. The proxy cannot tell who won a
+// game, so results are reported by the operator or a hook (the admin
+// console's result command) as one player beating or drawing with another.
+
+const kInitialRating = 1500
+const kRatingK = 32
+
+// RecordResult updates the ratings of two players after a game between them,
+// won by the first unless draw is set, and returns their new ratings.
+func RecordResult(db *sql.DB, first string, second string, draw bool) (data.DataPlayerRating, data.DataPlayerRating, error) {
+	a, err := rating(db, first)
+	if err != nil {
+		return a, a, err
+	}
+	b, err := rating(db, second)
+	if err != nil {
+		return a, b, err
+	}
+
+	score := 1.0
+	if draw {
+		score = 0.5
+	}
+	expected := 1 / (1 + math.Pow(10, (b.Rating-a.Rating)/400))
+	change := kRatingK * (score - expected)
+
+	a.Rating += change
+	b.Rating -= change
+	a.Games++
+	b.Games++
+	err = data.UpdateRatings(db, a, b)
+	return a, b, err
+}
+
+func rating(db *sql.DB, name string) (data.DataPlayerRating, error) {
+	player, ok, err := data.SelectRating(db, name)
+	if !ok {
+		player.Rating = kInitialRating
+	}
+	return player, err
+}
@@ -22,13 +22,14 @@ import (
 	"database/sql"
 	"encoding/binary"
 	"encoding/hex"
-	"fmt"
 	"net"
 	"strconv"
 	"time"
 
 	"git.astrospark.com/bolorama/bolo"
 	"git.astrospark.com/bolorama/data"
+	"git.astrospark.com/bolorama/events"
+	"git.astrospark.com/bolorama/privacy"
 	"git.astrospark.com/bolorama/state"
 	"git.astrospark.com/bolorama/util"
 )
@@ -36,82 +37,98 @@ import (
 const kLogIntervalSeconds = 60
 const kElapsedMinutesPerLogInterval = 1
 
-func Logger(context *state.ServerContext, db *sql.DB) {
-	defer context.WaitGroup.Done()
+func Logger(context *state.ServerContext, db *sql.DB, subscription <-chan events.Event) {
+	defer context.Stats.WaitGroup.Done()
+	defer func() {
+		context.Logger.Println("Stopped statistics")
+	}()
 
 	if db == nil {
-		LoggerNone(context)
+		LoggerNone(subscription)
 	} else {
-		LoggerSql(context, db)
+		LoggerSql(context, db, subscription)
 	}
 }
 
-func LoggerNone(context *state.ServerContext) {
-	for {
-		select {
-		case <-context.ShutdownChannel:
-			fmt.Println("Stopped statistics")
-			return
-		case <-context.LogGameEndChannel:
-		case <-context.LogPlayerJoinChannel:
-		case <-context.LogPlayerLeaveChannel:
-		}
+func LoggerNone(subscription <-chan events.Event) {
+	for range subscription {
 	}
 }
 
-func LoggerSql(context *state.ServerContext, db *sql.DB) {
+func LoggerSql(context *state.ServerContext, db *sql.DB, subscription <-chan events.Event) {
 	ticker := time.NewTicker(kLogIntervalSeconds * time.Second)
+	defer ticker.Stop()
+	players := newPlayerTracker(context.Logger)
 
 	for {
 		select {
-		case <-context.ShutdownChannel:
-			fmt.Println("Stopped statistics")
-			ticker.Stop()
-			return
 		case <-ticker.C:
 			LogGames(context, db)
-		case gameId := <-context.LogGameEndChannel:
-			LogEndGame(db, gameId)
-		case playerAddr := <-context.LogPlayerJoinChannel:
-			LogPlayerJoin(db, net.ParseIP(playerAddr.IpAddr), playerAddr.IpPort)
-		case playerAddr := <-context.LogPlayerLeaveChannel:
-			LogPlayerLeave(db, net.ParseIP(playerAddr.IpAddr), playerAddr.IpPort)
+		case event, ok := <-subscription:
+			if !ok {
+				players.endAll(db)
+				return
+			}
+			players.handle(db, event)
+			var err error
+			switch event.Type {
+			case events.GameEnded:
+				err = LogEndGame(db, event.GameId)
+			case events.PlayerJoined:
+				err = LogPlayerJoin(db, net.ParseIP(event.PlayerAddr.IpAddr), event.PlayerAddr.IpPort)
+			case events.PlayerLeft:
+				err = LogPlayerLeave(db, net.ParseIP(event.PlayerAddr.IpAddr), event.PlayerAddr.IpPort)
+			case events.PlayerMigrated:
+				// player ids are derived from the address, so a migration
+				// ends one session and starts another
+				err = LogPlayerLeave(db, net.ParseIP(event.PreviousAddr.IpAddr), event.PreviousAddr.IpPort)
+				if err == nil {
+					err = LogPlayerJoin(db, net.ParseIP(event.PlayerAddr.IpAddr), event.PlayerAddr.IpPort)
+				}
+			}
+			if err != nil {
+				context.Logger.Println("Statistics:", err)
+			}
 		}
 	}
 }
 
 func LogGames(context *state.ServerContext, db *sql.DB) {
-	context.Mutex.Lock()
-
 	games := make(map[string]data.DataGame)
-	for gameId, game := range context.Games {
-		hash := sha256.Sum256(gameId[:])
-		strHash := hex.EncodeToString(hash[:])
-		games[strHash] = data.DataGame{
-			GameId:               strHash,
-			MapName:              game.MapName,
-			StartTimestamp:       strconv.FormatInt(game.ServerStartTimestamp.Unix(), 10),
-			EndTimestamp:         sql.NullString{String: "", Valid: false},
-			MaxPlayerCount:       0,
-			ElapsedPlayerMinutes: 0,
-		}
-	}
 
-	for _, player := range context.Players {
-		hash := sha256.Sum256(player.GameId[:])
-		strHash := hex.EncodeToString(hash[:])
-		game := games[strHash]
-		game.MaxPlayerCount = game.MaxPlayerCount + 1
-		games[strHash] = game
-	}
+	state.Do(context, func(s *state.State) {
+		for gameId, game := range s.Games {
+			hash := sha256.Sum256(gameId[:])
+			strHash := hex.EncodeToString(hash[:])
+			games[strHash] = data.DataGame{
+				GameId:               strHash,
+				MapName:              game.MapName,
+				StartTimestamp:       strconv.FormatInt(game.ServerStartTimestamp.Unix(), 10),
+				EndTimestamp:         sql.NullString{String: "", Valid: false},
+				MaxPlayerCount:       0,
+				ElapsedPlayerMinutes: 0,
+				Tracker:              context.Name,
+			}
+		}
 
-	context.Mutex.Unlock()
+		for _, player := range s.Players {
+			hash := sha256.Sum256(player.GameId[:])
+			strHash := hex.EncodeToString(hash[:])
+			game := games[strHash]
+			game.MaxPlayerCount = game.MaxPlayerCount + 1
+			games[strHash] = game
+		}
+	})
 
 	var gameIds []string
 	for gameId := range games {
 		gameIds = append(gameIds, gameId)
 	}
-	dbGames := data.SelectGames(db, gameIds)
+	dbGames, err := data.SelectGames(db, gameIds)
+	if err != nil {
+		context.Logger.Println("Statistics:", err)
+		return
+	}
 
 	var insertGames []data.DataGame
 	var updateGames []data.DataGame
@@ -134,33 +151,40 @@ func LogGames(context *state.ServerContext, db *sql.DB) {
 	}
 
 	for _, game := range insertGames {
-		data.InsertGame(db, game)
+		if err := data.InsertGame(db, game); err != nil {
+			context.Logger.Println("Statistics:", err)
+		}
 	}
 
 	for _, game := range updateGames {
-		data.UpdateGame(db, game)
+		if err := data.UpdateGame(db, game); err != nil {
+			context.Logger.Println("Statistics:", err)
+		}
 	}
 }
 
-func LogEndGame(db *sql.DB, gameId bolo.GameId) {
+func LogEndGame(db *sql.DB, gameId bolo.GameId) error {
 	hash := sha256.Sum256(gameId[:])
-	data.EndGame(db, hex.EncodeToString(hash[:]))
+	return data.EndGame(db, hex.EncodeToString(hash[:]))
 }
 
-func LogPlayerJoin(db *sql.DB, ipAddr net.IP, port int) {
+func LogPlayerJoin(db *sql.DB, ipAddr net.IP, port int) error {
 	hash := hashPlayerId(ipAddr, port)
-	data.InsertPlayerSession(db, hash)
+	return data.InsertPlayerSession(db, hash)
 }
 
-func LogPlayerLeave(db *sql.DB, ipAddr net.IP, port int) {
+func LogPlayerLeave(db *sql.DB, ipAddr net.IP, port int) error {
 	hash := hashPlayerId(ipAddr, port)
-	data.EndPlayerSession(db, hash)
+	return data.EndPlayerSession(db, hash)
 }
 
 func hashPlayerId(ipAddr net.IP, port int) string {
 	var playerId [6]byte
 	copy(playerId[:], ipAddr.To4())
 	binary.BigEndian.PutUint16(playerId[4:6], uint16(port))
+	if privacy.Enabled() {
+		return hex.EncodeToString(privacy.Hash(playerId[:]))
+	}
 	hash := sha256.Sum256(playerId[:])
 	strHash := hex.EncodeToString(hash[:])
 	return strHash
@@ -0,0 +1,151 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package stun
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// A minimal RFC 5389 client: just enough to send a Binding Request and read
+// back our public (server reflexive) IPv4 address.
+
+const headerSize = 20
+const magicCookie = 0x2112a442
+
+const messageTypeBindingRequest = 0x0001
+const messageTypeBindingSuccess = 0x0101
+
+const attributeMappedAddress = 0x0001
+const attributeXorMappedAddress = 0x0020
+
+const addressFamilyIPv4 = 0x01
+
+// Discover asks the STUN server (host:port) for this host's public IPv4
+// address.
+func Discover(server string, timeout time.Duration) (net.IP, error) {
+	serverAddr, err := net.ResolveUDPAddr("udp4", server)
+	if err != nil {
+		return nil, err
+	}
+
+	connection, err := net.DialUDP("udp4", nil, serverAddr)
+	if err != nil {
+		return nil, err
+	}
+	defer connection.Close()
+
+	var transactionId [12]byte
+	if _, err := rand.Read(transactionId[:]); err != nil {
+		return nil, err
+	}
+
+	request := make([]byte, headerSize)
+	binary.BigEndian.PutUint16(request[0:2], messageTypeBindingRequest)
+	binary.BigEndian.PutUint16(request[2:4], 0)
+	binary.BigEndian.PutUint32(request[4:8], magicCookie)
+	copy(request[8:20], transactionId[:])
+
+	connection.SetDeadline(time.Now().Add(timeout))
+
+	if _, err := connection.Write(request); err != nil {
+		return nil, err
+	}
+
+	response := make([]byte, 1024)
+	for {
+		n, err := connection.Read(response)
+		if err != nil {
+			return nil, err
+		}
+
+		if n < headerSize || !bytes.Equal(response[8:20], transactionId[:]) {
+			// not a reply to our request
+			continue
+		}
+
+		return parseBindingResponse(response[:n])
+	}
+}
+
+func parseBindingResponse(msg []byte) (net.IP, error) {
+	messageType := binary.BigEndian.Uint16(msg[0:2])
+	if messageType != messageTypeBindingSuccess {
+		return nil, fmt.Errorf("stun: unexpected message type 0x%04x", messageType)
+	}
+
+	length := int(binary.BigEndian.Uint16(msg[2:4]))
+	if headerSize+length > len(msg) {
+		return nil, errors.New("stun: truncated response")
+	}
+
+	var mappedAddress net.IP
+	pos := headerSize
+	end := headerSize + length
+	for pos+4 <= end {
+		attributeType := binary.BigEndian.Uint16(msg[pos : pos+2])
+		attributeLength := int(binary.BigEndian.Uint16(msg[pos+2 : pos+4]))
+		value := msg[pos+4:]
+		if pos+4+attributeLength > end {
+			return nil, errors.New("stun: truncated attribute")
+		}
+		value = value[:attributeLength]
+
+		switch attributeType {
+		case attributeXorMappedAddress:
+			if ip := parseAddress(value, true); ip != nil {
+				// preferred, since some NATs rewrite addresses they find in payloads
+				return ip, nil
+			}
+		case attributeMappedAddress:
+			mappedAddress = parseAddress(value, false)
+		}
+
+		// attributes are padded to a multiple of 4 bytes
+		pos = pos + 4 + ((attributeLength + 3) &^ 3)
+	}
+
+	if mappedAddress != nil {
+		return mappedAddress, nil
+	}
+
+	return nil, errors.New("stun: no mapped address in response")
+}
+
+func parseAddress(value []byte, xor bool) net.IP {
+	// reserved byte, family, port, address
+	if len(value) < 8 || value[1] != addressFamilyIPv4 {
+		return nil
+	}
+
+	ip := net.IPv4(value[4], value[5], value[6], value[7]).To4()
+	if xor {
+		var cookie [4]byte
+		binary.BigEndian.PutUint32(cookie[:], magicCookie)
+		for i := range ip {
+			ip[i] = ip[i] ^ cookie[i]
+		}
+	}
+
+	return ip
+}
@@ -0,0 +1,157 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package systemd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Socket activation and service notification, as described in sd_listen_fds(3)
+// and sd_notify(3). Both do nothing when not started by systemd.
+
+const kListenFdsStart = 3
+
+var listenOnce sync.Once
+var mutex sync.Mutex
+var sockets []*net.UDPConn
+
+// TakeUdp returns the UDP sockets passed by systemd that are bound to port,
+// which are then no longer offered. Returns nil if there are none. Sockets
+// that cannot be used are logged to logger on the first call.
+func TakeUdp(port int, logger *log.Logger) []*net.UDPConn {
+	listenOnce.Do(func() {
+		listen(logger)
+	})
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	var taken []*net.UDPConn
+	var rest []*net.UDPConn
+	for _, socket := range sockets {
+		if addr, ok := socket.LocalAddr().(*net.UDPAddr); ok && addr.Port == port {
+			taken = append(taken, socket)
+		} else {
+			rest = append(rest, socket)
+		}
+	}
+	sockets = rest
+	return taken
+}
+
+func listen(logger *log.Logger) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return
+	}
+	// not for our children
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	for fd := kListenFdsStart; fd < kListenFdsStart+count; fd++ {
+		file := os.NewFile(uintptr(fd), fmt.Sprint("systemd socket ", fd))
+		conn, err := net.FilePacketConn(file)
+		file.Close()
+		if err != nil {
+			logger.Println("Ignoring socket from systemd:", err)
+			continue
+		}
+		udpConn, ok := conn.(*net.UDPConn)
+		if !ok {
+			logger.Println("Ignoring socket from systemd: not UDP:", conn.LocalAddr())
+			conn.Close()
+			continue
+		}
+		logger.Println("Using socket from systemd:", udpConn.LocalAddr())
+		sockets = append(sockets, udpConn)
+	}
+}
+
+// Notify sends state, e.g. "READY=1", to systemd. Does nothing if not started
+// by systemd with a notify socket.
+func Notify(state string) error {
+	socketName := os.Getenv("NOTIFY_SOCKET")
+	if socketName == "" {
+		return nil
+	}
+	// abstract sockets are written with a leading @
+	if socketName[0] == '@' {
+		socketName = "\x00" + socketName[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketName, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("systemd notify failed: %s", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("systemd notify failed: %s", err)
+	}
+	return nil
+}
+
+// WatchdogInterval returns how often systemd expects to hear from the
+// service, or 0 if the watchdog is off.
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.Atoi(os.Getenv("WATCHDOG_USEC"))
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid, err := strconv.Atoi(os.Getenv("WATCHDOG_PID")); err == nil && pid != os.Getpid() {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Watchdog pings the systemd watchdog at half its interval for as long as
+// alive returns true, so systemd restarts the service once it hangs. Returns
+// when ctx is done. Problems are logged to logger.
+func Watchdog(ctx context.Context, wg *sync.WaitGroup, logger *log.Logger, alive func() bool) {
+	defer wg.Done()
+
+	interval := WatchdogInterval()
+	if interval == 0 {
+		return
+	}
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !alive() {
+				logger.Println("Not answering the systemd watchdog: server is not responding")
+			} else if err := Notify("WATCHDOG=1"); err != nil {
+				logger.Println(err)
+			}
+		}
+	}
+}
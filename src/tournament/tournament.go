@@ -0,0 +1,291 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tournament
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"git.astrospark.com/bolorama/events"
+	"git.astrospark.com/bolorama/state"
+	"git.astrospark.com/bolorama/stats"
+)
+
+// A tournament is a single elimination bracket run by the operator from the
+// admin console: create it, add the entrants in seeding order, start it,
+// and report each match's winner. Each match is a named lobby: when both of
+// its players are seen in the same game, that game is taken to be the match
+// and is labelled with it in the web listing. Each tracker runs one
+// tournament at a time, kept in its state (see state.Tournament), and it does
+// not survive a restart.
+
+// Current returns a copy of the tournament, or nil if there is none.
+func Current(context *state.ServerContext) *state.Tournament {
+	var t *state.Tournament
+	state.Do(context, func(s *state.State) {
+		current := state.TournamentCurrent(s)
+		if current == nil {
+			return
+		}
+		copied := *current
+		copied.Entrants = append([]string(nil), current.Entrants...)
+		copied.Matches = append([]state.Match(nil), current.Matches...)
+		t = &copied
+	})
+	return t
+}
+
+// New replaces any tournament with an empty one.
+func New(context *state.ServerContext, name string) {
+	state.Do(context, func(s *state.State) {
+		state.TournamentReplace(s, &state.Tournament{Name: name})
+	})
+}
+
+// Add enters a player, seeded after those already entered.
+func Add(context *state.ServerContext, name string) error {
+	var err error
+	state.Do(context, func(s *state.State) {
+		err = add(state.TournamentCurrent(s), name)
+	})
+	return err
+}
+
+func add(current *state.Tournament, name string) error {
+	if current == nil {
+		return fmt.Errorf("no tournament")
+	}
+	if current.Started {
+		return fmt.Errorf("tournament has started")
+	}
+	for _, entrant := range current.Entrants {
+		if strings.EqualFold(entrant, name) {
+			return fmt.Errorf("%s is already entered", name)
+		}
+	}
+	current.Entrants = append(current.Entrants, name)
+	return nil
+}
+
+// Start draws the bracket. Top seeds get byes if the number of entrants is
+// not a power of two.
+func Start(context *state.ServerContext) error {
+	var err error
+	state.Do(context, func(s *state.State) {
+		err = start(state.TournamentCurrent(s))
+	})
+	return err
+}
+
+func start(current *state.Tournament) error {
+	if current == nil {
+		return fmt.Errorf("no tournament")
+	}
+	if current.Started {
+		return fmt.Errorf("tournament has started")
+	}
+	if len(current.Entrants) < 2 {
+		return fmt.Errorf("need at least 2 entrants")
+	}
+
+	size := 2
+	for size < len(current.Entrants) {
+		size *= 2
+	}
+
+	seeds := seedOrder(size)
+	id := 1
+	for round, matches := 1, size/2; matches >= 1; round, matches = round+1, matches/2 {
+		for i := 0; i < matches; i++ {
+			current.Matches = append(current.Matches, state.Match{Id: id, Round: round})
+			id++
+		}
+	}
+	for i := 0; i < size/2; i++ {
+		match := &current.Matches[i]
+		for slot := 0; slot < 2; slot++ {
+			if seed := seeds[2*i+slot]; seed <= len(current.Entrants) {
+				match.Players[slot] = current.Entrants[seed-1]
+			}
+		}
+	}
+	current.Started = true
+
+	// byes
+	for i := 0; i < size/2; i++ {
+		match := current.Matches[i]
+		if match.Players[1] == "" {
+			advance(current, i, match.Players[0])
+		}
+	}
+	return nil
+}
+
+// Result records the winner of a match and moves them on to the next round.
+// The result also counts towards the rankings if statistics are enabled.
+func Result(context *state.ServerContext, id int, winner string) error {
+	var loser string
+	var err error
+	state.Do(context, func(s *state.State) {
+		winner, loser, err = result(state.TournamentCurrent(s), id, winner)
+	})
+	if err != nil {
+		return err
+	}
+	if context.Db != nil {
+		if _, _, err := stats.RecordResult(context.Db, winner, loser, false); err != nil {
+			context.Logger.Println("Tournament:", err)
+		}
+	}
+	return nil
+}
+
+// result records the winner of a match, returning the names of the winner and
+// loser as entered.
+func result(current *state.Tournament, id int, winner string) (string, string, error) {
+	if current == nil || !current.Started {
+		return "", "", fmt.Errorf("no tournament in progress")
+	}
+	if id < 1 || id > len(current.Matches) {
+		return "", "", fmt.Errorf("no match %d", id)
+	}
+	match := current.Matches[id-1]
+	if match.Winner != "" {
+		return "", "", fmt.Errorf("match %d was won by %s", id, match.Winner)
+	}
+	if match.Players[0] == "" || match.Players[1] == "" {
+		return "", "", fmt.Errorf("match %d is waiting for its players", id)
+	}
+
+	var loser string
+	if strings.EqualFold(winner, match.Players[0]) {
+		winner, loser = match.Players[0], match.Players[1]
+	} else if strings.EqualFold(winner, match.Players[1]) {
+		winner, loser = match.Players[1], match.Players[0]
+	} else {
+		return "", "", fmt.Errorf("%s is not playing in match %d", winner, id)
+	}
+
+	advance(current, id-1, winner)
+	return winner, loser, nil
+}
+
+// advance sets the winner of the match at index and fills their place in the
+// next round.
+func advance(t *state.Tournament, index int, winner string) {
+	t.Matches[index].Winner = winner
+
+	// the matches of each round follow those of the previous one
+	first := 0
+	matches := (len(t.Matches) + 1) / 2
+	for index >= first+matches {
+		first += matches
+		matches /= 2
+	}
+	if matches == 1 {
+		return // the final
+	}
+	position := index - first
+	next := first + matches + position/2
+	t.Matches[next].Players[position%2] = winner
+}
+
+// seedOrder returns the seeds in bracket position order, so that the top
+// seeds can only meet in the later rounds: 1 8 4 5 2 7 3 6 for 8.
+func seedOrder(size int) []int {
+	order := []int{1}
+	for len(order) < size {
+		var next []int
+		for _, seed := range order {
+			next = append(next, seed, 2*len(order)+1-seed)
+		}
+		order = next
+	}
+	return order
+}
+
+// Run links matches to games as players show up, until the events channel
+// is closed.
+func Run(context *state.ServerContext, eventChannel <-chan events.Event) {
+	defer context.Stats.WaitGroup.Done()
+
+	for event := range eventChannel {
+		if event.Type == events.NameChanged {
+			linkGames(context)
+		}
+	}
+}
+
+// linkGames takes a game in which both players of an undecided match are
+// playing to be that match.
+func linkGames(context *state.ServerContext) {
+	state.Do(context, func(s *state.State) {
+		current := state.TournamentCurrent(s)
+		if current == nil || !current.Started {
+			return
+		}
+
+		names := make(map[string][]string)
+		for _, player := range s.Players {
+			if player.Name != "" {
+				gameId := hex.EncodeToString(player.GameId[:])
+				names[gameId] = append(names[gameId], player.Name)
+			}
+		}
+
+		for i, match := range current.Matches {
+			if match.Winner != "" || match.GameId != "" || match.Players[0] == "" || match.Players[1] == "" {
+				continue
+			}
+			for gameId, players := range names {
+				if containsFold(players, match.Players[0]) && containsFold(players, match.Players[1]) {
+					current.Matches[i].GameId = gameId
+					context.Logger.Printf("%s is game %s\n", current.MatchName(match), gameId)
+					break
+				}
+			}
+		}
+	})
+}
+
+// MatchNames returns the label of each game linked to a match, by game id.
+func MatchNames(context *state.ServerContext) map[string]string {
+	labels := make(map[string]string)
+	state.Do(context, func(s *state.State) {
+		current := state.TournamentCurrent(s)
+		if current == nil {
+			return
+		}
+		for _, match := range current.Matches {
+			if match.GameId != "" && match.Winner == "" {
+				labels[match.GameId] = current.MatchName(match)
+			}
+		}
+	})
+	return labels
+}
+
+func containsFold(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,245 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package trace
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"git.astrospark.com/bolorama/bolo"
+	"git.astrospark.com/bolorama/privacy"
+	"git.astrospark.com/bolorama/record"
+)
+
+// Filter selects the packets to hexdump. Unset fields match anything; all set
+// fields must match.
+type Filter struct {
+	PlayerIp   net.IP // player address: the sender of inbound packets, receiver of outbound
+	PlayerPort int
+	ProxyPort  int
+	GameId     *bolo.GameId
+	PacketType int // -1 for any
+	Direction  *record.Direction
+}
+
+// Tracer hexdumps packets matching any of its filters to its logger. Packet
+// is cheap when there are no filters, so it can be called for every packet.
+type Tracer struct {
+	enabled int32 // accessed atomically
+	mutex   sync.Mutex
+	filters []Filter
+	logger  *log.Logger
+}
+
+func NewTracer(logger *log.Logger) *Tracer {
+	return &Tracer{logger: logger}
+}
+
+// ParseFilter parses space separated name=value terms: player=ip[:port],
+// port=<proxy port>, game=<game id hex>, type=<packet type>, dir=in|out.
+func ParseFilter(terms []string) (Filter, error) {
+	filter := Filter{PacketType: -1}
+	for _, term := range terms {
+		s := strings.SplitN(term, "=", 2)
+		if len(s) < 2 {
+			return filter, fmt.Errorf("malformed filter term: %s", term)
+		}
+		name, value := s[0], s[1]
+
+		switch name {
+		case "player":
+			host, port := value, ""
+			if strings.Contains(value, ":") {
+				var err error
+				host, port, err = net.SplitHostPort(value)
+				if err != nil {
+					return filter, err
+				}
+			}
+			filter.PlayerIp = net.ParseIP(host).To4()
+			if filter.PlayerIp == nil {
+				return filter, fmt.Errorf("not an IPv4 address: %s", host)
+			}
+			if port != "" {
+				var err error
+				filter.PlayerPort, err = strconv.Atoi(port)
+				if err != nil {
+					return filter, fmt.Errorf("not a port: %s", port)
+				}
+			}
+		case "port":
+			port, err := strconv.Atoi(value)
+			if err != nil {
+				return filter, fmt.Errorf("not a port: %s", value)
+			}
+			filter.ProxyPort = port
+		case "game":
+			bytes, err := hex.DecodeString(value)
+			if err != nil || len(bytes) != len(bolo.GameId{}) {
+				return filter, fmt.Errorf("not a game id: %s", value)
+			}
+			var gameId bolo.GameId
+			copy(gameId[:], bytes)
+			filter.GameId = &gameId
+		case "type":
+			packetType, err := strconv.ParseUint(value, 0, 8)
+			if err != nil {
+				return filter, fmt.Errorf("not a packet type: %s", value)
+			}
+			filter.PacketType = int(packetType)
+		case "dir":
+			var direction record.Direction
+			switch value {
+			case "in":
+				direction = record.Inbound
+			case "out":
+				direction = record.Outbound
+			default:
+				return filter, fmt.Errorf("direction must be in or out: %s", value)
+			}
+			filter.Direction = &direction
+		default:
+			return filter, fmt.Errorf("unknown filter term: %s", name)
+		}
+	}
+	return filter, nil
+}
+
+func (filter Filter) String() string {
+	var terms []string
+	if filter.PlayerIp != nil {
+		if filter.PlayerPort != 0 {
+			terms = append(terms, fmt.Sprintf("player=%s:%d", filter.PlayerIp, filter.PlayerPort))
+		} else {
+			terms = append(terms, fmt.Sprintf("player=%s", filter.PlayerIp))
+		}
+	}
+	if filter.ProxyPort != 0 {
+		terms = append(terms, fmt.Sprintf("port=%d", filter.ProxyPort))
+	}
+	if filter.GameId != nil {
+		terms = append(terms, "game="+hex.EncodeToString(filter.GameId[:]))
+	}
+	if filter.PacketType >= 0 {
+		terms = append(terms, fmt.Sprintf("type=%d", filter.PacketType))
+	}
+	if filter.Direction != nil {
+		terms = append(terms, "dir="+directionName(*filter.Direction))
+	}
+	if len(terms) == 0 {
+		return "(all packets)"
+	}
+	return strings.Join(terms, " ")
+}
+
+func (filter Filter) matches(gameId bolo.GameId, direction record.Direction, proxyPort int, playerAddr net.UDPAddr, buffer []byte) bool {
+	if filter.PlayerIp != nil && !filter.PlayerIp.Equal(playerAddr.IP) {
+		return false
+	}
+	if filter.PlayerPort != 0 && filter.PlayerPort != playerAddr.Port {
+		return false
+	}
+	if filter.ProxyPort != 0 && filter.ProxyPort != proxyPort {
+		return false
+	}
+	if filter.GameId != nil && *filter.GameId != gameId {
+		return false
+	}
+	if filter.PacketType >= 0 && (len(buffer) < bolo.PacketHeaderSize || bolo.GetPacketType(buffer) != filter.PacketType) {
+		return false
+	}
+	if filter.Direction != nil && *filter.Direction != direction {
+		return false
+	}
+	return true
+}
+
+func (tracer *Tracer) Add(filter Filter) {
+	tracer.mutex.Lock()
+	defer tracer.mutex.Unlock()
+	tracer.filters = append(tracer.filters, filter)
+	atomic.StoreInt32(&tracer.enabled, 1)
+}
+
+// Remove deletes the filter at index, as numbered by Filters.
+func (tracer *Tracer) Remove(index int) bool {
+	tracer.mutex.Lock()
+	defer tracer.mutex.Unlock()
+	if index < 0 || index >= len(tracer.filters) {
+		return false
+	}
+	tracer.filters = append(tracer.filters[:index], tracer.filters[index+1:]...)
+	if len(tracer.filters) == 0 {
+		atomic.StoreInt32(&tracer.enabled, 0)
+	}
+	return true
+}
+
+func (tracer *Tracer) Clear() {
+	tracer.mutex.Lock()
+	defer tracer.mutex.Unlock()
+	tracer.filters = nil
+	atomic.StoreInt32(&tracer.enabled, 0)
+}
+
+func (tracer *Tracer) Filters() []Filter {
+	tracer.mutex.Lock()
+	defer tracer.mutex.Unlock()
+	return append([]Filter(nil), tracer.filters...)
+}
+
+// Packet hexdumps the packet if it matches a filter. Arguments are as for
+// record.Recorder.Record.
+func (tracer *Tracer) Packet(gameId bolo.GameId, direction record.Direction, proxyPort int, playerAddr net.UDPAddr, buffer []byte) {
+	if atomic.LoadInt32(&tracer.enabled) == 0 {
+		return
+	}
+
+	tracer.mutex.Lock()
+	matched := false
+	for _, filter := range tracer.filters {
+		if filter.matches(gameId, direction, proxyPort, playerAddr, buffer) {
+			matched = true
+			break
+		}
+	}
+	tracer.mutex.Unlock()
+	if !matched {
+		return
+	}
+
+	arrow := "<-"
+	if direction == record.Outbound {
+		arrow = "->"
+	}
+	tracer.logger.Printf("trace %s %d %s %s (%d bytes)\n%s",
+		hex.EncodeToString(gameId[:]), proxyPort, arrow, privacy.Addr(playerAddr.IP, playerAddr.Port), len(buffer), hex.Dump(buffer))
+}
+
+func directionName(direction record.Direction) string {
+	if direction == record.Outbound {
+		return "out"
+	}
+	return "in"
+}
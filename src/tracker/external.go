@@ -0,0 +1,55 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tracker
+
+import (
+	"fmt"
+	"net"
+
+	"git.astrospark.com/bolorama/config"
+	"git.astrospark.com/bolorama/proxy"
+	"git.astrospark.com/bolorama/state"
+)
+
+// In pure proxy mode (external_tracker) Bolorama only provides the NAT
+// traversal proxy and games are listed by another tracker. Hosts still send
+// their game info to our tracker port, which sets up the proxy as usual, and
+// the game info is passed on to the external tracker from the host's proxy
+// port, so the tracker lists the game at the proxy address and port.
+
+// getExternalTracker returns the address of external_tracker, or nil if
+// pure proxy mode is off.
+func getExternalTracker() (*net.UDPAddr, error) {
+	if !config.HasValue("external_tracker") {
+		return nil, nil
+	}
+	addr, err := net.ResolveUDPAddr("udp4", config.GetValueString("external_tracker"))
+	if err != nil {
+		return nil, fmt.Errorf("external_tracker: not a host:port address")
+	}
+	return addr, nil
+}
+
+// forwardToExternalTracker sends a game info packet to the external tracker
+// from the proxy port of the player who sent it.
+func forwardToExternalTracker(player state.Player, externalTracker *net.UDPAddr, packet proxy.UdpPacket) {
+	// the packet buffer is released before the queued copy is sent
+	buffer := make([]byte, packet.Len)
+	copy(buffer, packet.Buffer[:packet.Len])
+	player.Route.TxQueue.Send(proxy.UdpPacket{DstAddr: *externalTracker, Buffer: buffer})
+}
@@ -0,0 +1,199 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tracker
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.astrospark.com/bolorama/bolo"
+	"git.astrospark.com/bolorama/config"
+	"git.astrospark.com/bolorama/proxy"
+	"git.astrospark.com/bolorama/security"
+)
+
+// The tracker port is public and its packets are cheap to forge, so sources
+// sending too many packets, or too many that are not Bolo or WinBolo, are
+// blacklisted for a while and their packets dropped before they reach the
+// tracker (and the game state it locks).
+
+const kFloodWindow = time.Second
+const kMaxMalformedPerWindow = 5
+
+// don't let a spoofed flood from many addresses grow the table without bound
+const kMaxFloodSources = 10000
+
+// FloodStats counts the packets and connections seen by the flood guard since
+// startup.
+type FloodStats struct {
+	Received      uint64 `json:"received"`
+	Malformed     uint64 `json:"malformed"`
+	Dropped       uint64 `json:"dropped"`
+	Blacklistings uint64 `json:"blacklistings"`
+	Blacklisted   int    `json:"blacklisted"` // sources blacklisted now
+}
+
+type floodSource struct {
+	packets   int
+	malformed int
+}
+
+type floodGuard struct {
+	maxPerWindow int
+	blacklistFor time.Duration
+
+	mutex       sync.Mutex
+	windowStart time.Time
+	sources     map[string]*floodSource
+	blacklist   map[string]time.Time
+
+	received      uint64 // accessed atomically
+	malformed     uint64
+	dropped       uint64
+	blacklistings uint64
+}
+
+var guard *floodGuard
+var guardOnce sync.Once
+
+// getFloodGuard returns the guard shared by the tracker's listeners.
+func getFloodGuard() *floodGuard {
+	guardOnce.Do(func() {
+		guard = &floodGuard{
+			maxPerWindow: config.GetValueInt("flood_max_packets_per_second"),
+			blacklistFor: time.Duration(config.GetValueInt("flood_blacklist_seconds")) * time.Second,
+			sources:      make(map[string]*floodSource),
+			blacklist:    make(map[string]time.Time),
+		}
+	})
+	return guard
+}
+
+// FloodMetrics returns what the flood guard has seen.
+func FloodMetrics() FloodStats {
+	g := getFloodGuard()
+	g.mutex.Lock()
+	blacklisted := 0
+	now := time.Now()
+	for _, until := range g.blacklist {
+		if now.Before(until) {
+			blacklisted++
+		}
+	}
+	g.mutex.Unlock()
+
+	return FloodStats{
+		Received:      atomic.LoadUint64(&g.received),
+		Malformed:     atomic.LoadUint64(&g.malformed),
+		Dropped:       atomic.LoadUint64(&g.dropped),
+		Blacklistings: atomic.LoadUint64(&g.blacklistings),
+		Blacklisted:   blacklisted,
+	}
+}
+
+// allowPacket reports whether a packet received on the tracker port should be
+// handled.
+func (g *floodGuard) allowPacket(packet proxy.UdpPacket, logger *log.Logger) bool {
+	buffer := packet.Buffer[:packet.Len]
+	malformed := false
+	if !bolo.IsWinBoloInfoPacket(buffer) {
+		valid, _ := bolo.ValidatePacket(packet)
+		malformed = !valid
+	}
+	return g.allow(packet.SrcAddr.IP, packet.SrcAddr.Port, malformed, logger)
+}
+
+// allowConn reports whether a connection to a TCP tracker port should be
+// served.
+func (g *floodGuard) allowConn(conn net.Conn, logger *log.Logger) bool {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	return g.allow(addr.IP, addr.Port, false, logger)
+}
+
+func (g *floodGuard) allow(ip net.IP, port int, malformed bool, logger *log.Logger) bool {
+	atomic.AddUint64(&g.received, 1)
+	if malformed {
+		atomic.AddUint64(&g.malformed, 1)
+	}
+	if g.maxPerWindow <= 0 {
+		return !malformed
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	now := time.Now()
+	key := ip.String()
+	if until, ok := g.blacklist[key]; ok {
+		if now.Before(until) {
+			atomic.AddUint64(&g.dropped, 1)
+			return false
+		}
+		delete(g.blacklist, key)
+	}
+
+	if now.Sub(g.windowStart) >= kFloodWindow {
+		g.windowStart = now
+		g.sources = make(map[string]*floodSource)
+		for ip, until := range g.blacklist {
+			if !now.Before(until) {
+				delete(g.blacklist, ip)
+			}
+		}
+	}
+
+	source, ok := g.sources[key]
+	if !ok {
+		if len(g.sources) >= kMaxFloodSources {
+			return !malformed
+		}
+		source = &floodSource{}
+		g.sources[key] = source
+	}
+	source.packets++
+	if malformed {
+		source.malformed++
+		// once per window is enough to count offences
+		if source.malformed == 1 {
+			if err := security.Log(security.Malformed, ip, port, "invalid packet on tracker port"); err != nil {
+				logger.Println(err)
+			}
+		}
+	}
+
+	if source.packets > g.maxPerWindow || source.malformed > kMaxMalformedPerWindow {
+		if len(g.blacklist) < kMaxFloodSources {
+			g.blacklist[key] = now.Add(g.blacklistFor)
+			atomic.AddUint64(&g.blacklistings, 1)
+			if err := security.Log(security.Flood, ip, port, fmt.Sprintf("%d packets, %d malformed in %s", source.packets, source.malformed, kFloodWindow)); err != nil {
+				logger.Println(err)
+			}
+		}
+		delete(g.sources, key)
+		atomic.AddUint64(&g.dropped, 1)
+		return false
+	}
+	return !malformed
+}
@@ -0,0 +1,146 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tracker
+
+import (
+	"net"
+	"time"
+
+	"git.astrospark.com/bolorama/bolo"
+	"git.astrospark.com/bolorama/clock"
+	"git.astrospark.com/bolorama/events"
+	"git.astrospark.com/bolorama/privacy"
+	"git.astrospark.com/bolorama/proxy"
+	"git.astrospark.com/bolorama/ratelog"
+	"git.astrospark.com/bolorama/state"
+)
+
+// In pure tracker mode (pure_tracker) Mac Bolo hosts are listed with their
+// own address and no proxy ports are allocated. Before a game is listed, its
+// host is sent a game info request from a fresh socket, which a router would
+// drop unless the host's port is really open to the Internet.
+
+const kProbeAttempts = 3
+const kProbeTimeout = 2 * time.Second // per attempt
+const kProbeRetryInterval = time.Minute
+
+// handlePureTrackerInfoPacket refreshes a listed game, or starts verifying
+// that the host of a new one is reachable. probes holds when each unlisted
+// game was last probed and is only used by the tracker goroutine.
+func handlePureTrackerInfoPacket(context *state.ServerContext, packet proxy.UdpPacket, probes map[bolo.GameId]time.Time) {
+	newGameInfo, err := bolo.ParsePacketGameInfo(packet.Buffer[:packet.Len])
+	if err != nil {
+		ratelog.Println(context.Logger, err)
+		return
+	}
+
+	listed := false
+	state.Do(context, func(s *state.State) {
+		gameInfo, ok := s.Games[newGameInfo.GameId]
+		if !ok || gameInfo.DirectHost == nil {
+			return
+		}
+		listed = true
+		newGameInfo.ServerStartTimestamp = gameInfo.ServerStartTimestamp
+		newGameInfo.DirectHost = gameInfo.DirectHost
+		newGameInfo.LastSeen = context.Clock.Now()
+		s.Games[newGameInfo.GameId] = newGameInfo
+	})
+
+	if listed || clock.Since(context.Clock, probes[newGameInfo.GameId]) < kProbeRetryInterval {
+		return
+	}
+	probes[newGameInfo.GameId] = context.Clock.Now()
+	go probeHost(context, newGameInfo, packet.SrcAddr)
+}
+
+// probeHost lists the game if its host answers a game info request.
+func probeHost(context *state.ServerContext, gameInfo bolo.GameInfo, hostAddr net.UDPAddr) {
+	defer state.Recover(context, "probing a host")
+
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		context.Logger.Println(err)
+		return
+	}
+	defer conn.Close()
+
+	request := bolo.MarshalPacketTypeD()
+	buffer := make([]byte, proxy.BufferSize())
+	reachable := false
+	for attempt := 0; attempt < kProbeAttempts && !reachable; attempt++ {
+		if _, err := conn.WriteToUDP(request, &hostAddr); err != nil {
+			context.Logger.Println(err)
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(kProbeTimeout))
+		for {
+			n, addr, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				break
+			}
+			packet := proxy.UdpPacket{SrcAddr: *addr, Len: n, Buffer: buffer[:n]}
+			if valid, _ := bolo.ValidatePacket(packet); valid && addr.IP.Equal(hostAddr.IP) &&
+				bolo.GetPacketType(buffer) == bolo.PacketTypeGameInfo {
+				reachable = true
+				break
+			}
+		}
+	}
+
+	if !reachable {
+		context.Logger.Printf("Not listing game %x: host %s is not reachable\n", gameInfo.GameId, privacy.Addr(hostAddr.IP, hostAddr.Port))
+		return
+	}
+
+	state.Do(context, func(s *state.State) {
+		if _, ok := s.Games[gameInfo.GameId]; ok {
+			return
+		}
+		gameInfo.DirectHost = &hostAddr
+		gameInfo.ServerStartTimestamp = context.Clock.Now()
+		gameInfo.LastSeen = gameInfo.ServerStartTimestamp
+		context.Logger.Print(bolo.SprintGameInfo(gameInfo))
+		s.Games[gameInfo.GameId] = gameInfo
+		context.Events.Publish(events.Event{Type: events.GameStarted, GameId: gameInfo.GameId})
+	})
+}
+
+// pingDirectHosts asks the hosts of listed games for fresh game info, so
+// their listing stays current and they can be expired when they go away.
+func pingDirectHosts(context *state.ServerContext, probes map[bolo.GameId]time.Time) {
+	var hosts []net.UDPAddr
+	state.Do(context, func(s *state.State) {
+		for _, gameInfo := range s.Games {
+			if gameInfo.DirectHost != nil {
+				hosts = append(hosts, *gameInfo.DirectHost)
+			}
+		}
+	})
+
+	buffer := bolo.MarshalPacketTypeD()
+	for i := range hosts {
+		proxy.SelectConnection(context.UdpConnections, hosts[i].IP).WriteToUDP(buffer, &hosts[i])
+	}
+
+	for gameId, probed := range probes {
+		if clock.Since(context.Clock, probed) > kProbeRetryInterval {
+			delete(probes, gameId)
+		}
+	}
+}
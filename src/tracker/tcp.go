@@ -1,65 +1,129 @@
-/*
-	Copyright 2021 Astrospark Technologies
-
-	This file is part of bolorama. Bolorama is free software: you can
-	redistribute it and/or modify it under the terms of the GNU Affero General
-	Public License as published by the Free Software Foundation, either version
-	3 of the License, or (at your option) any later version.
-
-	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
-	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
-	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
-	details.
-
-	You should have received a copy of the GNU Affero General Public License
-	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
-*/
-
-package tracker
-
-import (
-	"fmt"
-	"log"
-	"net"
-	"strings"
-	"sync"
-)
-
-func tcpListener(wg *sync.WaitGroup, shutdownChannel chan struct{}, port int, tcpRequestChannel chan net.Conn) {
-	defer wg.Done()
-
-	listenAddr, err := net.ResolveTCPAddr("tcp4", fmt.Sprint(":", port))
-	if err != nil {
-		log.Fatalln(err)
-	}
-
-	connection, err := net.ListenTCP("tcp4", listenAddr)
-	if err != nil {
-		log.Fatalln(err)
-	}
-
-	go func() {
-		for {
-			_, ok := <-shutdownChannel
-			if !ok {
-				connection.Close()
-				break
-			}
-		}
-	}()
-
-	fmt.Println("Listening on TCP port", port)
-
-	for {
-		conn, err := connection.Accept()
-		if err != nil {
-			if !strings.HasSuffix(err.Error(), "use of closed network connection") {
-				fmt.Println(err)
-			}
-			fmt.Println("Stopped listening on TCP port", port)
-			break
-		}
-
-		tcpRequestChannel <- conn
-	}
-}
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tracker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+
+	"git.astrospark.com/bolorama/config"
+	"git.astrospark.com/bolorama/state"
+)
+
+// Listeners are a tracker's TCP ports, bound by Listen before the tracker
+// runs so that a port in use stops the server from starting, and the
+// external tracker, which Listen also resolves.
+type Listeners struct {
+	tracker  []*net.TCPListener
+	debug    []*net.TCPListener
+	external *net.UDPAddr // nil unless in pure proxy mode
+}
+
+// Listen binds the tracker's TCP port, and tracker_debug_port if set, on each
+// bind address. Nothing is bound in pure proxy mode, where games are listed by
+// the external tracker only, which cannot be combined with pure_tracker.
+func Listen(context *state.ServerContext) (*Listeners, error) {
+	external, err := getExternalTracker()
+	if err != nil {
+		return nil, err
+	}
+	listeners := &Listeners{external: external}
+	if external != nil {
+		if config.GetValueBool("pure_tracker") {
+			return nil, fmt.Errorf("pure_tracker and external_tracker cannot both be set")
+		}
+		return listeners, nil
+	}
+	bindAddresses, err := config.GetBindAddresses()
+	if err != nil {
+		return nil, err
+	}
+	if len(bindAddresses) == 0 {
+		bindAddresses = []net.IP{nil}
+	}
+	// off for the trackers in trackers unless their file sets it
+	debugPort := context.Config.GetValueInt("tracker_debug_port")
+	for _, ip := range bindAddresses {
+		listener, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: ip, Port: context.ProxyPort})
+		if err != nil {
+			listeners.Close()
+			return nil, err
+		}
+		listeners.tracker = append(listeners.tracker, listener)
+		if debugPort > 0 {
+			listener, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: ip, Port: debugPort})
+			if err != nil {
+				listeners.Close()
+				return nil, fmt.Errorf("tracker_debug_port: %s", err)
+			}
+			listeners.debug = append(listeners.debug, listener)
+		}
+	}
+	return listeners, nil
+}
+
+// Close closes the ports, for a server that fails to start after binding
+// them. A running tracker closes its own ports on shutdown.
+func (listeners *Listeners) Close() {
+	for _, listener := range listeners.tracker {
+		listener.Close()
+	}
+	for _, listener := range listeners.debug {
+		listener.Close()
+	}
+}
+
+func tcpListener(ctx context.Context, wg *sync.WaitGroup, logger *log.Logger, connection *net.TCPListener, tcpRequestChannel chan net.Conn) {
+	defer wg.Done()
+
+	port := connection.Addr().(*net.TCPAddr).Port
+
+	go func() {
+		<-ctx.Done()
+		connection.Close()
+	}()
+
+	logger.Println("Listening on TCP port", port)
+
+	guard := getFloodGuard()
+
+	for {
+		conn, err := connection.Accept()
+		if err != nil {
+			if !strings.HasSuffix(err.Error(), "use of closed network connection") {
+				logger.Println(err)
+			}
+			logger.Println("Stopped listening on TCP port", port)
+			break
+		}
+		if !guard.allowConn(conn, logger) {
+			conn.Close()
+			continue
+		}
+
+		select {
+		case tcpRequestChannel <- conn:
+		case <-ctx.Done():
+			conn.Close()
+		}
+	}
+}
@@ -18,15 +18,15 @@
 package tracker
 
 import (
-	"fmt"
-	"log"
 	"net"
 	"sync"
 	"time"
 
 	"git.astrospark.com/bolorama/bolo"
 	"git.astrospark.com/bolorama/config"
+	"git.astrospark.com/bolorama/events"
 	"git.astrospark.com/bolorama/proxy"
+	"git.astrospark.com/bolorama/ratelog"
 	"git.astrospark.com/bolorama/state"
 	"git.astrospark.com/bolorama/util"
 )
@@ -34,33 +34,72 @@ import (
 func Tracker(
 	context *state.ServerContext,
 	startPlayerPingChannel chan state.Player,
+	listeners *Listeners,
 ) {
-	defer context.WaitGroup.Done()
+	defer context.Network.WaitGroup.Done()
 	defer func() {
-		fmt.Println("Stopped tracker")
+		context.Logger.Println("Stopped tracker")
 	}()
 	udpPacketChannel := make(chan proxy.UdpPacket)
 	tcpTrackerRequestChannel := make(chan net.Conn)
 	tcpTrackerDebugRequestChannel := make(chan net.Conn)
 	playerPingTimeoutChannel := make(chan util.PlayerAddr)
 	trackerShutdownChannel := make(chan struct{})
-	hostname := config.GetValueString("hostname")
-	port := config.GetValueInt("tracker_port")
-	trackerDebugPort := config.GetValueInt("tracker_debug_port")
-	proxyIp := config.GetProxyIp()
+	hostname := context.Config.GetValueString("hostname")
+	port := context.ProxyPort
+	// in pure proxy mode games are listed by the external tracker only
+	externalTracker := listeners.external
+	proxyIp := context.ProxyIp()
 	wg := sync.WaitGroup{}
 
-	wg.Add(4)
-	go udpListener(&wg, context.ShutdownChannel, context.UdpConnection, port, udpPacketChannel)
-	go tcpListener(&wg, context.ShutdownChannel, port, tcpTrackerRequestChannel)
-	go tcpListener(&wg, context.ShutdownChannel, trackerDebugPort, tcpTrackerDebugRequestChannel)
-	go pingTimeout(&wg, context.ShutdownChannel, context.PlayerPongChannel, playerPingTimeoutChannel)
+	ctx := context.Network.Ctx
+
+	for _, connection := range context.UdpConnections {
+		wg.Add(1)
+		go udpListener(ctx, &wg, context.Logger, connection, port, udpPacketChannel)
+	}
+
+	for _, listener := range listeners.tracker {
+		wg.Add(1)
+		go tcpListener(ctx, &wg, context.Logger, listener, tcpTrackerRequestChannel)
+	}
+	for _, listener := range listeners.debug {
+		wg.Add(1)
+		go tcpListener(ctx, &wg, context.Logger, listener, tcpTrackerDebugRequestChannel)
+	}
+
+	wg.Add(1)
+	go pingTimeout(context, &wg, context.PlayerPongChannel, playerPingTimeoutChannel)
 
 	go func() {
 		wg.Wait()
 		close(trackerShutdownChannel)
 	}()
 
+	// a nil channel never fires, so nothing expires when the grace period is off
+	reconnectGrace := time.Duration(context.Config.GetValueInt("reconnect_grace_seconds")) * time.Second
+	var reconnectGraceChannel <-chan time.Time
+	if reconnectGrace > 0 {
+		ticker := context.Clock.NewTicker(time.Second)
+		defer ticker.Stop()
+		reconnectGraceChannel = ticker.C()
+	}
+
+	pureTracker := config.GetValueBool("pure_tracker")
+	probes := make(map[bolo.GameId]time.Time)
+	var directHostPingChannel <-chan time.Time
+	if pureTracker {
+		ticker := context.Clock.NewTicker(time.Duration(context.Config.GetValueInt("game_info_ping_seconds")) * time.Second)
+		defer ticker.Stop()
+		directHostPingChannel = ticker.C()
+	}
+
+	winBoloTimeout := time.Duration(context.Config.GetValueInt("winbolo_timeout_seconds")) * time.Second
+	hostTimeout := time.Duration(context.Config.GetValueInt("player_timeout_seconds")) * time.Second
+	gameIdleTimeout := time.Duration(context.Config.GetValueInt("game_idle_timeout_minutes")) * time.Minute
+	expiryTicker := context.Clock.NewTicker(time.Minute)
+	defer expiryTicker.Stop()
+
 	for {
 		select {
 		case _, ok := <-trackerShutdownChannel:
@@ -68,37 +107,80 @@ func Tracker(
 				return
 			}
 		case packet := <-udpPacketChannel:
-			player, err := state.PlayerGetByAddr(context, packet.SrcAddr, true)
+			var player state.Player
+			var err error
+			state.Do(context, func(s *state.State) {
+				player, err = state.PlayerGetByAddr(s, packet.SrcAddr)
+				if err == nil {
+					state.PlayerPingReply(s, player.ProxyPort)
+				}
+			})
 			if err == nil {
 				context.PlayerPongChannel <- util.PlayerAddr{IpAddr: player.IpAddr.String(), IpPort: player.IpPort, ProxyPort: player.ProxyPort}
 			}
-			handleGameInfoPacket(context, proxyIp, port, packet, context.PlayerPongChannel)
+			if pureTracker && !bolo.IsWinBoloInfoPacket(packet.Buffer[:packet.Len]) {
+				if valid, _ := bolo.ValidatePacket(packet); valid && bolo.GetPacketType(packet.Buffer) == bolo.PacketTypeGameInfo {
+					handlePureTrackerInfoPacket(context, packet, probes)
+				}
+			} else {
+				handleGameInfoPacket(context, proxyIp, port, externalTracker, packet, context.PlayerPongChannel)
+			}
+			packet.Release()
 		case conn := <-tcpTrackerRequestChannel:
-			fmt.Println("tracker request")
+			context.Logger.Println("tracker request")
 			conn.Write([]byte(getTrackerText(context, hostname)))
 			conn.Close()
 		case conn := <-tcpTrackerDebugRequestChannel:
-			fmt.Println("tracker debug request")
+			context.Logger.Println("tracker debug request")
 			conn.Write([]byte(getTrackerDebugText(context, hostname)))
 			conn.Close()
 		case player := <-startPlayerPingChannel:
 			context.PlayerPongChannel <- util.PlayerAddr{IpAddr: player.IpAddr.String(), IpPort: player.IpPort, ProxyPort: player.ProxyPort}
-			go pingGameInfo(context.UdpConnection, player, context.ShutdownChannel)
+			go pingGameInfo(context, player)
 		case playerAddr := <-playerPingTimeoutChannel:
-			log.Printf("Player timed out %s:%d\n", playerAddr.IpAddr, playerAddr.IpPort)
-			state.PlayerDelete(context, playerAddr, true)
-			state.PrintServerState(context, true)
+			state.Do(context, func(s *state.State) {
+				state.PlayerTimedOut(s, playerAddr, reconnectGrace)
+				state.PrintServerState(s)
+			})
+		case now := <-expiryTicker.C():
+			state.Do(context, func(s *state.State) {
+				expireDirectGames(s, now, winBoloTimeout, hostTimeout)
+				if gameIdleTimeout > 0 && state.GameExpireIdle(s, gameIdleTimeout) > 0 {
+					state.PrintServerState(s)
+				}
+			})
+		case <-directHostPingChannel:
+			pingDirectHosts(context, probes)
+		case <-reconnectGraceChannel:
+			state.Do(context, func(s *state.State) {
+				if state.PlayerExpireSuspended(s, reconnectGrace) > 0 {
+					state.PrintServerState(s)
+				}
+			})
 		}
 	}
 }
 
+// HandlePacket handles a packet sent to the tracker port, for a simulation,
+// which runs no tracker of its own. Pure tracker mode is not simulated.
+func HandlePacket(context *state.ServerContext, packet proxy.UdpPacket) {
+	externalTracker, _ := getExternalTracker()
+	handleGameInfoPacket(context, context.ProxyIp(), context.ProxyPort, externalTracker, packet, context.PlayerPongChannel)
+}
+
 func handleGameInfoPacket(
 	context *state.ServerContext,
 	proxyIp net.IP,
 	trackerPort int,
+	externalTracker *net.UDPAddr,
 	packet proxy.UdpPacket,
 	playerPongChannel chan util.PlayerAddr,
 ) {
+	if bolo.IsWinBoloInfoPacket(packet.Buffer[:packet.Len]) {
+		handleWinBoloInfoPacket(context, packet)
+		return
+	}
+
 	valid, _ := bolo.ValidatePacket(packet)
 	if !valid {
 		// skip non-bolo packets
@@ -108,14 +190,14 @@ func handleGameInfoPacket(
 	packetType := bolo.GetPacketType(packet.Buffer)
 
 	if packetType == bolo.PacketType7 {
-		context.Mutex.Lock()
-		player, err := state.PlayerGetByAddr(context, packet.SrcAddr, false)
-		if err == nil {
-			if player.NatPort != trackerPort {
-				state.PlayerSetNatPort(context, util.PlayerAddr{IpAddr: player.IpAddr.String(), IpPort: player.IpPort, ProxyPort: player.ProxyPort}, trackerPort, false)
+		state.Do(context, func(s *state.State) {
+			player, err := state.PlayerGetByAddr(s, packet.SrcAddr)
+			if err == nil {
+				if player.NatPort != trackerPort {
+					state.PlayerSetNatPort(s, util.PlayerAddr{IpAddr: player.IpAddr.String(), IpPort: player.IpPort, ProxyPort: player.ProxyPort}, trackerPort)
+				}
 			}
-		}
-		context.Mutex.Unlock()
+		})
 		return
 	}
 
@@ -126,88 +208,166 @@ func handleGameInfoPacket(
 
 	// game id is more unique if we leave the original ip address
 	//bolo.RewritePacketGameInfo(packet.Buffer, proxyIp)
-	newGameInfo := bolo.ParsePacketGameInfo(packet.Buffer)
-
-	context.Mutex.Lock()
-	defer func() { context.Mutex.Unlock() }()
-
-	newGame := false
-	gameInfo, ok := context.Games[newGameInfo.GameId]
-	if ok {
-		newGameInfo.ServerStartTimestamp = gameInfo.ServerStartTimestamp
-	} else {
-		newGameInfo.ServerStartTimestamp = time.Now()
-		newGame = true
-		bolo.PrintGameInfo(newGameInfo)
+	newGameInfo, err := bolo.ParsePacketGameInfo(packet.Buffer[:packet.Len])
+	if err != nil {
+		ratelog.Println(context.Logger, err)
+		return
 	}
-	context.Games[newGameInfo.GameId] = newGameInfo
 
-	player, err := state.PlayerGetByAddr(context, packet.SrcAddr, false)
-	if err == nil {
-		if player.GameId != newGameInfo.GameId {
-			state.PlayerJoinGame(context, player.ProxyPort, newGameInfo.GameId, false)
+	var player state.Player
+	newPlayer := false
+	accepted := false
+	unlisted := false
+	state.Do(context, func(s *state.State) {
+		state.ScheduleClaim(s, newGameInfo)
+
+		var err error
+		player, err = state.PlayerGetByAddr(s, packet.SrcAddr)
+		if err != nil {
+			player, err = state.PlayerReconnect(s, packet.SrcAddr, nil)
 		}
-		if player.NatPort != trackerPort {
-			state.PlayerSetNatPort(context, util.PlayerAddr{IpAddr: player.IpAddr.String(), IpPort: player.IpPort, ProxyPort: player.ProxyPort}, trackerPort, false)
+		if err != nil {
+			err := state.PlayerLimitError(s, packet.SrcAddr.IP, newGameInfo.GameId)
+			if err != nil {
+				state.PlayerRefuse(s, packet.SrcAddr, newGameInfo.GameId, err)
+				return
+			}
+		} else if err := state.GameLimitError(s, newGameInfo.GameId); err != nil {
+			// an existing player hosting a new game
+			state.PlayerRefuse(s, packet.SrcAddr, newGameInfo.GameId, err)
+			return
 		}
-	} else {
-		player = state.PlayerNew(context, packet.SrcAddr, newGameInfo.GameId, trackerPort, false)
-		playerPongChannel <- util.PlayerAddr{IpAddr: player.IpAddr.String(), IpPort: player.IpPort, ProxyPort: player.ProxyPort}
-		go pingGameInfo(context.UdpConnection, player, context.ShutdownChannel)
+
+		newGame := false
+		newGameInfo.LastSeen = context.Clock.Now()
+		gameInfo, ok := s.Games[newGameInfo.GameId]
+		if ok {
+			newGameInfo.ServerStartTimestamp = gameInfo.ServerStartTimestamp
+		} else {
+			newGameInfo.ServerStartTimestamp = context.Clock.Now()
+			newGame = true
+			context.Logger.Print(bolo.SprintGameInfo(newGameInfo))
+		}
+		s.Games[newGameInfo.GameId] = newGameInfo
 		if newGame {
-			state.PlayerSetId(context, util.PlayerAddr{IpAddr: player.IpAddr.String(), IpPort: player.IpPort, ProxyPort: player.ProxyPort}, 0, false)
+			context.Events.Publish(events.Event{Type: events.GameStarted, GameId: newGameInfo.GameId})
 		}
-		state.PrintServerState(context, false)
+
+		if err == nil {
+			if !player.DisconnectedAt.IsZero() {
+				state.PlayerResume(s, player.ProxyPort)
+			}
+			if player.GameId != newGameInfo.GameId {
+				state.PlayerJoinGame(s, player.ProxyPort, newGameInfo.GameId)
+			}
+			if player.NatPort != trackerPort {
+				state.PlayerSetNatPort(s, util.PlayerAddr{IpAddr: player.IpAddr.String(), IpPort: player.IpPort, ProxyPort: player.ProxyPort}, trackerPort)
+			}
+		} else {
+			player, err = state.PlayerNew(s, packet.SrcAddr, newGameInfo.GameId, trackerPort, newGameInfo.Version)
+			if err != nil {
+				state.PlayerRefuse(s, packet.SrcAddr, newGameInfo.GameId, err)
+				return
+			}
+			newPlayer = true
+			if newGame {
+				state.PlayerSetId(s, util.PlayerAddr{IpAddr: player.IpAddr.String(), IpPort: player.IpPort, ProxyPort: player.ProxyPort}, 0)
+			}
+			state.PrintServerState(s)
+		}
+		if newGame {
+			state.GameSetHost(s, newGameInfo.GameId, player.ProxyPort)
+		}
+		accepted = true
+		unlisted = state.GameUnlisted(s, newGameInfo.GameId)
+	})
+
+	if accepted && !unlisted && externalTracker != nil {
+		forwardToExternalTracker(player, externalTracker, packet)
+	}
+
+	if newPlayer {
+		playerPongChannel <- util.PlayerAddr{IpAddr: player.IpAddr.String(), IpPort: player.IpPort, ProxyPort: player.ProxyPort}
+		go pingGameInfo(context, player)
 	}
 }
 
 func pingGameInfo(
-	connection *net.UDPConn,
+	context *state.ServerContext,
 	player state.Player,
-	shutdownChannel chan struct{},
 ) {
-	gameInfoPingSeconds := config.GetValueInt("game_info_ping_seconds")
-	ticker := time.NewTicker(time.Duration(gameInfoPingSeconds) * time.Second)
+	defer state.RecoverPlayer(context, "pinging", player.Route.PlayerAddr())
+
+	ctx := context.Network.Ctx
+	gameInfoPingSeconds := context.Config.GetValueInt("game_info_ping_seconds")
+	ticker := context.Clock.NewTicker(time.Duration(gameInfoPingSeconds) * time.Second)
 
 	for {
 		select {
-		case <-player.DisconnectChannel:
-			fmt.Println("Stopped pinging player", player.ProxyPort)
+		case <-player.Ctx.Done():
+			context.Logger.Println("Stopped pinging player", player.ProxyPort)
 			ticker.Stop()
 			return
-		case <-shutdownChannel:
-			fmt.Println("Stopped pinging player", player.ProxyPort)
+		case <-ctx.Done():
+			context.Logger.Println("Stopped pinging player", player.ProxyPort)
 			ticker.Stop()
 			return
-		case <-ticker.C:
-			buffer := bolo.MarshalPacketTypeD()
-			dstAddr := &net.UDPAddr{IP: player.IpAddr, Port: player.IpPort}
-			connection.WriteToUDP(buffer, dstAddr)
+		case <-ticker.C():
+			// a simulation has no tracker socket to ping from, only a clock
+			if len(context.UdpConnections) > 0 {
+				buffer := bolo.MarshalPacketTypeD()
+				// the route follows the player if their address migrates
+				dstAddr := player.Route.PlayerAddr()
+				proxy.SelectConnection(context.UdpConnections, dstAddr.IP).WriteToUDP(buffer, &dstAddr)
+			}
+			state.Do(context, func(s *state.State) {
+				state.PlayerPingSent(s, player.ProxyPort)
+			})
 		}
 	}
 }
 
+// pingTimeout times players out when nothing has been heard from them for
+// player_timeout_seconds, plus player_timeout_rtt_multiplier times their
+// round trip time so that players on slow links get more slack.
 func pingTimeout(
+	context *state.ServerContext,
 	wg *sync.WaitGroup,
-	shutdownChannel chan struct{},
 	playerPongChannel chan util.PlayerAddr,
 	playerPingTimeoutChannel chan util.PlayerAddr,
 ) {
 	defer wg.Done()
-	playerTimeoutDuration := time.Duration(config.GetValueInt("player_timeout_seconds")) * time.Second
+	ctx := context.Network.Ctx
+	playerTimeoutDuration := time.Duration(context.Config.GetValueInt("player_timeout_seconds")) * time.Second
+	rttMultiplier := time.Duration(context.Config.GetValueInt("player_timeout_rtt_multiplier"))
 	mapPlayerTimestamp := make(map[util.PlayerAddr]time.Time)
-	ticker := time.NewTicker(playerTimeoutDuration / 4)
+	ticker := context.Clock.NewTicker(playerTimeoutDuration / 4)
 
 	for {
 		select {
-		case <-shutdownChannel:
+		case <-ctx.Done():
 			ticker.Stop()
 			return
 		case playerAddr := <-playerPongChannel:
-			mapPlayerTimestamp[playerAddr] = time.Now()
-		case <-ticker.C:
+			mapPlayerTimestamp[playerAddr] = context.Clock.Now()
+		case now := <-ticker.C():
+			var expired []util.PlayerAddr
 			for playerAddr, timestamp := range mapPlayerTimestamp {
-				if time.Now().After(timestamp.Add(playerTimeoutDuration)) {
+				if now.After(timestamp.Add(playerTimeoutDuration)) {
+					expired = append(expired, playerAddr)
+				}
+			}
+
+			var rtts map[util.PlayerAddr]time.Duration
+			if rttMultiplier > 0 && len(expired) > 0 {
+				state.Do(context, func(s *state.State) {
+					rtts = state.PlayerRtts(s, expired)
+				})
+			}
+
+			for _, playerAddr := range expired {
+				timeout := playerTimeoutDuration + rttMultiplier*rtts[playerAddr]
+				if now.After(mapPlayerTimestamp[playerAddr].Add(timeout)) {
 					playerPingTimeoutChannel <- playerAddr
 					delete(mapPlayerTimestamp, playerAddr)
 				}
@@ -18,50 +18,55 @@
 package tracker
 
 import (
-	"fmt"
-	"net"
+	"context"
+	"log"
 	"strings"
 	"sync"
 
+	"git.astrospark.com/bolorama/config"
 	"git.astrospark.com/bolorama/proxy"
-	"git.astrospark.com/bolorama/util"
 )
 
-func udpListener(wg *sync.WaitGroup, shutdownChannel chan struct{}, connection *net.UDPConn, port int, dataChannel chan proxy.UdpPacket) {
+func udpListener(ctx context.Context, wg *sync.WaitGroup, logger *log.Logger, connection proxy.PacketConn, port int, dataChannel chan proxy.UdpPacket) {
 	defer wg.Done()
 
-	buffer := make([]byte, util.MaxUdpPacketSize)
-
 	go func() {
-		for {
-			_, ok := <-shutdownChannel
-			if !ok {
-				connection.Close()
-				break
-			}
-		}
+		<-ctx.Done()
+		connection.Close()
 	}()
 
-	fmt.Println("Listening on UDP port", port)
+	logger.Println("Listening on UDP port", port)
+
+	reader, err := proxy.NewBatchReader(connection, config.GetValueInt("udp_batch_size"), logger)
+	if err != nil {
+		logger.Println(err)
+		return
+	}
+	defer reader.Close()
+
+	guard := getFloodGuard()
 
 	for {
-		n, addr, err := connection.ReadFromUDP(buffer)
+		packets, err := reader.Read()
 		if err != nil {
 			if !strings.HasSuffix(err.Error(), "use of closed network connection") {
-				fmt.Println(err)
+				logger.Println(err)
 			}
-			fmt.Println("Stopped listening on UDP port", port)
+			logger.Println("Stopped listening on UDP port", port)
 			break
 		}
 
-		data := make([]byte, n)
-		copy(data, buffer)
-		dataChannel <- proxy.UdpPacket{
-			SrcAddr: *addr,
-			DstAddr: net.UDPAddr{},
-			DstPort: port,
-			Len:     n,
-			Buffer:  data,
+		for _, packet := range packets {
+			if !guard.allowPacket(packet, logger) {
+				packet.Release()
+				continue
+			}
+			packet.DstPort = port
+			select {
+			case dataChannel <- packet:
+			case <-ctx.Done():
+				packet.Release()
+			}
 		}
 	}
 }
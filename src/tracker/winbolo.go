@@ -0,0 +1,72 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tracker
+
+import (
+	"time"
+
+	"git.astrospark.com/bolorama/bolo"
+	"git.astrospark.com/bolorama/events"
+	"git.astrospark.com/bolorama/proxy"
+	"git.astrospark.com/bolorama/ratelog"
+	"git.astrospark.com/bolorama/state"
+)
+
+// handleWinBoloInfoPacket lists or refreshes a game hosted on a WinBolo
+// server. Players connect to the server directly, so no proxy is set up.
+func handleWinBoloInfoPacket(context *state.ServerContext, packet proxy.UdpPacket) {
+	newGameInfo, err := bolo.ParsePacketWinBoloInfo(packet.Buffer[:packet.Len], packet.SrcAddr.IP)
+	if err != nil {
+		ratelog.Println(context.Logger, err)
+		return
+	}
+
+	newGameInfo.LastSeen = context.Clock.Now()
+	state.Do(context, func(s *state.State) {
+		gameInfo, ok := s.Games[newGameInfo.GameId]
+		if ok {
+			newGameInfo.ServerStartTimestamp = gameInfo.ServerStartTimestamp
+		} else {
+			newGameInfo.ServerStartTimestamp = newGameInfo.LastSeen
+			context.Logger.Print(bolo.SprintGameInfo(newGameInfo))
+		}
+		s.Games[newGameInfo.GameId] = newGameInfo
+		if !ok {
+			context.Events.Publish(events.Event{Type: events.GameStarted, GameId: newGameInfo.GameId})
+		}
+	})
+}
+
+// expireDirectGames removes WinBolo games whose server has not checked in
+// for winBoloTimeout as of now, and pure tracker games whose host has not
+// answered for hostTimeout.
+func expireDirectGames(s *state.State, now time.Time, winBoloTimeout time.Duration, hostTimeout time.Duration) int {
+	var expired []bolo.GameId
+	for gameId, gameInfo := range s.Games {
+		if gameInfo.WinBoloServer != nil && now.Sub(gameInfo.LastSeen) > winBoloTimeout {
+			expired = append(expired, gameId)
+		} else if gameInfo.DirectHost != nil && now.Sub(gameInfo.LastSeen) > hostTimeout {
+			expired = append(expired, gameId)
+		}
+	}
+
+	for _, gameId := range expired {
+		state.GameDelete(s, gameId)
+	}
+	return len(expired)
+}
@@ -18,15 +18,10 @@
 package util
 
 import (
-	"log"
 	"net"
 	"time"
 )
 
-// The largest safe UDP packet length is 576 for IPv4 and 1280 for IPv6, where
-// "safe" is defined as “guaranteed to be able to be reassembled, if fragmented."
-const MaxUdpPacketSize = 1024
-
 type PlayerAddr struct {
 	IpAddr    string
 	IpPort    int
@@ -37,21 +32,48 @@ type PlayerInfoEvent struct {
 	PlayerAddr PlayerAddr
 	SetId      bool
 	SetName    bool
+	Chat       bool
 	PlayerId   int
 	Name       string
+	Message    string // if Chat
 }
 
 // get preferred outbound ip of this machine
-func GetOutboundIp() net.IP {
+func GetOutboundIp() (net.IP, error) {
 	conn, err := net.Dial("udp", "1.1.1.1:1")
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	defer conn.Close()
 
 	localAddr := conn.LocalAddr().(*net.UDPAddr)
 
-	return localAddr.IP
+	return localAddr.IP, nil
+}
+
+// GetLocalIpFor returns this machine's IPv4 address on the network that
+// contains ip, or nil if ip is not on a directly attached network.
+func GetLocalIpFor(ip net.IP) net.IP {
+	ip = ip.To4()
+	if ip == nil {
+		return nil
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.To4() == nil {
+			continue
+		}
+		if ipNet.Contains(ip) {
+			return ipNet.IP.To4()
+		}
+	}
+	return nil
 }
 
 func MaxInt(a int, b int) int {
@@ -77,3 +99,13 @@ func ContainsString(strings []string, target string) bool {
 
 	return false
 }
+
+func ContainsInt(ints []int, target int) bool {
+	for _, element := range ints {
+		if element == target {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,135 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package web
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"git.astrospark.com/bolorama/config"
+	"git.astrospark.com/bolorama/util"
+)
+
+// API clients authenticate with a bearer token from api_tokens, a comma
+// separated list of name:role:token entries, e.g. "scoreboard:read:...". Each
+// role may do what the roles before it may.
+
+type role int
+
+const (
+	roleNone role = iota
+	roleRead
+	roleModerator
+	roleAdmin
+)
+
+var roleNames = map[string]role{
+	"read":      roleRead,
+	"moderator": roleModerator,
+	"admin":     roleAdmin,
+}
+
+type apiToken struct {
+	name  string
+	role  role
+	token string
+}
+
+// apiTokens parses api_tokens.
+func apiTokens() ([]apiToken, error) {
+	var tokens []apiToken
+	for _, item := range config.GetValueList("api_tokens") {
+		s := strings.SplitN(item, ":", 3)
+		if len(s) < 3 || roleNames[s[1]] == roleNone || s[2] == "" {
+			return nil, fmt.Errorf("malformed api_tokens entry for: %s", s[0])
+		}
+		tokens = append(tokens, apiToken{name: s[0], role: roleNames[s[1]], token: s[2]})
+	}
+	return tokens, nil
+}
+
+// authenticate returns the client named by the request's bearer token, or
+// false if there is none or it is not known.
+func authenticate(tokens []apiToken, r *http.Request) (apiToken, bool) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return apiToken{}, false
+	}
+	presented := []byte(strings.TrimSpace(strings.TrimPrefix(header, "Bearer ")))
+	for _, token := range tokens {
+		if subtle.ConstantTimeCompare(presented, []byte(token.token)) == 1 {
+			return token, true
+		}
+	}
+	return apiToken{}, false
+}
+
+// authorize returns the client if it holds at least the role, otherwise
+// responds 401 or 403 and returns false.
+func authorize(tokens []apiToken, w http.ResponseWriter, r *http.Request, minimum role) (apiToken, bool) {
+	token, ok := authenticate(tokens, r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="bolorama"`)
+		http.Error(w, "a valid bearer token is required", http.StatusUnauthorized)
+		return token, false
+	}
+	if token.role < minimum {
+		http.Error(w, "the token's role does not allow this", http.StatusForbidden)
+		return token, false
+	}
+	return token, true
+}
+
+// actor names the client in the audit log.
+func (token apiToken) actor() string {
+	return fmt.Sprintf("api %s", token.name)
+}
+
+// cors lets the pages of cors_origins ("*" for any) call the API from the
+// browser, with an Authorization header if they have a token.
+func cors(next http.Handler) http.Handler {
+	origins := config.GetValueList("cors_origins")
+	if len(origins) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		if util.ContainsString(origins, "*") {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else if util.ContainsString(origins, origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+			// preflight
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
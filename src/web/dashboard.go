@@ -0,0 +1,248 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"git.astrospark.com/bolorama/admin"
+	"git.astrospark.com/bolorama/state"
+)
+
+// The dashboard at /admin is a page that drives the admin API with the
+// bearer token the operator enters:
+//
+//	GET /api/admin/status    the server, its games and routes (read), as
+//	                         admin.Status
+//	POST /api/admin/command  {"command": "kick 40001 1d # camping"}, a console
+//	                         command, answered {"output": "..."}
+//
+// Commands are recorded in the audit log under the token's name.
+
+// the role each console command needs; the others need roleAdmin
+var commandRoles = map[string]role{
+	"help":        roleRead,
+	"status":      roleRead,
+	"kick":        roleModerator,
+	"unkick":      roleModerator,
+	"ban":         roleModerator,
+	"shadowban":   roleModerator,
+	"unshadowban": roleModerator,
+	"mute":        roleModerator,
+	"unmute":      roleModerator,
+	"tag":         roleModerator,
+	"untag":       roleModerator,
+	"title":       roleModerator,
+	"unlist":      roleModerator,
+	"list":        roleModerator,
+	"dedup":       roleModerator,
+	"schedule":    roleModerator,
+	"broadcast":   roleModerator,
+}
+
+func handleAdminStatus(context *state.ServerContext, tokens []apiToken, w http.ResponseWriter, r *http.Request) {
+	if _, ok := authorize(tokens, w, r, roleRead); !ok {
+		return
+	}
+	context, ok := selectTracker(context, w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(admin.CollectStatus(context))
+}
+
+type commandRequest struct {
+	Command string `json:"command"`
+	Output  string `json:"output"`
+}
+
+func handleAdminCommand(context *state.ServerContext, tokens []apiToken, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var request commandRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fields := strings.Fields(request.Command)
+	if len(fields) == 0 {
+		http.Error(w, "no command", http.StatusBadRequest)
+		return
+	}
+
+	// a command for a tracker set in trackers needs the role of the command
+	name := fields[0]
+	if strings.HasPrefix(name, "@") && len(fields) > 1 {
+		name = fields[1]
+	}
+	minimum, ok := commandRoles[name]
+	if !ok {
+		minimum = roleAdmin
+	}
+	token, ok := authorize(tokens, w, r, minimum)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(commandRequest{
+		Command: request.Command,
+		Output:  admin.Execute(context, token.actor(), fields),
+	})
+}
+
+func handleDashboard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(kDashboardPage))
+}
+
+const kDashboardPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Bolorama Admin</title>
+<style>
+body { font-family: sans-serif; }
+td, th { padding: 2px 8px; text-align: left; }
+pre { background: #eee; padding: 8px; white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<h1>Bolorama Admin</h1>
+<form id="login"><input id="token" type="password" placeholder="API token" size="40"> <button>Use token</button></form>
+<p id="server"></p>
+<table>
+<thead><tr><th>Port</th><th>Name</th><th>Game</th><th>Address</th><th>Version</th><th>RTT</th><th>Idle</th><th>Queued</th><th>Dropped</th><th>Tags</th><th></th></tr></thead>
+<tbody id="routes"></tbody>
+</table>
+<h2>Broadcast</h2>
+<form id="broadcast"><input id="message" size="60" placeholder="message shown at the top of the tracker listing"> <button>Broadcast</button> <button type="button" id="clear">Clear</button></form>
+<h2>Trace</h2>
+<form id="trace"><input id="filter" size="60" placeholder="e.g. port=40001 type=13"> <button>Add filter</button> <button type="button" id="untrace">Clear filters</button></form>
+<h2>Console</h2>
+<form id="console"><input id="command" size="60" placeholder="help"> <button>Run</button></form>
+<pre id="output"></pre>
+<script>
+var token = sessionStorage.getItem("token") || "";
+
+function api(method, path, body) {
+	return fetch(path, {
+		method: method,
+		headers: {"Authorization": "Bearer " + token, "Content-Type": "application/json"},
+		body: body && JSON.stringify(body)
+	}).then(function (response) {
+		if (!response.ok) {
+			return response.text().then(function (text) { throw new Error(text); });
+		}
+		return response.json();
+	});
+}
+
+function run(command) {
+	return api("POST", "/api/admin/command", {command: command}).then(function (result) {
+		document.getElementById("output").textContent = "> " + command + "\n" + result.output;
+		refresh();
+	}).catch(function (error) {
+		document.getElementById("output").textContent = error.message;
+	});
+}
+
+function cell(row, text) {
+	row.insertCell().textContent = text;
+}
+
+function button(row, label, command) {
+	var b = document.createElement("button");
+	b.textContent = label;
+	b.onclick = function () {
+		var reason = prompt(label + ": reason for the audit log (optional)");
+		if (reason !== null) {
+			run(command + (reason ? " # " + reason : ""));
+		}
+	};
+	row.lastChild.appendChild(b);
+}
+
+function refresh() {
+	if (!token) {
+		return;
+	}
+	api("GET", "/api/admin/status").then(function (status) {
+		var server = status.games.length + " games, " + status.routes.length + " players, " + status.drain;
+		if (status.restart) {
+			server += ", restart at " + new Date(status.restart).toLocaleString();
+		}
+		if (status.broadcast) {
+			server += ", broadcasting: " + status.broadcast;
+		}
+		document.getElementById("server").textContent = server;
+
+		var body = document.getElementById("routes");
+		body.innerHTML = "";
+		status.routes.forEach(function (route) {
+			var row = body.insertRow();
+			cell(row, route.proxy_port);
+			cell(row, route.name + (route.disconnected ? " (disconnected)" : ""));
+			cell(row, route.game_id.substring(0, 8));
+			cell(row, route.address);
+			cell(row, route.version);
+			cell(row, route.rtt_ms ? route.rtt_ms + " ms" : "");
+			cell(row, route.idle_seconds + " s");
+			cell(row, route.queued_packets);
+			cell(row, route.dropped_packets);
+			cell(row, (route.tags || []).join(", "));
+			row.insertCell();
+			button(row, "Kick", "kick " + route.proxy_port);
+			button(row, "Ban", "kick " + route.proxy_port + " 7d");
+			button(row, "Mute", "mute " + route.proxy_port);
+			button(row, "Trace", "trace add port=" + route.proxy_port);
+		});
+	}).catch(function (error) {
+		document.getElementById("server").textContent = error.message;
+	});
+}
+
+function onSubmit(id, handler) {
+	document.getElementById(id).onsubmit = function (event) {
+		event.preventDefault();
+		handler();
+	};
+}
+
+onSubmit("login", function () {
+	token = document.getElementById("token").value;
+	sessionStorage.setItem("token", token);
+	refresh();
+});
+onSubmit("broadcast", function () { run("broadcast " + document.getElementById("message").value); });
+onSubmit("trace", function () { run("trace add " + document.getElementById("filter").value); });
+onSubmit("console", function () { run(document.getElementById("command").value); });
+document.getElementById("clear").onclick = function () { run("broadcast clear"); };
+document.getElementById("untrace").onclick = function () { run("trace clear"); };
+
+refresh();
+setInterval(refresh, 2000);
+</script>
+</body>
+</html>
+`
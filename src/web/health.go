@@ -0,0 +1,121 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"git.astrospark.com/bolorama/proxy"
+	"git.astrospark.com/bolorama/state"
+)
+
+// /healthz answers whether the server is alive: the state goroutine, which
+// everything else waits on, still services requests. /readyz also requires
+// the tracker port to be bound, the server not to be draining and proxy ports
+// to be free for new players, so
+// an orchestrator can stop sending players to a server that cannot take them.
+// Both answer 200 or 503 with the result of each check.
+
+const kHealthTimeout = 2 * time.Second
+
+// ports left for new players below which the server is not ready
+const kMinFreePlayerPorts = 16
+
+type healthCheck struct {
+	Ok     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type health struct {
+	Ok     bool                   `json:"ok"`
+	Checks map[string]healthCheck `json:"checks"`
+}
+
+func handleHealth(context *state.ServerContext, w http.ResponseWriter, r *http.Request, ready bool) {
+	result := health{Ok: true, Checks: make(map[string]healthCheck)}
+	add := func(name string, check healthCheck) {
+		result.Checks[name] = check
+		result.Ok = result.Ok && check.Ok
+	}
+
+	portsInUse, draining, responded := checkState(context)
+	if responded {
+		add("state", healthCheck{Ok: true})
+	} else {
+		add("state", healthCheck{Ok: false, Detail: fmt.Sprintf("no response within %s", kHealthTimeout)})
+	}
+
+	if ready {
+		add("udp", checkUdp(context))
+		if responded {
+			add("drain", healthCheck{Ok: !draining})
+			free := proxy.MaxPlayerPorts - portsInUse
+			add("ports", healthCheck{
+				Ok:     free >= kMinFreePlayerPorts,
+				Detail: fmt.Sprintf("%d of %d in use", portsInUse, proxy.MaxPlayerPorts),
+			})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !result.Ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// checkState returns the proxy ports in use and whether the server is
+// draining, or false if the state goroutine did not answer in time.
+func checkState(context *state.ServerContext) (int, bool, bool) {
+	type result struct {
+		portsInUse int
+		draining   bool
+	}
+	done := make(chan result, 1)
+	go func() {
+		state.Do(context, func(s *state.State) {
+			done <- result{context.Ports.PlayerPortsInUse(), state.ServerDraining(s)}
+		})
+	}()
+
+	select {
+	case r := <-done:
+		return r.portsInUse, r.draining, true
+	case <-time.After(kHealthTimeout):
+		return 0, false, false
+	}
+}
+
+func checkUdp(context *state.ServerContext) healthCheck {
+	if context.Network.Ctx.Err() != nil {
+		return healthCheck{Ok: false, Detail: "shutting down"}
+	}
+	if len(context.UdpConnections) == 0 {
+		return healthCheck{Ok: false, Detail: "tracker port is not bound"}
+	}
+	for _, connection := range context.UdpConnections {
+		if connection == nil || connection.LocalAddr() == nil {
+			return healthCheck{Ok: false, Detail: "tracker port is not bound"}
+		}
+	}
+	return healthCheck{Ok: true, Detail: fmt.Sprintf("port %d on %d addresses", context.ProxyPort, len(context.UdpConnections))}
+}
@@ -0,0 +1,91 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package web
+
+import (
+	"encoding/hex"
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"sync"
+
+	"git.astrospark.com/bolorama/metrics"
+	"git.astrospark.com/bolorama/state"
+)
+
+// Profiler serves net/http/pprof and expvar on pprof_port, on the loopback
+// interface only, so profiles and counters can be taken from a server that
+// lags under load (e.g. go tool pprof http://127.0.0.1:<port>/debug/pprof/profile).
+func Profiler(context *state.ServerContext, listeners *Listeners) {
+	defer context.Network.WaitGroup.Done()
+
+	if listeners.pprof == nil {
+		return
+	}
+
+	publishVars(context)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go listen(context, &wg, listeners.pprof, &http.Server{Handler: mux}, "pprof")
+	wg.Wait()
+}
+
+// publishVars adds the registered metrics (see the metrics package) to
+// /debug/vars, next to expvar's own cmdline and memstats. latency_by_game has
+// each game's histogram of the time forwarded packets spend in the proxy, like
+// latency has for all games, with the upper bounds of the buckets in
+// latency_bounds_us and one more, unbounded, bucket at the end.
+func publishVars(context *state.ServerContext) {
+	for _, metric := range metrics.All() {
+		metric := metric
+		if metric.Kind == metrics.KindHistogram {
+			expvar.Publish(metric.Name, expvar.Func(func() interface{} {
+				return metric.Histogram()
+			}))
+		} else {
+			expvar.Publish(metric.Name, expvar.Func(func() interface{} {
+				return metric.Value()
+			}))
+		}
+	}
+	expvar.Publish("latency_bounds_us", expvar.Func(func() interface{} {
+		bounds := make([]int64, len(metrics.Bounds))
+		for i, bound := range metrics.Bounds {
+			bounds[i] = bound.Microseconds()
+		}
+		return bounds
+	}))
+	expvar.Publish("latency_by_game", expvar.Func(func() interface{} {
+		latencies := make(map[string]metrics.HistogramSnapshot)
+		state.Do(context, func(s *state.State) {
+			for gameId, snapshot := range state.GameLatencies(s) {
+				latencies[hex.EncodeToString(gameId[:])] = snapshot
+			}
+		})
+		return latencies
+	}))
+}
@@ -0,0 +1,732 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package web
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.astrospark.com/bolorama/accounts"
+	"git.astrospark.com/bolorama/acme"
+	"git.astrospark.com/bolorama/config"
+	"git.astrospark.com/bolorama/data"
+	"git.astrospark.com/bolorama/federation"
+	"git.astrospark.com/bolorama/geoip"
+	"git.astrospark.com/bolorama/state"
+	"git.astrospark.com/bolorama/tournament"
+	"git.astrospark.com/bolorama/tracker"
+)
+
+const kShutdownTimeout = 5 * time.Second
+
+// Game is the API representation of a listed game.
+type Game struct {
+	GameId         string   `json:"game_id"`
+	Title          string   `json:"title,omitempty"`
+	Host           string   `json:"host"`
+	Port           int      `json:"port"`
+	MapName        string   `json:"map_name"`
+	Version        string   `json:"version"`
+	GameType       string   `json:"game_type"`
+	HiddenMines    bool     `json:"hidden_mines"`
+	Bots           bool     `json:"bots"`
+	Password       bool     `json:"password"`
+	PlayerCount    int      `json:"player_count"`
+	NeutralPills   int      `json:"neutral_pills"`
+	NeutralBases   int      `json:"neutral_bases"`
+	Players        []string `json:"players"`
+	TrackedMinutes int      `json:"tracked_minutes"`
+	Continent      string   `json:"continent"`
+	Country        string   `json:"country"`
+	Region         string   `json:"region"`
+	Remote         bool     `json:"remote"`
+	Match          string   `json:"match,omitempty"` // the tournament match being played
+}
+
+// Tracker is the API representation of the main tracker, with an empty name,
+// or one set in trackers.
+type Tracker struct {
+	Name    string `json:"name"`
+	Port    int    `json:"port"`
+	Games   int    `json:"games"`
+	Players int    `json:"players"`
+}
+
+// LeaderboardPlayer is the API representation of a player's totals.
+type LeaderboardPlayer struct {
+	Name        string `json:"name"`
+	Sessions    int    `json:"sessions"`
+	PlayMinutes int    `json:"play_minutes"`
+	GamesHosted int    `json:"games_hosted"`
+	LastSeen    string `json:"last_seen"` // UTC, as stored
+}
+
+const kLeaderboardSize = 20
+
+// limits on games scheduled through the API (see public_scheduling)
+const kMaxScheduleAhead = 7 * 24 * time.Hour
+const kMaxMapNameLength = 35
+const kMaxPlayers = 16
+
+var gameTypeName = map[int]string{
+	1: "Open Game",
+	2: "Tournament",
+	3: "Strict Tournament",
+}
+
+// Listeners are the web server's and the profiler's ports, bound by Listen
+// before they run so that a port in use stops the server from starting, and
+// the API tokens, which Listen also checks.
+type Listeners struct {
+	http   net.Listener
+	https  net.Listener
+	pprof  net.Listener
+	tokens []apiToken
+}
+
+// Listen parses api_tokens and binds http_port, https_port and pprof_port,
+// those that are set.
+func Listen() (*Listeners, error) {
+	tokens, err := apiTokens()
+	if err != nil {
+		return nil, err
+	}
+	listeners := &Listeners{tokens: tokens}
+	ports := []struct {
+		name     string
+		host     string
+		listener *net.Listener
+	}{
+		{"http_port", "", &listeners.http},
+		{"https_port", "", &listeners.https},
+		{"pprof_port", "127.0.0.1", &listeners.pprof},
+	}
+	for _, port := range ports {
+		number := config.GetValueInt(port.name)
+		if number <= 0 {
+			continue
+		}
+		listener, err := net.Listen("tcp4", fmt.Sprint(port.host, ":", number))
+		if err != nil {
+			listeners.Close()
+			return nil, fmt.Errorf("%s: %s", port.name, err)
+		}
+		*port.listener = listener
+	}
+	return listeners, nil
+}
+
+// Close closes the ports, for a server that fails to start after binding
+// them. Server and Profiler close their own ports on shutdown.
+func (listeners *Listeners) Close() {
+	for _, listener := range []net.Listener{listeners.http, listeners.https, listeners.pprof} {
+		if listener != nil {
+			listener.Close()
+		}
+	}
+}
+
+// Server serves the game listing as a web page and as JSON, along with the
+// player leaderboard and rankings if statistics are enabled, and health checks
+// (see health.go). Also serves HTTPS on https_port, with a certificate from
+// Let's Encrypt or another ACME CA. Does nothing unless either port is set.
+func Server(context *state.ServerContext, listeners *Listeners) {
+	defer context.Network.WaitGroup.Done()
+
+	if listeners.http == nil && listeners.https == nil {
+		return
+	}
+
+	tokens := listeners.tokens
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		handleIndex(context, w, r)
+	})
+	if db := context.Db; db != nil {
+		mux.HandleFunc("/api/leaderboard", func(w http.ResponseWriter, r *http.Request) {
+			players, err := leaderboard(db)
+			if err != nil {
+				internalError(context, w, err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(players)
+		})
+		mux.HandleFunc("/api/rankings", func(w http.ResponseWriter, r *http.Request) {
+			players, err := rankings(db)
+			if err != nil {
+				internalError(context, w, err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(players)
+		})
+		if config.GetValueBool("accounts") {
+			mux.HandleFunc("/api/register", func(w http.ResponseWriter, r *http.Request) {
+				handleRegister(context, db, w, r)
+			})
+			mux.HandleFunc("/api/login", func(w http.ResponseWriter, r *http.Request) {
+				handleLogin(context, db, w, r)
+			})
+		}
+	}
+	mux.HandleFunc("/api/schedule", func(w http.ResponseWriter, r *http.Request) {
+		handleSchedule(context, tokens, w, r)
+	})
+	mux.HandleFunc("/api/tournament", func(w http.ResponseWriter, r *http.Request) {
+		context, ok := selectTracker(context, w, r)
+		if !ok {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tournament.Current(context))
+	})
+	mux.HandleFunc("/api/games", func(w http.ResponseWriter, r *http.Request) {
+		handleGames(context, w, r)
+	})
+	mux.HandleFunc("/api/trackers", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(listTrackers(context))
+	})
+	mux.HandleFunc("/admin", handleDashboard)
+	mux.HandleFunc("/api/admin/status", func(w http.ResponseWriter, r *http.Request) {
+		handleAdminStatus(context, tokens, w, r)
+	})
+	mux.HandleFunc("/api/admin/command", func(w http.ResponseWriter, r *http.Request) {
+		handleAdminCommand(context, tokens, w, r)
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		handleHealth(context, w, r, false)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		handleHealth(context, w, r, true)
+	})
+	if config.GetValueBool("federation") {
+		mux.HandleFunc(federation.ListingPath, federation.HandleListing(context))
+	}
+
+	var certManager *acme.Manager
+	if listeners.https != nil {
+		certManager = newCertManager(context)
+		mux.HandleFunc(acme.ChallengePath, certManager.ServeChallenge)
+		go certManager.Run(context.Network.Ctx)
+	}
+
+	wg := sync.WaitGroup{}
+	if listeners.http != nil {
+		wg.Add(1)
+		go listen(context, &wg, listeners.http, &http.Server{Handler: cors(mux)}, "HTTP")
+	}
+	if listeners.https != nil {
+		wg.Add(1)
+		go listen(context, &wg, listeners.https, &http.Server{Handler: cors(mux), TLSConfig: certManager.TLSConfig()}, "HTTPS")
+	}
+	wg.Wait()
+}
+
+// newCertManager returns the manager of the certificate for https_port, for
+// acme_domains or else the hostname.
+func newCertManager(context *state.ServerContext) *acme.Manager {
+	domains := config.GetValueList("acme_domains")
+	if len(domains) == 0 {
+		domains = []string{config.GetValueString("hostname")}
+	}
+	challenge := config.GetValueString("acme_challenge")
+	if challenge == acme.ChallengeHttp && config.GetValueInt("http_port") <= 0 {
+		context.Logger.Println("acme_challenge http-01 needs http_port, reached from port 80")
+	}
+	return &acme.Manager{
+		DirectoryUrl:   config.GetValueString("acme_directory_url"),
+		Email:          config.GetValueString("acme_email"),
+		Domains:        domains,
+		CacheDirectory: config.GetValueString("acme_cache_directory"),
+		Challenge:      challenge,
+		Logger:         context.Logger,
+	}
+}
+
+// listen serves on listener until shutdown, over TLS if the server has a
+// TLSConfig.
+func listen(context *state.ServerContext, wg *sync.WaitGroup, listener net.Listener, server *http.Server, name string) {
+	defer wg.Done()
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	context.Logger.Println("Listening on", name, "port", port)
+
+	go func() {
+		<-context.Network.Ctx.Done()
+		shutdown(server)
+	}()
+
+	var err error
+	if server.TLSConfig != nil {
+		err = server.ServeTLS(listener, "", "")
+	} else {
+		err = server.Serve(listener)
+	}
+	if err != http.ErrServerClosed {
+		context.Logger.Println(err)
+	}
+	context.Logger.Println("Stopped listening on", name, "port", port)
+}
+
+// internalError logs err and responds with a 500, without showing the client
+// what went wrong.
+func internalError(context *state.ServerContext, w http.ResponseWriter, err error) {
+	context.Logger.Println("Web:", err)
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
+
+func shutdown(server *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), kShutdownTimeout)
+	defer cancel()
+	server.Shutdown(ctx)
+}
+
+func listGames(context *state.ServerContext) []Game {
+	hostname := config.GetValueString("hostname")
+
+	var listed []tracker.ListedGame
+	state.Do(context, func(s *state.State) {
+		listed = tracker.ListGames(s, hostname)
+	})
+
+	matches := tournament.MatchNames(context)
+	games := make([]Game, 0, len(listed))
+	for _, game := range listed {
+		info := game.Info
+		players := game.Players
+		if players == nil {
+			players = []string{}
+		}
+		games = append(games, Game{
+			GameId:         hex.EncodeToString(info.GameId[:]),
+			Title:          game.Title,
+			Host:           game.Host,
+			Port:           game.Port,
+			MapName:        info.MapName,
+			Version:        info.Version.String(),
+			GameType:       gameTypeName[info.GameType],
+			HiddenMines:    info.AllowHiddenMines,
+			Bots:           info.AllowComputer,
+			Password:       info.HasPassword,
+			PlayerCount:    int(info.PlayerCount),
+			NeutralPills:   int(info.NeutralPillboxCount),
+			NeutralBases:   int(info.NeutralBaseCount),
+			Players:        players,
+			TrackedMinutes: int(time.Since(info.ServerStartTimestamp).Minutes()),
+			Continent:      game.Location.Continent,
+			Country:        game.Location.Country,
+			Region:         game.Location.Region,
+			Remote:         game.Remote,
+			Match:          matches[hex.EncodeToString(info.GameId[:])],
+		})
+	}
+	return games
+}
+
+// continentGroup is the games hosted on one continent, for the web page.
+type continentGroup struct {
+	Name  string
+	Games []Game
+}
+
+// groupByContinent groups the games by where they are hosted, so players can
+// pick one nearby. Known continents come first, alphabetically.
+func groupByContinent(games []Game) []continentGroup {
+	var groups []continentGroup
+	index := make(map[string]int)
+	for _, game := range games {
+		i, ok := index[game.Continent]
+		if !ok {
+			i = len(groups)
+			index[game.Continent] = i
+			groups = append(groups, continentGroup{Name: geoip.ContinentName(game.Continent)})
+		}
+		groups[i].Games = append(groups[i].Games, game)
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		if (groups[i].Name == "Unknown") != (groups[j].Name == "Unknown") {
+			return groups[j].Name == "Unknown"
+		}
+		return groups[i].Name < groups[j].Name
+	})
+	return groups
+}
+
+// handleGames returns the games as JSON. ?continent=EU (or ?country=DE)
+// returns only the games hosted there.
+// selectTracker returns the tracker named by the request's tracker
+// parameter, or the main tracker, whose context is given, if it has none. It
+// responds with 404 if there is no such tracker.
+func selectTracker(context *state.ServerContext, w http.ResponseWriter, r *http.Request) (*state.ServerContext, bool) {
+	selected, ok := context.Tracker(r.URL.Query().Get("tracker"))
+	if !ok {
+		http.Error(w, "no such tracker", http.StatusNotFound)
+	}
+	return selected, ok
+}
+
+func listTrackers(context *state.ServerContext) []Tracker {
+	var trackers []Tracker
+	for _, selected := range append([]*state.ServerContext{context}, context.Trackers...) {
+		t := Tracker{Name: selected.Name, Port: selected.ProxyPort}
+		state.Do(selected, func(s *state.State) {
+			t.Games = len(s.Games)
+			t.Players = len(s.Players)
+		})
+		trackers = append(trackers, t)
+	}
+	return trackers
+}
+
+func handleGames(context *state.ServerContext, w http.ResponseWriter, r *http.Request) {
+	context, ok := selectTracker(context, w, r)
+	if !ok {
+		return
+	}
+	continent := r.URL.Query().Get("continent")
+	country := r.URL.Query().Get("country")
+
+	games := make([]Game, 0)
+	for _, game := range listGames(context) {
+		if continent != "" && !strings.EqualFold(continent, game.Continent) {
+			continue
+		}
+		if country != "" && !strings.EqualFold(country, game.Country) {
+			continue
+		}
+		games = append(games, game)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(games)
+}
+
+func leaderboard(db *sql.DB) ([]LeaderboardPlayer, error) {
+	selected, err := data.SelectLeaderboard(db, kLeaderboardSize)
+	if err != nil {
+		return nil, err
+	}
+	players := make([]LeaderboardPlayer, 0)
+	for _, player := range selected {
+		players = append(players, LeaderboardPlayer{
+			Name:        player.Name,
+			Sessions:    player.Sessions,
+			PlayMinutes: player.PlaySeconds / 60,
+			GamesHosted: player.GamesHosted,
+			LastSeen:    player.LastSeen,
+		})
+	}
+	return players, nil
+}
+
+// RankedPlayer is the API representation of a player's rating.
+type RankedPlayer struct {
+	Rank   int    `json:"rank"`
+	Name   string `json:"name"`
+	Rating int    `json:"rating"`
+	Games  int    `json:"games"`
+}
+
+func rankings(db *sql.DB) ([]RankedPlayer, error) {
+	selected, err := data.SelectRatings(db)
+	if err != nil {
+		return nil, err
+	}
+	players := make([]RankedPlayer, 0)
+	for i, player := range selected {
+		players = append(players, RankedPlayer{
+			Rank:   i + 1,
+			Name:   player.Name,
+			Rating: int(math.Round(player.Rating)),
+			Games:  player.Games,
+		})
+	}
+	return players, nil
+}
+
+// accountRequest is the body of /api/register ({"name": ...}) and /api/login
+// ({"name": ..., "token": ...}). Register responds with the token.
+type accountRequest struct {
+	Name  string `json:"name"`
+	Token string `json:"token,omitempty"`
+}
+
+func decodeAccountRequest(w http.ResponseWriter, r *http.Request) (accountRequest, bool) {
+	var request accountRequest
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return request, false
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return request, false
+	}
+	return request, true
+}
+
+func handleRegister(context *state.ServerContext, db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	request, ok := decodeAccountRequest(w, r)
+	if !ok {
+		return
+	}
+
+	token, err := accounts.Register(db, request.Name)
+	if err == accounts.ErrNameTaken {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err == accounts.ErrBadName {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		internalError(context, w, err)
+		return
+	}
+	context.Logger.Println("Registered account", strings.TrimSpace(request.Name))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(accountRequest{Name: strings.TrimSpace(request.Name), Token: token})
+}
+
+// handleLogin lets players from the client's address use the name.
+func handleLogin(context *state.ServerContext, db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	request, ok := decodeAccountRequest(w, r)
+	if !ok {
+		return
+	}
+
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	err := accounts.Login(db, request.Name, request.Token, net.ParseIP(host))
+	if err == accounts.ErrBadLogin {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
+		internalError(context, w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleSchedule returns the scheduled games as JSON, and schedules a game
+// POSTed as {"start": "<RFC 3339>", "map_name": "...", "max_players": n} by a
+// moderator, or anyone if public_scheduling is set. Moderators can cancel a
+// game with DELETE ?id=<id>.
+func handleSchedule(context *state.ServerContext, tokens []apiToken, w http.ResponseWriter, r *http.Request) {
+	var games []state.ScheduledGame
+
+	switch r.Method {
+	case "GET":
+		state.Do(context, func(s *state.State) {
+			games = state.ScheduleList(s)
+		})
+		if games == nil {
+			games = []state.ScheduledGame{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(games)
+	case "POST":
+		scheduledBy, _, _ := net.SplitHostPort(r.RemoteAddr)
+		if !config.GetValueBool("public_scheduling") {
+			token, ok := authorize(tokens, w, r, roleModerator)
+			if !ok {
+				return
+			}
+			scheduledBy = token.actor()
+		}
+
+		var game state.ScheduledGame
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&game); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		game.MapName = strings.TrimSpace(game.MapName)
+		if game.MapName == "" || len(game.MapName) > kMaxMapNameLength || game.MaxPlayers < 0 || game.MaxPlayers > kMaxPlayers {
+			http.Error(w, "invalid map name or max players", http.StatusBadRequest)
+			return
+		}
+		if time.Until(game.Start) > kMaxScheduleAhead {
+			http.Error(w, "start time is too far ahead", http.StatusBadRequest)
+			return
+		}
+		game.ScheduledBy = scheduledBy
+
+		var err error
+		state.Do(context, func(s *state.State) {
+			game, err = state.ScheduleAdd(s, game)
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if strings.HasPrefix(scheduledBy, "api ") {
+			context.Audit.Record(scheduledBy, "schedule add", strconv.Itoa(game.Id), "", "")
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(game)
+	case "DELETE":
+		token, ok := authorize(tokens, w, r, roleModerator)
+		if !ok {
+			return
+		}
+		id, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil {
+			http.Error(w, "id is not a number", http.StatusBadRequest)
+			return
+		}
+		removed := false
+		state.Do(context, func(s *state.State) {
+			removed = state.ScheduleRemove(s, id)
+		})
+		if !removed {
+			http.Error(w, fmt.Sprintf("no scheduled game %d", id), http.StatusNotFound)
+			return
+		}
+		context.Audit.Record(token.actor(), "schedule rm", strconv.Itoa(id), "", "")
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// countdown is the time until start, for the web page.
+func countdown(start time.Time) string {
+	remaining := time.Until(start)
+	if remaining <= 0 {
+		return "now"
+	}
+	hours := int(remaining.Hours())
+	minutes := int(remaining.Minutes()) % 60
+	if hours >= 24 {
+		return fmt.Sprintf("in %d days %d h", hours/24, hours%24)
+	}
+	if hours > 0 {
+		return fmt.Sprintf("in %d h %d min", hours, minutes)
+	}
+	return fmt.Sprintf("in %d min", minutes+1)
+}
+
+type indexPage struct {
+	Groups      []continentGroup
+	Scheduled   []state.ScheduledGame
+	Leaderboard []LeaderboardPlayer
+	Tournament  *state.Tournament
+}
+
+func handleIndex(context *state.ServerContext, w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	context, ok := selectTracker(context, w, r)
+	if !ok {
+		return
+	}
+	page := indexPage{Groups: groupByContinent(listGames(context)), Tournament: tournament.Current(context)}
+	state.Do(context, func(s *state.State) {
+		page.Scheduled = state.ScheduleList(s)
+	})
+	if context.Db != nil {
+		var err error
+		if page.Leaderboard, err = leaderboard(context.Db); err != nil {
+			context.Logger.Println("Web:", err)
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := indexTemplate.Execute(w, page); err != nil {
+		context.Logger.Println(err)
+	}
+}
+
+var indexTemplate = template.Must(template.New("index").Funcs(template.FuncMap{
+	"join":      strings.Join,
+	"countdown": countdown,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Bolorama</title>
+</head>
+<body>
+<h1>Bolorama</h1>
+{{if not .Groups}}<p>There are no games in progress.</p>{{else}}
+<table>
+{{$grouped := gt (len .Groups) 1}}{{range .Groups}}{{if or $grouped (ne .Name "Unknown")}}<tr><th colspan="12"><h2>{{.Name}}</h2></th></tr>{{end}}
+<tr><th>Host</th><th>Location</th><th>Map</th><th>Game</th><th>Players</th><th>Bases</th><th>Pills</th><th>Mines</th><th>Bots</th><th>Password</th><th>Version</th><th>Tracked</th></tr>
+{{range .Games}}<tr>
+<td>{{with .Title}}<b>{{.}}</b><br>{{end}}{{.Host}}:{{.Port}}</td>
+<td>{{if .Region}}{{.Region}}, {{end}}{{.Country}}</td>
+<td>{{.MapName}}{{if .Match}}<br>{{.Match}}{{end}}</td>
+<td>{{.GameType}}</td>
+<td>{{.PlayerCount}}{{if .Players}} ({{join .Players ", "}}){{end}}</td>
+<td>{{.NeutralBases}}</td>
+<td>{{.NeutralPills}}</td>
+<td>{{if .HiddenMines}}Hidden{{else}}Visible{{end}}</td>
+<td>{{if .Bots}}Yes{{else}}No{{end}}</td>
+<td>{{if .Password}}&#x1f512; Yes{{else}}No{{end}}</td>
+<td>{{.Version}}</td>
+<td>{{.TrackedMinutes}} min</td>
+</tr>
+{{end}}{{end}}</table>{{end}}
+{{if .Scheduled}}<h2>Scheduled Games</h2>
+<table>
+<tr><th>Map</th><th>Start</th><th>Players</th><th></th></tr>
+{{range .Scheduled}}<tr>
+<td>{{.MapName}}</td>
+<td>{{.Start.Format "Mon Jan 2 15:04 MST"}}</td>
+<td>{{if .MaxPlayers}}up to {{.MaxPlayers}}{{else}}any{{end}}</td>
+<td>{{if .GameId}}started{{else}}{{countdown .Start}}{{end}}</td>
+</tr>
+{{end}}</table>{{end}}
+{{with .Tournament}}{{if .Started}}<h2>{{.Name}}</h2>
+<table>
+<tr><th>Round</th><th>Match</th><th>Players</th><th>Winner</th></tr>
+{{range .Matches}}<tr>
+<td>{{.Round}}</td>
+<td>{{.Id}}</td>
+<td>{{or (index .Players 0) "?"}} vs {{or (index .Players 1) "?"}}</td>
+<td>{{if .Winner}}{{.Winner}}{{else if .GameId}}playing{{end}}</td>
+</tr>
+{{end}}</table>
+{{with .Champion}}<p>Champion: {{.}}</p>{{end}}{{end}}{{end}}
+{{if .Leaderboard}}<h2>Leaderboard</h2>
+<table>
+<tr><th>Player</th><th>Play Time</th><th>Sessions</th><th>Games Hosted</th></tr>
+{{range .Leaderboard}}<tr>
+<td>{{.Name}}</td>
+<td>{{.PlayMinutes}} min</td>
+<td>{{.Sessions}}</td>
+<td>{{.GamesHosted}}</td>
+</tr>
+{{end}}</table>{{end}}
+</body>
+</html>
+`))